@@ -3,7 +3,13 @@ module github.com/bkrebsbach/simple-job-queue
 go 1.15
 
 require (
+	github.com/alicebob/miniredis/v2 v2.14.1
 	github.com/go-chi/chi v4.1.2+incompatible
+	github.com/gomodule/redigo v1.8.3
+	github.com/hashicorp/raft v1.3.1
+	github.com/hashicorp/raft-boltdb/v2 v2.2.0
+	github.com/lib/pq v1.10.0
 	github.com/rs/zerolog v1.19.0
 	github.com/stretchr/testify v1.6.1
+	modernc.org/sqlite v1.11.2
 )
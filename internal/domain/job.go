@@ -1,28 +1,77 @@
 package domain
 
+import (
+	"encoding/json"
+	"time"
+)
+
 const (
 	JobTypeTimeCritical    = "TIME_CRITICAL"
 	JobTypeNotTimeCritical = "NOT_TIME_CRITICAL"
 
+	JobStatusScheduled  = "SCHEDULED"
 	JobStatusQueued     = "QUEUED"
 	JobStatusInProgress = "IN_PROGRESS"
 	JobStatusConcluded  = "CONCLUDED"
 	JobStatusCancelled  = "CANCELLED"
+	JobStatusFailed     = "FAILED"
+	JobStatusBlocked    = "BLOCKED"
+
+	UniquePolicyReject  = "REJECT"
+	UniquePolicyMerge   = "MERGE"
+	UniquePolicyReplace = "REPLACE"
+
+	DependencyPolicyCancel = "CANCEL"
+	DependencyPolicyBlock  = "BLOCK"
 )
 
 var (
 	// JobStatues defines valide job status values
 	JobStatuses = map[string]bool{
+		JobStatusScheduled:  true,
 		JobStatusQueued:     true,
 		JobStatusInProgress: true,
 		JobStatusConcluded:  true,
 	}
 
+	// AllJobStatuses defines every status a job can be in
+	AllJobStatuses = map[string]bool{
+		JobStatusBlocked:    true,
+		JobStatusScheduled:  true,
+		JobStatusQueued:     true,
+		JobStatusInProgress: true,
+		JobStatusConcluded:  true,
+		JobStatusCancelled:  true,
+		JobStatusFailed:     true,
+	}
+
 	// JobTypes defines valid job type values
 	JobTypes = map[string]bool{
 		JobTypeTimeCritical:    true,
 		JobTypeNotTimeCritical: true,
 	}
+
+	// ActiveJobStatuses defines the statuses of jobs that have not finished,
+	// including jobs waiting to be retried
+	ActiveJobStatuses = map[string]bool{
+		JobStatusBlocked:    true,
+		JobStatusScheduled:  true,
+		JobStatusQueued:     true,
+		JobStatusInProgress: true,
+	}
+
+	// UniquePolicies defines valid unique policy values
+	UniquePolicies = map[string]bool{
+		UniquePolicyReject:  true,
+		UniquePolicyMerge:   true,
+		UniquePolicyReplace: true,
+	}
+
+	// DependencyPolicies defines valid dependency policy values
+	DependencyPolicies = map[string]bool{
+		DependencyPolicyCancel: true,
+		DependencyPolicyBlock:  true,
+	}
 )
 
 // Job defines the basic job structure
@@ -31,4 +80,132 @@ type Job struct {
 	Type       string
 	Status     string
 	ConsumerID string
+
+	// Payload is opaque data from the producer telling the consumer what to
+	// do.
+	Payload json.RawMessage
+
+	// Result is opaque data attached by the consumer when it concludes the
+	// job.
+	Result json.RawMessage
+
+	// Priority orders jobs in the queue, higher priorities are dequeued
+	// first. Jobs with the same priority are dequeued in the order they were
+	// enqueued.
+	Priority int
+
+	// LeaseExpiresAt is the time at which an in progress job is returned to
+	// the queue if the consumer has not concluded it.
+	LeaseExpiresAt time.Time
+
+	// Progress is the completion percentage last reported by the consumer.
+	Progress int
+
+	// Attempts is the number of times the job has been dequeued. Once it
+	// reaches MaxAttempts a failure is final. A MaxAttempts of zero uses the
+	// queue's retry policy for the job type.
+	Attempts    int
+	MaxAttempts int
+
+	// LastError is the reason given by the consumer for the last failure.
+	LastError string
+
+	// Failures is the history of failed attempts, including lost leases.
+	Failures []Failure
+
+	// RunAt is the time a scheduled job becomes available for dequeue, either
+	// because the producer delayed it or because it is waiting to be retried.
+	RunAt time.Time
+
+	// DeadLetteredAt is the time a job that ran out of attempts was moved to
+	// the dead-letter queue.
+	DeadLetteredAt time.Time
+
+	// IdempotencyKey identifies the producer request that enqueued the job.
+	// Until IdempotencyExpiresAt, enqueuing with the same key returns this job
+	// instead of adding a new one, as long as the request has the same
+	// IdempotencyHash.
+	IdempotencyKey       string
+	IdempotencyHash      string
+	IdempotencyExpiresAt time.Time
+
+	// UniqueKey identifies the work a job does, e.g. reindexing a customer.
+	// Only one active job with the same key can exist at a time. UniquePolicy
+	// decides whether enqueuing another job with the key is rejected, merged
+	// into the active job, or replaces the active job if it has not started.
+	// It only applies to the enqueue, and defaults to UniquePolicyReject.
+	UniqueKey    string
+	UniquePolicy string
+
+	// DependsOn holds the IDs of the jobs in the same queue that have to be
+	// concluded before the job can be dequeued. Until then the job is
+	// BLOCKED. If one of them is cancelled or dead-lettered, the
+	// DependencyPolicy decides whether the job is cancelled, the default, or
+	// stays blocked, e.g. until the dead-lettered job is redriven.
+	DependsOn        []int
+	DependencyPolicy string
+
+	// WorkflowID identifies the workflow the job was submitted with.
+	WorkflowID string
+
+	// BatchFollowUp is the ID of the follow-up job of the batch the job was
+	// enqueued with, which waits for every job of the batch to conclude.
+	BatchFollowUp int
+
+	// BatchRemaining and BatchFailed count the jobs of its batch a follow-up
+	// job waits for that have not concluded yet, and that were cancelled or
+	// dead-lettered. The follow-up job is BLOCKED until BatchRemaining
+	// reaches zero, and the DependencyPolicy decides what happens once
+	// BatchFailed is not zero, as for DependsOn.
+	BatchRemaining int
+	BatchFailed    int
+
+	// CreatedAt is the time the job was enqueued.
+	CreatedAt time.Time
+}
+
+// JobFilter selects jobs by their fields, fields left empty match every job.
+type JobFilter struct {
+	Status     string
+	Type       string
+	ConsumerID string
+
+	// CreatedAfter and CreatedBefore bound the time jobs were created,
+	// exclusively.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+
+	// AfterID skips the jobs up to and including the ID, so listing can
+	// continue after the last job of a page. Jobs are listed by ID.
+	AfterID int
+
+	// Limit is the maximum number of jobs to list, zero for no limit.
+	Limit int
+}
+
+// Matches reports whether a job is selected by the filter. The page of the
+// filter, AfterID and Limit, is not considered.
+func (f JobFilter) Matches(job Job) bool {
+	switch {
+	case f.Status != "" && job.Status != f.Status:
+		return false
+	case f.Type != "" && job.Type != f.Type:
+		return false
+	case f.ConsumerID != "" && job.ConsumerID != f.ConsumerID:
+		return false
+	case !f.CreatedAfter.IsZero() && !job.CreatedAt.After(f.CreatedAfter):
+		return false
+	case !f.CreatedBefore.IsZero() && !job.CreatedAt.Before(f.CreatedBefore):
+		return false
+	}
+
+	return true
+}
+
+// Failure records a single failed attempt at processing a job.
+type Failure struct {
+	Attempt    int
+	ConsumerID string
+	Error      string
+	FailedAt   time.Time
 }
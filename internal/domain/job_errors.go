@@ -19,6 +19,13 @@ func (e ErrJobNotFound) Error() string {
 	return fmt.Sprintf("unable to find job %d", e.JobID)
 }
 
+// Is matches any ErrJobNotFound regardless of the job ID, so callers can check
+// errors.Is(err, ErrJobNotFound{}).
+func (e ErrJobNotFound) Is(target error) bool {
+	_, ok := target.(ErrJobNotFound)
+	return ok
+}
+
 // ErrJobStatusTransitionNotAllowed is an error that indicates an invalid job
 // status transition
 type ErrJobStatusTransitionNotAllowed struct {
@@ -28,3 +35,42 @@ type ErrJobStatusTransitionNotAllowed struct {
 func (e ErrJobStatusTransitionNotAllowed) Error() string {
 	return fmt.Sprintf("unable to transition job status for job %d", e.JobID)
 }
+
+// Is matches any ErrJobStatusTransitionNotAllowed regardless of the job ID.
+func (e ErrJobStatusTransitionNotAllowed) Is(target error) bool {
+	_, ok := target.(ErrJobStatusTransitionNotAllowed)
+	return ok
+}
+
+// ErrIdempotencyKeyReused indicates a job was enqueued with an idempotency key
+// that was already used for a different request.
+type ErrIdempotencyKeyReused struct {
+	Key string
+}
+
+func (e ErrIdempotencyKeyReused) Error() string {
+	return fmt.Sprintf("idempotency key %q was used for a different request", e.Key)
+}
+
+// Is matches any ErrIdempotencyKeyReused regardless of the key.
+func (e ErrIdempotencyKeyReused) Is(target error) bool {
+	_, ok := target.(ErrIdempotencyKeyReused)
+	return ok
+}
+
+// ErrDuplicateJob indicates a job was enqueued with the unique key of an active
+// job.
+type ErrDuplicateJob struct {
+	UniqueKey string
+	JobID     int
+}
+
+func (e ErrDuplicateJob) Error() string {
+	return fmt.Sprintf("job %d with unique key %q is already active", e.JobID, e.UniqueKey)
+}
+
+// Is matches any ErrDuplicateJob regardless of the key.
+func (e ErrDuplicateJob) Is(target error) bool {
+	_, ok := target.(ErrDuplicateJob)
+	return ok
+}
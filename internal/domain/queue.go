@@ -0,0 +1,14 @@
+package domain
+
+// DefaultQueueName is the name of the queue served by the /jobs routes.
+const DefaultQueueName = "default"
+
+// QueueStats summarizes the jobs tracked by a queue.
+type QueueStats struct {
+	Name string
+
+	// Total is the number of jobs tracked by the queue, and Statuses breaks
+	// that number down by job status.
+	Total    int
+	Statuses map[string]int
+}
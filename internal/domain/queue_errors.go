@@ -0,0 +1,70 @@
+package domain
+
+import "fmt"
+
+// ErrQueueNotFound indicates a named queue does not exist.
+type ErrQueueNotFound struct {
+	Name string
+}
+
+func (e ErrQueueNotFound) Error() string {
+	return fmt.Sprintf("unable to find queue %q", e.Name)
+}
+
+// Is matches any ErrQueueNotFound regardless of the queue name.
+func (e ErrQueueNotFound) Is(target error) bool {
+	_, ok := target.(ErrQueueNotFound)
+	return ok
+}
+
+// ErrQueueExists indicates a named queue already exists.
+type ErrQueueExists struct {
+	Name string
+}
+
+func (e ErrQueueExists) Error() string {
+	return fmt.Sprintf("queue %q already exists", e.Name)
+}
+
+// Is matches any ErrQueueExists regardless of the queue name.
+func (e ErrQueueExists) Is(target error) bool {
+	_, ok := target.(ErrQueueExists)
+	return ok
+}
+
+// ErrInvalidQueueName indicates a queue name contains characters other than
+// letters, digits, dashes and underscores, or is too long.
+type ErrInvalidQueueName struct {
+	Name string
+}
+
+func (e ErrInvalidQueueName) Error() string {
+	return fmt.Sprintf("invalid queue name %q", e.Name)
+}
+
+// Is matches any ErrInvalidQueueName regardless of the queue name.
+func (e ErrInvalidQueueName) Is(target error) bool {
+	_, ok := target.(ErrInvalidQueueName)
+	return ok
+}
+
+// ErrOutcomeUnknown indicates a change may or may not have been made, because
+// the queue failed before it could tell. Retrying the change may make it twice.
+type ErrOutcomeUnknown struct {
+	Err error
+}
+
+func (e ErrOutcomeUnknown) Error() string {
+	return fmt.Sprintf("outcome unknown: %v", e.Err)
+}
+
+// Unwrap returns the error that left the outcome unknown.
+func (e ErrOutcomeUnknown) Unwrap() error {
+	return e.Err
+}
+
+// Is matches any ErrOutcomeUnknown regardless of the error.
+func (e ErrOutcomeUnknown) Is(target error) bool {
+	_, ok := target.(ErrOutcomeUnknown)
+	return ok
+}
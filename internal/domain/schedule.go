@@ -0,0 +1,27 @@
+package domain
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Schedule defines a recurring job. A fresh job is enqueued from the template
+// fields every time the cron expression fires.
+type Schedule struct {
+	ID int
+
+	// job template
+	Type     string
+	Payload  json.RawMessage
+	Priority int
+
+	// Cron is a five field cron expression evaluated in Timezone, which
+	// defaults to UTC.
+	Cron     string
+	Timezone string
+
+	Paused    bool
+	NextRunAt time.Time
+	LastRunAt time.Time
+	CreatedAt time.Time
+}
@@ -0,0 +1,34 @@
+package domain
+
+import "fmt"
+
+// ErrScheduleNotFound indicates a given schedule ID was not found.
+type ErrScheduleNotFound struct {
+	ScheduleID int
+}
+
+func (e ErrScheduleNotFound) Error() string {
+	return fmt.Sprintf("unable to find schedule %d", e.ScheduleID)
+}
+
+// Is matches any ErrScheduleNotFound regardless of the schedule ID.
+func (e ErrScheduleNotFound) Is(target error) bool {
+	_, ok := target.(ErrScheduleNotFound)
+	return ok
+}
+
+// ErrInvalidSchedule indicates a schedule's cron expression or timezone could
+// not be parsed.
+type ErrInvalidSchedule struct {
+	Reason string
+}
+
+func (e ErrInvalidSchedule) Error() string {
+	return fmt.Sprintf("invalid schedule: %s", e.Reason)
+}
+
+// Is matches any ErrInvalidSchedule regardless of the reason.
+func (e ErrInvalidSchedule) Is(target error) bool {
+	_, ok := target.(ErrInvalidSchedule)
+	return ok
+}
@@ -0,0 +1,46 @@
+package domain
+
+// Workflow is a set of jobs submitted together, where jobs depend on other jobs
+// of the workflow.
+type Workflow struct {
+	ID     string
+	Status string
+	Jobs   []Job
+}
+
+// WorkflowJob is a job submitted with a workflow. Besides the jobs in its
+// DependsOn, which were enqueued before the workflow, the job depends on the
+// jobs of the workflow at the Parents positions, which have to come before it.
+type WorkflowJob struct {
+	Job
+	Parents []int
+}
+
+// WorkflowStatus aggregates the status of a workflow's jobs. A workflow is
+// CONCLUDED once every job concluded, and QUEUED until one of its jobs started.
+// While jobs can still run it is IN_PROGRESS, otherwise it is FAILED if a job
+// was dead-lettered, CANCELLED if a job was cancelled, or BLOCKED if its jobs
+// wait for jobs outside of the workflow.
+func WorkflowStatus(jobs []Job) string {
+	counts := make(map[string]int)
+	for _, job := range jobs {
+		counts[job.Status]++
+	}
+
+	runnable := counts[JobStatusScheduled] + counts[JobStatusQueued] + counts[JobStatusInProgress]
+
+	switch {
+	case counts[JobStatusConcluded] == len(jobs):
+		return JobStatusConcluded
+	case runnable > 0 && counts[JobStatusInProgress]+counts[JobStatusConcluded] == 0:
+		return JobStatusQueued
+	case runnable > 0:
+		return JobStatusInProgress
+	case counts[JobStatusFailed] > 0:
+		return JobStatusFailed
+	case counts[JobStatusCancelled] > 0:
+		return JobStatusCancelled
+	default:
+		return JobStatusBlocked
+	}
+}
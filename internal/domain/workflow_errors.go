@@ -0,0 +1,18 @@
+package domain
+
+import "fmt"
+
+// ErrWorkflowNotFound indicates a workflow does not exist.
+type ErrWorkflowNotFound struct {
+	WorkflowID string
+}
+
+func (e ErrWorkflowNotFound) Error() string {
+	return fmt.Sprintf("unable to find workflow %q", e.WorkflowID)
+}
+
+// Is matches any ErrWorkflowNotFound regardless of the workflow ID.
+func (e ErrWorkflowNotFound) Is(target error) bool {
+	_, ok := target.(ErrWorkflowNotFound)
+	return ok
+}
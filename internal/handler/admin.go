@@ -0,0 +1,256 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+// DefaultBulkChunk is the number of jobs a bulk change lists and changes at a
+// time when no chunk size is given.
+const DefaultBulkChunk = 100
+
+// JobRequeuer defines the interface for job queues that can return an in
+// progress job to the queue before its lease expires.
+type JobRequeuer interface {
+	RequeueJob(ctx context.Context, jobID int) error
+}
+
+// BulkJobQueuer defines the interface for job queues that can cancel or
+// requeue every job selected by a filter atomically.
+type BulkJobQueuer interface {
+	CancelJobs(ctx context.Context, filter domain.JobFilter) (int, error)
+	RequeueJobs(ctx context.Context, filter domain.JobFilter) (int, error)
+}
+
+// bulkResponse defines the JSON payload for a bulk change, with the number of
+// jobs changed, or that would have been changed by a dry run.
+type bulkResponse struct {
+	Count  int  `json:"Count"`
+	DryRun bool `json:"DryRun,omitempty"`
+}
+
+// bulkChange defines a change applied to every job selected by a filter.
+type bulkChange struct {
+	// status narrows the filter to the jobs with the status, if set
+	status string
+
+	// eligible reports whether a job selected by the filter can be changed
+	eligible func(job domain.Job) bool
+
+	// apply changes a single job, for changes applied in chunks. It is nil if
+	// the queue cannot change single jobs.
+	apply func(ctx context.Context, jobID int) error
+
+	// applyAll changes every job at once, for atomic changes
+	applyAll func(ctx context.Context, queuer BulkJobQueuer, filter domain.JobFilter) (int, error)
+}
+
+// CancelJobs cancels every active job selected by a filter, given as for
+// ListJobs.
+func (h *JobHandler) CancelJobs(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r).With().Str("handler", "CancelJobs").Logger()
+	queuer := h.queuer(r.Context())
+
+	// only active jobs can be cancelled
+	filter, err := newJobFilter(r.URL.Query())
+	if err == nil && filter.Status != "" && !domain.ActiveJobStatuses[filter.Status] {
+		err = errors.New("status is not active")
+	}
+	if err != nil {
+		log.Info().Err(err).Msg("invalid filter")
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
+	h.changeJobs(w, r, log, filter, bulkChange{
+		eligible: func(job domain.Job) bool {
+			return domain.ActiveJobStatuses[job.Status]
+		},
+		apply: queuer.CancelJob,
+		applyAll: func(ctx context.Context, queuer BulkJobQueuer, filter domain.JobFilter) (int, error) {
+			return queuer.CancelJobs(ctx, filter)
+		},
+	})
+}
+
+// RequeueJobs returns every in progress job selected by a filter, given as for
+// ListJobs, to the queue without waiting for their leases to expire.
+func (h *JobHandler) RequeueJobs(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r).With().Str("handler", "RequeueJobs").Logger()
+
+	// only in progress jobs can be requeued
+	filter, err := newJobFilter(r.URL.Query())
+	if err == nil && filter.Status != "" && filter.Status != domain.JobStatusInProgress {
+		err = errors.New("status is not in progress")
+	}
+	if err != nil {
+		log.Info().Err(err).Msg("invalid filter")
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
+	change := bulkChange{
+		status: domain.JobStatusInProgress,
+		eligible: func(job domain.Job) bool {
+			return job.Status == domain.JobStatusInProgress
+		},
+		applyAll: func(ctx context.Context, queuer BulkJobQueuer, filter domain.JobFilter) (int, error) {
+			return queuer.RequeueJobs(ctx, filter)
+		},
+	}
+	if requeuer, ok := h.queuer(r.Context()).(JobRequeuer); ok {
+		change.apply = requeuer.RequeueJob
+	}
+
+	h.changeJobs(w, r, log, filter, change)
+}
+
+// changeJobs applies a bulk change to the jobs selected by a filter. The change
+// is applied in chunks of jobs, or atomically with the atomic query parameter,
+// and only counts the jobs it would change with the dry_run query parameter.
+func (h *JobHandler) changeJobs(w http.ResponseWriter, r *http.Request, log zerolog.Logger, filter domain.JobFilter, change bulkChange) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	queuer := h.queuer(ctx)
+
+	// a filter that selects every job is most likely a mistake
+	if filter == (domain.JobFilter{}) {
+		log.Info().Msg("empty filter")
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+	if change.status != "" {
+		filter.Status = change.status
+	}
+
+	// validate the mode flags, which are optional
+	flags := map[string]bool{"atomic": false, "dry_run": false}
+	for param := range flags {
+		paramValue := query.Get(param)
+		if paramValue == "" {
+			continue
+		}
+
+		value, err := strconv.ParseBool(paramValue)
+		if err != nil {
+			log.Info().Err(err).
+				Str(param, paramValue).
+				Msgf("invalid %s", param)
+			WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+			return
+		}
+		flags[param] = value
+	}
+	atomic, dryRun := flags["atomic"], flags["dry_run"]
+
+	// validate the chunk size, which is optional
+	chunk := DefaultBulkChunk
+	if paramChunk := query.Get("chunk"); paramChunk != "" {
+		var err error
+		chunk, err = strconv.Atoi(paramChunk)
+		if err != nil || chunk < 1 || chunk > MaxListLimit {
+			log.Info().Err(err).
+				Str("chunk", paramChunk).
+				Msg("invalid chunk")
+			WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// dry runs and chunked changes list the jobs, atomic changes are left to
+	// the queue
+	bulk, isBulk := queuer.(BulkJobQueuer)
+	lister, isLister := queuer.(JobLister)
+	switch {
+	case dryRun && !isLister,
+		atomic && !dryRun && !isBulk,
+		!atomic && !dryRun && (!isLister || change.apply == nil):
+		WriteErrorResponse(w, ErrNotImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	var count int
+	var err error
+	switch {
+	case dryRun:
+		err = forEachJob(ctx, lister, filter, chunk, func(job domain.Job) error {
+			if change.eligible(job) {
+				count++
+			}
+			return nil
+		})
+	case atomic:
+		count, err = change.applyAll(ctx, bulk, filter)
+	default:
+		err = forEachJob(ctx, lister, filter, chunk, func(job domain.Job) error {
+			if !change.eligible(job) {
+				return nil
+			}
+
+			// jobs that changed since they were listed are left alone
+			err := change.apply(ctx, job.ID)
+			if errors.Is(err, domain.ErrJobNotFound{}) || errors.Is(err, domain.ErrJobStatusTransitionNotAllowed{}) {
+				return nil
+			}
+			if err == nil {
+				count++
+			}
+			return err
+		})
+	}
+	if err != nil {
+		// jobs changed before the error stay changed
+		log.Error().Err(err).
+			Int("count", count).
+			Msgf("error changing jobs")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	log.Info().
+		Int("count", count).
+		Bool("atomic", atomic).
+		Bool("dry_run", dryRun).
+		Msg("changed jobs")
+
+	// marshal and return the count in the response
+	response, err := json.Marshal(bulkResponse{Count: count, DryRun: dryRun})
+	if err != nil {
+		log.Error().Err(err).Msgf("error marshalling response")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// forEachJob calls fn with every job selected by a filter, listing chunk jobs
+// at a time. It stops at the first error fn returns.
+func forEachJob(ctx context.Context, lister JobLister, filter domain.JobFilter, chunk int, fn func(job domain.Job) error) error {
+	filter.Limit = chunk
+	for {
+		jobs, err := lister.ListJobs(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		for _, job := range jobs {
+			if err := fn(job); err != nil {
+				return err
+			}
+		}
+
+		if len(jobs) < chunk {
+			return nil
+		}
+		filter.AfterID = jobs[len(jobs)-1].ID
+	}
+}
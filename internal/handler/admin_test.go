@@ -0,0 +1,146 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/queue"
+)
+
+// bulkResult is the outcome of a bulk change.
+type bulkResult struct {
+	Count  int
+	DryRun bool
+}
+
+func TestChangeJobs_InvalidInput(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(queue.NewInMemoryQueue())
+
+	// check that a filter is required, and invalid filters and flags are
+	// rejected
+	for _, target := range []string{
+		"/jobs/admin/cancel",
+		"/jobs/admin/cancel?status=CONCLUDED",
+		"/jobs/admin/cancel?type=SOON",
+		"/jobs/admin/cancel?type=TIME_CRITICAL&atomic=maybe",
+		"/jobs/admin/cancel?type=TIME_CRITICAL&dry_run=maybe",
+		"/jobs/admin/cancel?type=TIME_CRITICAL&chunk=0",
+		"/jobs/admin/cancel?type=TIME_CRITICAL&chunk=1001",
+		"/jobs/admin/requeue",
+		"/jobs/admin/requeue?status=QUEUED",
+	} {
+		w := request(ctx, router, http.MethodPost, target, "", nil)
+		require.Equal(t, http.StatusBadRequest, w.Code, target)
+	}
+}
+
+func TestCancelJobs(t *testing.T) {
+	for _, mode := range []string{"chunk=1", "atomic=true"} {
+		t.Run(mode, func(t *testing.T) {
+			ctx := context.Background()
+			q := queue.NewInMemoryQueue()
+			router := newTestRouter(q)
+
+			// set up state
+			ids := make([]int, 0)
+			for _, jobType := range []string{domain.JobTypeTimeCritical, domain.JobTypeNotTimeCritical, domain.JobTypeNotTimeCritical} {
+				id, err := q.Enqueue(ctx, domain.Job{Type: jobType, Status: domain.JobStatusQueued})
+				require.Nil(t, err)
+				ids = append(ids, id)
+			}
+
+			// check that a dry run counts the jobs without changing them
+			w := request(ctx, router, http.MethodPost, "/jobs/admin/cancel?type=NOT_TIME_CRITICAL&dry_run=true&"+mode, "", nil)
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, bulkResult{Count: 2, DryRun: true}, decodeBulkResult(t, w))
+
+			// check that the jobs selected by the filter are cancelled
+			w = request(ctx, router, http.MethodPost, "/jobs/admin/cancel?type=NOT_TIME_CRITICAL&"+mode, "", nil)
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, bulkResult{Count: 2}, decodeBulkResult(t, w))
+
+			for i, id := range ids {
+				job, err := q.FetchJob(ctx, id)
+				require.Nil(t, err)
+
+				expected := domain.JobStatusCancelled
+				if i == 0 {
+					expected = domain.JobStatusQueued
+				}
+				require.Equal(t, expected, job.Status)
+			}
+
+			// check that jobs that are no longer active are not counted
+			w = request(ctx, router, http.MethodPost, "/jobs/admin/cancel?type=NOT_TIME_CRITICAL&"+mode, "", nil)
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, bulkResult{Count: 0}, decodeBulkResult(t, w))
+		})
+	}
+}
+
+func TestRequeueJobs(t *testing.T) {
+	for _, mode := range []string{"chunk=1", "atomic=true"} {
+		t.Run(mode, func(t *testing.T) {
+			ctx := context.Background()
+			q := queue.NewInMemoryQueue()
+			router := newTestRouter(q)
+
+			// set up state: jobs claimed by two consumers
+			for i := 0; i < 3; i++ {
+				_, err := q.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+				require.Nil(t, err)
+			}
+			for _, consumerID := range []string{"consumer-1", "consumer-2", "consumer-1"} {
+				_, err := q.Dequeue(ctx, consumerID)
+				require.Nil(t, err)
+			}
+
+			// check that a dry run counts the jobs without changing them
+			w := request(ctx, router, http.MethodPost, "/jobs/admin/requeue?consumer=consumer-1&dry_run=true&"+mode, "", nil)
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, bulkResult{Count: 2, DryRun: true}, decodeBulkResult(t, w))
+
+			// check that the jobs of the consumer are returned to the queue in
+			// their place
+			w = request(ctx, router, http.MethodPost, "/jobs/admin/requeue?consumer=consumer-1&"+mode, "", nil)
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, bulkResult{Count: 2}, decodeBulkResult(t, w))
+
+			w = request(ctx, router, http.MethodPost, "/jobs/dequeue?max=5", "", consumer("consumer-3"))
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, []int{1, 3}, decodeJobIDs(t, w))
+		})
+	}
+}
+
+func TestChangeJobs_NotImplemented(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(basicQueue{JobQueuer: queue.NewInMemoryQueue()})
+
+	// check that queues that cannot list or change jobs in bulk answer that
+	// it is not supported
+	for _, target := range []string{
+		"/jobs/admin/cancel?type=TIME_CRITICAL",
+		"/jobs/admin/cancel?type=TIME_CRITICAL&dry_run=true",
+		"/jobs/admin/cancel?type=TIME_CRITICAL&atomic=true",
+		"/jobs/admin/requeue?consumer=consumer-1",
+	} {
+		w := request(ctx, router, http.MethodPost, target, "", nil)
+		require.Equal(t, http.StatusNotImplemented, w.Code, target)
+	}
+}
+
+// decodeBulkResult decodes the outcome of a bulk change.
+func decodeBulkResult(t *testing.T, w *httptest.ResponseRecorder) bulkResult {
+	var result bulkResult
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &result))
+
+	return result
+}
@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/rs/zerolog/hlog"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+// maxBatchJobs is the maximum number of jobs in a batch.
+const maxBatchJobs = 10000
+
+// batchRequest defines the JSON payload for enqueuing a batch. OnComplete is
+// an optional job enqueued once every job of the batch concluded.
+type batchRequest struct {
+	Jobs       []job `json:"Jobs"`
+	OnComplete *job  `json:"OnComplete"`
+}
+
+// enqueueBatchResponse returns the ID of an enqueued batch, the IDs of its jobs
+// in the order they were given, and the ID of its follow-up job.
+type enqueueBatchResponse struct {
+	ID         string `json:"ID"`
+	Jobs       []int  `json:"Jobs"`
+	OnComplete int    `json:"OnComplete,omitempty"`
+}
+
+// batch defines the JSON payload for the progress of a batch.
+type batch struct {
+	ID         string         `json:"ID"`
+	Status     string         `json:"Status"`
+	Total      int            `json:"Total"`
+	Statuses   map[string]int `json:"Statuses"`
+	OnComplete *job           `json:"OnComplete,omitempty"`
+}
+
+// EnqueueBatch enqueues a batch of jobs that do not depend on each other. The
+// follow-up job is enqueued first, and waits for the count of the jobs of the
+// batch that have not concluded to reach zero. If a job cannot be enqueued the
+// jobs enqueued along with it are cancelled.
+func (h *JobHandler) EnqueueBatch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", "EnqueueBatch").Logger()
+
+	var payload batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		log.Info().Err(err).Msg("unable to decode payload")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// validate the jobs and the follow-up job
+	jobs, onComplete, err := newBatchRequest(payload)
+	if err != nil {
+		log.Info().Err(err).Msg("invalid batch")
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
+	batchID, err := newWorkflowID()
+	if err != nil {
+		log.Error().Err(err).Msg("error generating batch id")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	queuer := h.queuer(ctx)
+	response := enqueueBatchResponse{ID: batchID}
+	if onComplete != nil {
+		onComplete.WorkflowID = batchID
+		onComplete.BatchRemaining = len(jobs)
+
+		response.OnComplete, err = queuer.Enqueue(ctx, *onComplete)
+		if err != nil {
+			writeEnqueueError(w, log.With().Int("position", len(jobs)).Logger(), err)
+			return
+		}
+	}
+
+	// enqueue the jobs of the batch at once
+	for i := range jobs {
+		jobs[i].WorkflowID = batchID
+		jobs[i].BatchFollowUp = response.OnComplete
+	}
+
+	ids, errs := queuer.EnqueueBatch(ctx, jobs)
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+
+		enqueued := make([]int, 0, len(ids)+1)
+		if response.OnComplete != 0 {
+			enqueued = append(enqueued, response.OnComplete)
+		}
+		for j, id := range ids {
+			if errs[j] == nil {
+				enqueued = append(enqueued, id)
+			}
+		}
+		cancelJobs(ctx, queuer, log, enqueued)
+
+		writeEnqueueError(w, log.With().Int("position", i).Logger(), err)
+		return
+	}
+	response.Jobs = ids
+
+	// marshal and return the batch ID in the response
+	body, err := json.Marshal(response)
+	if err != nil {
+		log.Error().Err(err).Msgf("error marshalling response")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, http.StatusOK, body)
+}
+
+// GetBatch returns the number of jobs of a batch by status, and its follow-up
+// job.
+func (h *JobHandler) GetBatch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", "GetBatch").Logger()
+
+	workflows, ok := h.queuer(ctx).(WorkflowQueuer)
+	if !ok {
+		WriteErrorResponse(w, ErrNotImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	batchID := chi.URLParam(r, "batchID")
+	jobs, err := workflows.ListWorkflowJobs(ctx, batchID)
+	if err != nil {
+		if errors.Is(err, domain.ErrWorkflowNotFound{}) {
+			WriteErrorResponse(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		log.Error().Err(err).Str("batch_id", batchID).Msgf("error listing batch jobs")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	// the jobs of a batch refer to its follow-up job
+	followUpID := 0
+	for _, batchJob := range jobs {
+		if batchJob.BatchFollowUp != 0 {
+			followUpID = batchJob.BatchFollowUp
+			break
+		}
+	}
+
+	members := make([]domain.Job, 0, len(jobs))
+	payload := batch{ID: batchID, Statuses: map[string]int{}}
+	for _, batchJob := range jobs {
+		if followUpID != 0 && batchJob.ID == followUpID {
+			onComplete := newJobResponse(batchJob)
+			payload.OnComplete = &onComplete
+			continue
+		}
+
+		members = append(members, batchJob)
+		payload.Statuses[batchJob.Status]++
+	}
+	payload.Total = len(members)
+	payload.Status = domain.WorkflowStatus(members)
+
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Error().Err(err).Msgf("error marshalling response")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// newBatchRequest validates the jobs of a batch, and returns them along with
+// the follow-up job, if any.
+func newBatchRequest(payload batchRequest) ([]domain.Job, *domain.Job, error) {
+	if len(payload.Jobs) == 0 || len(payload.Jobs) > maxBatchJobs {
+		return nil, nil, fmt.Errorf("invalid number of batch jobs: %d", len(payload.Jobs))
+	}
+
+	payloads := payload.Jobs
+	if payload.OnComplete != nil {
+		payloads = append(payloads[:len(payloads):len(payloads)], *payload.OnComplete)
+	}
+
+	jobs := make([]domain.Job, 0, len(payloads))
+	for i, p := range payloads {
+		if len(p.DependsOn) > 0 {
+			return nil, nil, fmt.Errorf("batch job %d depends on other jobs", i)
+		}
+
+		newJob, err := newJobRequest(p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("batch job %d: %w", i, err)
+		}
+
+		// a merged job would not be counted by the follow-up job
+		if payload.OnComplete != nil && newJob.UniquePolicy == domain.UniquePolicyMerge {
+			return nil, nil, fmt.Errorf("batch job %d is merged with its unique key", i)
+		}
+		jobs = append(jobs, newJob)
+	}
+
+	if payload.OnComplete == nil {
+		return jobs, nil, nil
+	}
+
+	return jobs[:len(jobs)-1], &jobs[len(jobs)-1], nil
+}
@@ -0,0 +1,129 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/queue"
+)
+
+// batchProgress is the progress of a batch returned by GetBatch.
+type batchProgress struct {
+	ID         string
+	Status     string
+	Total      int
+	Statuses   map[string]int
+	OnComplete *domain.Job
+}
+
+func TestEnqueueBatch_InvalidInput(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(queue.NewInMemoryQueue())
+
+	// check that invalid batches are rejected before any job is enqueued
+	for name, body := range map[string]string{
+		"invalid json":      `{"Jobs":`,
+		"no jobs":           `{"Jobs":[]}`,
+		"invalid job":       `{"Jobs":[{"Type":"SOON","Status":"QUEUED"}]}`,
+		"dependency":        `{"Jobs":[{"Type":"TIME_CRITICAL","Status":"QUEUED","DependsOn":[1]}]}`,
+		"invalid follow-up": `{"Jobs":[{"Type":"TIME_CRITICAL","Status":"QUEUED"}],"OnComplete":{"Type":"SOON","Status":"QUEUED"}}`,
+		"merged job":        `{"Jobs":[{"Type":"TIME_CRITICAL","Status":"QUEUED","UniqueKey":"a","UniquePolicy":"MERGE"}],"OnComplete":{"Type":"TIME_CRITICAL","Status":"QUEUED"}}`,
+	} {
+		w := request(ctx, router, http.MethodPost, "/batches", body, nil)
+		require.Equal(t, http.StatusBadRequest, w.Code, name)
+	}
+
+	w := request(ctx, router, http.MethodPost, "/jobs/dequeue", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestEnqueueBatch(t *testing.T) {
+	ctx := context.Background()
+	q := queue.NewInMemoryQueue()
+	router := newTestRouter(q)
+
+	// set up state
+	w := request(ctx, router, http.MethodPost, "/batches", `{
+		"Jobs":[{"Type":"TIME_CRITICAL","Status":"QUEUED"},{"Type":"TIME_CRITICAL","Status":"QUEUED"}],
+		"OnComplete":{"Type":"NOT_TIME_CRITICAL","Status":"QUEUED"}
+	}`, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var enqueued struct {
+		ID         string
+		Jobs       []int
+		OnComplete int
+	}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &enqueued))
+	require.Len(t, enqueued.Jobs, 2)
+	require.NotZero(t, enqueued.OnComplete)
+
+	// check that the follow-up job waits for the jobs of the batch
+	progress := getBatch(t, router, enqueued.ID)
+	require.Equal(t, domain.JobStatusQueued, progress.Status)
+	require.Equal(t, 2, progress.Total)
+	require.Equal(t, map[string]int{domain.JobStatusQueued: 2}, progress.Statuses)
+	require.Equal(t, enqueued.OnComplete, progress.OnComplete.ID)
+	require.Equal(t, domain.JobStatusBlocked, progress.OnComplete.Status)
+
+	for _, id := range enqueued.Jobs {
+		w := request(ctx, router, http.MethodPost, "/jobs/dequeue", "", consumer("consumer-1"))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, id, decodeJob(t, w).ID)
+		require.Nil(t, q.Conclude(ctx, id, "consumer-1", nil))
+	}
+
+	// check that the follow-up job is released once every job concluded
+	progress = getBatch(t, router, enqueued.ID)
+	require.Equal(t, domain.JobStatusConcluded, progress.Status)
+	require.Equal(t, map[string]int{domain.JobStatusConcluded: 2}, progress.Statuses)
+	require.Equal(t, domain.JobStatusQueued, progress.OnComplete.Status)
+}
+
+func TestEnqueueBatch_Rejected(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(queue.NewInMemoryQueue())
+
+	// check that a batch with a job that is rejected is not enqueued
+	w := request(ctx, router, http.MethodPost, "/batches", `{
+		"Jobs":[
+			{"Type":"TIME_CRITICAL","Status":"QUEUED","UniqueKey":"a"},
+			{"Type":"TIME_CRITICAL","Status":"QUEUED","UniqueKey":"a"}
+		],
+		"OnComplete":{"Type":"NOT_TIME_CRITICAL","Status":"QUEUED"}
+	}`, nil)
+	require.Equal(t, http.StatusConflict, w.Code)
+
+	// check that the jobs enqueued along with it were cancelled
+	w = request(ctx, router, http.MethodPost, "/jobs/dequeue", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestGetBatch_NotFound(t *testing.T) {
+	ctx := context.Background()
+
+	// check that an unknown batch is not found
+	w := request(ctx, newTestRouter(queue.NewInMemoryQueue()), http.MethodGet, "/batches/unknown", "", nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	// check that queues without workflows answer that batches are not
+	// supported
+	w = request(ctx, newTestRouter(basicQueue{JobQueuer: queue.NewInMemoryQueue()}), http.MethodGet, "/batches/unknown", "", nil)
+	require.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+// getBatch returns the progress of the batch.
+func getBatch(t *testing.T, router http.Handler, batchID string) batchProgress {
+	w := request(context.Background(), router, http.MethodGet, "/batches/"+batchID, "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var progress batchProgress
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &progress))
+
+	return progress
+}
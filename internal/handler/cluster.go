@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+const (
+	// HeaderForwardedBy marks requests forwarded to the leader by another node
+	// with the ID of that node, so they are not forwarded again.
+	HeaderForwardedBy = "Cluster-Forwarded-By"
+
+	ErrNoLeader = "no cluster leader"
+)
+
+// ClusterNode defines the interface for a node in a cluster where only the
+// leader serves requests.
+type ClusterNode interface {
+	IsLeader() bool
+	LeaderID() (string, bool)
+}
+
+// ClusterHandler provides the HTTP interface for a node in a cluster.
+type ClusterHandler struct {
+	Node ClusterNode
+
+	// NodeID is the ID of the local node
+	NodeID string
+
+	// Peers holds the base URL of the HTTP API of every node by node ID
+	Peers map[string]*url.URL
+}
+
+// ForwardToLeader is middleware that serves requests on the leader, and
+// forwards requests made to a follower to the leader. Requests fail with a
+// service unavailable error while there is no leader.
+func (h *ClusterHandler) ForwardToLeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := hlog.FromRequest(r).With().Str("handler", "ForwardToLeader").Logger()
+
+		if h.Node.IsLeader() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// a node that forwarded the request to us took us for the leader, so
+		// leadership is changing
+		if forwardedBy := r.Header.Get(HeaderForwardedBy); forwardedBy != "" {
+			log.Info().Str("forwarded_by", forwardedBy).Msg("not the leader of a forwarded request")
+			WriteErrorResponse(w, ErrNoLeader, http.StatusServiceUnavailable)
+			return
+		}
+
+		leaderID, ok := h.Node.LeaderID()
+		if !ok || leaderID == h.NodeID {
+			log.Info().Msg("no leader to forward request to")
+			WriteErrorResponse(w, ErrNoLeader, http.StatusServiceUnavailable)
+			return
+		}
+
+		leaderURL, ok := h.Peers[leaderID]
+		if !ok {
+			log.Error().Str("leader", leaderID).Msg("no URL configured for leader")
+			WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+			return
+		}
+
+		r.Header.Set(HeaderForwardedBy, h.NodeID)
+		httputil.NewSingleHostReverseProxy(leaderURL).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/rs/zerolog/hlog"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+// DeadLetterQueuer defines the interface for job queues that move jobs which
+// ran out of attempts to a dead-letter queue.
+type DeadLetterQueuer interface {
+	ListDeadLetters(ctx context.Context) ([]domain.Job, error)
+	FetchDeadLetter(ctx context.Context, jobID int) (domain.Job, error)
+	Redrive(ctx context.Context, jobID int) error
+	RedriveAll(ctx context.Context) (int, error)
+}
+
+type redriveResponse struct {
+	Count int `json:"Count"`
+}
+
+// ListDeadLetters returns the jobs in the dead-letter queue.
+func (h *JobHandler) ListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", "ListDeadLetters").Logger()
+
+	deadLetters, ok := h.queuer(ctx).(DeadLetterQueuer)
+	if !ok {
+		WriteErrorResponse(w, ErrNotImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	jobs, err := deadLetters.ListDeadLetters(ctx)
+	if err != nil {
+		log.Error().Err(err).Msgf("error listing dead-lettered jobs")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	// marshal and return the jobs in the response
+	payload := make([]job, 0, len(jobs))
+	for _, deadLetteredJob := range jobs {
+		payload = append(payload, newJobResponse(deadLetteredJob))
+	}
+
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Error().Err(err).Msgf("error marshalling response")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// GetDeadLetter returns a job from the dead-letter queue, including its
+// failure history.
+func (h *JobHandler) GetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", "GetDeadLetter").Logger()
+
+	deadLetters, ok := h.queuer(ctx).(DeadLetterQueuer)
+	if !ok {
+		WriteErrorResponse(w, ErrNotImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	// validate jobID param is a non-negative integer
+	paramJobID := chi.URLParam(r, "jobID")
+	jobID, err := strconv.Atoi(paramJobID)
+	if err != nil || jobID < 0 {
+		log.Info().Err(err).
+			Str("job_id", paramJobID).
+			Msg("invalid job id")
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
+	deadLetteredJob, err := deadLetters.FetchDeadLetter(ctx, jobID)
+	if err != nil {
+		if errors.Is(err, domain.ErrJobNotFound{}) {
+			WriteErrorResponse(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		log.Error().Err(err).Msgf("error fetching dead-lettered job")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	// marshal and return the job in the response
+	response, err := json.Marshal(newJobResponse(deadLetteredJob))
+	if err != nil {
+		log.Error().Err(err).
+			Str("job_id", strconv.Itoa(deadLetteredJob.ID)).
+			Msgf("error marshalling response")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// RedriveDeadLetter moves a job from the dead-letter queue back into the queue.
+func (h *JobHandler) RedriveDeadLetter(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", "RedriveDeadLetter").Logger()
+
+	deadLetters, ok := h.queuer(ctx).(DeadLetterQueuer)
+	if !ok {
+		WriteErrorResponse(w, ErrNotImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	// validate jobID param is a non-negative integer
+	paramJobID := chi.URLParam(r, "jobID")
+	jobID, err := strconv.Atoi(paramJobID)
+	if err != nil || jobID < 0 {
+		log.Info().Err(err).
+			Str("job_id", paramJobID).
+			Msg("invalid job id")
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
+	if err := deadLetters.Redrive(ctx, jobID); err != nil {
+		if errors.Is(err, domain.ErrJobNotFound{}) {
+			WriteErrorResponse(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		log.Error().Err(err).Msgf("error redriving dead-lettered job")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, http.StatusNoContent, nil)
+}
+
+// RedriveAllDeadLetters moves every job in the dead-letter queue back into the
+// queue, and returns how many jobs were redriven.
+func (h *JobHandler) RedriveAllDeadLetters(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", "RedriveAllDeadLetters").Logger()
+
+	deadLetters, ok := h.queuer(ctx).(DeadLetterQueuer)
+	if !ok {
+		WriteErrorResponse(w, ErrNotImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	count, err := deadLetters.RedriveAll(ctx)
+	if err != nil {
+		log.Error().Err(err).Msgf("error redriving dead-lettered jobs")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	// marshal and return the count in the response
+	response, err := json.Marshal(redriveResponse{Count: count})
+	if err != nil {
+		log.Error().Err(err).Msgf("error marshalling response")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, http.StatusOK, response)
+}
@@ -0,0 +1,160 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/queue"
+)
+
+// deadLetter enqueues jobs that run out of attempts on their first failure,
+// fails them, and returns their IDs.
+func deadLetter(t *testing.T, q *queue.InMemoryQueue, n int) []int {
+	ctx := context.Background()
+
+	ids := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		id, err := q.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued, MaxAttempts: 1})
+		require.Nil(t, err)
+
+		_, err = q.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+		_, err = q.Fail(ctx, id, "consumer-1", "boom")
+		require.Nil(t, err)
+
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+func TestDeadLetters_NotImplemented(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(basicQueue{JobQueuer: queue.NewInMemoryQueue()})
+
+	// check that a queue without a dead-letter queue is reported
+	for _, r := range []struct {
+		method string
+		target string
+	}{
+		{http.MethodGet, "/jobs/dead-letters"},
+		{http.MethodGet, "/jobs/dead-letters/1"},
+		{http.MethodPost, "/jobs/dead-letters/1/redrive"},
+		{http.MethodPost, "/jobs/dead-letters/redrive"},
+	} {
+		w := request(ctx, router, r.method, r.target, "", nil)
+		require.Equal(t, http.StatusNotImplemented, w.Code, r.target)
+	}
+}
+
+func TestListDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	q := queue.NewInMemoryQueue()
+	router := newTestRouter(q)
+
+	// check that an empty dead-letter queue is listed as an empty array
+	w := request(ctx, router, http.MethodGet, "/jobs/dead-letters", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `[]`, w.Body.String())
+
+	// set up state
+	ids := deadLetter(t, q, 2)
+
+	_, err := q.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+	require.Nil(t, err)
+
+	// check that only the dead-lettered jobs are listed, oldest first
+	w = request(ctx, router, http.MethodGet, "/jobs/dead-letters", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, ids, decodeJobIDs(t, w))
+
+	// check that a dead-lettered job is returned with its failure history
+	w = request(ctx, router, http.MethodGet, fmt.Sprintf("/jobs/dead-letters/%d", ids[0]), "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	deadLetteredJob := decodeJob(t, w)
+	require.Equal(t, domain.JobStatusFailed, deadLetteredJob.Status)
+	require.Len(t, deadLetteredJob.Failures, 1)
+	require.Equal(t, "boom", deadLetteredJob.Failures[0].Error)
+
+	w = request(ctx, router, http.MethodGet, "/jobs/dead-letters/first", "", nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(ctx, router, http.MethodGet, fmt.Sprintf("/jobs/dead-letters/%d", ids[1]+1), "", nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRedriveDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	q := queue.NewInMemoryQueue()
+	router := newTestRouter(q)
+
+	// set up state
+	ids := deadLetter(t, q, 2)
+
+	// check that invalid job IDs are rejected
+	w := request(ctx, router, http.MethodPost, "/jobs/dead-letters/first/redrive", "", nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(ctx, router, http.MethodPost, fmt.Sprintf("/jobs/dead-letters/%d/redrive", ids[1]+1), "", nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	// check that a redriven job is queued again, and leaves the dead-letter
+	// queue
+	w = request(ctx, router, http.MethodPost, fmt.Sprintf("/jobs/dead-letters/%d/redrive", ids[0]), "", nil)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = request(ctx, router, http.MethodGet, "/jobs/dead-letters", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, ids[1:], decodeJobIDs(t, w))
+
+	w = request(ctx, router, http.MethodPost, "/jobs/dequeue", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusOK, w.Code)
+	redrivenJob := decodeJob(t, w)
+	require.Equal(t, ids[0], redrivenJob.ID)
+	require.Len(t, redrivenJob.Failures, 1)
+
+	// check that a job no longer dead-lettered cannot be redriven
+	w = request(ctx, router, http.MethodPost, fmt.Sprintf("/jobs/dead-letters/%d/redrive", ids[0]), "", nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRedriveAllDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	q := queue.NewInMemoryQueue()
+	router := newTestRouter(q)
+
+	// set up state
+	ids := deadLetter(t, q, 3)
+
+	// check that every dead-lettered job is redriven and counted
+	w := request(ctx, router, http.MethodPost, "/jobs/dead-letters/redrive", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var redriven struct {
+		Count int
+	}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &redriven))
+	require.Equal(t, 3, redriven.Count)
+
+	w = request(ctx, router, http.MethodGet, "/jobs/dead-letters", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `[]`, w.Body.String())
+
+	for _, id := range ids {
+		w := request(ctx, router, http.MethodPost, "/jobs/dequeue", "", consumer("consumer-1"))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, id, decodeJob(t, w).ID)
+	}
+
+	// check that redriving an empty dead-letter queue counts no jobs
+	w = request(ctx, router, http.MethodPost, "/jobs/dead-letters/redrive", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &redriven))
+	require.Equal(t, 0, redriven.Count)
+}
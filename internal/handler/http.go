@@ -12,6 +12,9 @@ const (
 	ErrInternalServerError = "internal error"
 	ErrNotFound            = "not found"
 	ErrQueueEmpty          = "queue empty"
+	ErrConflict            = "conflict"
+	ErrNotImplemented      = "not implemented"
+	ErrOutcomeUnknown      = "outcome unknown"
 )
 
 // ErrorResponse is a simple JSON error response.
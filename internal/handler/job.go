@@ -1,19 +1,52 @@
 package handler
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/bkrebsbach/simple-job-queue/internal/domain"
 	"github.com/go-chi/chi"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 )
 
 const (
 	HeaderQueueConsumer = "QUEUE_CONSUMER"
+
+	// HeaderIdempotencyKey identifies an enqueue request, so a producer can
+	// safely retry it without enqueuing the job twice.
+	HeaderIdempotencyKey = "Idempotency-Key"
+
+	// DefaultIdempotencyWindow is how long an idempotency key is remembered
+	// when no other window is configured.
+	DefaultIdempotencyWindow = 24 * time.Hour
+
+	// maxIdempotencyKeyLength is the maximum length of an idempotency key.
+	maxIdempotencyKeyLength = 255
+
+	// MaxEnqueueBatch is the maximum number of jobs a single bulk enqueue can
+	// add.
+	MaxEnqueueBatch = 10000
+
+	// MaxDequeueWait is the longest a dequeue can wait for a job to arrive.
+	MaxDequeueWait = 60 * time.Second
+
+	// MaxDequeueBatch is the maximum number of jobs a single dequeue can
+	// claim.
+	MaxDequeueBatch = 100
+
+	// dequeuePollInterval is how often a waiting dequeue checks the queue for
+	// jobs it was not notified about, e.g. scheduled jobs that came due.
+	dequeuePollInterval = time.Second
 )
 
 // only the consumer that dequeued can conclude a job
@@ -23,28 +56,149 @@ const (
 
 // job defines the JSON payload for a job.
 type job struct {
-	ID     int    `json:"ID"`
-	Type   string `json:"Type"`
-	Status string `json:"Status"`
+	ID               int             `json:"ID"`
+	Type             string          `json:"Type"`
+	Status           string          `json:"Status"`
+	Priority         int             `json:"Priority"`
+	Payload          json.RawMessage `json:"Payload,omitempty"`
+	Result           json.RawMessage `json:"Result,omitempty"`
+	LeaseExpiresAt   *time.Time      `json:"LeaseExpiresAt,omitempty"`
+	Progress         int             `json:"Progress,omitempty"`
+	Attempts         int             `json:"Attempts"`
+	MaxAttempts      int             `json:"MaxAttempts,omitempty"`
+	LastError        string          `json:"LastError,omitempty"`
+	Failures         []failure       `json:"Failures,omitempty"`
+	RunAt            *time.Time      `json:"RunAt,omitempty"`
+	DelaySeconds     int             `json:"DelaySeconds,omitempty"`
+	DeadLetteredAt   *time.Time      `json:"DeadLetteredAt,omitempty"`
+	UniqueKey        string          `json:"UniqueKey,omitempty"`
+	UniquePolicy     string          `json:"UniquePolicy,omitempty"`
+	DependsOn        []int           `json:"DependsOn,omitempty"`
+	DependencyPolicy string          `json:"DependencyPolicy,omitempty"`
+	WorkflowID       string          `json:"WorkflowID,omitempty"`
+	ConsumerID       string          `json:"ConsumerID,omitempty"`
+	CreatedAt        *time.Time      `json:"CreatedAt,omitempty"`
+}
+
+// failure defines the JSON payload for a failed attempt at a job.
+type failure struct {
+	Attempt    int       `json:"Attempt"`
+	ConsumerID string    `json:"ConsumerID"`
+	Error      string    `json:"Error"`
+	FailedAt   time.Time `json:"FailedAt"`
+}
+
+// newJobResponse converts a domain job into its JSON payload.
+func newJobResponse(queuedJob domain.Job) job {
+	response := job{
+		ID:               queuedJob.ID,
+		Status:           queuedJob.Status,
+		Type:             queuedJob.Type,
+		Priority:         queuedJob.Priority,
+		Payload:          queuedJob.Payload,
+		Result:           queuedJob.Result,
+		Progress:         queuedJob.Progress,
+		Attempts:         queuedJob.Attempts,
+		MaxAttempts:      queuedJob.MaxAttempts,
+		LastError:        queuedJob.LastError,
+		UniqueKey:        queuedJob.UniqueKey,
+		DependsOn:        queuedJob.DependsOn,
+		DependencyPolicy: queuedJob.DependencyPolicy,
+		WorkflowID:       queuedJob.WorkflowID,
+		ConsumerID:       queuedJob.ConsumerID,
+	}
+
+	if !queuedJob.LeaseExpiresAt.IsZero() {
+		leaseExpiresAt := queuedJob.LeaseExpiresAt
+		response.LeaseExpiresAt = &leaseExpiresAt
+	}
+
+	if !queuedJob.RunAt.IsZero() {
+		runAt := queuedJob.RunAt
+		response.RunAt = &runAt
+	}
+
+	if !queuedJob.DeadLetteredAt.IsZero() {
+		deadLetteredAt := queuedJob.DeadLetteredAt
+		response.DeadLetteredAt = &deadLetteredAt
+	}
+
+	if !queuedJob.CreatedAt.IsZero() {
+		createdAt := queuedJob.CreatedAt
+		response.CreatedAt = &createdAt
+	}
+
+	for _, f := range queuedJob.Failures {
+		response.Failures = append(response.Failures, failure(f))
+	}
+
+	return response
 }
 
 type enqueueResponse struct {
 	ID int `json:"ID"`
 }
 
+// enqueueJobsResult defines the outcome of enqueuing one job of a bulk enqueue,
+// either the ID of the job or the error that kept it from being enqueued.
+type enqueueJobsResult struct {
+	ID     int    `json:"ID,omitempty"`
+	Status int    `json:"Status"`
+	Error  string `json:"Error,omitempty"`
+}
+
+// concludeRequest defines the optional JSON payload for concluding a job.
+type concludeRequest struct {
+	Result json.RawMessage `json:"Result"`
+}
+
+// failRequest defines the JSON payload for reporting a failed job.
+type failRequest struct {
+	Error string `json:"Error"`
+}
+
+// heartbeatRequest defines the optional JSON payload for a heartbeat.
+type heartbeatRequest struct {
+	Progress *int `json:"Progress"`
+}
+
 // JobQueuer defines an basic interface for a job queue
 type JobQueuer interface {
 	Enqueue(ctx context.Context, job domain.Job) (int, error)
+	EnqueueBatch(ctx context.Context, jobs []domain.Job) ([]int, []error)
 	Dequeue(ctx context.Context, consumerID string) (domain.Job, error)
-	Conclude(ctx context.Context, jobID int, consumerID string) error
+	DequeueBatch(ctx context.Context, consumerID string, max int) ([]domain.Job, error)
+	Conclude(ctx context.Context, jobID int, consumerID string, result json.RawMessage) error
 	FetchJob(ctx context.Context, jobID int) (domain.Job, error)
 	CancelJob(ctx context.Context, jobID int) error
+	Heartbeat(ctx context.Context, jobID int, consumerID string, progress *int) (domain.Job, error)
+	Fail(ctx context.Context, jobID int, consumerID string, reason string) (domain.Job, error)
+}
+
+// JobNotifier defines the interface for job queues that can wake consumers
+// waiting for a job, so they do not have to poll the queue.
+type JobNotifier interface {
+	JobAvailable() <-chan struct{}
 }
 
 // JobHandler provides the HTTP interface for queuing, dequeuing, and retrieving
 // jobs from a job queue.
 type JobHandler struct {
 	JobQueuer JobQueuer
+
+	// IdempotencyWindow is how long the queue remembers an idempotency key,
+	// DefaultIdempotencyWindow when zero.
+	IdempotencyWindow time.Duration
+}
+
+// queuer returns the named queue resolved for the request by
+// QueueHandler.QueueCtx, or the default job queue for the /jobs routes.
+func (h *JobHandler) queuer(ctx context.Context) JobQueuer {
+	if q, ok := ctx.Value(queueCtxKey{}).(JobQueuer); ok {
+		return q
+	}
+
+	return h.JobQueuer
 }
 
 // EnqueueJob takes a job payload and adds it to the job queue.
@@ -52,6 +206,14 @@ func (h *JobHandler) EnqueueJob(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	log := hlog.FromRequest(r).With().Str("handler", "EnqueueJob").Logger()
 
+	// validate the idempotency key, which is optional
+	idempotencyKey := r.Header.Get(HeaderIdempotencyKey)
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		log.Info().Msgf("invalid idempotency key of length %d", len(idempotencyKey))
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
 	var payload job
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		log.Info().Err(err).Msg("unable to decode payload")
@@ -59,31 +221,37 @@ func (h *JobHandler) EnqueueJob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// validate job status (TODO: use validator)
-	if _, ok := domain.JobStatuses[payload.Status]; !ok {
-		log.Info().Msgf("invalid job status: %s", payload.Status)
+	newJob, err := newJobRequest(payload)
+	if err != nil {
+		log.Info().Err(err).Msg("invalid job")
 		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
 		return
 	}
 
-	// validate job type (TODO: use validator)
-	if _, ok := domain.JobTypes[payload.Type]; !ok {
-		log.Info().Msgf("invalid job type: %s", payload.Type)
-		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
-		return
+	if idempotencyKey != "" {
+		window := h.IdempotencyWindow
+		if window == 0 {
+			window = DefaultIdempotencyWindow
+		}
+
+		hash, err := idempotencyHash(payload)
+		if err != nil {
+			log.Info().Err(err).Msg("unable to hash payload")
+			WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+			return
+		}
+		newJob.IdempotencyKey = idempotencyKey
+		newJob.IdempotencyHash = hash
+		newJob.IdempotencyExpiresAt = time.Now().Add(window)
 	}
 
-	// enqueue the job
-	jobID, err := h.JobQueuer.Enqueue(ctx, domain.Job{
-		Type:   payload.Type,
-		Status: payload.Status,
-	})
+	// enqueue the job, a retried request gets the job enqueued the first time
+	jobID, err := h.queuer(ctx).Enqueue(ctx, newJob)
 	if err != nil {
-		log.Error().Err(err).
+		writeEnqueueError(w, log.With().
 			Str("job_type", payload.Type).
 			Str("job_status", payload.Status).
-			Msgf("error enqueuing job")
-		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+			Logger(), err)
 		return
 	}
 
@@ -100,6 +268,206 @@ func (h *JobHandler) EnqueueJob(w http.ResponseWriter, r *http.Request) {
 	WriteJSONResponse(w, http.StatusOK, response)
 }
 
+// idempotencyHash returns the hash that tells a retry from a different request
+// with the same idempotency key. The job is hashed in a canonical form, so a
+// retry that formats or orders its JSON differently is still a retry.
+func idempotencyHash(payload job) (string, error) {
+	// the job payload is kept as is when decoding, its keys are sorted by
+	// decoding it once more
+	if len(payload.Payload) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(payload.Payload))
+		decoder.UseNumber()
+
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return "", err
+		}
+
+		canonical, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		payload.Payload = canonical
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// EnqueueJobs takes an array of job payloads and adds the valid jobs to the job
+// queue at once. It returns the outcome of every job in the order they were
+// given, so a job that fails does not fail the request.
+func (h *JobHandler) EnqueueJobs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", "EnqueueJobs").Logger()
+
+	var payload []job
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		log.Info().Err(err).Msg("unable to decode payload")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if len(payload) == 0 || len(payload) > MaxEnqueueBatch {
+		log.Info().Msgf("invalid number of jobs: %d", len(payload))
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
+	// validate every job, only the valid jobs are enqueued
+	results := make([]enqueueJobsResult, len(payload))
+	positions := make([]int, 0, len(payload))
+	jobs := make([]domain.Job, 0, len(payload))
+	for i, p := range payload {
+		newJob, err := newJobRequest(p)
+		if err != nil {
+			log.Info().Err(err).Int("position", i).Msg("invalid job")
+			results[i] = enqueueJobsResult{Status: http.StatusBadRequest, Error: ErrInvalidInput}
+			continue
+		}
+
+		positions = append(positions, i)
+		jobs = append(jobs, newJob)
+	}
+
+	if len(jobs) > 0 {
+		ids, errs := h.queuer(ctx).EnqueueBatch(ctx, jobs)
+		for j, i := range positions {
+			if errs[j] != nil {
+				message, statusCode := enqueueError(log.With().Int("position", i).Logger(), errs[j])
+				results[i] = enqueueJobsResult{Status: statusCode, Error: message}
+				continue
+			}
+
+			results[i] = enqueueJobsResult{ID: ids[j], Status: http.StatusOK}
+		}
+	}
+
+	// marshal and return the outcome of every job in the response
+	response, err := json.Marshal(results)
+	if err != nil {
+		log.Error().Err(err).Msgf("error marshalling response")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// newJobRequest validates a job payload, and returns the job to enqueue.
+func newJobRequest(payload job) (domain.Job, error) {
+	// validate job status (TODO: use validator)
+	if _, ok := domain.JobStatuses[payload.Status]; !ok {
+		return domain.Job{}, fmt.Errorf("invalid job status: %s", payload.Status)
+	}
+
+	// validate job type (TODO: use validator)
+	if _, ok := domain.JobTypes[payload.Type]; !ok {
+		return domain.Job{}, fmt.Errorf("invalid job type: %s", payload.Type)
+	}
+
+	// validate max attempts, zero uses the queue's retry policy
+	if payload.MaxAttempts < 0 {
+		return domain.Job{}, fmt.Errorf("invalid job max attempts: %d", payload.MaxAttempts)
+	}
+
+	// validate the schedule, a job may either be delayed or run at a given
+	// time, but not both
+	if payload.DelaySeconds < 0 || (payload.DelaySeconds > 0 && payload.RunAt != nil) {
+		return domain.Job{}, fmt.Errorf("invalid job schedule: %d seconds delay", payload.DelaySeconds)
+	}
+
+	// validate the unique policy, a job with a unique key is rejected while
+	// another job with the key is active unless the policy says otherwise
+	uniquePolicy := payload.UniquePolicy
+	if uniquePolicy == "" {
+		uniquePolicy = domain.UniquePolicyReject
+	}
+	if _, ok := domain.UniquePolicies[uniquePolicy]; !ok {
+		return domain.Job{}, fmt.Errorf("invalid job unique policy: %s", payload.UniquePolicy)
+	}
+
+	// validate the dependencies, a job is cancelled when a job it depends on
+	// fails unless the policy says otherwise
+	for _, id := range payload.DependsOn {
+		if id < 0 {
+			return domain.Job{}, fmt.Errorf("invalid job dependency: %d", id)
+		}
+	}
+	dependencyPolicy := payload.DependencyPolicy
+	if dependencyPolicy == "" {
+		dependencyPolicy = domain.DependencyPolicyCancel
+	}
+	if _, ok := domain.DependencyPolicies[dependencyPolicy]; !ok {
+		return domain.Job{}, fmt.Errorf("invalid job dependency policy: %s", payload.DependencyPolicy)
+	}
+
+	// scheduled jobs stay invisible to dequeue until they are due
+	var runAt time.Time
+	if payload.RunAt != nil {
+		runAt = *payload.RunAt
+	}
+	if payload.DelaySeconds > 0 {
+		runAt = time.Now().Add(time.Duration(payload.DelaySeconds) * time.Second)
+	}
+
+	status := payload.Status
+	if !runAt.IsZero() {
+		status = domain.JobStatusScheduled
+	} else if status == domain.JobStatusScheduled {
+		return domain.Job{}, errors.New("scheduled job without run at time")
+	}
+
+	return domain.Job{
+		Type:             payload.Type,
+		Status:           status,
+		Priority:         payload.Priority,
+		Payload:          payload.Payload,
+		MaxAttempts:      payload.MaxAttempts,
+		RunAt:            runAt,
+		UniqueKey:        payload.UniqueKey,
+		UniquePolicy:     uniquePolicy,
+		DependsOn:        payload.DependsOn,
+		DependencyPolicy: dependencyPolicy,
+	}, nil
+}
+
+// writeEnqueueError maps an error enqueuing a job to a response.
+func writeEnqueueError(w http.ResponseWriter, log zerolog.Logger, err error) {
+	message, statusCode := enqueueError(log, err)
+	WriteErrorResponse(w, message, statusCode)
+}
+
+// enqueueError logs the error returned by enqueuing a job, and returns the
+// error message and status code it maps to.
+func enqueueError(log zerolog.Logger, err error) (string, int) {
+	switch {
+	case errors.Is(err, domain.ErrIdempotencyKeyReused{}):
+		log.Info().Err(err).Msg("idempotency key reused")
+		return ErrConflict, http.StatusConflict
+	case errors.Is(err, domain.ErrDuplicateJob{}):
+		log.Info().Err(err).Msg("duplicate job")
+		return ErrConflict, http.StatusConflict
+	case errors.Is(err, domain.ErrJobNotFound{}):
+		// the job depends on a job that does not exist
+		log.Info().Err(err).Msg("unknown job dependency")
+		return ErrInvalidInput, http.StatusBadRequest
+	case errors.Is(err, domain.ErrOutcomeUnknown{}):
+		// the job may have been enqueued, retrying with an idempotency key
+		// is safe
+		log.Warn().Err(err).Msg("unknown enqueue outcome")
+		return ErrOutcomeUnknown, http.StatusServiceUnavailable
+	default:
+		log.Error().Err(err).Msgf("error enqueuing job")
+		return ErrInternalServerError, http.StatusInternalServerError
+	}
+}
+
 // DequeueJob returns the first avaiable job from the queue. It returns an not f
 // found error if there are no available jobs.
 func (h *JobHandler) DequeueJob(w http.ResponseWriter, r *http.Request) {
@@ -114,8 +482,38 @@ func (h *JobHandler) DequeueJob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// dequeue a job
-	dequeuedJob, err := h.JobQueuer.Dequeue(ctx, consumerID)
+	// validate the time to wait for a job, in seconds, which is optional
+	var wait time.Duration
+	if paramWait := r.URL.Query().Get("wait"); paramWait != "" {
+		seconds, err := strconv.Atoi(paramWait)
+		if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > MaxDequeueWait {
+			log.Info().Err(err).
+				Str("wait", paramWait).
+				Msg("invalid wait")
+			WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+			return
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+
+	// validate the maximum number of jobs to claim, which is optional. Without
+	// it a single job is returned instead of an array
+	max := 1
+	paramMax := r.URL.Query().Get("max")
+	if paramMax != "" {
+		var err error
+		max, err = strconv.Atoi(paramMax)
+		if err != nil || max < 1 || max > MaxDequeueBatch {
+			log.Info().Err(err).
+				Str("max", paramMax).
+				Msg("invalid max")
+			WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// dequeue the jobs
+	dequeuedJobs, err := h.dequeue(ctx, consumerID, max, wait)
 	if err != nil {
 		if errors.Is(err, domain.ErrQueueEmpty) {
 			log.Info().Err(err).Msg("no available jobs in queue")
@@ -123,22 +521,197 @@ func (h *JobHandler) DequeueJob(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// the consumer went away while waiting for a job
+		if ctx.Err() != nil {
+			log.Info().Err(err).Msg("dequeue cancelled")
+			return
+		}
+
 		log.Error().Err(err).Msgf("error dequeuing job")
 		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
 		return
 	}
 
+	// marshal and return the jobs in the response
+	var response []byte
+	if paramMax == "" {
+		dequeuedJob := dequeuedJobs[0]
+		response, err = json.Marshal(newJobResponse(dequeuedJob))
+		if err != nil {
+			log.Error().Err(err).
+				Str("job_id", strconv.Itoa(dequeuedJob.ID)).
+				Str("job_type", dequeuedJob.Type).
+				Str("job_status", dequeuedJob.Status).
+				Msgf("error marshalling response")
+			WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+			return
+		}
+	} else {
+		payload := make([]job, 0, len(dequeuedJobs))
+		for _, dequeuedJob := range dequeuedJobs {
+			payload = append(payload, newJobResponse(dequeuedJob))
+		}
+
+		response, err = json.Marshal(payload)
+		if err != nil {
+			log.Error().Err(err).Msgf("error marshalling response")
+			WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// dequeue claims up to max jobs from the queue. While the queue is empty it
+// waits up to wait for a job to arrive, or until the context is cancelled.
+// Queues that cannot notify consumers are polled.
+func (h *JobHandler) dequeue(ctx context.Context, consumerID string, max int, wait time.Duration) ([]domain.Job, error) {
+	queuer := h.queuer(ctx)
+	notifier, _ := queuer.(JobNotifier)
+
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+	for {
+		// watch for jobs before dequeuing, so a job that arrives in between
+		// is not missed
+		var available <-chan struct{}
+		if notifier != nil {
+			available = notifier.JobAvailable()
+		}
+
+		jobs, err := queuer.DequeueBatch(ctx, consumerID, max)
+		if wait == 0 || !errors.Is(err, domain.ErrQueueEmpty) {
+			return jobs, err
+		}
+
+		poll := time.NewTimer(dequeuePollInterval)
+		select {
+		case <-available:
+		case <-poll.C:
+		case <-deadline.C:
+			poll.Stop()
+			return nil, domain.ErrQueueEmpty
+		case <-ctx.Done():
+			poll.Stop()
+			return nil, ctx.Err()
+		}
+		poll.Stop()
+	}
+}
+
+// ConcludeJob finishes execution on a job, and stores the result attached by
+// the consumer.
+func (h *JobHandler) ConcludeJob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", "ConcludeJob").Logger()
+
+	// validate jobID param is a non-negative integer
+	paramJobID := chi.URLParam(r, "jobID")
+	jobID, err := strconv.Atoi(paramJobID)
+	if err != nil || jobID < 0 {
+		log.Info().Err(err).
+			Str("job_id", paramJobID).
+			Msg("invalid job id")
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
+	// get the consumer id from the header
+	consumerID := r.Header.Get(HeaderQueueConsumer)
+	if consumerID == "" {
+		log.Info().Msg("no valid queue consumer ID")
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
+	// the payload is optional, an empty body concludes the job without a result
+	var payload concludeRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && !errors.Is(err, io.EOF) {
+		log.Info().Err(err).Msg("unable to decode payload")
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
+	// conclude the job
+	if err := h.queuer(ctx).Conclude(ctx, jobID, consumerID, payload.Result); err != nil {
+		if errors.Is(err, domain.ErrJobNotFound{}) {
+			WriteErrorResponse(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		if errors.Is(err, domain.ErrJobStatusTransitionNotAllowed{}) {
+			log.Info().Err(err).Msg("job is not in progress")
+			WriteErrorResponse(w, ErrConflict, http.StatusConflict)
+			return
+		}
+
+		log.Error().Err(err).Msgf("error concluding job")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, http.StatusNoContent, nil)
+}
+
+// FailJob reports that the calling consumer was unable to process a job. The
+// queue retries the job after a backoff until it runs out of attempts.
+func (h *JobHandler) FailJob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", "FailJob").Logger()
+
+	// validate jobID param is a non-negative integer
+	paramJobID := chi.URLParam(r, "jobID")
+	jobID, err := strconv.Atoi(paramJobID)
+	if err != nil || jobID < 0 {
+		log.Info().Err(err).
+			Str("job_id", paramJobID).
+			Msg("invalid job id")
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
+	// get the consumer id from the header
+	consumerID := r.Header.Get(HeaderQueueConsumer)
+	if consumerID == "" {
+		log.Info().Msg("no valid queue consumer ID")
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
+	// the payload is optional, an empty body fails the job without a reason
+	var payload failRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && !errors.Is(err, io.EOF) {
+		log.Info().Err(err).Msg("unable to decode payload")
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
+	// fail the job
+	failedJob, err := h.queuer(ctx).Fail(ctx, jobID, consumerID, payload.Error)
+	if err != nil {
+		if errors.Is(err, domain.ErrJobNotFound{}) {
+			WriteErrorResponse(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		if errors.Is(err, domain.ErrJobStatusTransitionNotAllowed{}) {
+			log.Info().Err(err).Msg("job is not in progress")
+			WriteErrorResponse(w, ErrConflict, http.StatusConflict)
+			return
+		}
+
+		log.Error().Err(err).Msgf("error failing job")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
 	// marshal and return the job in the response
-	response, err := json.Marshal(job{
-		ID:     dequeuedJob.ID,
-		Status: dequeuedJob.Status,
-		Type:   dequeuedJob.Type,
-	})
+	response, err := json.Marshal(newJobResponse(failedJob))
 	if err != nil {
 		log.Error().Err(err).
-			Str("job_id", strconv.Itoa(dequeuedJob.ID)).
-			Str("job_type", dequeuedJob.Type).
-			Str("job_status", dequeuedJob.Status).
+			Str("job_id", strconv.Itoa(failedJob.ID)).
 			Msgf("error marshalling response")
 		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
 		return
@@ -147,10 +720,11 @@ func (h *JobHandler) DequeueJob(w http.ResponseWriter, r *http.Request) {
 	WriteJSONResponse(w, http.StatusOK, response)
 }
 
-// ConcludeJob finishes execution on a job.
-func (h *JobHandler) ConcludeJob(w http.ResponseWriter, r *http.Request) {
+// HeartbeatJob extends the lease on a job held by the calling consumer, and
+// optionally records its progress.
+func (h *JobHandler) HeartbeatJob(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	log := hlog.FromRequest(r).With().Str("handler", "ConcludeJob").Logger()
+	log := hlog.FromRequest(r).With().Str("handler", "HeartbeatJob").Logger()
 
 	// validate jobID param is a non-negative integer
 	paramJobID := chi.URLParam(r, "jobID")
@@ -171,19 +745,51 @@ func (h *JobHandler) ConcludeJob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// conclude the job
-	if err := h.JobQueuer.Conclude(ctx, jobID, consumerID); err != nil {
+	// the payload is optional, an empty body only extends the lease
+	var payload heartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && !errors.Is(err, io.EOF) {
+		log.Info().Err(err).Msg("unable to decode payload")
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
+	// validate progress is a percentage
+	if payload.Progress != nil && (*payload.Progress < 0 || *payload.Progress > 100) {
+		log.Info().Msgf("invalid job progress: %d", *payload.Progress)
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
+	// extend the lease
+	leasedJob, err := h.queuer(ctx).Heartbeat(ctx, jobID, consumerID, payload.Progress)
+	if err != nil {
 		if errors.Is(err, domain.ErrJobNotFound{}) {
 			WriteErrorResponse(w, ErrNotFound, http.StatusNotFound)
 			return
 		}
 
-		log.Error().Err(err).Msgf("error concluding job")
+		if errors.Is(err, domain.ErrJobStatusTransitionNotAllowed{}) {
+			log.Info().Err(err).Msg("job is not in progress")
+			WriteErrorResponse(w, ErrConflict, http.StatusConflict)
+			return
+		}
+
+		log.Error().Err(err).Msgf("error extending job lease")
 		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
 		return
 	}
 
-	WriteJSONResponse(w, http.StatusNoContent, nil)
+	// marshal and return the job in the response
+	response, err := json.Marshal(newJobResponse(leasedJob))
+	if err != nil {
+		log.Error().Err(err).
+			Str("job_id", strconv.Itoa(leasedJob.ID)).
+			Msgf("error marshalling response")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, http.StatusOK, response)
 }
 
 // GetJobStatus returns the status of a job.
@@ -203,7 +809,7 @@ func (h *JobHandler) GetJobStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// fetch the job status
-	queuedJob, err := h.JobQueuer.FetchJob(ctx, jobID)
+	queuedJob, err := h.queuer(ctx).FetchJob(ctx, jobID)
 	if err != nil {
 		if errors.Is(err, domain.ErrJobNotFound{}) {
 			WriteErrorResponse(w, ErrNotFound, http.StatusNotFound)
@@ -216,11 +822,7 @@ func (h *JobHandler) GetJobStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// marshal and return the job in the response
-	response, err := json.Marshal(job{
-		ID:     queuedJob.ID,
-		Status: queuedJob.Status,
-		Type:   queuedJob.Type,
-	})
+	response, err := json.Marshal(newJobResponse(queuedJob))
 	if err != nil {
 		log.Error().Err(err).
 			Str("job_id", strconv.Itoa(queuedJob.ID)).
@@ -251,7 +853,7 @@ func (h *JobHandler) CancelJob(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// fetch the job status
-	err = h.JobQueuer.CancelJob(ctx, jobID)
+	err = h.queuer(ctx).CancelJob(ctx, jobID)
 	if err != nil {
 		if errors.Is(err, domain.ErrJobNotFound{}) {
 			WriteErrorResponse(w, ErrNotFound, http.StatusNotFound)
@@ -1,4 +1,454 @@
-package handler
+package handler_test
 
-// NOTE: I ran out of time to test. I would've used https://github.com/golang/mock
-// to mock the JobQueuer interface to test the implementation here.
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/handler"
+	"github.com/bkrebsbach/simple-job-queue/internal/queue"
+)
+
+// basicQueue hides the optional interfaces a queue implements, so the handler
+// only sees a JobQueuer.
+type basicQueue struct {
+	handler.JobQueuer
+}
+
+// newTestRouter returns a router serving the /jobs and /batches routes of a
+// handler for the queue.
+func newTestRouter(q handler.JobQueuer) http.Handler {
+	h := &handler.JobHandler{JobQueuer: q}
+
+	router := chi.NewRouter()
+	router.Route("/jobs", func(router chi.Router) {
+		router.Get("/", h.ListJobs)
+		router.Post("/enqueue", h.EnqueueJob)
+		router.Post("/enqueue:batch", h.EnqueueJobs)
+		router.Post("/dequeue", h.DequeueJob)
+		router.Post("/admin/cancel", h.CancelJobs)
+		router.Post("/admin/requeue", h.RequeueJobs)
+		router.Post("/{jobID}/heartbeat", h.HeartbeatJob)
+		router.Post("/{jobID}/fail", h.FailJob)
+		router.Get("/dead-letters", h.ListDeadLetters)
+		router.Post("/dead-letters/redrive", h.RedriveAllDeadLetters)
+		router.Get("/dead-letters/{jobID}", h.GetDeadLetter)
+		router.Post("/dead-letters/{jobID}/redrive", h.RedriveDeadLetter)
+		router.Post("/workflows", h.SubmitWorkflow)
+		router.Get("/workflows/{workflowID}", h.GetWorkflow)
+	})
+	router.Route("/batches", func(router chi.Router) {
+		router.Post("/", h.EnqueueBatch)
+		router.Get("/{batchID}", h.GetBatch)
+	})
+
+	return router
+}
+
+// request sends a request to the router, and returns the response.
+func request(ctx context.Context, router http.Handler, method string, target string, body string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body)).WithContext(ctx)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	return w
+}
+
+// consumer returns the headers identifying a consumer.
+func consumer(consumerID string) http.Header {
+	header := http.Header{}
+	header.Set(handler.HeaderQueueConsumer, consumerID)
+
+	return header
+}
+
+// decodeJob decodes the job in a response.
+func decodeJob(t *testing.T, w *httptest.ResponseRecorder) domain.Job {
+	var job domain.Job
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &job))
+
+	return job
+}
+
+// decodeJobIDs decodes the IDs of the jobs in a response.
+func decodeJobIDs(t *testing.T, w *httptest.ResponseRecorder) []int {
+	var jobs []domain.Job
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &jobs))
+
+	return jobIDs(jobs)
+}
+
+// jobIDs returns the IDs of the jobs.
+func jobIDs(jobs []domain.Job) []int {
+	ids := make([]int, 0, len(jobs))
+	for _, job := range jobs {
+		ids = append(ids, job.ID)
+	}
+
+	return ids
+}
+
+func TestHeartbeatJob(t *testing.T) {
+	ctx := context.Background()
+	q := queue.NewInMemoryQueue()
+	router := newTestRouter(q)
+
+	// set up state
+	jobID, err := q.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+	require.Nil(t, err)
+
+	w := request(ctx, router, http.MethodPost, "/jobs/dequeue", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusOK, w.Code)
+	leaseExpiresAt := decodeJob(t, w).LeaseExpiresAt
+
+	target := fmt.Sprintf("/jobs/%d/heartbeat", jobID)
+
+	// check that invalid heartbeats are rejected
+	for name, r := range map[string]struct {
+		target string
+		body   string
+		header http.Header
+	}{
+		"invalid job id":   {"/jobs/first/heartbeat", "", consumer("consumer-1")},
+		"no consumer":      {target, "", nil},
+		"invalid json":     {target, `{"Progress":`, consumer("consumer-1")},
+		"negative":         {target, `{"Progress":-1}`, consumer("consumer-1")},
+		"over one hundred": {target, `{"Progress":101}`, consumer("consumer-1")},
+	} {
+		w := request(ctx, router, http.MethodPost, r.target, r.body, r.header)
+		require.Equal(t, http.StatusBadRequest, w.Code, name)
+	}
+
+	// check that only the consumer holding a job can extend its lease
+	w = request(ctx, router, http.MethodPost, target, "", consumer("consumer-2"))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = request(ctx, router, http.MethodPost, fmt.Sprintf("/jobs/%d/heartbeat", jobID+1), "", consumer("consumer-1"))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	// check that a heartbeat extends the lease and records the progress
+	w = request(ctx, router, http.MethodPost, target, `{"Progress":50}`, consumer("consumer-1"))
+	require.Equal(t, http.StatusOK, w.Code)
+	leasedJob := decodeJob(t, w)
+	require.Equal(t, domain.JobStatusInProgress, leasedJob.Status)
+	require.Equal(t, 50, leasedJob.Progress)
+	require.False(t, leasedJob.LeaseExpiresAt.Before(leaseExpiresAt))
+
+	// check that an empty heartbeat keeps the progress
+	w = request(ctx, router, http.MethodPost, target, "", consumer("consumer-1"))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, 50, decodeJob(t, w).Progress)
+
+	// check that a concluded job has no lease to extend
+	require.Nil(t, q.Conclude(ctx, jobID, "consumer-1", nil))
+	w = request(ctx, router, http.MethodPost, target, "", consumer("consumer-1"))
+	require.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestFailJob(t *testing.T) {
+	ctx := context.Background()
+	q := queue.NewInMemoryQueue(queue.WithRetryPolicy(queue.RetryPolicy{
+		MaxAttempts:    2,
+		InitialBackoff: time.Hour,
+		Multiplier:     2,
+	}))
+	router := newTestRouter(q)
+
+	// set up state
+	jobID, err := q.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+	require.Nil(t, err)
+
+	w := request(ctx, router, http.MethodPost, "/jobs/dequeue", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	target := fmt.Sprintf("/jobs/%d/fail", jobID)
+
+	// check that invalid failures are rejected
+	w = request(ctx, router, http.MethodPost, "/jobs/first/fail", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(ctx, router, http.MethodPost, target, "", nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// check that only the consumer holding a job can fail it
+	w = request(ctx, router, http.MethodPost, target, `{"Error":"timeout"}`, consumer("consumer-2"))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	fetchedJob, err := q.FetchJob(ctx, jobID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusInProgress, fetchedJob.Status)
+
+	// check that a job with attempts left is retried after the backoff
+	now := time.Now()
+	w = request(ctx, router, http.MethodPost, target, `{"Error":"timeout"}`, consumer("consumer-1"))
+	require.Equal(t, http.StatusOK, w.Code)
+	failedJob := decodeJob(t, w)
+	require.Equal(t, domain.JobStatusScheduled, failedJob.Status)
+	require.Equal(t, 1, failedJob.Attempts)
+	require.Equal(t, "timeout", failedJob.LastError)
+	require.True(t, failedJob.RunAt.After(now.Add(time.Hour-time.Second)))
+
+	w = request(ctx, router, http.MethodPost, "/jobs/dequeue", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	// check that a job is dead-lettered once it runs out of attempts
+	jobID, err = q.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued, MaxAttempts: 1})
+	require.Nil(t, err)
+
+	w = request(ctx, router, http.MethodPost, "/jobs/dequeue", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, jobID, decodeJob(t, w).ID)
+
+	target = fmt.Sprintf("/jobs/%d/fail", jobID)
+	w = request(ctx, router, http.MethodPost, target, `{"Error":"boom"}`, consumer("consumer-1"))
+	require.Equal(t, http.StatusOK, w.Code)
+	failedJob = decodeJob(t, w)
+	require.Equal(t, domain.JobStatusFailed, failedJob.Status)
+	require.False(t, failedJob.DeadLetteredAt.IsZero())
+	require.Len(t, failedJob.Failures, 1)
+	require.Equal(t, "boom", failedJob.Failures[0].Error)
+
+	// check that a dead-lettered job is no longer held by the consumer
+	w = request(ctx, router, http.MethodPost, target, `{"Error":"boom"}`, consumer("consumer-1"))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestEnqueueJob_IdempotencyKey(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(queue.NewInMemoryQueue())
+
+	body := `{"Type":"TIME_CRITICAL","Status":"QUEUED"}`
+	header := http.Header{}
+	header.Set(handler.HeaderIdempotencyKey, "order-42")
+	formatHeader := http.Header{}
+	formatHeader.Set(handler.HeaderIdempotencyKey, "order-7")
+
+	// set up state
+	w := request(ctx, router, http.MethodPost, "/jobs/enqueue", body, header)
+	require.Equal(t, http.StatusOK, w.Code)
+	first := decodeJob(t, w)
+
+	// check that a retry gets the job enqueued the first time
+	w = request(ctx, router, http.MethodPost, "/jobs/enqueue", body, header)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, first.ID, decodeJob(t, w).ID)
+
+	// check that a retry that formats the job differently is still a retry
+	w = request(ctx, router, http.MethodPost, "/jobs/enqueue", `{"Type":"TIME_CRITICAL","Status":"QUEUED","Payload":{"customer":42,"order":7}}`, formatHeader)
+	require.Equal(t, http.StatusOK, w.Code)
+	second := decodeJob(t, w)
+
+	w = request(ctx, router, http.MethodPost, "/jobs/enqueue", "{\n  \"Status\": \"QUEUED\",\n  \"Payload\": {\"order\": 7, \"customer\": 42},\n  \"Type\": \"TIME_CRITICAL\"\n}", formatHeader)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, second.ID, decodeJob(t, w).ID)
+
+	// check that the key cannot be reused for a different job
+	w = request(ctx, router, http.MethodPost, "/jobs/enqueue", `{"Type":"NOT_TIME_CRITICAL","Status":"QUEUED"}`, header)
+	require.Equal(t, http.StatusConflict, w.Code)
+
+	// check that a request without a key always enqueues a job
+	w = request(ctx, router, http.MethodPost, "/jobs/enqueue", body, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotEqual(t, first.ID, decodeJob(t, w).ID)
+
+	// check that the key has a maximum length
+	header.Set(handler.HeaderIdempotencyKey, strings.Repeat("k", 256))
+	w = request(ctx, router, http.MethodPost, "/jobs/enqueue", body, header)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestDequeueJob_InvalidInput(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(queue.NewInMemoryQueue())
+
+	// check that a consumer ID is required
+	w := request(ctx, router, http.MethodPost, "/jobs/dequeue", "", nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// check that the wait has to be a number of seconds up to the maximum
+	for _, wait := range []string{"soon", "-1", "61"} {
+		w := request(ctx, router, http.MethodPost, "/jobs/dequeue?wait="+wait, "", consumer("consumer-1"))
+		require.Equal(t, http.StatusBadRequest, w.Code, wait)
+	}
+
+	// check that the maximum number of jobs has to be between 1 and the
+	// maximum batch
+	for _, max := range []string{"many", "0", "101"} {
+		w := request(ctx, router, http.MethodPost, "/jobs/dequeue?max="+max, "", consumer("consumer-1"))
+		require.Equal(t, http.StatusBadRequest, w.Code, max)
+	}
+}
+
+func TestDequeueJob_Max(t *testing.T) {
+	ctx := context.Background()
+	q := queue.NewInMemoryQueue()
+	router := newTestRouter(q)
+
+	// set up state
+	ids := make([]int, 0)
+	for i := 0; i < 3; i++ {
+		id, err := q.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+		require.Nil(t, err)
+		ids = append(ids, id)
+	}
+
+	// check that a single job is returned as an array when a maximum is given
+	w := request(ctx, router, http.MethodPost, "/jobs/dequeue?max=1", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, ids[:1], decodeJobIDs(t, w))
+
+	// check that the jobs are returned in order, with fewer jobs than asked
+	// for when the queue runs out
+	w = request(ctx, router, http.MethodPost, "/jobs/dequeue?max=5", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, ids[1:], decodeJobIDs(t, w))
+
+	// check that an empty queue is not found
+	w = request(ctx, router, http.MethodPost, "/jobs/dequeue?max=5", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestDequeueJob_WaitTimeout(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(queue.NewInMemoryQueue())
+
+	// check that a dequeue without a wait does not wait
+	start := time.Now()
+	w := request(ctx, router, http.MethodPost, "/jobs/dequeue", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Less(t, int64(time.Since(start)), int64(500*time.Millisecond))
+
+	// check that a dequeue waits until the wait is over when no job arrives
+	start = time.Now()
+	w = request(ctx, router, http.MethodPost, "/jobs/dequeue?wait=1", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(time.Second))
+	require.JSONEq(t, `{"message":"queue empty"}`, w.Body.String())
+}
+
+func TestDequeueJob_WaitCancelled(t *testing.T) {
+	q := queue.NewInMemoryQueue()
+	router := newTestRouter(q)
+
+	// check that a consumer that goes away stops waiting, and is not
+	// responded to
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	w := request(ctx, router, http.MethodPost, "/jobs/dequeue?wait=10", "", consumer("consumer-1"))
+	require.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	require.Empty(t, w.Body.String())
+
+	// check that no job was claimed for the consumer that went away
+	id, err := q.Enqueue(context.Background(), domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+	require.Nil(t, err)
+
+	w = request(context.Background(), router, http.MethodPost, "/jobs/dequeue", "", consumer("consumer-2"))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, id, decodeJob(t, w).ID)
+}
+
+func TestDequeueJob_WaitForJob(t *testing.T) {
+	for name, newQueue := range map[string]func() (handler.JobQueuer, *queue.InMemoryQueue){
+		"notified": func() (handler.JobQueuer, *queue.InMemoryQueue) {
+			q := queue.NewInMemoryQueue()
+			return q, q
+		},
+		"polled": func() (handler.JobQueuer, *queue.InMemoryQueue) {
+			q := queue.NewInMemoryQueue()
+			return basicQueue{JobQueuer: q}, q
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			served, q := newQueue()
+			router := newTestRouter(served)
+
+			// set up state: a job that arrives while the consumer waits
+			enqueued := make(chan int, 1)
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				id, err := q.Enqueue(context.Background(), domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+				require.Nil(t, err)
+				enqueued <- id
+			}()
+
+			// check that the waiting consumer receives the job
+			start := time.Now()
+			w := request(context.Background(), router, http.MethodPost, "/jobs/dequeue?wait=10", "", consumer("consumer-1"))
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Less(t, int64(time.Since(start)), int64(5*time.Second))
+
+			job := decodeJob(t, w)
+			require.Equal(t, <-enqueued, job.ID)
+			require.Equal(t, domain.JobStatusInProgress, job.Status)
+			require.Equal(t, "consumer-1", job.ConsumerID)
+		})
+	}
+}
+
+func TestEnqueueJobs_InvalidInput(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(queue.NewInMemoryQueue())
+
+	// check that the jobs have to be an array of up to the maximum batch
+	tooMany := "[" + strings.Repeat(`{"Type":"TIME_CRITICAL","Status":"QUEUED"},`, handler.MaxEnqueueBatch) +
+		`{"Type":"TIME_CRITICAL","Status":"QUEUED"}]`
+	for name, body := range map[string]string{
+		"invalid json": `[`,
+		"not an array": `{"Type":"TIME_CRITICAL","Status":"QUEUED"}`,
+		"no jobs":      `[]`,
+		"too many":     tooMany,
+	} {
+		w := request(ctx, router, http.MethodPost, "/jobs/enqueue:batch", body, nil)
+		require.Equal(t, http.StatusBadRequest, w.Code, name)
+	}
+}
+
+func TestEnqueueJobs(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(queue.NewInMemoryQueue())
+
+	// check that the outcome of every job is returned in order, and a job
+	// that is rejected does not fail the others
+	w := request(ctx, router, http.MethodPost, "/jobs/enqueue:batch", `[
+		{"Type":"TIME_CRITICAL","Status":"QUEUED","UniqueKey":"a"},
+		{"Type":"SOON","Status":"QUEUED"},
+		{"Type":"TIME_CRITICAL","Status":"QUEUED","UniqueKey":"a"},
+		{"Type":"NOT_TIME_CRITICAL","Status":"QUEUED"}
+	]`, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var results []struct {
+		ID     int
+		Status int
+		Error  string
+	}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &results))
+	require.Len(t, results, 4)
+
+	require.Equal(t, http.StatusOK, results[0].Status)
+	require.Equal(t, http.StatusBadRequest, results[1].Status)
+	require.Equal(t, handler.ErrInvalidInput, results[1].Error)
+	require.Equal(t, http.StatusConflict, results[2].Status)
+	require.Equal(t, handler.ErrConflict, results[2].Error)
+	require.Equal(t, http.StatusOK, results[3].Status)
+
+	// check that the enqueued jobs can be dequeued
+	w = request(ctx, router, http.MethodPost, "/jobs/dequeue?max=5", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, []int{results[0].ID, results[3].ID}, decodeJobIDs(t, w))
+}
@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+const (
+	// DefaultListLimit is the number of jobs in a page when no limit is given.
+	DefaultListLimit = 100
+
+	// MaxListLimit is the maximum number of jobs in a page.
+	MaxListLimit = 1000
+)
+
+// JobLister defines the interface for job queues that can list their jobs.
+type JobLister interface {
+	ListJobs(ctx context.Context, filter domain.JobFilter) ([]domain.Job, error)
+}
+
+// listJobsResponse defines the JSON payload for a page of jobs. NextCursor is
+// set when there are more jobs to list.
+type listJobsResponse struct {
+	Jobs       []job  `json:"Jobs"`
+	NextCursor string `json:"NextCursor,omitempty"`
+}
+
+// ListJobs returns a page of the jobs in the queue, ordered by ID. Jobs can be
+// filtered by status, type, consumer and creation time, and the next page is
+// requested with the cursor returned with the previous one.
+func (h *JobHandler) ListJobs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", "ListJobs").Logger()
+
+	lister, ok := h.queuer(ctx).(JobLister)
+	if !ok {
+		WriteErrorResponse(w, ErrNotImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	query := r.URL.Query()
+
+	filter, err := newJobFilter(query)
+	if err != nil {
+		log.Info().Err(err).Msg("invalid filter")
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
+	// validate the page size, which is optional
+	filter.Limit = DefaultListLimit
+	if paramLimit := query.Get("limit"); paramLimit != "" {
+		filter.Limit, err = strconv.Atoi(paramLimit)
+		if err != nil || filter.Limit < 1 || filter.Limit > MaxListLimit {
+			log.Info().Err(err).
+				Str("limit", paramLimit).
+				Msg("invalid limit")
+			WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// continue after the last job of the previous page
+	if paramCursor := query.Get("cursor"); paramCursor != "" {
+		filter.AfterID, err = decodeCursor(paramCursor)
+		if err != nil {
+			log.Info().Err(err).
+				Str("cursor", paramCursor).
+				Msg("invalid cursor")
+			WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// list one job more than the page holds, to tell whether there is a next
+	// page
+	limit := filter.Limit
+	filter.Limit++
+	jobs, err := lister.ListJobs(ctx, filter)
+	if err != nil {
+		log.Error().Err(err).Msgf("error listing jobs")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	payload := listJobsResponse{Jobs: make([]job, 0, len(jobs))}
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+		payload.NextCursor = encodeCursor(jobs[len(jobs)-1].ID)
+	}
+	for _, listedJob := range jobs {
+		payload.Jobs = append(payload.Jobs, newJobResponse(listedJob))
+	}
+
+	// marshal and return the jobs in the response
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Error().Err(err).Msgf("error marshalling response")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// newJobFilter reads a job filter from the query parameters of a request. The
+// status and type have to be valid, and creation times are RFC 3339
+// timestamps.
+func newJobFilter(query url.Values) (domain.JobFilter, error) {
+	filter := domain.JobFilter{
+		Status:     query.Get("status"),
+		Type:       query.Get("type"),
+		ConsumerID: query.Get("consumer"),
+	}
+
+	if filter.Status != "" && !domain.AllJobStatuses[filter.Status] {
+		return domain.JobFilter{}, fmt.Errorf("invalid status %q", filter.Status)
+	}
+
+	if filter.Type != "" && !domain.JobTypes[filter.Type] {
+		return domain.JobFilter{}, fmt.Errorf("invalid type %q", filter.Type)
+	}
+
+	times := map[string]*time.Time{
+		"created_after":  &filter.CreatedAfter,
+		"created_before": &filter.CreatedBefore,
+	}
+	for param, value := range times {
+		if query.Get(param) == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, query.Get(param))
+		if err != nil {
+			return domain.JobFilter{}, fmt.Errorf("invalid %s: %w", param, err)
+		}
+		*value = t
+	}
+
+	return filter, nil
+}
+
+// encodeCursor returns the cursor for the page of jobs after a job ID. Cursors
+// are opaque to clients, so the way pages are tracked can change.
+func encodeCursor(jobID int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(jobID)))
+}
+
+// decodeCursor returns the job ID a cursor continues after.
+func decodeCursor(cursor string) (int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	jobID, err := strconv.Atoi(string(data))
+	if err != nil || jobID < 0 {
+		return 0, fmt.Errorf("invalid job ID %q", data)
+	}
+
+	return jobID, nil
+}
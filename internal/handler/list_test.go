@@ -0,0 +1,105 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/queue"
+)
+
+// jobsPage is a page of jobs returned by ListJobs.
+type jobsPage struct {
+	Jobs       []domain.Job
+	NextCursor string
+}
+
+func TestListJobs_InvalidInput(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(queue.NewInMemoryQueue())
+
+	// check that invalid filters, page sizes and cursors are rejected
+	for _, query := range []string{
+		"status=DONE",
+		"type=SOON",
+		"created_after=yesterday",
+		"created_before=2020-01-01",
+		"limit=0",
+		"limit=1001",
+		"limit=many",
+		"cursor=%21%21",
+		"cursor=LTE",
+	} {
+		w := request(ctx, router, http.MethodGet, "/jobs?"+query, "", nil)
+		require.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestListJobs(t *testing.T) {
+	ctx := context.Background()
+	q := queue.NewInMemoryQueue()
+	router := newTestRouter(q)
+
+	// set up state
+	ids := make([]int, 0)
+	for _, jobType := range []string{domain.JobTypeTimeCritical, domain.JobTypeNotTimeCritical, domain.JobTypeTimeCritical} {
+		id, err := q.Enqueue(ctx, domain.Job{Type: jobType, Status: domain.JobStatusQueued})
+		require.Nil(t, err)
+		ids = append(ids, id)
+	}
+
+	_, err := q.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+
+	// check that jobs are listed in pages, ordered by ID
+	w := request(ctx, router, http.MethodGet, "/jobs?limit=2", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	page := decodeJobsPage(t, w)
+	require.Equal(t, ids[:2], jobIDs(page.Jobs))
+	require.NotEmpty(t, page.NextCursor)
+
+	w = request(ctx, router, http.MethodGet, "/jobs?limit=2&cursor="+page.NextCursor, "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	page = decodeJobsPage(t, w)
+	require.Equal(t, ids[2:], jobIDs(page.Jobs))
+	require.Empty(t, page.NextCursor)
+
+	// check that jobs are filtered by status, type and consumer
+	for query, expected := range map[string][]int{
+		"status=IN_PROGRESS":                    ids[:1],
+		"status=QUEUED":                         ids[1:],
+		"type=NOT_TIME_CRITICAL":                ids[1:2],
+		"consumer=consumer-1":                   ids[:1],
+		"status=QUEUED&type=TIME_CRITICAL":      ids[2:],
+		"created_before=2000-01-01T00:00:00Z":   {},
+		"created_after=2000-01-01T00:00:00Z":    ids,
+		"status=CONCLUDED&consumer=consumer-1":  {},
+		"consumer=consumer-2":                   {},
+		"status=IN_PROGRESS&type=TIME_CRITICAL": ids[:1],
+	} {
+		w := request(ctx, router, http.MethodGet, "/jobs?"+query, "", nil)
+		require.Equal(t, http.StatusOK, w.Code, query)
+		require.Equal(t, expected, jobIDs(decodeJobsPage(t, w).Jobs), query)
+	}
+}
+
+func TestListJobs_NotImplemented(t *testing.T) {
+	router := newTestRouter(basicQueue{JobQueuer: queue.NewInMemoryQueue()})
+
+	// check that queues that cannot list jobs answer that it is not supported
+	w := request(context.Background(), router, http.MethodGet, "/jobs", "", nil)
+	require.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+// decodeJobsPage decodes the page of jobs in a response.
+func decodeJobsPage(t *testing.T, w *httptest.ResponseRecorder) jobsPage {
+	var page jobsPage
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &page))
+
+	return page
+}
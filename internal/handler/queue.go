@@ -0,0 +1,191 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+// queueCtxKey is the request context key for the named queue a request is for.
+type queueCtxKey struct{}
+
+// queue defines the JSON payload for a named queue and its stats.
+type queue struct {
+	Name     string         `json:"Name"`
+	Total    int            `json:"Total"`
+	Statuses map[string]int `json:"Statuses,omitempty"`
+}
+
+// QueueRegistry defines the interface for looking up and creating named job
+// queues.
+type QueueRegistry interface {
+	Queue(ctx context.Context, name string) (JobQueuer, error)
+	CreateQueue(ctx context.Context, name string) (JobQueuer, error)
+	ListQueues(ctx context.Context) ([]string, error)
+}
+
+// StatsReporter defines the interface for job queues that report stats.
+type StatsReporter interface {
+	Stats(ctx context.Context) (domain.QueueStats, error)
+}
+
+// QueueHandler provides the HTTP interface for managing named queues.
+type QueueHandler struct {
+	Queues QueueRegistry
+}
+
+// QueueCtx is middleware that resolves the queue named in the URL, and makes it
+// the queue the job handlers operate on.
+func (h *QueueHandler) QueueCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := hlog.FromRequest(r).With().Str("handler", "QueueCtx").Logger()
+
+		q, err := h.Queues.Queue(ctx, chi.URLParam(r, "queue"))
+		if err != nil {
+			writeQueueError(w, log, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, queueCtxKey{}, q)))
+	})
+}
+
+// CreateQueue creates a named queue.
+func (h *QueueHandler) CreateQueue(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", "CreateQueue").Logger()
+
+	var payload queue
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		log.Info().Err(err).Msg("unable to decode payload")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	q, err := h.Queues.CreateQueue(ctx, payload.Name)
+	if err != nil {
+		writeQueueError(w, log, err)
+		return
+	}
+
+	writeQueueResponse(ctx, w, log, http.StatusCreated, payload.Name, q)
+}
+
+// ListQueues returns every named queue along with its stats.
+func (h *QueueHandler) ListQueues(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", "ListQueues").Logger()
+
+	names, err := h.Queues.ListQueues(ctx)
+	if err != nil {
+		log.Error().Err(err).Msgf("error listing queues")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	payload := make([]queue, 0, len(names))
+	for _, name := range names {
+		q, err := h.Queues.Queue(ctx, name)
+		if err != nil {
+			log.Error().Err(err).Msgf("error fetching queue %q", name)
+			WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+			return
+		}
+
+		stats, err := queueStats(ctx, name, q)
+		if err != nil {
+			log.Error().Err(err).Msgf("error fetching stats for queue %q", name)
+			WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+			return
+		}
+		payload = append(payload, stats)
+	}
+
+	// marshal and return the queues in the response
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Error().Err(err).Msgf("error marshalling response")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// GetQueue returns a named queue along with its stats.
+func (h *QueueHandler) GetQueue(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", "GetQueue").Logger()
+
+	name := chi.URLParam(r, "queue")
+	q, err := h.Queues.Queue(ctx, name)
+	if err != nil {
+		writeQueueError(w, log, err)
+		return
+	}
+
+	writeQueueResponse(ctx, w, log, http.StatusOK, name, q)
+}
+
+// writeQueueResponse marshals a queue and its stats into the response.
+func writeQueueResponse(ctx context.Context, w http.ResponseWriter, log zerolog.Logger, statusCode int, name string, q JobQueuer) {
+	payload, err := queueStats(ctx, name, q)
+	if err != nil {
+		log.Error().Err(err).Msgf("error fetching stats for queue %q", name)
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	// marshal and return the queue in the response
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Error().Err(err).Msgf("error marshalling response")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, statusCode, response)
+}
+
+// queueStats returns the JSON payload for a queue, with stats when the queue
+// reports them.
+func queueStats(ctx context.Context, name string, q JobQueuer) (queue, error) {
+	payload := queue{Name: name}
+
+	reporter, ok := q.(StatsReporter)
+	if !ok {
+		return payload, nil
+	}
+
+	stats, err := reporter.Stats(ctx)
+	if err != nil {
+		return queue{}, err
+	}
+	payload.Total = stats.Total
+	payload.Statuses = stats.Statuses
+
+	return payload, nil
+}
+
+// writeQueueError maps an error looking up or creating a queue to a response.
+func writeQueueError(w http.ResponseWriter, log zerolog.Logger, err error) {
+	switch {
+	case errors.Is(err, domain.ErrQueueNotFound{}):
+		WriteErrorResponse(w, ErrNotFound, http.StatusNotFound)
+	case errors.Is(err, domain.ErrInvalidQueueName{}):
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+	case errors.Is(err, domain.ErrQueueExists{}):
+		WriteErrorResponse(w, ErrConflict, http.StatusConflict)
+	default:
+		log.Error().Err(err).Msgf("error resolving queue")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,146 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/handler"
+	"github.com/bkrebsbach/simple-job-queue/internal/queue"
+	"github.com/bkrebsbach/simple-job-queue/internal/registry"
+)
+
+// queueStats is the JSON payload for a named queue and its stats.
+type queueStats struct {
+	Name     string
+	Total    int
+	Statuses map[string]int
+}
+
+// newQueueRouter returns a router serving the /queues routes of a handler for
+// in-memory named queues, next to the /jobs routes of the default queue.
+func newQueueRouter(autoCreate bool) http.Handler {
+	queues := registry.New(func(name string) (handler.JobQueuer, error) {
+		return queue.NewInMemoryQueue(), nil
+	}, autoCreate)
+
+	jobHandler := &handler.JobHandler{JobQueuer: queue.NewInMemoryQueue()}
+	queueHandler := &handler.QueueHandler{Queues: queues}
+
+	jobRoutes := func(router chi.Router) {
+		router.Post("/enqueue", jobHandler.EnqueueJob)
+		router.Post("/dequeue", jobHandler.DequeueJob)
+	}
+
+	router := chi.NewRouter()
+	router.Route("/jobs", jobRoutes)
+	router.Route("/queues", func(router chi.Router) {
+		router.Post("/", queueHandler.CreateQueue)
+		router.Get("/", queueHandler.ListQueues)
+		router.Get("/{queue}", queueHandler.GetQueue)
+		router.With(queueHandler.QueueCtx).Route("/{queue}/jobs", jobRoutes)
+	})
+
+	return router
+}
+
+func TestCreateQueue(t *testing.T) {
+	ctx := context.Background()
+	router := newQueueRouter(false)
+
+	// check that a queue is created once
+	w := request(ctx, router, http.MethodPost, "/queues", `{"Name":"emails"}`, nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var created queueStats
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &created))
+	require.Equal(t, "emails", created.Name)
+	require.Equal(t, 0, created.Total)
+
+	w = request(ctx, router, http.MethodPost, "/queues", `{"Name":"emails"}`, nil)
+	require.Equal(t, http.StatusConflict, w.Code)
+
+	// check that invalid queues are rejected
+	for name, body := range map[string]string{
+		"invalid json": `{"Name":`,
+		"no name":      `{}`,
+		"invalid name": `{"Name":"e-mails/2024"}`,
+	} {
+		w := request(ctx, router, http.MethodPost, "/queues", body, nil)
+		require.Equal(t, http.StatusBadRequest, w.Code, name)
+	}
+
+	w = request(ctx, router, http.MethodGet, "/queues", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var queues []queueStats
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &queues))
+	require.Len(t, queues, 1)
+	require.Equal(t, "emails", queues[0].Name)
+}
+
+func TestQueueRoutes(t *testing.T) {
+	ctx := context.Background()
+	router := newQueueRouter(false)
+
+	// set up state
+	for _, name := range []string{"emails", "reports"} {
+		w := request(ctx, router, http.MethodPost, "/queues", `{"Name":"`+name+`"}`, nil)
+		require.Equal(t, http.StatusCreated, w.Code)
+	}
+
+	w := request(ctx, router, http.MethodPost, "/queues/emails/jobs/enqueue", `{"Type":"TIME_CRITICAL","Status":"QUEUED"}`, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	jobID := decodeJob(t, w).ID
+
+	// check that a job only lands in the queue it was enqueued to
+	w = request(ctx, router, http.MethodGet, "/queues/emails", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var stats queueStats
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	require.Equal(t, 1, stats.Total)
+	require.Equal(t, map[string]int{domain.JobStatusQueued: 1}, stats.Statuses)
+
+	w = request(ctx, router, http.MethodPost, "/queues/reports/jobs/dequeue", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = request(ctx, router, http.MethodPost, "/jobs/dequeue", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = request(ctx, router, http.MethodPost, "/queues/emails/jobs/dequeue", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, jobID, decodeJob(t, w).ID)
+
+	// check that an unknown queue is not found
+	w = request(ctx, router, http.MethodGet, "/queues/invoices", "", nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = request(ctx, router, http.MethodPost, "/queues/invoices/jobs/enqueue", `{"Type":"TIME_CRITICAL","Status":"QUEUED"}`, nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestQueueRoutes_AutoCreate(t *testing.T) {
+	ctx := context.Background()
+	router := newQueueRouter(true)
+
+	// check that a queue is created the first time it is used
+	w := request(ctx, router, http.MethodPost, "/queues/invoices/jobs/enqueue", `{"Type":"TIME_CRITICAL","Status":"QUEUED"}`, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = request(ctx, router, http.MethodGet, "/queues/invoices", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var stats queueStats
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	require.Equal(t, 1, stats.Total)
+
+	// check that a queue with an invalid name is not created
+	w = request(ctx, router, http.MethodPost, "/queues/in%20voices/jobs/enqueue", `{"Type":"TIME_CRITICAL","Status":"QUEUED"}`, nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
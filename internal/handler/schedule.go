@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+// schedule defines the JSON payload for a recurring job schedule.
+type schedule struct {
+	ID        int             `json:"ID"`
+	Type      string          `json:"Type"`
+	Payload   json.RawMessage `json:"Payload,omitempty"`
+	Priority  int             `json:"Priority"`
+	Cron      string          `json:"Cron"`
+	Timezone  string          `json:"Timezone,omitempty"`
+	Paused    bool            `json:"Paused"`
+	NextRunAt *time.Time      `json:"NextRunAt,omitempty"`
+	LastRunAt *time.Time      `json:"LastRunAt,omitempty"`
+	CreatedAt time.Time       `json:"CreatedAt"`
+}
+
+// newScheduleResponse converts a domain schedule into its JSON payload.
+func newScheduleResponse(s domain.Schedule) schedule {
+	response := schedule{
+		ID:        s.ID,
+		Type:      s.Type,
+		Payload:   s.Payload,
+		Priority:  s.Priority,
+		Cron:      s.Cron,
+		Timezone:  s.Timezone,
+		Paused:    s.Paused,
+		CreatedAt: s.CreatedAt,
+	}
+
+	if !s.NextRunAt.IsZero() {
+		nextRunAt := s.NextRunAt
+		response.NextRunAt = &nextRunAt
+	}
+
+	if !s.LastRunAt.IsZero() {
+		lastRunAt := s.LastRunAt
+		response.LastRunAt = &lastRunAt
+	}
+
+	return response
+}
+
+// Scheduler defines the interface for managing recurring job schedules.
+type Scheduler interface {
+	CreateSchedule(ctx context.Context, schedule domain.Schedule) (domain.Schedule, error)
+	ListSchedules(ctx context.Context) ([]domain.Schedule, error)
+	FetchSchedule(ctx context.Context, scheduleID int) (domain.Schedule, error)
+	PauseSchedule(ctx context.Context, scheduleID int) (domain.Schedule, error)
+	ResumeSchedule(ctx context.Context, scheduleID int) (domain.Schedule, error)
+	DeleteSchedule(ctx context.Context, scheduleID int) error
+}
+
+// ScheduleHandler provides the HTTP interface for registering and managing
+// recurring job schedules.
+type ScheduleHandler struct {
+	Scheduler Scheduler
+}
+
+// CreateSchedule registers a recurring job schedule.
+func (h *ScheduleHandler) CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", "CreateSchedule").Logger()
+
+	var payload schedule
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		log.Info().Err(err).Msg("unable to decode payload")
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
+	// validate job type (TODO: use validator)
+	if _, ok := domain.JobTypes[payload.Type]; !ok {
+		log.Info().Msgf("invalid job type: %s", payload.Type)
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
+	created, err := h.Scheduler.CreateSchedule(ctx, domain.Schedule{
+		Type:     payload.Type,
+		Payload:  payload.Payload,
+		Priority: payload.Priority,
+		Cron:     payload.Cron,
+		Timezone: payload.Timezone,
+	})
+	if err != nil {
+		if errors.Is(err, domain.ErrInvalidSchedule{}) {
+			log.Info().Err(err).Msg("invalid schedule")
+			WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+			return
+		}
+
+		log.Error().Err(err).Msgf("error creating schedule")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	writeScheduleResponse(w, log, created)
+}
+
+// ListSchedules returns every registered schedule.
+func (h *ScheduleHandler) ListSchedules(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", "ListSchedules").Logger()
+
+	schedules, err := h.Scheduler.ListSchedules(ctx)
+	if err != nil {
+		log.Error().Err(err).Msgf("error listing schedules")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	// marshal and return the schedules in the response
+	payload := make([]schedule, 0, len(schedules))
+	for _, s := range schedules {
+		payload = append(payload, newScheduleResponse(s))
+	}
+
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Error().Err(err).Msgf("error marshalling response")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// GetSchedule returns a single schedule.
+func (h *ScheduleHandler) GetSchedule(w http.ResponseWriter, r *http.Request) {
+	h.withSchedule(w, r, "GetSchedule", h.Scheduler.FetchSchedule)
+}
+
+// PauseSchedule stops a schedule from firing until it is resumed.
+func (h *ScheduleHandler) PauseSchedule(w http.ResponseWriter, r *http.Request) {
+	h.withSchedule(w, r, "PauseSchedule", h.Scheduler.PauseSchedule)
+}
+
+// ResumeSchedule lets a paused schedule fire again.
+func (h *ScheduleHandler) ResumeSchedule(w http.ResponseWriter, r *http.Request) {
+	h.withSchedule(w, r, "ResumeSchedule", h.Scheduler.ResumeSchedule)
+}
+
+// DeleteSchedule removes a schedule.
+func (h *ScheduleHandler) DeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", "DeleteSchedule").Logger()
+
+	scheduleID, ok := scheduleIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.Scheduler.DeleteSchedule(ctx, scheduleID); err != nil {
+		if errors.Is(err, domain.ErrScheduleNotFound{}) {
+			WriteErrorResponse(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		log.Error().Err(err).Msgf("error deleting schedule")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, http.StatusNoContent, nil)
+}
+
+// withSchedule runs an operation on the schedule named in the URL, and writes
+// the resulting schedule to the response.
+func (h *ScheduleHandler) withSchedule(w http.ResponseWriter, r *http.Request, name string, op func(context.Context, int) (domain.Schedule, error)) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", name).Logger()
+
+	scheduleID, ok := scheduleIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := op(ctx, scheduleID)
+	if err != nil {
+		if errors.Is(err, domain.ErrScheduleNotFound{}) {
+			WriteErrorResponse(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		log.Error().Err(err).Msgf("error handling schedule")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	writeScheduleResponse(w, log, result)
+}
+
+// scheduleIDParam validates the scheduleID URL param is a non-negative integer,
+// writing a bad request response if it is not.
+func scheduleIDParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	paramScheduleID := chi.URLParam(r, "scheduleID")
+	scheduleID, err := strconv.Atoi(paramScheduleID)
+	if err != nil || scheduleID < 0 {
+		hlog.FromRequest(r).Info().Err(err).
+			Str("schedule_id", paramScheduleID).
+			Msg("invalid schedule id")
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return 0, false
+	}
+
+	return scheduleID, true
+}
+
+// writeScheduleResponse marshals a schedule into the response.
+func writeScheduleResponse(w http.ResponseWriter, log zerolog.Logger, s domain.Schedule) {
+	response, err := json.Marshal(newScheduleResponse(s))
+	if err != nil {
+		log.Error().Err(err).
+			Str("schedule_id", strconv.Itoa(s.ID)).
+			Msgf("error marshalling response")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, http.StatusOK, response)
+}
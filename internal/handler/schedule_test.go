@@ -0,0 +1,136 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/handler"
+	"github.com/bkrebsbach/simple-job-queue/internal/queue"
+	"github.com/bkrebsbach/simple-job-queue/internal/schedule"
+)
+
+// newScheduleRouter returns a router serving the /schedules routes of a
+// handler for a scheduler that keeps its schedules in memory.
+func newScheduleRouter(t *testing.T) http.Handler {
+	scheduler, err := schedule.NewScheduler(queue.NewInMemoryQueue(), nil, zerolog.Nop())
+	require.Nil(t, err)
+
+	h := &handler.ScheduleHandler{Scheduler: scheduler}
+
+	router := chi.NewRouter()
+	router.Route("/schedules", func(router chi.Router) {
+		router.Post("/", h.CreateSchedule)
+		router.Get("/", h.ListSchedules)
+		router.Get("/{scheduleID}", h.GetSchedule)
+		router.Post("/{scheduleID}/pause", h.PauseSchedule)
+		router.Post("/{scheduleID}/resume", h.ResumeSchedule)
+		router.Delete("/{scheduleID}", h.DeleteSchedule)
+	})
+
+	return router
+}
+
+// decodeSchedule decodes the schedule in a response.
+func decodeSchedule(t *testing.T, w *httptest.ResponseRecorder) domain.Schedule {
+	var s domain.Schedule
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &s))
+
+	return s
+}
+
+func TestCreateSchedule_InvalidInput(t *testing.T) {
+	ctx := context.Background()
+	router := newScheduleRouter(t)
+
+	// check that invalid schedules are rejected
+	for name, body := range map[string]string{
+		"invalid json":     `{"Type":`,
+		"invalid job type": `{"Type":"SOON","Cron":"0 * * * *"}`,
+		"invalid cron":     `{"Type":"TIME_CRITICAL","Cron":"every hour"}`,
+		"out of range":     `{"Type":"TIME_CRITICAL","Cron":"60 * * * *"}`,
+		"invalid timezone": `{"Type":"TIME_CRITICAL","Cron":"0 * * * *","Timezone":"Mars/Olympus_Mons"}`,
+	} {
+		w := request(ctx, router, http.MethodPost, "/schedules", body, nil)
+		require.Equal(t, http.StatusBadRequest, w.Code, name)
+	}
+
+	w := request(ctx, router, http.MethodGet, "/schedules", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `[]`, w.Body.String())
+}
+
+func TestSchedules(t *testing.T) {
+	ctx := context.Background()
+	router := newScheduleRouter(t)
+
+	// set up state
+	w := request(ctx, router, http.MethodPost, "/schedules", `{"Type":"TIME_CRITICAL","Cron":"0 9 * * *","Timezone":"Europe/Berlin","Payload":{"report":"daily"}}`, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	created := decodeSchedule(t, w)
+	require.NotZero(t, created.ID)
+	require.Equal(t, "Europe/Berlin", created.Timezone)
+	require.False(t, created.NextRunAt.IsZero())
+	require.False(t, created.Paused)
+
+	w = request(ctx, router, http.MethodPost, "/schedules", `{"Type":"NOT_TIME_CRITICAL","Cron":"*/5 * * * *"}`, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	other := decodeSchedule(t, w)
+
+	target := fmt.Sprintf("/schedules/%d", created.ID)
+
+	// check that the schedules are listed and fetched
+	w = request(ctx, router, http.MethodGet, "/schedules", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var schedules []domain.Schedule
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &schedules))
+	require.Len(t, schedules, 2)
+	require.Equal(t, created.ID, schedules[0].ID)
+	require.Equal(t, other.ID, schedules[1].ID)
+
+	w = request(ctx, router, http.MethodGet, target, "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	fetched := decodeSchedule(t, w)
+	require.Equal(t, created.Cron, fetched.Cron)
+	require.JSONEq(t, `{"report":"daily"}`, string(fetched.Payload))
+
+	// check that a schedule is paused and resumed
+	w = request(ctx, router, http.MethodPost, target+"/pause", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.True(t, decodeSchedule(t, w).Paused)
+
+	w = request(ctx, router, http.MethodPost, target+"/resume", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.False(t, decodeSchedule(t, w).Paused)
+
+	// check that a deleted schedule is gone
+	w = request(ctx, router, http.MethodDelete, target, "", nil)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = request(ctx, router, http.MethodGet, target, "", nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = request(ctx, router, http.MethodDelete, target, "", nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = request(ctx, router, http.MethodGet, "/schedules", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &schedules))
+	require.Len(t, schedules, 1)
+	require.Equal(t, other.ID, schedules[0].ID)
+
+	// check that invalid and unknown schedule IDs are rejected
+	w = request(ctx, router, http.MethodGet, "/schedules/daily", "", nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(ctx, router, http.MethodPost, target+"/pause", "", nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,288 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+// maxWorkflowJobs is the maximum number of jobs in a workflow.
+const maxWorkflowJobs = 1000
+
+// WorkflowQueuer defines the interface for job queues that can enqueue the jobs
+// of a workflow at once, and list the jobs submitted with a workflow.
+type WorkflowQueuer interface {
+	EnqueueWorkflow(ctx context.Context, jobs []domain.WorkflowJob) ([]int, error)
+	ListWorkflowJobs(ctx context.Context, workflowID string) ([]domain.Job, error)
+}
+
+// workflowJob defines the JSON payload for a job of a workflow. Its DependsOn
+// takes the place of the job's, see workflowDependencies.
+type workflowJob struct {
+	job
+	Ref       string               `json:"Ref"`
+	DependsOn workflowDependencies `json:"DependsOn"`
+}
+
+// workflowDependencies holds the jobs a job of a workflow depends on. Jobs of
+// the workflow are referred to by their Ref, and jobs enqueued before the
+// workflow by their ID.
+type workflowDependencies struct {
+	Refs []string
+	IDs  []int
+}
+
+// UnmarshalJSON reads the dependencies from an array of refs and job IDs.
+func (d *workflowDependencies) UnmarshalJSON(data []byte) error {
+	var values []json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+
+	for _, value := range values {
+		var ref string
+		if err := json.Unmarshal(value, &ref); err == nil {
+			d.Refs = append(d.Refs, ref)
+			continue
+		}
+
+		var id int
+		if err := json.Unmarshal(value, &id); err != nil {
+			return fmt.Errorf("invalid workflow dependency: %s", value)
+		}
+		d.IDs = append(d.IDs, id)
+	}
+
+	return nil
+}
+
+// workflowRequest defines the JSON payload for submitting a workflow.
+type workflowRequest struct {
+	Jobs []workflowJob `json:"Jobs"`
+}
+
+// submitWorkflowResponse returns the ID of a submitted workflow, and the IDs of
+// its jobs by their Ref.
+type submitWorkflowResponse struct {
+	ID   string         `json:"ID"`
+	Jobs map[string]int `json:"Jobs"`
+}
+
+// workflow defines the JSON payload for a workflow.
+type workflow struct {
+	ID     string `json:"ID"`
+	Status string `json:"Status"`
+	Jobs   []job  `json:"Jobs"`
+}
+
+// SubmitWorkflow enqueues the jobs of a workflow, where jobs depend on other
+// jobs of the workflow. Jobs are enqueued after the jobs they depend on, and
+// either every job is enqueued or none of them.
+func (h *JobHandler) SubmitWorkflow(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", "SubmitWorkflow").Logger()
+
+	workflows, ok := h.queuer(ctx).(WorkflowQueuer)
+	if !ok {
+		WriteErrorResponse(w, ErrNotImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	var payload workflowRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		log.Info().Err(err).Msg("unable to decode payload")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// validate the jobs, and the order they can be enqueued in
+	order, err := orderWorkflow(payload.Jobs)
+	if err != nil {
+		log.Info().Err(err).Msg("invalid workflow")
+		WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+		return
+	}
+
+	workflowID, err := newWorkflowID()
+	if err != nil {
+		log.Error().Err(err).Msg("error generating workflow id")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	// list the jobs in order, each one after the jobs it depends on
+	positions := make(map[string]int, len(order))
+	jobs := make([]domain.WorkflowJob, 0, len(order))
+	for _, i := range order {
+		workflowJob := payload.Jobs[i]
+		workflowJob.job.DependsOn = workflowJob.DependsOn.IDs
+
+		newJob, err := newJobRequest(workflowJob.job)
+		if err != nil {
+			log.Info().Err(err).Str("ref", workflowJob.Ref).Msg("invalid job")
+			WriteErrorResponse(w, ErrInvalidInput, http.StatusBadRequest)
+			return
+		}
+		newJob.WorkflowID = workflowID
+
+		parents := make([]int, 0, len(workflowJob.DependsOn.Refs))
+		for _, ref := range workflowJob.DependsOn.Refs {
+			parents = append(parents, positions[ref])
+		}
+
+		positions[workflowJob.Ref] = len(jobs)
+		jobs = append(jobs, domain.WorkflowJob{Job: newJob, Parents: parents})
+	}
+
+	enqueued, err := workflows.EnqueueWorkflow(ctx, jobs)
+	if err != nil {
+		writeEnqueueError(w, log, err)
+		return
+	}
+
+	ids := make(map[string]int, len(enqueued))
+	for ref, position := range positions {
+		ids[ref] = enqueued[position]
+	}
+
+	// marshal and return the workflow ID in the response
+	response, err := json.Marshal(submitWorkflowResponse{ID: workflowID, Jobs: ids})
+	if err != nil {
+		log.Error().Err(err).Msgf("error marshalling response")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// GetWorkflow returns the jobs of a workflow, and the status of the workflow.
+func (h *JobHandler) GetWorkflow(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r).With().Str("handler", "GetWorkflow").Logger()
+
+	workflows, ok := h.queuer(ctx).(WorkflowQueuer)
+	if !ok {
+		WriteErrorResponse(w, ErrNotImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	workflowID := chi.URLParam(r, "workflowID")
+	jobs, err := workflows.ListWorkflowJobs(ctx, workflowID)
+	if err != nil {
+		if errors.Is(err, domain.ErrWorkflowNotFound{}) {
+			WriteErrorResponse(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		log.Error().Err(err).Str("workflow_id", workflowID).Msgf("error listing workflow jobs")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	// marshal and return the workflow in the response
+	payload := workflow{
+		ID:     workflowID,
+		Status: domain.WorkflowStatus(jobs),
+		Jobs:   make([]job, 0, len(jobs)),
+	}
+	for _, workflowJob := range jobs {
+		payload.Jobs = append(payload.Jobs, newJobResponse(workflowJob))
+	}
+
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Error().Err(err).Msgf("error marshalling response")
+		WriteErrorResponse(w, ErrInternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// orderWorkflow validates the references between the jobs of a workflow, and
+// returns the positions of the jobs in an order where every job comes after the
+// jobs it depends on. Jobs that do not depend on each other keep their order.
+func orderWorkflow(jobs []workflowJob) ([]int, error) {
+	if len(jobs) == 0 || len(jobs) > maxWorkflowJobs {
+		return nil, fmt.Errorf("invalid number of workflow jobs: %d", len(jobs))
+	}
+
+	positions := make(map[string]int, len(jobs))
+	for i, j := range jobs {
+		if j.Ref == "" {
+			return nil, fmt.Errorf("workflow job %d has no ref", i)
+		}
+		if _, ok := positions[j.Ref]; ok {
+			return nil, fmt.Errorf("duplicate workflow job ref: %s", j.Ref)
+		}
+		positions[j.Ref] = i
+	}
+
+	// count the dependencies of every job, and which jobs wait on each job
+	waiting := make([]int, len(jobs))
+	dependents := make([][]int, len(jobs))
+	for i, j := range jobs {
+		for _, ref := range j.DependsOn.Refs {
+			parent, ok := positions[ref]
+			if !ok {
+				return nil, fmt.Errorf("workflow job %s depends on unknown ref: %s", j.Ref, ref)
+			}
+			waiting[i]++
+			dependents[parent] = append(dependents[parent], i)
+		}
+	}
+
+	order := make([]int, 0, len(jobs))
+	for i := range jobs {
+		if waiting[i] == 0 {
+			order = append(order, i)
+		}
+	}
+	for next := 0; next < len(order); next++ {
+		for _, dependent := range dependents[order[next]] {
+			waiting[dependent]--
+			if waiting[dependent] == 0 {
+				order = append(order, dependent)
+			}
+		}
+	}
+
+	// jobs that are still waiting depend on each other
+	if len(order) < len(jobs) {
+		return nil, errors.New("workflow jobs depend on each other in a cycle")
+	}
+
+	return order, nil
+}
+
+// cancelJobs cancels the jobs of a batch that was enqueued in part, latest
+// first.
+func cancelJobs(ctx context.Context, queuer JobQueuer, log zerolog.Logger, ids []int) {
+	for i := len(ids) - 1; i >= 0; i-- {
+		err := queuer.CancelJob(ctx, ids[i])
+		if err != nil && !errors.Is(err, domain.ErrJobStatusTransitionNotAllowed{}) {
+			log.Error().Err(err).Int("job_id", ids[i]).Msg("error cancelling job")
+		}
+	}
+}
+
+// newWorkflowID returns a random workflow ID.
+func newWorkflowID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,113 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/queue"
+)
+
+func TestSubmitWorkflow_InvalidInput(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(queue.NewInMemoryQueue())
+
+	// check that invalid workflows are rejected before any job is enqueued
+	for name, body := range map[string]string{
+		"invalid json":       `{"Jobs":`,
+		"no jobs":            `{"Jobs":[]}`,
+		"missing ref":        `{"Jobs":[{"Type":"TIME_CRITICAL","Status":"QUEUED"}]}`,
+		"duplicate ref":      `{"Jobs":[{"Ref":"a","Type":"TIME_CRITICAL","Status":"QUEUED"},{"Ref":"a","Type":"TIME_CRITICAL","Status":"QUEUED"}]}`,
+		"unknown ref":        `{"Jobs":[{"Ref":"a","Type":"TIME_CRITICAL","Status":"QUEUED","DependsOn":["b"]}]}`,
+		"cycle":              `{"Jobs":[{"Ref":"a","Type":"TIME_CRITICAL","Status":"QUEUED","DependsOn":["b"]},{"Ref":"b","Type":"TIME_CRITICAL","Status":"QUEUED","DependsOn":["a"]}]}`,
+		"invalid dependency": `{"Jobs":[{"Ref":"a","Type":"TIME_CRITICAL","Status":"QUEUED","DependsOn":[{}]}]}`,
+		"invalid job":        `{"Jobs":[{"Ref":"a","Type":"SOON","Status":"QUEUED"}]}`,
+		"unknown job":        `{"Jobs":[{"Ref":"a","Type":"TIME_CRITICAL","Status":"QUEUED","DependsOn":[42]}]}`,
+	} {
+		w := request(ctx, router, http.MethodPost, "/jobs/workflows", body, nil)
+		require.Equal(t, http.StatusBadRequest, w.Code, name)
+	}
+
+	w := request(ctx, router, http.MethodPost, "/jobs/dequeue", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestSubmitWorkflow(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(queue.NewInMemoryQueue())
+
+	// set up state: a job that runs after two jobs listed after it
+	w := request(ctx, router, http.MethodPost, "/jobs/workflows", `{"Jobs":[
+		{"Ref":"report","Type":"NOT_TIME_CRITICAL","Status":"QUEUED","DependsOn":["fetch","parse"]},
+		{"Ref":"fetch","Type":"TIME_CRITICAL","Status":"QUEUED"},
+		{"Ref":"parse","Type":"TIME_CRITICAL","Status":"QUEUED","DependsOn":["fetch"]}
+	]}`, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var submitted struct {
+		ID   string
+		Jobs map[string]int
+	}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &submitted))
+	require.NotEmpty(t, submitted.ID)
+	require.Len(t, submitted.Jobs, 3)
+
+	// check that jobs are enqueued after the jobs they depend on, and only
+	// the job without dependencies can be dequeued
+	require.Less(t, submitted.Jobs["fetch"], submitted.Jobs["parse"])
+	require.Less(t, submitted.Jobs["parse"], submitted.Jobs["report"])
+
+	w = request(ctx, router, http.MethodPost, "/jobs/dequeue", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, submitted.Jobs["fetch"], decodeJob(t, w).ID)
+
+	w = request(ctx, router, http.MethodPost, "/jobs/dequeue", "", consumer("consumer-1"))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	// check that the workflow lists its jobs with the aggregate status
+	w = request(ctx, router, http.MethodGet, "/jobs/workflows/"+submitted.ID, "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var workflow struct {
+		ID     string
+		Status string
+		Jobs   []domain.Job
+	}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &workflow))
+	require.Equal(t, submitted.ID, workflow.ID)
+	require.Equal(t, domain.JobStatusInProgress, workflow.Status)
+
+	statuses := make(map[int]string, len(workflow.Jobs))
+	for _, job := range workflow.Jobs {
+		statuses[job.ID] = job.Status
+	}
+	require.Equal(t, map[int]string{
+		submitted.Jobs["fetch"]:  domain.JobStatusInProgress,
+		submitted.Jobs["parse"]:  domain.JobStatusBlocked,
+		submitted.Jobs["report"]: domain.JobStatusBlocked,
+	}, statuses)
+}
+
+func TestGetWorkflow_NotFound(t *testing.T) {
+	router := newTestRouter(queue.NewInMemoryQueue())
+
+	// check that an unknown workflow is not found
+	w := request(context.Background(), router, http.MethodGet, "/jobs/workflows/unknown", "", nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestSubmitWorkflow_NotImplemented(t *testing.T) {
+	ctx := context.Background()
+	router := newTestRouter(basicQueue{JobQueuer: queue.NewInMemoryQueue()})
+
+	// check that queues without workflows answer that they are not supported
+	w := request(ctx, router, http.MethodPost, "/jobs/workflows", `{"Jobs":[{"Ref":"a","Type":"TIME_CRITICAL","Status":"QUEUED"}]}`, nil)
+	require.Equal(t, http.StatusNotImplemented, w.Code)
+
+	w = request(ctx, router, http.MethodGet, "/jobs/workflows/unknown", "", nil)
+	require.Equal(t, http.StatusNotImplemented, w.Code)
+}
@@ -0,0 +1,62 @@
+package queue
+
+import (
+	"context"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+// CancelJobs cancels every active job selected by the filter at once, and
+// returns the number of jobs cancelled. Either all of the jobs are cancelled or
+// none is.
+func (q *InMemoryQueue) CancelJobs(ctx context.Context, filter domain.JobFilter) (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	filter.AfterID, filter.Limit = 0, 0
+
+	jobs := make([]domain.Job, 0)
+	for _, job := range q.list(filter) {
+		if domain.ActiveJobStatuses[job.Status] {
+			job.Status = domain.JobStatusCancelled
+			jobs = append(jobs, job)
+		}
+	}
+
+	if len(jobs) == 0 {
+		return 0, nil
+	}
+
+	if err := q.save(jobs...); err != nil {
+		return 0, err
+	}
+
+	return len(jobs), nil
+}
+
+// RequeueJobs returns every in progress job selected by the filter to the queue
+// at once, and returns the number of jobs requeued. Either all of the jobs are
+// requeued or none is.
+func (q *InMemoryQueue) RequeueJobs(ctx context.Context, filter domain.JobFilter) (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	filter.AfterID, filter.Limit = 0, 0
+
+	jobs := make([]domain.Job, 0)
+	for _, job := range q.list(filter) {
+		if job.Status == domain.JobStatusInProgress {
+			jobs = append(jobs, job)
+		}
+	}
+
+	if len(jobs) == 0 {
+		return 0, nil
+	}
+
+	if err := q.requeue(jobs); err != nil {
+		return 0, err
+	}
+
+	return len(jobs), nil
+}
@@ -0,0 +1,459 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/rs/zerolog"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+// clusterApplyTimeout bounds how long a command waits to be committed when the
+// request context has no deadline.
+const clusterApplyTimeout = 10 * time.Second
+
+// ClusterConfig defines the Raft node a cluster runs on. Tests use the
+// in-memory stores and transport provided by the raft package.
+type ClusterConfig struct {
+	Raft        *raft.Config
+	LogStore    raft.LogStore
+	StableStore raft.StableStore
+	Snapshots   raft.SnapshotStore
+	Transport   raft.Transport
+}
+
+// Cluster replicates named job queues across nodes with Raft consensus. Every
+// node keeps the queues in memory, and changes them by applying the commands
+// committed to the Raft log in the same order. Only the leader accepts
+// commands, and serves reads once it applied every command committed before
+// it was elected.
+type Cluster struct {
+	raft *raft.Raft
+	fsm  *clusterFSM
+
+	// leading is set to 1 while the node is the leader and is up to date
+	leading int32
+
+	// now is the clock the leader stamps on commands
+	now func() time.Time
+
+	done chan struct{}
+}
+
+// NewCluster starts a cluster node. The node recovers its queues from the
+// latest Raft snapshot and log, and then joins the cluster it was part of.
+// A new cluster has to be bootstrapped with Bootstrap first.
+func NewCluster(c ClusterConfig, opts ...Option) (*Cluster, error) {
+	fsm := newClusterFSM(opts)
+
+	// leadership changes are consumed by watchLeadership, which has to keep
+	// up as raft blocks on the channel
+	notify := make(chan bool, 1)
+	conf := *c.Raft
+	conf.NotifyCh = notify
+
+	r, err := raft.NewRaft(&conf, fsm, c.LogStore, c.StableStore, c.Snapshots, c.Transport)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster := &Cluster{
+		raft: r,
+		fsm:  fsm,
+		now:  time.Now,
+		done: make(chan struct{}),
+	}
+	go cluster.watchLeadership(notify)
+
+	return cluster, nil
+}
+
+// Bootstrap forms a new cluster of the given servers, which has to include the
+// local node. It may be called on every node of the new cluster with the same
+// servers, and does nothing if the node already has state.
+func (c *Cluster) Bootstrap(servers []raft.Server) error {
+	err := c.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+	if errors.Is(err, raft.ErrCantBootstrap) {
+		return nil
+	}
+
+	return err
+}
+
+// Queue returns the named queue. Queues are created on every node by the first
+// command applied to them.
+func (c *Cluster) Queue(name string) *ClusterQueue {
+	return &ClusterQueue{cluster: c, name: name}
+}
+
+// ListQueues returns the names of the queues in ascending order.
+func (c *Cluster) ListQueues() []string {
+	return c.fsm.names()
+}
+
+// IsLeader reports whether the node is the leader, and has applied every
+// command committed before it was elected.
+func (c *Cluster) IsLeader() bool {
+	return atomic.LoadInt32(&c.leading) == 1 && c.raft.State() == raft.Leader
+}
+
+// LeaderID returns the ID of the current leader, if there is one.
+func (c *Cluster) LeaderID() (string, bool) {
+	addr := c.raft.Leader()
+	if addr == "" {
+		return "", false
+	}
+
+	future := c.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return "", false
+	}
+
+	for _, server := range future.Configuration().Servers {
+		if server.Address == addr {
+			return string(server.ID), true
+		}
+	}
+
+	return "", false
+}
+
+// RunReaper periodically returns in progress jobs with an expired lease to
+// their queue, and moves scheduled jobs to their queue once they are due. Only
+// the leader reaps, through a command that is applied by every node. It blocks
+// until the context is cancelled.
+func (c *Cluster) RunReaper(ctx context.Context, interval time.Duration, log zerolog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !c.IsLeader() {
+				continue
+			}
+
+			if _, err := c.apply(ctx, command{Op: opTick}); err != nil {
+				log.Error().Err(err).Msg("unable to reap expired leases")
+			}
+		}
+	}
+}
+
+// Close stops the node. A leader hands over leadership first, so the cluster
+// does not have to wait for an election. The queues must not be used
+// afterwards.
+func (c *Cluster) Close() error {
+	if c.raft.State() == raft.Leader {
+		_ = c.raft.LeadershipTransfer().Error()
+	}
+
+	err := c.raft.Shutdown().Error()
+	close(c.done)
+
+	return err
+}
+
+// watchLeadership keeps track of whether the node is the leader. A new leader
+// waits for the commands committed by earlier leaders to be applied, so it
+// does not serve reads that miss acknowledged changes.
+func (c *Cluster) watchLeadership(notify <-chan bool) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case leader := <-notify:
+			if !leader {
+				atomic.StoreInt32(&c.leading, 0)
+				continue
+			}
+
+			if err := c.raft.Barrier(clusterApplyTimeout).Error(); err != nil {
+				continue
+			}
+			atomic.StoreInt32(&c.leading, 1)
+		}
+	}
+}
+
+// apply commits a command to the Raft log, and returns its result once the
+// leader applied it. It fails with raft.ErrNotLeader on followers, and with
+// domain.ErrOutcomeUnknown when the command may have been committed anyway.
+func (c *Cluster) apply(ctx context.Context, cmd command) (applyResult, error) {
+	cmd.Now = c.now()
+	cmd.Seed = rand.Int63()
+
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return applyResult{}, err
+	}
+
+	// raft treats a timeout of zero as no timeout, so a command is not
+	// submitted once the deadline passed
+	timeout := clusterApplyTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return applyResult{}, context.DeadlineExceeded
+		}
+	}
+
+	future := c.raft.Apply(data, timeout)
+	if err := future.Error(); err != nil {
+		// a command the leader lost its leadership or shut down with may
+		// still be committed by the next leader. One that timed out before
+		// reaching the log was not committed
+		switch err {
+		case raft.ErrLeadershipLost, raft.ErrRaftShutdown:
+			return applyResult{}, domain.ErrOutcomeUnknown{Err: err}
+		}
+		return applyResult{}, err
+	}
+
+	result, ok := future.Response().(applyResult)
+	if !ok {
+		return applyResult{}, fmt.Errorf("unexpected apply response %T", future.Response())
+	}
+
+	return result, result.Err
+}
+
+// ClusterQueue is a named job queue replicated by a cluster. Changes are
+// applied through the Raft log, and reads are served from the local copy of
+// the queue, which is only guaranteed to be current on the leader.
+type ClusterQueue struct {
+	cluster *Cluster
+	name    string
+}
+
+// Enqueue adds a job to the queue, and returns the ID of the job.
+func (q *ClusterQueue) Enqueue(ctx context.Context, job domain.Job) (int, error) {
+	result, err := q.cluster.apply(ctx, command{Op: opEnqueue, Queue: q.name, Job: job})
+
+	return result.Job.ID, err
+}
+
+// EnqueueBatch adds jobs to the queue with a single command, and returns the ID
+// of every job or the error that kept it from being added.
+func (q *ClusterQueue) EnqueueBatch(ctx context.Context, jobs []domain.Job) ([]int, []error) {
+	result, err := q.cluster.apply(ctx, command{Op: opEnqueueBatch, Queue: q.name, Jobs: jobs})
+	if err != nil {
+		// none of the jobs were added, unless the outcome is unknown
+		errs := make([]error, len(jobs))
+		for i := range errs {
+			errs[i] = err
+		}
+		return make([]int, len(jobs)), errs
+	}
+
+	return result.IDs, result.Errs
+}
+
+// Dequeue leases the next available job to the consumer. The leader answers
+// from its own copy of the queue when no job is available, so consumers
+// polling an empty queue do not add entries to the Raft log.
+func (q *ClusterQueue) Dequeue(ctx context.Context, consumerID string) (domain.Job, error) {
+	if q.empty() {
+		return domain.Job{}, domain.ErrQueueEmpty
+	}
+
+	result, err := q.cluster.apply(ctx, command{Op: opDequeue, Queue: q.name, ConsumerID: consumerID})
+
+	return result.Job, err
+}
+
+// DequeueBatch leases up to max available jobs to the consumer at once. As
+// with Dequeue, an empty queue is answered by the leader without the Raft log.
+func (q *ClusterQueue) DequeueBatch(ctx context.Context, consumerID string, max int) ([]domain.Job, error) {
+	if q.empty() {
+		return nil, domain.ErrQueueEmpty
+	}
+
+	result, err := q.cluster.apply(ctx, command{Op: opDequeueBatch, Queue: q.name, ConsumerID: consumerID, Max: max})
+
+	return result.Jobs, err
+}
+
+// Conclude finishes execution on the job, and stores the result reported by
+// the consumer.
+func (q *ClusterQueue) Conclude(ctx context.Context, jobID int, consumerID string, result json.RawMessage) error {
+	_, err := q.cluster.apply(ctx, command{
+		Op:         opConclude,
+		Queue:      q.name,
+		JobID:      jobID,
+		ConsumerID: consumerID,
+		Result:     result,
+	})
+
+	return err
+}
+
+// Fail reports that a consumer was unable to process a job.
+func (q *ClusterQueue) Fail(ctx context.Context, jobID int, consumerID string, reason string) (domain.Job, error) {
+	result, err := q.cluster.apply(ctx, command{
+		Op:         opFail,
+		Queue:      q.name,
+		JobID:      jobID,
+		ConsumerID: consumerID,
+		Reason:     reason,
+	})
+
+	return result.Job, err
+}
+
+// Heartbeat extends the lease on an in progress job, and records the progress
+// reported by the consumer if one is given.
+func (q *ClusterQueue) Heartbeat(ctx context.Context, jobID int, consumerID string, progress *int) (domain.Job, error) {
+	result, err := q.cluster.apply(ctx, command{
+		Op:         opHeartbeat,
+		Queue:      q.name,
+		JobID:      jobID,
+		ConsumerID: consumerID,
+		Progress:   progress,
+	})
+
+	return result.Job, err
+}
+
+// CancelJob cancels a job that has not yet been concluded.
+func (q *ClusterQueue) CancelJob(ctx context.Context, jobID int) error {
+	_, err := q.cluster.apply(ctx, command{Op: opCancel, Queue: q.name, JobID: jobID})
+
+	return err
+}
+
+// CancelJobs cancels every active job selected by the filter with a single
+// command, and returns the number of jobs cancelled.
+func (q *ClusterQueue) CancelJobs(ctx context.Context, filter domain.JobFilter) (int, error) {
+	result, err := q.cluster.apply(ctx, command{Op: opCancelJobs, Queue: q.name, Filter: &filter})
+
+	return result.Count, err
+}
+
+// RequeueJob returns an in progress job to the queue without waiting for its
+// lease to expire.
+func (q *ClusterQueue) RequeueJob(ctx context.Context, jobID int) error {
+	_, err := q.cluster.apply(ctx, command{Op: opRequeue, Queue: q.name, JobID: jobID})
+
+	return err
+}
+
+// RequeueJobs returns every in progress job selected by the filter to the queue
+// with a single command, and returns the number of jobs requeued.
+func (q *ClusterQueue) RequeueJobs(ctx context.Context, filter domain.JobFilter) (int, error) {
+	result, err := q.cluster.apply(ctx, command{Op: opRequeueJobs, Queue: q.name, Filter: &filter})
+
+	return result.Count, err
+}
+
+// FetchJob returns a job definition for the given job ID.
+func (q *ClusterQueue) FetchJob(ctx context.Context, jobID int) (domain.Job, error) {
+	memory, ok := q.cluster.fsm.lookup(q.name)
+	if !ok {
+		return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+	}
+
+	return memory.FetchJob(ctx, jobID)
+}
+
+// ListDeadLetters returns the jobs in the dead-letter queue, oldest first.
+func (q *ClusterQueue) ListDeadLetters(ctx context.Context) ([]domain.Job, error) {
+	memory, ok := q.cluster.fsm.lookup(q.name)
+	if !ok {
+		return []domain.Job{}, nil
+	}
+
+	return memory.ListDeadLetters(ctx)
+}
+
+// FetchDeadLetter returns a job from the dead-letter queue.
+func (q *ClusterQueue) FetchDeadLetter(ctx context.Context, jobID int) (domain.Job, error) {
+	memory, ok := q.cluster.fsm.lookup(q.name)
+	if !ok {
+		return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+	}
+
+	return memory.FetchDeadLetter(ctx, jobID)
+}
+
+// Redrive moves a job from the dead-letter queue back into the queue with a
+// fresh set of attempts.
+func (q *ClusterQueue) Redrive(ctx context.Context, jobID int) error {
+	_, err := q.cluster.apply(ctx, command{Op: opRedrive, Queue: q.name, JobID: jobID})
+
+	return err
+}
+
+// RedriveAll moves every job in the dead-letter queue back into the queue, and
+// returns the number of jobs redriven.
+func (q *ClusterQueue) RedriveAll(ctx context.Context) (int, error) {
+	result, err := q.cluster.apply(ctx, command{Op: opRedriveAll, Queue: q.name})
+
+	return result.Count, err
+}
+
+// empty reports whether the queue has no job to dequeue, according to the
+// leader's copy. A follower cannot tell, and submits the dequeue to be
+// rejected.
+func (q *ClusterQueue) empty() bool {
+	if !q.cluster.IsLeader() {
+		return false
+	}
+	memory, ok := q.cluster.fsm.lookup(q.name)
+
+	return !ok || !memory.mayDequeue(q.cluster.now())
+}
+
+// EnqueueWorkflow adds the jobs of a workflow to the queue with a single
+// command, and returns the IDs of the jobs in the order they were given.
+func (q *ClusterQueue) EnqueueWorkflow(ctx context.Context, jobs []domain.WorkflowJob) ([]int, error) {
+	result, err := q.cluster.apply(ctx, command{Op: opEnqueueWorkflow, Queue: q.name, Workflow: jobs})
+
+	return result.IDs, err
+}
+
+// ListWorkflowJobs returns the jobs of a workflow in the order they were
+// enqueued.
+func (q *ClusterQueue) ListWorkflowJobs(ctx context.Context, workflowID string) ([]domain.Job, error) {
+	memory, ok := q.cluster.fsm.lookup(q.name)
+	if !ok {
+		return nil, domain.ErrWorkflowNotFound{WorkflowID: workflowID}
+	}
+
+	return memory.ListWorkflowJobs(ctx, workflowID)
+}
+
+// ListJobs returns the jobs selected by the filter, ordered by ID.
+func (q *ClusterQueue) ListJobs(ctx context.Context, filter domain.JobFilter) ([]domain.Job, error) {
+	memory, ok := q.cluster.fsm.lookup(q.name)
+	if !ok {
+		return []domain.Job{}, nil
+	}
+
+	return memory.ListJobs(ctx, filter)
+}
+
+// JobAvailable returns a channel that is closed the next time a job is added to
+// the ready queue, once the change is applied on this node.
+func (q *ClusterQueue) JobAvailable() <-chan struct{} {
+	return q.cluster.fsm.jobAvailable(q.name)
+}
+
+// Stats returns the number of jobs in the queue, broken down by status.
+func (q *ClusterQueue) Stats(ctx context.Context) (domain.QueueStats, error) {
+	memory, ok := q.cluster.fsm.lookup(q.name)
+	if !ok {
+		return domain.QueueStats{Statuses: make(map[string]int)}, nil
+	}
+
+	return memory.Stats(ctx)
+}
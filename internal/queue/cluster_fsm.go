@@ -0,0 +1,390 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/schedule"
+)
+
+// Cluster commands, each applying one job queue operation to the named queue.
+const (
+	opEnqueue         = "enqueue"
+	opEnqueueBatch    = "enqueue-batch"
+	opEnqueueWorkflow = "enqueue-workflow"
+	opDequeue         = "dequeue"
+	opDequeueBatch    = "dequeue-batch"
+	opConclude        = "conclude"
+	opFail            = "fail"
+	opHeartbeat       = "heartbeat"
+	opCancel          = "cancel"
+	opCancelJobs      = "cancel-jobs"
+	opRequeue         = "requeue"
+	opRequeueJobs     = "requeue-jobs"
+	opRedrive         = "redrive"
+	opRedriveAll      = "redrive-all"
+
+	// opTick reaps expired leases and promotes due jobs in every queue
+	opTick = "tick"
+
+	// opSaveSchedules replaces the state of the recurring job schedules
+	opSaveSchedules = "save-schedules"
+)
+
+// command defines a Raft log entry. The leader stamps every command with the
+// current time and a random seed, so every node applying it ends up in the
+// same state.
+type command struct {
+	Op    string    `json:"op"`
+	Queue string    `json:"queue,omitempty"`
+	Now   time.Time `json:"now"`
+	Seed  int64     `json:"seed"`
+
+	Job        domain.Job           `json:"job"`
+	Jobs       []domain.Job         `json:"jobs,omitempty"`
+	Workflow   []domain.WorkflowJob `json:"workflow,omitempty"`
+	JobID      int                  `json:"jobID,omitempty"`
+	ConsumerID string               `json:"consumerID,omitempty"`
+	Result     json.RawMessage      `json:"result,omitempty"`
+	Reason     string               `json:"reason,omitempty"`
+	Progress   *int                 `json:"progress,omitempty"`
+	Max        int                  `json:"max,omitempty"`
+	Filter     *domain.JobFilter    `json:"filter,omitempty"`
+	Schedules  *schedule.State      `json:"schedules,omitempty"`
+}
+
+// applyResult defines the outcome of a command, which is handed back to the
+// caller on the leader.
+type applyResult struct {
+	Job   domain.Job
+	Jobs  []domain.Job
+	IDs   []int
+	Errs  []error
+	Count int
+	Err   error
+}
+
+// clusterFSM is the Raft state machine replicated by a cluster. It keeps every
+// named queue and the recurring job schedules in memory.
+type clusterFSM struct {
+	opts      []Option
+	queues    map[string]*InMemoryQueue
+	schedules schedule.State
+
+	// waiting holds the channels handed out for queues no command created
+	// yet, they are closed once the queue is created
+	waiting map[string]chan struct{}
+
+	// now and random are the clock and random source of the command being
+	// applied, they are only used by the goroutine applying commands
+	now    time.Time
+	random *rand.Rand
+
+	lock sync.RWMutex
+}
+
+// clusterSnapshot defines the state of a cluster written to a Raft snapshot.
+type clusterSnapshot struct {
+	Queues    map[string]clusterQueueState `json:"queues"`
+	Schedules schedule.State               `json:"schedules"`
+}
+
+// clusterQueueState defines the state of a named queue in a Raft snapshot.
+type clusterQueueState struct {
+	MaxID              int          `json:"maxID"`
+	TimeCriticalStreak int          `json:"timeCriticalStreak"`
+	Jobs               []domain.Job `json:"jobs"`
+}
+
+// newClusterFSM returns a state machine without any queues.
+func newClusterFSM(opts []Option) *clusterFSM {
+	return &clusterFSM{
+		opts:    opts,
+		queues:  make(map[string]*InMemoryQueue),
+		waiting: make(map[string]chan struct{}),
+		random:  rand.New(rand.NewSource(0)),
+		lock:    sync.RWMutex{},
+	}
+}
+
+// Apply applies a committed command, and returns its applyResult.
+func (f *clusterFSM) Apply(entry *raft.Log) interface{} {
+	var cmd command
+	if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+		return applyResult{Err: err}
+	}
+	cmd.Job.Payload = omitNull(cmd.Job.Payload)
+	cmd.Job.Result = omitNull(cmd.Job.Result)
+	for i := range cmd.Jobs {
+		cmd.Jobs[i].Payload = omitNull(cmd.Jobs[i].Payload)
+		cmd.Jobs[i].Result = omitNull(cmd.Jobs[i].Result)
+	}
+	for i := range cmd.Workflow {
+		cmd.Workflow[i].Payload = omitNull(cmd.Workflow[i].Payload)
+		cmd.Workflow[i].Result = omitNull(cmd.Workflow[i].Result)
+	}
+	cmd.Result = omitNull(cmd.Result)
+
+	f.now = cmd.Now
+	f.random = rand.New(rand.NewSource(cmd.Seed))
+
+	ctx := context.Background()
+
+	if cmd.Op == opTick {
+		// queues in a cluster have no journal, so reaping cannot fail, but
+		// a failure is reported to the leader rather than dropped
+		var result applyResult
+		for _, name := range f.names() {
+			q := f.queue(name)
+
+			if _, err := q.reapExpiredLeases(); err != nil && result.Err == nil {
+				result.Err = fmt.Errorf("queue %s: %w", name, err)
+			}
+
+			q.lock.Lock()
+			q.promoteDueJobs()
+			q.evictIdempotencyKeys()
+			q.lock.Unlock()
+		}
+
+		return result
+	}
+
+	if cmd.Op == opSaveSchedules {
+		return applyResult{Err: f.saveSchedules(*cmd.Schedules)}
+	}
+
+	q := f.queue(cmd.Queue)
+
+	var result applyResult
+	switch cmd.Op {
+	case opEnqueue:
+		result.Job.ID, result.Err = q.Enqueue(ctx, cmd.Job)
+	case opEnqueueBatch:
+		result.IDs, result.Errs = q.EnqueueBatch(ctx, cmd.Jobs)
+	case opEnqueueWorkflow:
+		result.IDs, result.Err = q.EnqueueWorkflow(ctx, cmd.Workflow)
+	case opDequeue:
+		result.Job, result.Err = q.Dequeue(ctx, cmd.ConsumerID)
+	case opDequeueBatch:
+		result.Jobs, result.Err = q.DequeueBatch(ctx, cmd.ConsumerID, cmd.Max)
+	case opConclude:
+		result.Err = q.Conclude(ctx, cmd.JobID, cmd.ConsumerID, cmd.Result)
+	case opFail:
+		result.Job, result.Err = q.Fail(ctx, cmd.JobID, cmd.ConsumerID, cmd.Reason)
+	case opHeartbeat:
+		result.Job, result.Err = q.Heartbeat(ctx, cmd.JobID, cmd.ConsumerID, cmd.Progress)
+	case opCancel:
+		result.Err = q.CancelJob(ctx, cmd.JobID)
+	case opCancelJobs:
+		result.Count, result.Err = q.CancelJobs(ctx, *cmd.Filter)
+	case opRequeue:
+		result.Err = q.RequeueJob(ctx, cmd.JobID)
+	case opRequeueJobs:
+		result.Count, result.Err = q.RequeueJobs(ctx, *cmd.Filter)
+	case opRedrive:
+		result.Err = q.Redrive(ctx, cmd.JobID)
+	case opRedriveAll:
+		result.Count, result.Err = q.RedriveAll(ctx)
+	}
+
+	return result
+}
+
+// Snapshot copies the state of every queue. It is not called concurrently
+// with Apply, and the copy is encoded while commands are applied.
+func (f *clusterFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	s := clusterSnapshot{
+		Queues:    make(map[string]clusterQueueState, len(f.queues)),
+		Schedules: f.schedules,
+	}
+	for name, q := range f.queues {
+		q.lock.RLock()
+		state := clusterQueueState{
+			MaxID:              q.maxID,
+			TimeCriticalStreak: q.timeCriticalStreak,
+			Jobs:               make([]domain.Job, 0, len(q.jobs)),
+		}
+		for _, job := range q.jobs {
+			state.Jobs = append(state.Jobs, job)
+		}
+		q.lock.RUnlock()
+
+		sort.Slice(state.Jobs, func(i, j int) bool {
+			return state.Jobs[i].ID < state.Jobs[j].ID
+		})
+		s.Queues[name] = state
+	}
+
+	return s, nil
+}
+
+// Restore replaces every queue with the queues in a snapshot.
+func (f *clusterFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	var s clusterSnapshot
+	if err := json.NewDecoder(rc).Decode(&s); err != nil {
+		return err
+	}
+
+	queues := make(map[string]*InMemoryQueue, len(s.Queues))
+	for name, state := range s.Queues {
+		q := f.newQueue()
+		for _, job := range state.Jobs {
+			q.restore(job)
+		}
+		if state.MaxID > q.maxID {
+			q.maxID = state.MaxID
+		}
+		q.timeCriticalStreak = state.TimeCriticalStreak
+		q.rebuild()
+
+		queues[name] = q
+	}
+
+	f.lock.Lock()
+	replaced := f.queues
+	f.queues = queues
+	f.schedules = s.Schedules
+	for name, available := range f.waiting {
+		if _, ok := queues[name]; ok {
+			close(available)
+			delete(f.waiting, name)
+		}
+	}
+	f.lock.Unlock()
+
+	// consumers waiting on a replaced queue would never be woken up, so they
+	// are woken up to wait on the restored one
+	for _, q := range replaced {
+		q.lock.Lock()
+		close(q.available)
+		q.available = make(chan struct{})
+		q.lock.Unlock()
+	}
+
+	return nil
+}
+
+// Persist writes the snapshot to the sink.
+func (s clusterSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+// Release is a no-op, the snapshot does not hold on to any resources.
+func (s clusterSnapshot) Release() {}
+
+// queue returns the named queue, creating it if it does not exist. It must only
+// be called while applying a command, so every node creates the same queues.
+func (f *clusterFSM) queue(name string) *InMemoryQueue {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	q, ok := f.queues[name]
+	if !ok {
+		q = f.newQueue()
+		f.queues[name] = q
+
+		if available, ok := f.waiting[name]; ok {
+			close(available)
+			delete(f.waiting, name)
+		}
+	}
+
+	return q
+}
+
+// lookup returns the named queue for reading, and whether a command created
+// it yet.
+func (f *clusterFSM) lookup(name string) (*InMemoryQueue, bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	q, ok := f.queues[name]
+
+	return q, ok
+}
+
+// jobAvailable returns a channel that is closed the next time a job is added
+// to the named queue. If no command created the queue yet, the channel is
+// closed once one does.
+func (f *clusterFSM) jobAvailable(name string) <-chan struct{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if q, ok := f.queues[name]; ok {
+		return q.JobAvailable()
+	}
+
+	available, ok := f.waiting[name]
+	if !ok {
+		available = make(chan struct{})
+		f.waiting[name] = available
+	}
+
+	return available
+}
+
+// saveSchedules replaces the scheduler state if the current state is the
+// version before it.
+func (f *clusterFSM) saveSchedules(state schedule.State) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if state.Version != f.schedules.Version+1 {
+		return schedule.ErrStateChanged
+	}
+	f.schedules = state
+
+	return nil
+}
+
+// scheduleState returns the scheduler state.
+func (f *clusterFSM) scheduleState() schedule.State {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.schedules
+}
+
+// names returns the names of the queues in ascending order.
+func (f *clusterFSM) names() []string {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	names := make([]string, 0, len(f.queues))
+	for name := range f.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// newQueue returns an empty queue that runs on the clock and random source of
+// the command being applied.
+func (f *clusterFSM) newQueue() *InMemoryQueue {
+	q := NewInMemoryQueue(f.opts...)
+	q.now = func() time.Time { return f.now }
+	q.random = func() float64 { return f.random.Float64() }
+
+	return q
+}
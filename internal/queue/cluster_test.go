@@ -0,0 +1,369 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/handler"
+	"github.com/bkrebsbach/simple-job-queue/internal/queue/queuetest"
+)
+
+// testCluster is a cluster running in-process on a simulated network.
+type testCluster struct {
+	nodes      []*Cluster
+	transports []*raft.InmemTransport
+}
+
+// newTestCluster starts and bootstraps a cluster of the given size.
+func newTestCluster(t *testing.T, size int, opts ...Option) *testCluster {
+	tc := &testCluster{}
+
+	servers := make([]raft.Server, 0, size)
+	for i := 0; i < size; i++ {
+		addr, transport := raft.NewInmemTransport("")
+		tc.transports = append(tc.transports, transport)
+		servers = append(servers, raft.Server{ID: raft.ServerID(fmt.Sprintf("node-%d", i)), Address: addr})
+	}
+
+	for _, transport := range tc.transports {
+		for _, peer := range tc.transports {
+			transport.Connect(peer.LocalAddr(), peer)
+		}
+	}
+
+	for i, server := range servers {
+		conf := raft.DefaultConfig()
+		conf.LocalID = server.ID
+		conf.HeartbeatTimeout = 150 * time.Millisecond
+		conf.ElectionTimeout = 150 * time.Millisecond
+		conf.LeaderLeaseTimeout = 150 * time.Millisecond
+		conf.CommitTimeout = 5 * time.Millisecond
+		conf.LogOutput = ioutil.Discard
+
+		store := raft.NewInmemStore()
+		node, err := NewCluster(ClusterConfig{
+			Raft:        conf,
+			LogStore:    store,
+			StableStore: store,
+			Snapshots:   raft.NewInmemSnapshotStore(),
+			Transport:   tc.transports[i],
+		}, opts...)
+		require.Nil(t, err)
+		t.Cleanup(func() { _ = node.Close() })
+
+		tc.nodes = append(tc.nodes, node)
+	}
+
+	require.Nil(t, tc.nodes[0].Bootstrap(servers))
+
+	return tc
+}
+
+// leader waits for one of the given nodes to become the leader, and returns it.
+func (tc *testCluster) leader(t *testing.T, nodes ...*Cluster) *Cluster {
+	if len(nodes) == 0 {
+		nodes = tc.nodes
+	}
+
+	var leader *Cluster
+	require.Eventually(t, func() bool {
+		for _, node := range nodes {
+			if node.IsLeader() {
+				leader = node
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return leader
+}
+
+// isolate disconnects a node from the rest of the cluster, and returns the
+// nodes that are still connected.
+func (tc *testCluster) isolate(node *Cluster) []*Cluster {
+	remaining := make([]*Cluster, 0, len(tc.nodes)-1)
+	for i, n := range tc.nodes {
+		if n == node {
+			tc.transports[i].DisconnectAll()
+			continue
+		}
+		remaining = append(remaining, n)
+	}
+
+	for i, n := range tc.nodes {
+		if n == node {
+			for _, transport := range tc.transports {
+				transport.Disconnect(tc.transports[i].LocalAddr())
+			}
+		}
+	}
+
+	return remaining
+}
+
+func TestCluster_Conformance(t *testing.T) {
+	queuetest.Run(t, func(t *testing.T) handler.JobQueuer {
+		tc := newTestCluster(t, 3)
+		return tc.leader(t).Queue("jobs")
+	})
+}
+
+func TestCluster_Failover(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestCluster(t, 3)
+	leader := tc.leader(t)
+
+	// set up state
+	ids := make([]int, 0)
+	for i := 0; i < 10; i++ {
+		id, err := leader.Queue("jobs").Enqueue(ctx, domain.Job{
+			Type:   domain.JobTypeTimeCritical,
+			Status: domain.JobStatusQueued,
+		})
+		require.Nil(t, err)
+		ids = append(ids, id)
+	}
+
+	dequeuedJob, err := leader.Queue("jobs").Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Equal(t, ids[0], dequeuedJob.ID)
+
+	// check that followers do not accept changes
+	for _, node := range tc.nodes {
+		if node == leader {
+			continue
+		}
+
+		_, err := node.Queue("jobs").Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+		require.True(t, errors.Is(err, raft.ErrNotLeader))
+	}
+
+	// check that a new leader is elected once the leader is cut off, and that
+	// it has every acknowledged job
+	oldLeader := leader
+	leader = tc.leader(t, tc.isolate(oldLeader)...)
+	require.True(t, leader != oldLeader)
+
+	stats, err := leader.Queue("jobs").Stats(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 10, stats.Total)
+
+	leasedJob, err := leader.Queue("jobs").FetchJob(ctx, ids[0])
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusInProgress, leasedJob.Status)
+	require.Equal(t, "consumer-1", leasedJob.ConsumerID)
+
+	for _, want := range ids[1:] {
+		job, err := leader.Queue("jobs").Dequeue(ctx, "consumer-2")
+		require.Nil(t, err)
+		require.Equal(t, want, job.ID)
+	}
+
+	_, err = leader.Queue("jobs").Dequeue(ctx, "consumer-2")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+
+	require.Nil(t, leader.Queue("jobs").Conclude(ctx, ids[0], "consumer-1", nil))
+
+	// check that the old leader cannot commit changes on its own
+	_, err = oldLeader.Queue("jobs").Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+	require.NotNil(t, err)
+}
+
+func TestCluster_OutcomeUnknown(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestCluster(t, 3)
+	leader := tc.leader(t)
+
+	// set up state
+	require.Nil(t, leader.raft.Shutdown().Error())
+
+	// check that a batch the node could not commit is not reported as rejected
+	jobs := []domain.Job{
+		{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued},
+		{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued},
+	}
+	_, errs := leader.Queue("jobs").EnqueueBatch(ctx, jobs)
+	require.Len(t, errs, 2)
+	for _, err := range errs {
+		require.True(t, errors.Is(err, domain.ErrOutcomeUnknown{}))
+		require.True(t, errors.Is(err, raft.ErrRaftShutdown))
+	}
+}
+
+func TestCluster_JobAvailable(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestCluster(t, 3)
+	leader := tc.leader(t)
+
+	// set up state
+	available := leader.Queue("reports").JobAvailable()
+
+	_, err := leader.Queue("reports").FetchJob(ctx, 1)
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+
+	// check that a consumer waiting on a queue before it is created is woken
+	// up by the first job
+	_, err = leader.Queue("reports").Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+	require.Nil(t, err)
+
+	select {
+	case <-available:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer was not woken up")
+	}
+}
+
+func TestCluster_EmptyDequeue(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestCluster(t, 3)
+	leader := tc.leader(t)
+
+	// set up state
+	_, err := leader.Queue("jobs").Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+	require.Nil(t, err)
+
+	_, err = leader.Queue("jobs").Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+
+	// check that dequeuing from an empty queue does not add to the Raft log
+	index := leader.raft.LastIndex()
+
+	_, err = leader.Queue("jobs").Dequeue(ctx, "consumer-1")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+
+	_, err = leader.Queue("jobs").DequeueBatch(ctx, "consumer-1", 10)
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+
+	require.Equal(t, index, leader.raft.LastIndex())
+
+	// check that a command is not submitted once the deadline passed
+	expired, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+	defer cancel()
+
+	_, err = leader.Queue("jobs").Enqueue(expired, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	require.Equal(t, index, leader.raft.LastIndex())
+}
+
+func TestCluster_Replication(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tc := newTestCluster(t, 3, WithRetryPolicy(RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Minute,
+		Multiplier:     2,
+		Jitter:         0.5,
+	}))
+	leader := tc.leader(t)
+	leader.now = func() time.Time { return now }
+
+	// set up state
+	jobID, err := leader.Queue("jobs").Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+	require.Nil(t, err)
+
+	_, err = leader.Queue("jobs").Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+
+	_, err = leader.Queue("jobs").Fail(ctx, jobID, "consumer-1", "boom")
+	require.Nil(t, err)
+
+	// check that the reaper promotes the retried job on every node
+	now = now.Add(time.Minute)
+	_, err = leader.apply(ctx, command{Op: opTick})
+	require.Nil(t, err)
+
+	want, err := leader.Queue("jobs").FetchJob(ctx, jobID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusQueued, want.Status)
+
+	// check that every node applied the commands to the same state, including
+	// the randomized backoff
+	for _, node := range tc.nodes {
+		require.Eventually(t, func() bool {
+			job, err := node.Queue("jobs").FetchJob(ctx, jobID)
+			return err == nil && job.Status == want.Status
+		}, 5*time.Second, 10*time.Millisecond)
+
+		job, err := node.Queue("jobs").FetchJob(ctx, jobID)
+		require.Nil(t, err)
+		require.Equal(t, want, job)
+		require.Equal(t, []string{"jobs"}, node.ListQueues())
+	}
+}
+
+func TestCluster_SnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fsm := newClusterFSM(nil)
+
+	// set up state
+	apply := func(cmd command) applyResult {
+		cmd.Now = now
+		data, err := json.Marshal(cmd)
+		require.Nil(t, err)
+
+		return fsm.Apply(&raft.Log{Data: data}).(applyResult)
+	}
+
+	for _, priority := range []int{0, 5, 0} {
+		result := apply(command{Op: opEnqueue, Queue: "jobs", Job: domain.Job{
+			Type:     domain.JobTypeTimeCritical,
+			Status:   domain.JobStatusQueued,
+			Priority: priority,
+		}})
+		require.Nil(t, result.Err)
+	}
+	result := apply(command{Op: opEnqueue, Queue: "reports", Job: domain.Job{
+		Type:   domain.JobTypeNotTimeCritical,
+		Status: domain.JobStatusQueued,
+		RunAt:  now.Add(time.Hour),
+	}})
+	require.Nil(t, result.Err)
+
+	snapshot, err := fsm.Snapshot()
+	require.Nil(t, err)
+
+	store := raft.NewInmemSnapshotStore()
+	sink, err := store.Create(raft.SnapshotVersionMax, 1, 1, raft.Configuration{}, 1, nil)
+	require.Nil(t, err)
+	require.Nil(t, snapshot.Persist(sink))
+
+	_, rc, err := store.Open(sink.ID())
+	require.Nil(t, err)
+
+	// check that the restored queues serve jobs in the same order, and keep
+	// scheduled jobs back
+	fsm = newClusterFSM(nil)
+	require.Nil(t, fsm.Restore(rc))
+	require.Equal(t, []string{"jobs", "reports"}, fsm.names())
+
+	for _, want := range []int{2, 1, 3} {
+		result := apply(command{Op: opDequeue, Queue: "jobs", ConsumerID: "consumer-1"})
+		require.Nil(t, result.Err)
+		require.Equal(t, want, result.Job.ID)
+	}
+
+	result = apply(command{Op: opDequeue, Queue: "reports", ConsumerID: "consumer-1"})
+	require.True(t, errors.Is(result.Err, domain.ErrQueueEmpty))
+
+	now = now.Add(time.Hour)
+	result = apply(command{Op: opDequeue, Queue: "reports", ConsumerID: "consumer-1"})
+	require.Nil(t, result.Err)
+	require.Equal(t, 1, result.Job.ID)
+
+	jobs, ok := fsm.lookup("jobs")
+	require.True(t, ok)
+	_, err = jobs.FetchJob(ctx, 4)
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+}
@@ -0,0 +1,125 @@
+package queue
+
+import (
+	"context"
+	"time"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+// ListDeadLetters returns the jobs in the dead-letter queue, oldest first.
+func (q *InMemoryQueue) ListDeadLetters(ctx context.Context) ([]domain.Job, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.compactDeadLetters()
+
+	jobs := make([]domain.Job, 0, len(q.deadLetters))
+	for _, id := range q.deadLetters {
+		jobs = append(jobs, q.jobs[id])
+	}
+
+	return jobs, nil
+}
+
+// FetchDeadLetter returns a job from the dead-letter queue, including its
+// failure history.
+func (q *InMemoryQueue) FetchDeadLetter(ctx context.Context, jobID int) (domain.Job, error) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	// check if the job is defined and dead-lettered
+	job, ok := q.jobs[jobID]
+	if !ok || job.Status != domain.JobStatusFailed {
+		return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+	}
+
+	return job, nil
+}
+
+// Redrive moves a job from the dead-letter queue back into the queue with a
+// fresh set of attempts. The failure history is kept.
+func (q *InMemoryQueue) Redrive(ctx context.Context, jobID int) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	// check if the job is defined and dead-lettered
+	job, ok := q.jobs[jobID]
+	if !ok || job.Status != domain.JobStatusFailed {
+		return domain.ErrJobNotFound{JobID: jobID}
+	}
+
+	if err := q.redrive([]int{jobID}); err != nil {
+		return err
+	}
+	q.compactDeadLetters()
+
+	return nil
+}
+
+// RedriveAll moves every job in the dead-letter queue back into the queue, and
+// returns the number of jobs redriven.
+func (q *InMemoryQueue) RedriveAll(ctx context.Context) (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.compactDeadLetters()
+
+	count := len(q.deadLetters)
+	if err := q.redrive(q.deadLetters); err != nil {
+		return 0, err
+	}
+	q.deadLetters = make([]int, 0)
+
+	return count, nil
+}
+
+// deadLetter marks a job as failed and adds it to the dead-letter queue. The
+// caller must hold the write lock.
+func (q *InMemoryQueue) deadLetter(job domain.Job, now time.Time) (domain.Job, error) {
+	job.Status = domain.JobStatusFailed
+	job.DeadLetteredAt = now
+	if err := q.save(job); err != nil {
+		return domain.Job{}, err
+	}
+	q.deadLetters = append(q.deadLetters, job.ID)
+
+	return job, nil
+}
+
+// redrive returns dead-lettered jobs to the queue, where they keep their place
+// ahead of newer jobs of the same priority. The caller must hold the write
+// lock.
+func (q *InMemoryQueue) redrive(ids []int) error {
+	jobs := make([]domain.Job, 0, len(ids))
+	for _, id := range ids {
+		job := q.jobs[id]
+		job.Status = domain.JobStatusQueued
+		job.Attempts = 0
+		job.DeadLetteredAt = time.Time{}
+		jobs = append(jobs, job)
+	}
+
+	if err := q.save(jobs...); err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		q.push(job)
+	}
+
+	return nil
+}
+
+// compactDeadLetters drops jobs that are no longer failed, e.g. because they
+// were redriven or cancelled, from the dead-letter queue. The caller must hold
+// the write lock.
+func (q *InMemoryQueue) compactDeadLetters() {
+	remaining := q.deadLetters[:0]
+	for _, id := range q.deadLetters {
+		if job, ok := q.jobs[id]; ok && job.Status == domain.JobStatusFailed {
+			remaining = append(remaining, id)
+		}
+	}
+	q.deadLetters = remaining
+}
@@ -0,0 +1,142 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+func TestDeadLetter_Fail(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	mq := NewInMemoryQueue(WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+	mq.now = func() time.Time { return now }
+
+	// set up state
+	consumerID := "consumer-1"
+	job := domain.Job{
+		Type:   domain.JobTypeTimeCritical,
+		Status: domain.JobStatusQueued,
+	}
+
+	jobID, err := mq.Enqueue(context.Background(), job)
+	require.Nil(t, err)
+
+	_, err = mq.Dequeue(context.Background(), consumerID)
+	require.Nil(t, err)
+
+	// check that the job is dead-lettered once it runs out of attempts
+	failedJob, err := mq.Fail(context.Background(), jobID, consumerID, "boom")
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusFailed, failedJob.Status)
+	require.Equal(t, now, failedJob.DeadLetteredAt)
+
+	deadLetters, err := mq.ListDeadLetters(context.Background())
+	require.Nil(t, err)
+	require.Len(t, deadLetters, 1)
+	require.Equal(t, jobID, deadLetters[0].ID)
+
+	// check that the failure history is recorded
+	deadLetteredJob, err := mq.FetchDeadLetter(context.Background(), jobID)
+	require.Nil(t, err)
+	require.Equal(t, []domain.Failure{{
+		Attempt:    1,
+		ConsumerID: consumerID,
+		Error:      "boom",
+		FailedAt:   now,
+	}}, deadLetteredJob.Failures)
+}
+
+func TestDeadLetter_LostLeases(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	mq := NewInMemoryQueue(
+		WithVisibilityTimeout(time.Minute),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2}),
+	)
+	mq.now = func() time.Time { return now }
+
+	// set up state
+	job := domain.Job{
+		Type:   domain.JobTypeTimeCritical,
+		Status: domain.JobStatusQueued,
+	}
+
+	jobID, err := mq.Enqueue(context.Background(), job)
+	require.Nil(t, err)
+
+	// check that the first lost lease requeues the job
+	_, err = mq.Dequeue(context.Background(), "consumer-1")
+	require.Nil(t, err)
+	now = now.Add(time.Minute)
+	reaped, err := mq.reapExpiredLeases()
+	require.Nil(t, err)
+	require.Equal(t, 1, reaped)
+	require.Equal(t, []int{jobID}, mq.queue.ids())
+
+	// check that the job is dead-lettered once it keeps losing its lease
+	_, err = mq.Dequeue(context.Background(), "consumer-2")
+	require.Nil(t, err)
+	now = now.Add(time.Minute)
+	reaped, err = mq.reapExpiredLeases()
+	require.Nil(t, err)
+	require.Equal(t, 1, reaped)
+	require.Equal(t, 0, mq.queue.Len())
+
+	deadLetteredJob, err := mq.FetchDeadLetter(context.Background(), jobID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusFailed, deadLetteredJob.Status)
+	require.Equal(t, "lease expired", deadLetteredJob.LastError)
+	require.Len(t, deadLetteredJob.Failures, 2)
+	require.Equal(t, "consumer-2", deadLetteredJob.Failures[1].ConsumerID)
+}
+
+func TestRedrive(t *testing.T) {
+	mq := NewInMemoryQueue(WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+
+	// set up state
+	consumerID := "consumer-1"
+	job := domain.Job{
+		Type:   domain.JobTypeTimeCritical,
+		Status: domain.JobStatusQueued,
+	}
+
+	for i := 0; i < 3; i++ {
+		jobID, err := mq.Enqueue(context.Background(), job)
+		require.Nil(t, err)
+		_, err = mq.Dequeue(context.Background(), consumerID)
+		require.Nil(t, err)
+		_, err = mq.Fail(context.Background(), jobID, consumerID, "boom")
+		require.Nil(t, err)
+	}
+
+	// check that only dead-lettered jobs can be redriven
+	_, err := mq.Enqueue(context.Background(), job)
+	require.Nil(t, err)
+	err = mq.Redrive(context.Background(), 4)
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+
+	// check that a single job is redriven with fresh attempts
+	err = mq.Redrive(context.Background(), 2)
+	require.Nil(t, err)
+
+	redrivenJob, err := mq.FetchJob(context.Background(), 2)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusQueued, redrivenJob.Status)
+	require.Equal(t, 0, redrivenJob.Attempts)
+	require.Len(t, redrivenJob.Failures, 1)
+	require.Equal(t, []int{2, 4}, mq.queue.ids())
+
+	// check that the remaining jobs are redriven together
+	count, err := mq.RedriveAll(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+	require.Equal(t, []int{1, 2, 3, 4}, mq.queue.ids())
+
+	deadLetters, err := mq.ListDeadLetters(context.Background())
+	require.Nil(t, err)
+	require.Empty(t, deadLetters)
+}
@@ -0,0 +1,248 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+// resolveDependencies returns a job that depends on other jobs with the status
+// the state of those jobs leads to. The job is released once every job it
+// depends on concluded, and stays BLOCKED until then. If one of them was
+// cancelled or dead-lettered, the job is cancelled unless its dependency policy
+// keeps it blocked. The jobs of the batch a follow-up job waits for are counted
+// by the job itself.
+func resolveDependencies(job domain.Job, parents []domain.Job, now time.Time) domain.Job {
+	if job.BatchFailed > 0 && job.DependencyPolicy != domain.DependencyPolicyBlock {
+		job.Status = domain.JobStatusCancelled
+		return job
+	}
+
+	concluded := 0
+	for _, parent := range parents {
+		switch parent.Status {
+		case domain.JobStatusConcluded:
+			concluded++
+		case domain.JobStatusCancelled, domain.JobStatusFailed:
+			if job.DependencyPolicy != domain.DependencyPolicyBlock {
+				job.Status = domain.JobStatusCancelled
+				return job
+			}
+		}
+	}
+
+	if concluded < len(parents) || job.BatchRemaining > 0 {
+		job.Status = domain.JobStatusBlocked
+		return job
+	}
+
+	// released jobs keep their delay
+	if job.RunAt.After(now) {
+		job.Status = domain.JobStatusScheduled
+	} else {
+		job.Status = domain.JobStatusQueued
+		job.RunAt = time.Time{}
+	}
+
+	return job
+}
+
+// batchProgress returns how the number of jobs a batch follow-up job waits for,
+// and the number of cancelled or dead-lettered jobs of the batch, change when a
+// job of the batch changes from the previous to the current status. Redriving
+// a dead-lettered job does not take back its failure.
+func batchProgress(previous, current string) (int, int) {
+	switch {
+	case current == previous:
+		return 0, 0
+	case current == domain.JobStatusConcluded:
+		return -1, 0
+	case current == domain.JobStatusCancelled || current == domain.JobStatusFailed:
+		return 0, 1
+	}
+
+	return 0, 0
+}
+
+// ListWorkflowJobs returns the jobs of a workflow in the order they were
+// enqueued.
+func (q *InMemoryQueue) ListWorkflowJobs(ctx context.Context, workflowID string) ([]domain.Job, error) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	ids, ok := q.workflows[workflowID]
+	if !ok {
+		return nil, domain.ErrWorkflowNotFound{WorkflowID: workflowID}
+	}
+
+	jobs := make([]domain.Job, 0, len(ids))
+	for _, id := range ids {
+		jobs = append(jobs, q.jobs[id])
+	}
+
+	return jobs, nil
+}
+
+// EnqueueWorkflow adds the jobs of a workflow to the queue while holding the
+// lock once, and returns the IDs of the jobs in the order they were given.
+// Either every job is added, or none of them if one cannot be added.
+func (q *InMemoryQueue) EnqueueWorkflow(ctx context.Context, jobs []domain.WorkflowJob) ([]int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	ids := make([]int, 0, len(jobs))
+
+	q.beginBatch()
+	for _, workflowJob := range jobs {
+		job, err := workflowDependencies(workflowJob, ids)
+		if err == nil {
+			job.ID, err = q.enqueue(job)
+		}
+		if err != nil {
+			q.rollbackBatch()
+			return nil, err
+		}
+
+		ids = append(ids, job.ID)
+	}
+
+	if err := q.commitBatch(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// workflowDependencies returns the job of a workflow with the jobs of the
+// workflow it depends on added to its DependsOn, given the IDs of the jobs of
+// the workflow that come before it.
+func workflowDependencies(workflowJob domain.WorkflowJob, ids []int) (domain.Job, error) {
+	job := workflowJob.Job
+	if len(workflowJob.Parents) == 0 {
+		return job, nil
+	}
+
+	job.DependsOn = append([]int{}, job.DependsOn...)
+
+	for _, parent := range workflowJob.Parents {
+		if parent < 0 || parent >= len(ids) {
+			return domain.Job{}, fmt.Errorf("workflow job %d depends on job %d, which does not come before it", len(ids), parent)
+		}
+		job.DependsOn = append(job.DependsOn, ids[parent])
+	}
+
+	return job, nil
+}
+
+// parents returns the jobs a job depends on. The caller must hold the lock.
+func (q *InMemoryQueue) parents(job domain.Job) ([]domain.Job, error) {
+	parents := make([]domain.Job, 0, len(job.DependsOn))
+	for _, id := range job.DependsOn {
+		parent, ok := q.jobs[id]
+		if !ok {
+			return nil, domain.ErrJobNotFound{JobID: id}
+		}
+		parents = append(parents, parent)
+	}
+
+	return parents, nil
+}
+
+// track indexes a new job by the jobs it depends on and by its workflow. The
+// caller must hold the write lock.
+func (q *InMemoryQueue) track(job domain.Job) {
+	for _, id := range job.DependsOn {
+		q.dependents[id] = append(q.dependents[id], job.ID)
+	}
+
+	if job.WorkflowID != "" {
+		q.workflows[job.WorkflowID] = append(q.workflows[job.WorkflowID], job.ID)
+	}
+}
+
+// settleDependents returns the blocked jobs that depend on the given jobs,
+// with the status the new state of the given jobs leads to. Cancelled jobs are
+// settled in turn, so cancellation cascades to their own dependents. Jobs that
+// stay blocked are left out, unless they are the follow-up job of a batch that
+// counted a change of one of its jobs. The caller must hold the write lock.
+func (q *InMemoryQueue) settleDependents(jobs []domain.Job) []domain.Job {
+	changed := make(map[int]domain.Job, len(jobs))
+	for _, job := range jobs {
+		changed[job.ID] = job
+	}
+
+	lookup := func(id int) domain.Job {
+		if job, ok := changed[id]; ok {
+			return job
+		}
+		return q.jobs[id]
+	}
+
+	// a follow-up job can change several times, it is settled once
+	settledIDs := make([]int, 0)
+	isSettled := make(map[int]bool)
+	settle := func(job domain.Job) {
+		if !isSettled[job.ID] {
+			isSettled[job.ID] = true
+			settledIDs = append(settledIDs, job.ID)
+		}
+		changed[job.ID] = job
+	}
+
+	pending := append([]domain.Job{}, jobs...)
+	for len(pending) > 0 {
+		job := pending[0]
+		pending = pending[1:]
+
+		// the follow-up job of a batch counts the jobs of the batch as they
+		// change
+		if followUp := lookup(job.BatchFollowUp); job.BatchFollowUp != 0 && followUp.Status == domain.JobStatusBlocked {
+			remaining, failed := batchProgress(q.jobs[job.ID].Status, job.Status)
+			if remaining != 0 || failed != 0 {
+				followUp.BatchRemaining += remaining
+				followUp.BatchFailed += failed
+				followUp = resolveDependencies(followUp, nil, q.now())
+
+				settle(followUp)
+				if followUp.Status != domain.JobStatusBlocked {
+					pending = append(pending, followUp)
+				}
+			}
+		}
+
+		// jobs that are still active cannot release or cancel their
+		// dependents
+		if domain.ActiveJobStatuses[job.Status] {
+			continue
+		}
+
+		for _, id := range q.dependents[job.ID] {
+			dependent := lookup(id)
+			if dependent.Status != domain.JobStatusBlocked {
+				continue
+			}
+
+			parents := make([]domain.Job, 0, len(dependent.DependsOn))
+			for _, parentID := range dependent.DependsOn {
+				parents = append(parents, lookup(parentID))
+			}
+
+			dependent = resolveDependencies(dependent, parents, q.now())
+			if dependent.Status == domain.JobStatusBlocked {
+				continue
+			}
+
+			settle(dependent)
+			pending = append(pending, dependent)
+		}
+	}
+
+	settled := make([]domain.Job, 0, len(settledIDs))
+	for _, id := range settledIDs {
+		settled = append(settled, changed[id])
+	}
+
+	return settled
+}
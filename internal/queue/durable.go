@@ -0,0 +1,293 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/wal"
+)
+
+// logDirName is the name of the directory holding the write-ahead log in a
+// durable queue's directory.
+const logDirName = "wal"
+
+// logRecord defines a write-ahead log entry. Every entry holds the full state
+// of the jobs that changed, so replaying the log only has to keep the latest
+// state of every job.
+type logRecord struct {
+	Jobs []domain.Job `json:"jobs"`
+}
+
+// DurableQueue is a job queue that keeps its jobs in memory, and appends every
+// change to a write-ahead log before applying it, so no acknowledged change is
+// lost when the process restarts or crashes. Snapshots of the queue replace the
+// part of the log they cover, which keeps the log and recovery time bounded.
+type DurableQueue struct {
+	*InMemoryQueue
+
+	dir string
+	log *wal.Log
+
+	// dirty is set when jobs changed since the last snapshot, under the queue
+	// lock
+	dirty bool
+
+	// snapshotLock serializes snapshots
+	snapshotLock sync.Mutex
+}
+
+// NewDurableQueue opens the durable job queue stored in dir, creating it if it
+// does not exist. Its jobs are recovered from the latest snapshot, and then by
+// replaying the part of the write-ahead log written after the snapshot.
+func NewDurableQueue(dir string, opts ...Option) (*DurableQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	log, err := wal.Open(filepath.Join(dir, logDirName))
+	if err != nil {
+		return nil, err
+	}
+
+	q := &DurableQueue{
+		InMemoryQueue: NewInMemoryQueue(opts...),
+		dir:           dir,
+		log:           log,
+		snapshotLock:  sync.Mutex{},
+	}
+
+	if err := q.recover(); err != nil {
+		_ = log.Close()
+		return nil, err
+	}
+
+	q.journal = func(jobs []domain.Job) error {
+		data, err := json.Marshal(logRecord{Jobs: jobs})
+		if err != nil {
+			return err
+		}
+
+		if err := log.Append(data); err != nil {
+			return err
+		}
+		q.dirty = true
+
+		return nil
+	}
+
+	return q, nil
+}
+
+// Snapshot writes the state of the queue to disk, and removes the part of the
+// write-ahead log it covers. The queue is only locked while its state is
+// copied, so producers and consumers are not held up while the snapshot is
+// written.
+func (q *DurableQueue) Snapshot() error {
+	q.snapshotLock.Lock()
+	defer q.snapshotLock.Unlock()
+
+	q.lock.Lock()
+	if !q.dirty {
+		q.lock.Unlock()
+		return nil
+	}
+
+	// every change so far is in the segments up to the one that was closed,
+	// and is captured by the copy of the jobs
+	segment, err := q.log.Rotate()
+	if err != nil {
+		q.lock.Unlock()
+		return err
+	}
+
+	s := snapshot{
+		Segment: segment,
+		MaxID:   q.maxID,
+		Jobs:    make([]domain.Job, 0, len(q.jobs)),
+	}
+	for _, job := range q.jobs {
+		s.Jobs = append(s.Jobs, job)
+	}
+	q.dirty = false
+	q.lock.Unlock()
+
+	if err := writeSnapshot(q.dir, s); err != nil {
+		// the log still holds every change, keep it until the next snapshot
+		q.lock.Lock()
+		q.dirty = true
+		q.lock.Unlock()
+
+		return err
+	}
+
+	if err := q.log.RemoveThrough(segment); err != nil {
+		return err
+	}
+
+	return removeSnapshotsBefore(q.dir, segment)
+}
+
+// RunSnapshotter periodically snapshots the queue if its jobs changed since
+// the last snapshot. It blocks until the context is cancelled.
+func (q *DurableQueue) RunSnapshotter(ctx context.Context, interval time.Duration, log zerolog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := q.Snapshot(); err != nil {
+				log.Error().Err(err).Str("dir", q.dir).Msg("unable to snapshot queue")
+			}
+		}
+	}
+}
+
+// Close snapshots the queue, so the next start does not have to replay the
+// log, and closes the write-ahead log. The queue must not be used afterwards.
+func (q *DurableQueue) Close() error {
+	snapshotErr := q.Snapshot()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if err := q.log.Close(); err != nil {
+		return err
+	}
+
+	return snapshotErr
+}
+
+// recover loads the latest snapshot and replays the write-ahead log written
+// after it.
+func (q *DurableQueue) recover() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	s, err := loadLatestSnapshot(q.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range s.Jobs {
+		q.restore(job)
+	}
+	if s.MaxID > q.maxID {
+		q.maxID = s.MaxID
+	}
+
+	err = q.log.Replay(s.Segment, func(data []byte) error {
+		var record logRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+
+		for _, job := range record.Jobs {
+			q.restore(job)
+		}
+
+		// the replayed records are not covered by a snapshot yet
+		q.dirty = true
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to replay write-ahead log: %w", err)
+	}
+
+	// segments covered by the snapshot are left behind if the process
+	// stopped before it removed them
+	if err := q.log.RemoveThrough(s.Segment); err != nil {
+		return err
+	}
+
+	q.rebuild()
+
+	return nil
+}
+
+// restore stores a recovered job. The caller must hold the write lock.
+func (q *InMemoryQueue) restore(job domain.Job) {
+	job.Payload = omitNull(job.Payload)
+	job.Result = omitNull(job.Result)
+	q.jobs[job.ID] = job
+
+	if job.ID > q.maxID {
+		q.maxID = job.ID
+	}
+}
+
+// rebuild recreates the ready queue, the delayed jobs, the dead-letter queue,
+// the idempotency and unique keys, and the dependency, workflow and ListJobs
+// indexes from the state of the jobs. The queue is ordered by priority and then
+// by ID, so the order does not need to be stored. In progress jobs keep their
+// lease, and are returned to the queue by the reaper if it expired while the
+// queue was down. The caller must hold the write lock.
+func (q *InMemoryQueue) rebuild() {
+	q.queue = newReadyQueue()
+	q.delayed = make(delayHeap, 0)
+	q.deadLetters = make([]int, 0)
+	q.idempotencyKeys = make(map[string]int)
+	q.uniqueKeys = make(map[string]int)
+	q.dependents = make(map[int][]int)
+	q.workflows = make(map[string][]int)
+	q.byStatus = make(jobIndex)
+	q.byType = make(jobIndex)
+	q.byConsumer = make(jobIndex)
+
+	ids := make([]int, 0, len(q.jobs))
+	for id := range q.jobs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	q.created = ids
+
+	now := q.now()
+	for _, id := range ids {
+		job := q.jobs[id]
+		q.index(job)
+
+		if job.IdempotencyKey != "" && job.IdempotencyExpiresAt.After(now) {
+			q.idempotencyKeys[job.IdempotencyKey] = job.ID
+		}
+		if job.UniqueKey != "" && domain.ActiveJobStatuses[job.Status] {
+			q.uniqueKeys[job.UniqueKey] = job.ID
+		}
+		q.track(job)
+
+		switch job.Status {
+		case domain.JobStatusQueued:
+			q.push(job)
+		case domain.JobStatusScheduled:
+			q.schedule(job)
+		case domain.JobStatusFailed:
+			q.deadLetters = append(q.deadLetters, job.ID)
+		}
+	}
+
+	// dead letters are listed in the order they were dead-lettered
+	sort.SliceStable(q.deadLetters, func(i, j int) bool {
+		return q.jobs[q.deadLetters[i]].DeadLetteredAt.Before(q.jobs[q.deadLetters[j]].DeadLetteredAt)
+	})
+}
+
+// omitNull restores raw JSON that was empty before it was journaled, which is
+// encoded as null.
+func omitNull(raw json.RawMessage) json.RawMessage {
+	if string(raw) == "null" {
+		return nil
+	}
+
+	return raw
+}
@@ -0,0 +1,312 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/handler"
+	"github.com/bkrebsbach/simple-job-queue/internal/queue/queuetest"
+)
+
+func TestDurableQueue_Recover(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	opts := []Option{
+		WithVisibilityTimeout(time.Minute),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1, InitialBackoff: time.Second, MaxBackoff: time.Second, Multiplier: 1}),
+	}
+
+	dq, err := NewDurableQueue(dir, opts...)
+	require.Nil(t, err)
+	dq.now = func() time.Time { return now }
+
+	// set up state: a concluded, an in progress, a cancelled, a dead-lettered,
+	// a scheduled, and two queued jobs
+	ctx := context.Background()
+	for i := 0; i < 7; i++ {
+		_, err := dq.Enqueue(ctx, domain.Job{
+			Type:    domain.JobTypeTimeCritical,
+			Status:  domain.JobStatusQueued,
+			Payload: json.RawMessage(`{"n":1}`),
+		})
+		require.Nil(t, err)
+	}
+
+	concluded, err := dq.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Nil(t, dq.Conclude(ctx, concluded.ID, "consumer-1", json.RawMessage(`{"ok":true}`)))
+
+	inProgress, err := dq.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+
+	require.Nil(t, dq.CancelJob(ctx, 3))
+
+	failed, err := dq.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	_, err = dq.Fail(ctx, failed.ID, "consumer-1", "boom")
+	require.Nil(t, err)
+
+	_, err = dq.Enqueue(ctx, domain.Job{
+		Type:   domain.JobTypeTimeCritical,
+		Status: domain.JobStatusQueued,
+		RunAt:  now.Add(time.Hour),
+	})
+	require.Nil(t, err)
+
+	before := make(map[int]domain.Job)
+	for id := 1; id <= 8; id++ {
+		before[id], err = dq.FetchJob(ctx, id)
+		require.Nil(t, err)
+	}
+
+	// simulate a crash, which leaves no snapshot behind
+	require.Nil(t, dq.log.Close())
+
+	// check that every job is recovered with its latest state
+	dq, err = NewDurableQueue(dir, opts...)
+	require.Nil(t, err)
+	dq.now = func() time.Time { return now }
+	defer dq.Close()
+
+	for id := 1; id <= 8; id++ {
+		recovered, err := dq.FetchJob(ctx, id)
+		require.Nil(t, err)
+		require.Equal(t, before[id].Status, recovered.Status)
+		require.Equal(t, before[id].Result, recovered.Result)
+		require.True(t, before[id].LeaseExpiresAt.Equal(recovered.LeaseExpiresAt))
+	}
+
+	// check that the queue order, dead letters and scheduled jobs are rebuilt
+	require.Equal(t, []int{5, 6, 7}, dq.queue.ids())
+	require.Equal(t, []int{failed.ID}, dq.deadLetters)
+	require.Equal(t, 1, dq.delayed.Len())
+
+	// check that new jobs do not reuse IDs
+	jobID, err := dq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+	require.Nil(t, err)
+	require.Equal(t, 9, jobID)
+
+	// check that the recovered lease is still held, and reaped once expired
+	now = now.Add(2 * time.Minute)
+	reaped, err := dq.reapExpiredLeases()
+	require.Nil(t, err)
+	require.Equal(t, 1, reaped)
+
+	reapedJob, err := dq.FetchJob(ctx, inProgress.ID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusFailed, reapedJob.Status)
+}
+
+func TestDurableQueue_Snapshot(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	dq, err := NewDurableQueue(dir)
+	require.Nil(t, err)
+
+	// set up state
+	for i := 0; i < 3; i++ {
+		_, err := dq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+		require.Nil(t, err)
+	}
+
+	// check that the snapshot replaces the log it covers
+	require.Nil(t, dq.Snapshot())
+	require.Equal(t, []int{1}, mustListSnapshots(t, dir))
+	require.Equal(t, []int{2}, mustListSegments(t, dq))
+
+	// check that nothing is written when no jobs changed
+	require.Nil(t, dq.Snapshot())
+	require.Equal(t, []int{1}, mustListSnapshots(t, dir))
+
+	// change jobs covered by the snapshot, and add a new one
+	dequeuedJob, err := dq.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Nil(t, dq.Conclude(ctx, dequeuedJob.ID, "consumer-1", nil))
+	require.Nil(t, dq.CancelJob(ctx, 2))
+	_, err = dq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued, Priority: 1})
+	require.Nil(t, err)
+
+	// simulate a crash
+	require.Nil(t, dq.log.Close())
+
+	// check that the snapshot and the log after it are recovered
+	dq, err = NewDurableQueue(dir)
+	require.Nil(t, err)
+
+	concludedJob, err := dq.FetchJob(ctx, dequeuedJob.ID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusConcluded, concludedJob.Status)
+
+	cancelledJob, err := dq.FetchJob(ctx, 2)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusCancelled, cancelledJob.Status)
+
+	require.Equal(t, []int{4, 3}, dq.queue.ids())
+
+	// check that closing the queue snapshots it, and removes the old snapshot
+	require.Nil(t, dq.Close())
+	require.Equal(t, []int{2}, mustListSnapshots(t, dir))
+
+	dq, err = NewDurableQueue(dir)
+	require.Nil(t, err)
+	defer dq.Close()
+
+	require.Equal(t, []int{4, 3}, dq.queue.ids())
+	jobID, err := dq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+	require.Nil(t, err)
+	require.Equal(t, 5, jobID)
+}
+
+func TestDurableQueue_RecoverUniqueKeys(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	dq, err := NewDurableQueue(dir)
+	require.Nil(t, err)
+
+	// set up state: a job with a unique key replaced by another one
+	job := domain.Job{
+		Type:         domain.JobTypeTimeCritical,
+		Status:       domain.JobStatusQueued,
+		UniqueKey:    "reindex-customer-42",
+		UniquePolicy: domain.UniquePolicyReplace,
+	}
+	_, err = dq.Enqueue(ctx, job)
+	require.Nil(t, err)
+
+	replacingID, err := dq.Enqueue(ctx, job)
+	require.Nil(t, err)
+
+	// simulate a crash, which leaves no snapshot behind
+	require.Nil(t, dq.log.Close())
+
+	// check that the recovered queue knows which job holds the key
+	dq, err = NewDurableQueue(dir)
+	require.Nil(t, err)
+	defer dq.Close()
+
+	job.UniquePolicy = domain.UniquePolicyMerge
+	mergedID, err := dq.Enqueue(ctx, job)
+	require.Nil(t, err)
+	require.Equal(t, replacingID, mergedID)
+}
+
+func TestDurableQueue_RecoverDependencies(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	dq, err := NewDurableQueue(dir)
+	require.Nil(t, err)
+
+	// set up state: a workflow with a job blocked on another one
+	parentID, err := dq.Enqueue(ctx, domain.Job{
+		Type:       domain.JobTypeTimeCritical,
+		Status:     domain.JobStatusQueued,
+		WorkflowID: "workflow-1",
+	})
+	require.Nil(t, err)
+
+	dependentID, err := dq.Enqueue(ctx, domain.Job{
+		Type:       domain.JobTypeTimeCritical,
+		Status:     domain.JobStatusQueued,
+		DependsOn:  []int{parentID},
+		WorkflowID: "workflow-1",
+	})
+	require.Nil(t, err)
+
+	// simulate a crash, which leaves no snapshot behind
+	require.Nil(t, dq.log.Close())
+
+	// check that the recovered queue releases the blocked job once the job it
+	// depends on concluded
+	dq, err = NewDurableQueue(dir)
+	require.Nil(t, err)
+	defer dq.Close()
+
+	jobs, err := dq.ListWorkflowJobs(ctx, "workflow-1")
+	require.Nil(t, err)
+	require.Len(t, jobs, 2)
+
+	dequeuedJob, err := dq.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Equal(t, parentID, dequeuedJob.ID)
+	require.Nil(t, dq.Conclude(ctx, parentID, "consumer-1", nil))
+
+	dequeuedJob, err = dq.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Equal(t, dependentID, dequeuedJob.ID)
+}
+
+func TestDurableQueue_RecoverListJobs(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	dq, err := NewDurableQueue(dir)
+	require.Nil(t, err)
+
+	// set up state
+	firstID, err := dq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+	require.Nil(t, err)
+	secondID, err := dq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+	require.Nil(t, err)
+
+	_, err = dq.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Nil(t, dq.Close())
+
+	// check that the recovered queue lists jobs by their latest state
+	dq, err = NewDurableQueue(dir)
+	require.Nil(t, err)
+	defer dq.Close()
+
+	jobs, err := dq.ListJobs(ctx, domain.JobFilter{Status: domain.JobStatusQueued})
+	require.Nil(t, err)
+	require.Len(t, jobs, 1)
+	require.Equal(t, secondID, jobs[0].ID)
+
+	jobs, err = dq.ListJobs(ctx, domain.JobFilter{ConsumerID: "consumer-1"})
+	require.Nil(t, err)
+	require.Len(t, jobs, 1)
+	require.Equal(t, firstID, jobs[0].ID)
+	require.False(t, jobs[0].CreatedAt.IsZero())
+}
+
+func TestDurableQueue_Conformance(t *testing.T) {
+	queuetest.Run(t, func(t *testing.T) handler.JobQueuer {
+		dq, err := NewDurableQueue(t.TempDir())
+		require.Nil(t, err)
+		t.Cleanup(func() { _ = dq.Close() })
+
+		return dq
+	})
+}
+
+func mustListSnapshots(t *testing.T, dir string) []int {
+	segments, err := listSnapshots(dir)
+	require.Nil(t, err)
+
+	return segments
+}
+
+func mustListSegments(t *testing.T, dq *DurableQueue) []int {
+	segments := make([]int, 0)
+	entries, err := ioutil.ReadDir(filepath.Join(dq.dir, logDirName))
+	require.Nil(t, err)
+	for _, entry := range entries {
+		segment, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".wal"))
+		require.Nil(t, err)
+		segments = append(segments, segment)
+	}
+
+	return segments
+}
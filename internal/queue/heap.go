@@ -0,0 +1,112 @@
+package queue
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+// queueEntry is a queued job waiting in a jobHeap.
+type queueEntry struct {
+	id       int
+	priority int
+}
+
+// before reports whether the entry should be dequeued before the other entry.
+// Jobs with a higher priority come first, and jobs with the same priority are
+// ordered by ID, which is the order they were enqueued in.
+func (e queueEntry) before(other queueEntry) bool {
+	if e.priority != other.priority {
+		return e.priority > other.priority
+	}
+
+	return e.id < other.id
+}
+
+// jobHeap is a heap of queued jobs implementing heap.Interface, with the next
+// job to dequeue at the root.
+type jobHeap []queueEntry
+
+func (h jobHeap) Len() int           { return len(h) }
+func (h jobHeap) Less(i, j int) bool { return h[i].before(h[j]) }
+func (h jobHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *jobHeap) Push(x interface{}) {
+	*h = append(*h, x.(queueEntry))
+}
+
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	*h = old[:n-1]
+
+	return entry
+}
+
+// readyQueue holds the jobs that are available for dequeue. Time critical jobs
+// are kept in their own heap so priority scheduling can serve them first.
+type readyQueue struct {
+	timeCritical    jobHeap
+	notTimeCritical jobHeap
+}
+
+// newReadyQueue returns an empty ready queue.
+func newReadyQueue() *readyQueue {
+	return &readyQueue{
+		timeCritical:    make(jobHeap, 0),
+		notTimeCritical: make(jobHeap, 0),
+	}
+}
+
+// Len returns the number of entries in the queue, including entries for jobs
+// that have been cancelled since they were queued.
+func (r *readyQueue) Len() int {
+	return r.timeCritical.Len() + r.notTimeCritical.Len()
+}
+
+// push adds a job to the heap for its type.
+func (r *readyQueue) push(job domain.Job) {
+	entry := queueEntry{id: job.ID, priority: job.Priority}
+
+	if job.Type == domain.JobTypeTimeCritical {
+		heap.Push(&r.timeCritical, entry)
+		return
+	}
+
+	heap.Push(&r.notTimeCritical, entry)
+}
+
+// delayEntry is a scheduled job waiting in a delayHeap.
+type delayEntry struct {
+	id    int
+	runAt time.Time
+}
+
+// delayHeap is a heap of scheduled jobs implementing heap.Interface, with the
+// job that is due first at the root.
+type delayHeap []delayEntry
+
+func (h delayHeap) Len() int { return len(h) }
+func (h delayHeap) Less(i, j int) bool {
+	if !h[i].runAt.Equal(h[j].runAt) {
+		return h[i].runAt.Before(h[j].runAt)
+	}
+
+	return h[i].id < h[j].id
+}
+func (h delayHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *delayHeap) Push(x interface{}) {
+	*h = append(*h, x.(delayEntry))
+}
+
+func (h *delayHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	*h = old[:n-1]
+
+	return entry
+}
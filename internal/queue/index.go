@@ -0,0 +1,161 @@
+package queue
+
+import (
+	"context"
+	"sort"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+// jobIndex holds the IDs of the jobs with each value of an indexed field, in
+// ascending order, so a page of jobs is listed from the ID it starts after.
+type jobIndex map[string][]int
+
+// add adds a job to the jobs with the value. Empty values are not indexed.
+// Jobs are mostly added with an ID above every ID with the value, which only
+// appends the ID.
+func (i jobIndex) add(value string, id int) {
+	if value == "" {
+		return
+	}
+
+	ids := i[value]
+	n := sort.SearchInts(ids, id)
+	if n < len(ids) && ids[n] == id {
+		return
+	}
+
+	ids = append(ids, 0)
+	copy(ids[n+1:], ids[n:])
+	ids[n] = id
+	i[value] = ids
+}
+
+// remove removes a job from the jobs with the value.
+func (i jobIndex) remove(value string, id int) {
+	ids := i[value]
+	n := sort.SearchInts(ids, id)
+	if n == len(ids) || ids[n] != id {
+		return
+	}
+
+	if len(ids) == 1 {
+		delete(i, value)
+		return
+	}
+	i[value] = append(ids[:n], ids[n+1:]...)
+}
+
+// ListJobs returns the jobs selected by the filter, ordered by ID. Jobs are
+// looked up by the most selective index for the filter, and listed by the time
+// they were created otherwise.
+func (q *InMemoryQueue) ListJobs(ctx context.Context, filter domain.JobFilter) ([]domain.Job, error) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return q.list(filter), nil
+}
+
+// list returns the jobs selected by the filter, ordered by ID. The caller must
+// hold the lock.
+func (q *InMemoryQueue) list(filter domain.JobFilter) []domain.Job {
+	// the IDs of the jobs that can match, in ascending order
+	var ids []int
+
+	indexed := false
+	for _, i := range []struct {
+		index jobIndex
+		value string
+	}{
+		{q.byStatus, filter.Status},
+		{q.byType, filter.Type},
+		{q.byConsumer, filter.ConsumerID},
+	} {
+		if i.value == "" {
+			continue
+		}
+		if matching := i.index[i.value]; !indexed || len(matching) < len(ids) {
+			ids = matching
+			indexed = true
+		}
+	}
+
+	if indexed {
+		ids = ids[sort.SearchInts(ids, filter.AfterID+1):]
+	} else {
+		ids = q.createdBetween(filter)
+	}
+
+	jobs := make([]domain.Job, 0)
+	for _, id := range ids {
+		if filter.Limit > 0 && len(jobs) >= filter.Limit {
+			break
+		}
+
+		if job := q.jobs[id]; filter.Matches(job) {
+			jobs = append(jobs, job)
+		}
+	}
+
+	return jobs
+}
+
+// createdBetween returns the IDs of the jobs after the ID of the filter, that
+// were created in the time range of the filter. Jobs are created in the order
+// of their ID, so both bounds are found by binary search. The caller must hold
+// the lock.
+func (q *InMemoryQueue) createdBetween(filter domain.JobFilter) []int {
+	start := sort.SearchInts(q.created, filter.AfterID+1)
+	end := len(q.created)
+
+	if !filter.CreatedAfter.IsZero() {
+		after := sort.Search(len(q.created), func(i int) bool {
+			return q.jobs[q.created[i]].CreatedAt.After(filter.CreatedAfter)
+		})
+		if after > start {
+			start = after
+		}
+	}
+
+	if !filter.CreatedBefore.IsZero() {
+		end = sort.Search(len(q.created), func(i int) bool {
+			return !q.jobs[q.created[i]].CreatedAt.Before(filter.CreatedBefore)
+		})
+	}
+
+	if start >= end {
+		return nil
+	}
+
+	return q.created[start:end]
+}
+
+// store stores the state of a job, and keeps the indexes of ListJobs current.
+// The caller must hold the write lock.
+func (q *InMemoryQueue) store(job domain.Job) {
+	previous, ok := q.jobs[job.ID]
+	if ok {
+		q.unindex(previous)
+	} else {
+		q.created = append(q.created, job.ID)
+	}
+
+	q.jobs[job.ID] = job
+	q.index(job)
+}
+
+// index adds a job to the indexes of ListJobs. The caller must hold the write
+// lock.
+func (q *InMemoryQueue) index(job domain.Job) {
+	q.byStatus.add(job.Status, job.ID)
+	q.byType.add(job.Type, job.ID)
+	q.byConsumer.add(job.ConsumerID, job.ID)
+}
+
+// unindex removes a job from the indexes of ListJobs. The caller must hold the
+// write lock.
+func (q *InMemoryQueue) unindex(job domain.Job) {
+	q.byStatus.remove(job.Status, job.ID)
+	q.byType.remove(job.Type, job.ID)
+	q.byConsumer.remove(job.ConsumerID, job.ID)
+}
@@ -1,41 +1,297 @@
 package queue
 
 import (
+	"container/heap"
 	"context"
+	"encoding/json"
+	"math/rand"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
 
 	"github.com/bkrebsbach/simple-job-queue/internal/domain"
 )
 
+// DefaultVisibilityTimeout is the lease duration handed out on dequeue when no
+// other visibility timeout is configured.
+const DefaultVisibilityTimeout = 5 * time.Minute
+
+// requeueReason is the failure recorded for a job that was taken back from its
+// consumer by RequeueJob.
+const requeueReason = "requeued"
+
+// Option configures a job queue.
+type Option func(*config)
+
+// WithVisibilityTimeout sets how long a dequeued job stays leased to its
+// consumer before the reaper returns it to the queue.
+func WithVisibilityTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.visibilityTimeout = timeout
+	}
+}
+
+// config holds the settings shared by the job queue implementations.
+type config struct {
+	visibilityTimeout time.Duration
+	retryPolicy       RetryPolicy
+	typeRetryPolicies map[string]RetryPolicy
+
+	// prioritize makes dequeue serve time critical jobs first, with a
+	// waiting job that is not time critical served after every
+	// timeCriticalRatio time critical jobs
+	prioritize        bool
+	timeCriticalRatio int
+
+	now    func() time.Time
+	random func() float64
+}
+
+// newConfig returns the default settings with the options applied.
+func newConfig(opts []Option) config {
+	c := config{
+		visibilityTimeout: DefaultVisibilityTimeout,
+		retryPolicy:       DefaultRetryPolicy,
+		typeRetryPolicies: make(map[string]RetryPolicy),
+		now:               time.Now,
+		random:            rand.Float64,
+	}
+
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	return c
+}
+
 // InMemoryQueue is an in-memory implementation of a job queue. Job IDs are stored
-// in a slice, and the job definitions are stored in a map with the job IDs as
-// keys. Maps are unordered, so the slice is necessary to preserve ordering.
+// in heaps ordered by priority and then by ID, and the job definitions are
+// stored in a map with the job IDs as keys. Maps are unordered, so the heaps are
+// necessary to preserve ordering.
 type InMemoryQueue struct {
-	queue []int
+	queue *readyQueue
 	jobs  map[int]domain.Job
 	maxID int
 
+	// delayed holds scheduled jobs, including jobs waiting out a retry
+	// backoff, ordered by the time they are due
+	delayed delayHeap
+
+	// deadLetters holds the IDs of jobs that ran out of attempts, in the
+	// order they were dead-lettered
+	deadLetters []int
+
+	// idempotencyKeys holds the ID of the last job enqueued with each
+	// idempotency key
+	idempotencyKeys map[string]int
+
+	// uniqueKeys holds the ID of the last job enqueued with each unique key
+	uniqueKeys map[string]int
+
+	// dependents holds the IDs of the jobs that depend on each job
+	dependents map[int][]int
+
+	// workflows holds the IDs of the jobs of each workflow, in the order they
+	// were enqueued
+	workflows map[string][]int
+
+	// byStatus, byType and byConsumer hold the IDs of the jobs by status, type
+	// and consumer, and created holds the IDs of the jobs in the order they
+	// were created, see ListJobs
+	byStatus   jobIndex
+	byType     jobIndex
+	byConsumer jobIndex
+	created    []int
+
+	config
+
+	// timeCriticalStreak counts the time critical jobs served in a row with
+	// priority scheduling
+	timeCriticalStreak int
+
+	// journal, when set, durably records changed jobs before they are
+	// applied, see NewDurableQueue
+	journal func(jobs []domain.Job) error
+
+	// batch, when set, collects the changes of EnqueueBatch and
+	// EnqueueWorkflow so they are journaled at once, see beginBatch
+	batch *journalBatch
+
+	// available is closed and replaced whenever a job is added to the ready
+	// queue, waking the consumers waiting for a job
+	available chan struct{}
+
 	lock sync.RWMutex
 }
 
 // NewInMemoryQueue returns an in-memory job queue.
-func NewInMemoryQueue() *InMemoryQueue {
-	queue := make([]int, 0)
+func NewInMemoryQueue(opts ...Option) *InMemoryQueue {
+	queue := newReadyQueue()
 	jobs := make(map[int]domain.Job)
 
 	return &InMemoryQueue{
-		queue: queue,
-		jobs:  jobs,
-		maxID: 0,
-		lock:  sync.RWMutex{},
+		queue:           queue,
+		jobs:            jobs,
+		maxID:           0,
+		delayed:         make(delayHeap, 0),
+		deadLetters:     make([]int, 0),
+		idempotencyKeys: make(map[string]int),
+		uniqueKeys:      make(map[string]int),
+		dependents:      make(map[int][]int),
+		workflows:       make(map[string][]int),
+		byStatus:        make(jobIndex),
+		byType:          make(jobIndex),
+		byConsumer:      make(jobIndex),
+		created:         make([]int, 0),
+		config:          newConfig(opts),
+		available:       make(chan struct{}),
+		lock:            sync.RWMutex{},
 	}
 }
 
-// Enqueue adds a job to the queue, and returns the ID of the job.
+// Enqueue adds a job to the queue, and returns the ID of the job. Jobs with a
+// RunAt in the future are scheduled, and stay invisible to Dequeue until then.
+// A job with the idempotency key of a job enqueued earlier is not added, the ID
+// of the earlier job is returned instead. A job with the unique key of an
+// active job is handled according to its unique policy. A job that depends on
+// other jobs is blocked until they concluded.
 func (q *InMemoryQueue) Enqueue(ctx context.Context, job domain.Job) (int, error) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
+	return q.enqueue(job)
+}
+
+// EnqueueBatch adds jobs to the queue while holding the lock once, and returns
+// the ID of every job or the error that kept it from being added, in the order
+// the jobs were given. Every job is added as if by Enqueue, so a job that
+// fails does not keep the other jobs from being added. The changes are
+// journaled at once, if the journal fails none of the jobs is added.
+func (q *InMemoryQueue) EnqueueBatch(ctx context.Context, jobs []domain.Job) ([]int, []error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	ids := make([]int, len(jobs))
+	errs := make([]error, len(jobs))
+
+	q.beginBatch()
+	for i, job := range jobs {
+		ids[i], errs[i] = q.enqueue(job)
+	}
+
+	if err := q.commitBatch(); err != nil {
+		for i := range errs {
+			ids[i], errs[i] = 0, err
+		}
+	}
+
+	return ids, errs
+}
+
+// beginBatch starts collecting the changes to the queue, so they are journaled
+// at once by commitBatch, or undone by rollbackBatch. The caller must hold the
+// write lock.
+func (q *InMemoryQueue) beginBatch() {
+	q.batch = &journalBatch{maxID: q.maxID, previous: make(map[int]*domain.Job)}
+}
+
+// commitBatch journals the changes collected since beginBatch, and reverts them
+// if the journal fails. The caller must hold the write lock.
+func (q *InMemoryQueue) commitBatch() error {
+	batch := q.batch
+	q.batch = nil
+
+	if q.journal != nil && len(batch.jobs) > 0 {
+		if err := q.journal(batch.jobs); err != nil {
+			batch.revert(q)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rollbackBatch reverts the changes collected since beginBatch. The caller must
+// hold the write lock.
+func (q *InMemoryQueue) rollbackBatch() {
+	batch := q.batch
+	q.batch = nil
+
+	batch.revert(q)
+}
+
+// journalBatch collects the changes to a queue that are journaled at once, and
+// the state of the changed jobs before the batch, so the changes can be
+// reverted if the journal fails or the batch is rolled back.
+type journalBatch struct {
+	jobs  []domain.Job
+	maxID int
+
+	// previous holds the state of every changed job before the batch, nil for
+	// jobs the batch added
+	previous map[int]*domain.Job
+}
+
+// add records changed jobs before they are stored.
+func (b *journalBatch) add(q *InMemoryQueue, jobs []domain.Job) {
+	for _, job := range jobs {
+		if _, ok := b.previous[job.ID]; ok {
+			continue
+		}
+
+		if previous, ok := q.jobs[job.ID]; ok {
+			b.previous[job.ID] = &previous
+		} else {
+			b.previous[job.ID] = nil
+		}
+	}
+
+	b.jobs = append(b.jobs, jobs...)
+}
+
+// revert restores the state of the queue before the batch. The caller must
+// hold the write lock.
+func (b *journalBatch) revert(q *InMemoryQueue) {
+	for id, previous := range b.previous {
+		if previous == nil {
+			delete(q.jobs, id)
+			continue
+		}
+		q.jobs[id] = *previous
+	}
+	q.maxID = b.maxID
+
+	q.rebuild()
+}
+
+// enqueue adds a job to the queue, see Enqueue. The caller must hold the write
+// lock.
+func (q *InMemoryQueue) enqueue(job domain.Job) (int, error) {
+	// a repeated request gets the job it enqueued the first time, until the
+	// key expires
+	if id, ok := q.idempotencyKeys[job.IdempotencyKey]; ok && job.IdempotencyKey != "" {
+		enqueuedJob := q.jobs[id]
+		if enqueuedJob.IdempotencyExpiresAt.After(q.now()) {
+			if enqueuedJob.IdempotencyHash != job.IdempotencyHash {
+				return 0, domain.ErrIdempotencyKeyReused{Key: job.IdempotencyKey}
+			}
+
+			return id, nil
+		}
+	}
+
+	// only one active job may hold a unique key
+	replaced := make([]domain.Job, 0, 1)
+	if id, ok := q.uniqueKeys[job.UniqueKey]; ok && job.UniqueKey != "" && domain.ActiveJobStatuses[q.jobs[id].Status] {
+		merged, activeJob, err := resolveUniqueKey(job, q.jobs[id])
+		if err != nil || merged {
+			return activeJob.ID, err
+		}
+		replaced = append(replaced, activeJob)
+	}
+
 	// get the next available job ID
 	id := q.maxID + 1
 	_, ok := q.jobs[id]
@@ -49,48 +305,122 @@ func (q *InMemoryQueue) Enqueue(ctx context.Context, job domain.Job) (int, error
 	// add the job to the queue
 	// update the max ID
 	job.ID = id
-	q.jobs[job.ID] = job
-	q.queue = append(q.queue, job.ID)
+
+	// jobs are created in the order of their ID, even if the clock goes back
+	job.CreatedAt = q.now()
+	if n := len(q.created); n > 0 && job.CreatedAt.Before(q.jobs[q.created[n-1]].CreatedAt) {
+		job.CreatedAt = q.jobs[q.created[n-1]].CreatedAt
+	}
+
+	// hold scheduled jobs back until they are due
+	if job.RunAt.After(q.now()) {
+		job.Status = domain.JobStatusScheduled
+	} else {
+		if job.Status == domain.JobStatusScheduled {
+			job.Status = domain.JobStatusQueued
+		}
+		job.RunAt = time.Time{}
+	}
+
+	// hold the job back until the jobs it depends on, or the jobs of its
+	// batch, concluded
+	if len(job.DependsOn) > 0 || job.BatchRemaining > 0 {
+		parents, err := q.parents(job)
+		if err != nil {
+			return 0, err
+		}
+		job = resolveDependencies(job, parents, q.now())
+	}
+
+	// the replaced job is cancelled along with enqueuing the job
+	if err := q.save(append(replaced, job)...); err != nil {
+		return 0, err
+	}
 	q.maxID = job.ID
+	q.track(job)
+
+	if job.IdempotencyKey != "" {
+		q.idempotencyKeys[job.IdempotencyKey] = job.ID
+	}
+	if job.UniqueKey != "" {
+		q.uniqueKeys[job.UniqueKey] = job.ID
+	}
+
+	q.place(job)
 
 	return job.ID, nil
 }
 
 // Dequeue returns a job from the queue. Jobs are considered available for
-// Dequeue if the job has not been concluded and has not dequeued already.
+// Dequeue if the job has not been concluded and has not dequeued already. The
+// consumer holds a lease on the job until the visibility timeout passes. Jobs
+// are served by priority, and then in the order they were enqueued. With
+// priority scheduling, time critical jobs are served first.
 func (q *InMemoryQueue) Dequeue(ctx context.Context, consumerID string) (domain.Job, error) {
+	jobs, err := q.DequeueBatch(ctx, consumerID, 1)
+	if err != nil {
+		return domain.Job{}, err
+	}
+
+	return jobs[0], nil
+}
+
+// DequeueBatch returns up to max jobs from the queue, in the order Dequeue
+// would return them one by one. The jobs are claimed at once, so either all of
+// them are leased to the consumer or none is.
+func (q *InMemoryQueue) DequeueBatch(ctx context.Context, consumerID string, max int) ([]domain.Job, error) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
-	// pop jobs off the queue until one is available for processing
-	for len(q.queue) > 0 {
-		// pop the first job off the queue
-		var jobID int
-		jobID, q.queue = q.queue[0], q.queue[1:]
+	// make scheduled jobs that are due available first
+	q.promoteDueJobs()
 
-		// get the job definition
-		job, ok := q.jobs[jobID]
+	// pop the next jobs available for processing off the queue, and mark them
+	// as in progress
+	leaseExpiresAt := q.now().Add(q.visibilityTimeout)
+	queued := make([]domain.Job, 0)
+	jobs := make([]domain.Job, 0)
+	claimed := make(map[int]bool)
+	for len(jobs) < max {
+		jobID, ok := q.popNext()
 		if !ok {
-			return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+			break
 		}
+		if claimed[jobID] {
+			continue
+		}
+		claimed[jobID] = true
 
-		// if the job status is queued, dequeue the job, mark it as in progress,
-		// and return it
-		if job.Status == domain.JobStatusQueued {
-			job.Status = domain.JobStatusInProgress
-			job.ConsumerID = consumerID
-			q.jobs[job.ID] = job
+		queuedJob := q.jobs[jobID]
+		job := queuedJob
+		job.Status = domain.JobStatusInProgress
+		job.ConsumerID = consumerID
+		job.LeaseExpiresAt = leaseExpiresAt
+		job.Attempts++
 
-			return job, nil
-		}
+		queued = append(queued, queuedJob)
+		jobs = append(jobs, job)
 	}
 
 	// if there are no jobs in the queue, return an error
-	return domain.Job{}, domain.ErrQueueEmpty
+	if len(jobs) == 0 {
+		return nil, domain.ErrQueueEmpty
+	}
+
+	if err := q.save(jobs...); err != nil {
+		// put the jobs back in their place for the next consumer
+		for _, queuedJob := range queued {
+			q.push(queuedJob)
+		}
+		return nil, err
+	}
+
+	return jobs, nil
 }
 
-// Conclude finishes execution on the job.
-func (q *InMemoryQueue) Conclude(ctx context.Context, jobID int, consumerID string) error {
+// Conclude finishes execution on the job, and stores the result reported by
+// the consumer.
+func (q *InMemoryQueue) Conclude(ctx context.Context, jobID int, consumerID string, result json.RawMessage) error {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
@@ -105,12 +435,105 @@ func (q *InMemoryQueue) Conclude(ctx context.Context, jobID int, consumerID stri
 		return domain.ErrJobNotFound{JobID: jobID}
 	}
 
-	// TODO: prevent cancelled jobs from being concluded
+	// a job cancelled or requeued while the consumer worked on it cannot be
+	// concluded
+	if job.Status != domain.JobStatusInProgress {
+		return domain.ErrJobStatusTransitionNotAllowed{JobID: jobID}
+	}
 
 	job.Status = domain.JobStatusConcluded
-	q.jobs[job.ID] = job
+	job.Result = result
 
-	return nil
+	return q.save(job)
+}
+
+// Fail reports that a consumer was unable to process a job. The job is retried
+// after a backoff, unless it has run out of attempts, in which case it is moved
+// to the dead-letter queue.
+func (q *InMemoryQueue) Fail(ctx context.Context, jobID int, consumerID string, reason string) (domain.Job, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	// check if the job is defined
+	job, ok := q.jobs[jobID]
+	if !ok {
+		return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+	}
+
+	// only the consumer that dequeued the job is allowed to fail it
+	if job.ConsumerID != consumerID {
+		return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+	}
+
+	if job.Status != domain.JobStatusInProgress {
+		return domain.Job{}, domain.ErrJobStatusTransitionNotAllowed{JobID: jobID}
+	}
+
+	now := q.now()
+	policy := q.retryPolicyFor(job)
+
+	job = recordFailure(job, reason, now)
+
+	if job.Attempts >= policy.MaxAttempts {
+		return q.deadLetter(job, now)
+	}
+
+	// hold the job back until the backoff has passed
+	job.Status = domain.JobStatusScheduled
+	job.RunAt = now.Add(policy.Backoff(job.Attempts, q.random()))
+	if err := q.save(job); err != nil {
+		return domain.Job{}, err
+	}
+	q.schedule(job)
+
+	return job, nil
+}
+
+// retryPolicyFor returns the retry policy for a job, taking the job's own max
+// attempts into account.
+func (c *config) retryPolicyFor(job domain.Job) RetryPolicy {
+	policy, ok := c.typeRetryPolicies[job.Type]
+	if !ok {
+		policy = c.retryPolicy
+	}
+
+	if job.MaxAttempts > 0 {
+		policy.MaxAttempts = job.MaxAttempts
+	}
+
+	return policy
+}
+
+// Heartbeat extends the lease on an in progress job by the visibility timeout,
+// and records the progress reported by the consumer if one is given.
+func (q *InMemoryQueue) Heartbeat(ctx context.Context, jobID int, consumerID string, progress *int) (domain.Job, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	// check if the job is defined
+	job, ok := q.jobs[jobID]
+	if !ok {
+		return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+	}
+
+	// only the consumer that dequeued the job is allowed to extend its lease
+	if job.ConsumerID != consumerID {
+		return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+	}
+
+	if job.Status != domain.JobStatusInProgress {
+		return domain.Job{}, domain.ErrJobStatusTransitionNotAllowed{JobID: jobID}
+	}
+
+	job.LeaseExpiresAt = q.now().Add(q.visibilityTimeout)
+	if progress != nil {
+		job.Progress = *progress
+	}
+	if err := q.save(job); err != nil {
+		return domain.Job{}, err
+	}
+
+	return job, nil
 }
 
 // FetchJob returns a job definition for the given job ID.
@@ -143,7 +566,281 @@ func (q *InMemoryQueue) CancelJob(ctx context.Context, jobID int) error {
 	}
 
 	job.Status = domain.JobStatusCancelled
-	q.jobs[job.ID] = job
+
+	return q.save(job)
+}
+
+// RequeueJob returns an in progress job to the queue, e.g. because its consumer
+// is known to be gone, without waiting for its lease to expire. The attempt is
+// recorded as failed, but the job is not dead-lettered even if it ran out of
+// attempts.
+func (q *InMemoryQueue) RequeueJob(ctx context.Context, jobID int) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	// check if the job is defined
+	job, ok := q.jobs[jobID]
+	if !ok {
+		return domain.ErrJobNotFound{JobID: jobID}
+	}
+
+	if job.Status != domain.JobStatusInProgress {
+		return domain.ErrJobStatusTransitionNotAllowed{JobID: jobID}
+	}
+
+	return q.requeue([]domain.Job{job})
+}
+
+// requeue returns in progress jobs to the queue, where they keep their place
+// ahead of newer jobs of the same priority. The caller must hold the write
+// lock.
+func (q *InMemoryQueue) requeue(jobs []domain.Job) error {
+	now := q.now()
+
+	requeued := make([]domain.Job, 0, len(jobs))
+	for _, job := range jobs {
+		job = recordFailure(job, requeueReason, now)
+		job.Status = domain.JobStatusQueued
+		requeued = append(requeued, job)
+	}
+
+	if err := q.save(requeued...); err != nil {
+		return err
+	}
+
+	for _, job := range requeued {
+		q.push(job)
+	}
 
 	return nil
 }
+
+// Stats returns the number of jobs tracked by the queue, broken down by status.
+func (q *InMemoryQueue) Stats(ctx context.Context) (domain.QueueStats, error) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	stats := domain.QueueStats{
+		Total:    len(q.jobs),
+		Statuses: make(map[string]int),
+	}
+	for _, job := range q.jobs {
+		stats.Statuses[job.Status]++
+	}
+
+	return stats, nil
+}
+
+// RunReaper periodically returns in progress jobs with an expired lease to the
+// queue, moves scheduled jobs to the queue once they are due, and forgets
+// expired idempotency keys. It blocks until the context is cancelled, or until
+// reaping fails, which only happens when the journal of a durable queue cannot
+// be written. The failure is logged, and the reaper stops rather than keep
+// changing jobs the journal may not hold.
+func (q *InMemoryQueue) RunReaper(ctx context.Context, interval time.Duration, log zerolog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := q.reapExpiredLeases(); err != nil {
+				log.Error().Err(err).Msg("unable to reap expired leases, stopping the reaper")
+				return
+			}
+
+			q.lock.Lock()
+			q.promoteDueJobs()
+			q.evictIdempotencyKeys()
+			q.lock.Unlock()
+		}
+	}
+}
+
+// reapExpiredLeases puts in progress jobs whose lease has expired back in the
+// queue so another consumer can pick them up. A lost lease counts
+// as a failed attempt, so jobs that keep losing their lease are eventually
+// dead-lettered. It returns the number of jobs that were reaped.
+func (q *InMemoryQueue) reapExpiredLeases() (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := q.now()
+
+	expired := make([]int, 0)
+	for id, job := range q.jobs {
+		if job.Status == domain.JobStatusInProgress && !job.LeaseExpiresAt.After(now) {
+			expired = append(expired, id)
+		}
+	}
+	sort.Ints(expired)
+
+	// requeued jobs keep their place ahead of newer jobs of the same priority,
+	// and jobs that expired together are dead-lettered in the order of their ID
+	for i, id := range expired {
+		job := recordFailure(q.jobs[id], "lease expired", now)
+
+		if job.Attempts >= q.retryPolicyFor(job).MaxAttempts {
+			if _, err := q.deadLetter(job, now); err != nil {
+				return i, err
+			}
+			continue
+		}
+
+		job.Status = domain.JobStatusQueued
+		if err := q.save(job); err != nil {
+			return i, err
+		}
+		q.push(job)
+	}
+
+	return len(expired), nil
+}
+
+// schedule holds a job back until its RunAt. The caller must hold the write
+// lock.
+func (q *InMemoryQueue) schedule(job domain.Job) {
+	heap.Push(&q.delayed, delayEntry{id: job.ID, runAt: job.RunAt})
+}
+
+// promoteDueJobs moves scheduled jobs that are due to the queue, where retried
+// jobs keep their place ahead of newer jobs of the same priority. Promotion is
+// not journaled, a recovered queue promotes due jobs again. The caller must
+// hold the write lock.
+func (q *InMemoryQueue) promoteDueJobs() {
+	now := q.now()
+
+	for q.delayed.Len() > 0 && !q.delayed[0].runAt.After(now) {
+		entry := heap.Pop(&q.delayed).(delayEntry)
+
+		// drop jobs that were cancelled while they were scheduled
+		job, ok := q.jobs[entry.id]
+		if !ok || job.Status != domain.JobStatusScheduled {
+			continue
+		}
+
+		job.Status = domain.JobStatusQueued
+		job.RunAt = time.Time{}
+		q.store(job)
+		q.push(job)
+	}
+}
+
+// evictIdempotencyKeys forgets the idempotency keys that expired, so keys are
+// not held for longer than they are used. The jobs keep their key, which is no
+// longer looked up once it expired. The caller must hold the write lock.
+func (q *InMemoryQueue) evictIdempotencyKeys() {
+	now := q.now()
+
+	for key, id := range q.idempotencyKeys {
+		if !q.jobs[id].IdempotencyExpiresAt.After(now) {
+			delete(q.idempotencyKeys, key)
+		}
+	}
+}
+
+// save journals the jobs along with the blocked jobs their new state releases
+// or cancels, and then stores them. Released jobs are placed in the queue.
+// Nothing is stored if the journal fails. Within a batch the jobs are stored
+// right away, and journaled when the batch is committed. The caller must hold
+// the write lock.
+func (q *InMemoryQueue) save(jobs ...domain.Job) error {
+	settled := q.settleDependents(jobs)
+	jobs = append(jobs, settled...)
+
+	if q.batch != nil {
+		q.batch.add(q, jobs)
+	} else if q.journal != nil {
+		if err := q.journal(jobs); err != nil {
+			return err
+		}
+	}
+
+	for _, job := range jobs {
+		q.store(job)
+	}
+
+	for _, job := range settled {
+		q.place(job)
+	}
+
+	return nil
+}
+
+// mayDequeue reports whether a job may be dequeued at the given time: the
+// ready queue holds a job, or a scheduled job is due. The ready queue can hold
+// entries of jobs that were cancelled, so a dequeue can still find it empty.
+func (q *InMemoryQueue) mayDequeue(now time.Time) bool {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return q.queue.Len() > 0 || (q.delayed.Len() > 0 && !q.delayed[0].runAt.After(now))
+}
+
+// JobAvailable returns a channel that is closed the next time a job is added to
+// the ready queue. Scheduled jobs that come due are only added to the ready
+// queue by Dequeue and the reaper, so they do not close the channel on time.
+func (q *InMemoryQueue) JobAvailable() <-chan struct{} {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return q.available
+}
+
+// push adds a job to the ready queue, and wakes the consumers waiting for a
+// job. The caller must hold the write lock.
+func (q *InMemoryQueue) push(job domain.Job) {
+	q.queue.push(job)
+
+	close(q.available)
+	q.available = make(chan struct{})
+}
+
+// place adds a job to the ready queue or the delayed jobs according to its
+// status. The caller must hold the write lock.
+func (q *InMemoryQueue) place(job domain.Job) {
+	switch job.Status {
+	case domain.JobStatusQueued:
+		q.push(job)
+	case domain.JobStatusScheduled:
+		q.schedule(job)
+	}
+}
+
+// resolveUniqueKey applies the unique policy of a job that is enqueued while
+// activeJob holds its unique key. It reports whether the job is merged into the
+// active job, and otherwise returns the active job cancelled so the job can
+// replace it. A job is rejected if it cannot be merged or replace the active
+// job.
+func resolveUniqueKey(job domain.Job, activeJob domain.Job) (bool, domain.Job, error) {
+	switch job.UniquePolicy {
+	case domain.UniquePolicyMerge:
+		return true, activeJob, nil
+	case domain.UniquePolicyReplace:
+		// a job that started cannot be taken back from its consumer
+		if activeJob.Status != domain.JobStatusInProgress {
+			activeJob.Status = domain.JobStatusCancelled
+			return false, activeJob, nil
+		}
+	}
+
+	return false, domain.Job{}, domain.ErrDuplicateJob{UniqueKey: job.UniqueKey, JobID: activeJob.ID}
+}
+
+// recordFailure releases a job from its consumer and adds the failure to its
+// history.
+func recordFailure(job domain.Job, reason string, now time.Time) domain.Job {
+	job.Failures = append(job.Failures, domain.Failure{
+		Attempt:    job.Attempts,
+		ConsumerID: job.ConsumerID,
+		Error:      reason,
+		FailedAt:   now,
+	})
+	job.LastError = reason
+	job.ConsumerID = ""
+	job.LeaseExpiresAt = time.Time{}
+
+	return job
+}
@@ -1,12 +1,21 @@
 package queue
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
 
 	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/handler"
+	"github.com/bkrebsbach/simple-job-queue/internal/queue/queuetest"
 )
 
 // NOTE: I ran out of time writing tests, so I only have the first few functions
@@ -37,6 +46,12 @@ func TestEnqueue(t *testing.T) {
 	require.Nil(t, err)
 }
 
+func TestInMemoryQueue_Conformance(t *testing.T) {
+	queuetest.Run(t, func(t *testing.T) handler.JobQueuer {
+		return NewInMemoryQueue()
+	})
+}
+
 func TestDequeue(t *testing.T) {
 	mq := NewInMemoryQueue()
 
@@ -58,7 +73,10 @@ func TestDequeue(t *testing.T) {
 			Status: domain.JobStatusQueued,
 		},
 	}
-	queue := []int{1, 2, 3}
+	queue := newReadyQueue()
+	for _, id := range []int{1, 2, 3} {
+		queue.push(jobs[id])
+	}
 
 	mq.jobs = jobs
 	mq.queue = queue
@@ -67,7 +85,7 @@ func TestDequeue(t *testing.T) {
 	job, err := mq.Dequeue(context.Background(), consumerID)
 	require.Nil(t, err)
 
-	require.Equal(t, len(mq.queue), 0)
+	require.Equal(t, mq.queue.Len(), 0)
 	require.Equal(t, job, jobs[3])
 }
 
@@ -90,10 +108,10 @@ func TestConclude(t *testing.T) {
 	dequeuedJob, err := mq.Dequeue(context.Background(), consumerID)
 	require.Nil(t, err)
 
-	require.Equal(t, len(mq.queue), 0)
+	require.Equal(t, mq.queue.Len(), 0)
 	// check that dequeuedJob matches enqueued job
 
-	err = mq.Conclude(context.Background(), dequeuedJob.ID, consumerID)
+	err = mq.Conclude(context.Background(), dequeuedJob.ID, consumerID, nil)
 	require.Nil(t, err)
 }
 
@@ -116,9 +134,617 @@ func TestConclude_InvalidConsumer(t *testing.T) {
 	dequeuedJob, err := mq.Dequeue(context.Background(), consumerID)
 	require.Nil(t, err)
 
-	require.Equal(t, len(mq.queue), 0)
+	require.Equal(t, mq.queue.Len(), 0)
 	// check that dequeuedJob matches enqueued job
 
-	err = mq.Conclude(context.Background(), dequeuedJob.ID, "foo")
+	err = mq.Conclude(context.Background(), dequeuedJob.ID, "foo", nil)
+	require.Error(t, err)
+}
+
+func TestReapExpiredLeases(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	mq := NewInMemoryQueue(WithVisibilityTimeout(time.Minute))
+	mq.now = func() time.Time { return now }
+
+	// set up state
+	consumerID := "consumer-1"
+	job := domain.Job{
+		Type:   domain.JobTypeTimeCritical,
+		Status: domain.JobStatusQueued,
+	}
+
+	_, err := mq.Enqueue(context.Background(), job)
+	require.Nil(t, err)
+	_, err = mq.Enqueue(context.Background(), job)
+	require.Nil(t, err)
+
+	// check that the dequeued job is leased for the visibility timeout
+	dequeuedJob, err := mq.Dequeue(context.Background(), consumerID)
+	require.Nil(t, err)
+	require.Equal(t, now.Add(time.Minute), dequeuedJob.LeaseExpiresAt)
+
+	// check that nothing is reaped before the lease expires
+	now = now.Add(30 * time.Second)
+	reaped, err := mq.reapExpiredLeases()
+	require.Nil(t, err)
+	require.Equal(t, 0, reaped)
+
+	// check that the expired job is returned to the front of the queue
+	now = now.Add(30 * time.Second)
+	reaped, err = mq.reapExpiredLeases()
+	require.Nil(t, err)
+	require.Equal(t, 1, reaped)
+	require.Equal(t, []int{dequeuedJob.ID, 2}, mq.queue.ids())
+
+	reapedJob, err := mq.FetchJob(context.Background(), dequeuedJob.ID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusQueued, reapedJob.Status)
+	require.Equal(t, "", reapedJob.ConsumerID)
+
+	// check that the previous consumer can no longer conclude the job
+	err = mq.Conclude(context.Background(), dequeuedJob.ID, consumerID, nil)
 	require.Error(t, err)
+
+	// check that another consumer picks the job up
+	redeliveredJob, err := mq.Dequeue(context.Background(), "consumer-2")
+	require.Nil(t, err)
+	require.Equal(t, dequeuedJob.ID, redeliveredJob.ID)
+}
+
+func TestRunReaper_JournalFailure(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	mq := NewInMemoryQueue(WithVisibilityTimeout(time.Minute))
+	mq.now = func() time.Time { return now }
+
+	// set up state: a job with an expired lease, and a journal that fails
+	_, err := mq.Enqueue(context.Background(), domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+	require.Nil(t, err)
+	_, err = mq.Dequeue(context.Background(), "consumer-1")
+	require.Nil(t, err)
+
+	mq.journal = func(jobs []domain.Job) error {
+		return errors.New("disk full")
+	}
+	now = now.Add(time.Hour)
+
+	// check that the reaper logs the failure and stops
+	var logged bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		mq.RunReaper(context.Background(), time.Millisecond, zerolog.New(&logged))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reaper did not stop")
+	}
+	require.Contains(t, logged.String(), "disk full")
+}
+
+func TestHeartbeat(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	mq := NewInMemoryQueue(WithVisibilityTimeout(time.Minute))
+	mq.now = func() time.Time { return now }
+
+	// set up state
+	consumerID := "consumer-1"
+	job := domain.Job{
+		Type:   domain.JobTypeTimeCritical,
+		Status: domain.JobStatusQueued,
+	}
+
+	_, err := mq.Enqueue(context.Background(), job)
+	require.Nil(t, err)
+
+	dequeuedJob, err := mq.Dequeue(context.Background(), consumerID)
+	require.Nil(t, err)
+
+	// check that the lease is extended and progress is recorded
+	now = now.Add(50 * time.Second)
+	progress := 40
+	leasedJob, err := mq.Heartbeat(context.Background(), dequeuedJob.ID, consumerID, &progress)
+	require.Nil(t, err)
+	require.Equal(t, now.Add(time.Minute), leasedJob.LeaseExpiresAt)
+	require.Equal(t, 40, leasedJob.Progress)
+
+	// check that the extended lease is not reaped
+	now = now.Add(30 * time.Second)
+	reaped, err := mq.reapExpiredLeases()
+	require.Nil(t, err)
+	require.Equal(t, 0, reaped)
+
+	// check that progress is kept when none is reported
+	leasedJob, err = mq.Heartbeat(context.Background(), dequeuedJob.ID, consumerID, nil)
+	require.Nil(t, err)
+	require.Equal(t, 40, leasedJob.Progress)
+
+	// check that other consumers cannot extend the lease
+	_, err = mq.Heartbeat(context.Background(), dequeuedJob.ID, "foo", nil)
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+
+	// check that cancelled jobs cannot be extended
+	err = mq.CancelJob(context.Background(), dequeuedJob.ID)
+	require.Nil(t, err)
+	_, err = mq.Heartbeat(context.Background(), dequeuedJob.ID, consumerID, nil)
+	require.True(t, errors.Is(err, domain.ErrJobStatusTransitionNotAllowed{}))
+}
+
+func TestFail(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	mq := NewInMemoryQueue(WithRetryPolicy(RetryPolicy{
+		MaxAttempts:    2,
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Minute,
+		Multiplier:     2,
+	}))
+	mq.now = func() time.Time { return now }
+
+	// set up state
+	consumerID := "consumer-1"
+	job := domain.Job{
+		Type:   domain.JobTypeTimeCritical,
+		Status: domain.JobStatusQueued,
+	}
+
+	_, err := mq.Enqueue(context.Background(), job)
+	require.Nil(t, err)
+
+	dequeuedJob, err := mq.Dequeue(context.Background(), consumerID)
+	require.Nil(t, err)
+	require.Equal(t, 1, dequeuedJob.Attempts)
+
+	// check that the failed job is held back for the backoff
+	failedJob, err := mq.Fail(context.Background(), dequeuedJob.ID, consumerID, "boom")
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusScheduled, failedJob.Status)
+	require.Equal(t, "boom", failedJob.LastError)
+	require.Equal(t, now.Add(time.Second), failedJob.RunAt)
+
+	_, err = mq.Dequeue(context.Background(), consumerID)
+	require.Equal(t, domain.ErrQueueEmpty, err)
+
+	// check that the job is retried once the backoff has passed
+	now = now.Add(time.Second)
+	retriedJob, err := mq.Dequeue(context.Background(), consumerID)
+	require.Nil(t, err)
+	require.Equal(t, dequeuedJob.ID, retriedJob.ID)
+	require.Equal(t, 2, retriedJob.Attempts)
+
+	// check that the job fails for good once it runs out of attempts
+	failedJob, err = mq.Fail(context.Background(), retriedJob.ID, consumerID, "boom again")
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusFailed, failedJob.Status)
+	require.Equal(t, "boom again", failedJob.LastError)
+
+	_, err = mq.Dequeue(context.Background(), consumerID)
+	require.Equal(t, domain.ErrQueueEmpty, err)
+
+	// check that only in progress jobs can be failed
+	_, err = mq.Fail(context.Background(), retriedJob.ID, "", "")
+	require.True(t, errors.Is(err, domain.ErrJobStatusTransitionNotAllowed{}))
+}
+
+func TestFail_JobMaxAttempts(t *testing.T) {
+	mq := NewInMemoryQueue(WithJobTypeRetryPolicy(domain.JobTypeTimeCritical, RetryPolicy{MaxAttempts: 3}))
+
+	// set up state
+	consumerID := "consumer-1"
+	job := domain.Job{
+		Type:        domain.JobTypeTimeCritical,
+		Status:      domain.JobStatusQueued,
+		MaxAttempts: 1,
+	}
+
+	_, err := mq.Enqueue(context.Background(), job)
+	require.Nil(t, err)
+
+	dequeuedJob, err := mq.Dequeue(context.Background(), consumerID)
+	require.Nil(t, err)
+
+	// check that the job's max attempts overrides the type's policy
+	failedJob, err := mq.Fail(context.Background(), dequeuedJob.ID, consumerID, "boom")
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusFailed, failedJob.Status)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: time.Second,
+		MaxBackoff:     10 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.5,
+	}
+
+	// check that the backoff grows exponentially up to the max
+	require.Equal(t, time.Second, policy.Backoff(1, 0.5))
+	require.Equal(t, 2*time.Second, policy.Backoff(2, 0.5))
+	require.Equal(t, 8*time.Second, policy.Backoff(4, 0.5))
+	require.Equal(t, 10*time.Second, policy.Backoff(5, 0.5))
+
+	// check that jitter spreads the backoff
+	require.Equal(t, 500*time.Millisecond, policy.Backoff(1, 0))
+	require.Equal(t, 1250*time.Millisecond, policy.Backoff(1, 0.75))
+	require.Equal(t, 10*time.Second, policy.Backoff(5, 0.99))
+}
+
+func TestEnqueue_Priority(t *testing.T) {
+	mq := NewInMemoryQueue()
+
+	// set up state
+	consumerID := "consumer-1"
+	priorities := []int{0, 5, 0, 10, 5}
+	for _, priority := range priorities {
+		_, err := mq.Enqueue(context.Background(), domain.Job{
+			Type:     domain.JobTypeNotTimeCritical,
+			Status:   domain.JobStatusQueued,
+			Priority: priority,
+		})
+		require.Nil(t, err)
+	}
+
+	// check that jobs are dequeued by priority, and then in FIFO order
+	expected := []int{4, 2, 5, 1, 3}
+	for _, expectedID := range expected {
+		job, err := mq.Dequeue(context.Background(), consumerID)
+		require.Nil(t, err)
+		require.Equal(t, expectedID, job.ID)
+	}
+}
+
+// ids returns the queued job IDs in the order they are dequeued without
+// priority scheduling.
+func (r *readyQueue) ids() []int {
+	entries := make([]queueEntry, 0, r.Len())
+	entries = append(entries, r.timeCritical...)
+	entries = append(entries, r.notTimeCritical...)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].before(entries[j])
+	})
+
+	ids := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, entry.id)
+	}
+
+	return ids
+}
+
+func TestEnqueue_Scheduled(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	mq := NewInMemoryQueue()
+	mq.now = func() time.Time { return now }
+
+	// set up state
+	consumerID := "consumer-1"
+	runAts := []time.Time{now.Add(time.Hour), now.Add(time.Minute), now.Add(-time.Minute)}
+	for _, runAt := range runAts {
+		_, err := mq.Enqueue(context.Background(), domain.Job{
+			Type:   domain.JobTypeNotTimeCritical,
+			Status: domain.JobStatusQueued,
+			RunAt:  runAt,
+		})
+		require.Nil(t, err)
+	}
+
+	// check that jobs in the future are scheduled, and past jobs are queued
+	scheduledJob, err := mq.FetchJob(context.Background(), 1)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusScheduled, scheduledJob.Status)
+
+	queuedJob, err := mq.FetchJob(context.Background(), 3)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusQueued, queuedJob.Status)
+	require.True(t, queuedJob.RunAt.IsZero())
+
+	// check that scheduled jobs are invisible to dequeue until they are due
+	job, err := mq.Dequeue(context.Background(), consumerID)
+	require.Nil(t, err)
+	require.Equal(t, 3, job.ID)
+
+	_, err = mq.Dequeue(context.Background(), consumerID)
+	require.Equal(t, domain.ErrQueueEmpty, err)
+
+	// check that cancelled scheduled jobs are never queued
+	err = mq.CancelJob(context.Background(), 2)
+	require.Nil(t, err)
+
+	now = now.Add(time.Hour)
+	job, err = mq.Dequeue(context.Background(), consumerID)
+	require.Nil(t, err)
+	require.Equal(t, 1, job.ID)
+
+	_, err = mq.Dequeue(context.Background(), consumerID)
+	require.Equal(t, domain.ErrQueueEmpty, err)
+}
+
+func TestEnqueue_IdempotencyKeyExpires(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	mq := NewInMemoryQueue()
+	mq.now = func() time.Time { return now }
+
+	// set up state
+	job := domain.Job{
+		Type:                 domain.JobTypeTimeCritical,
+		Status:               domain.JobStatusQueued,
+		IdempotencyKey:       "order-42",
+		IdempotencyHash:      "hash-1",
+		IdempotencyExpiresAt: now.Add(time.Hour),
+	}
+	jobID, err := mq.Enqueue(context.Background(), job)
+	require.Nil(t, err)
+
+	// check that the key can be reused once it expired
+	now = now.Add(time.Hour)
+	job.IdempotencyHash = "hash-2"
+	job.IdempotencyExpiresAt = now.Add(time.Hour)
+	newJobID, err := mq.Enqueue(context.Background(), job)
+	require.Nil(t, err)
+	require.NotEqual(t, jobID, newJobID)
+
+	retriedID, err := mq.Enqueue(context.Background(), job)
+	require.Nil(t, err)
+	require.Equal(t, newJobID, retriedID)
+}
+
+func TestEvictIdempotencyKeys(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	mq := NewInMemoryQueue()
+	mq.now = func() time.Time { return now }
+
+	// set up state
+	for i, ttl := range []time.Duration{time.Minute, time.Hour} {
+		_, err := mq.Enqueue(context.Background(), domain.Job{
+			Type:                 domain.JobTypeTimeCritical,
+			Status:               domain.JobStatusQueued,
+			IdempotencyKey:       "order-" + strconv.Itoa(i),
+			IdempotencyHash:      "hash",
+			IdempotencyExpiresAt: now.Add(ttl),
+		})
+		require.Nil(t, err)
+	}
+
+	// check that only the expired key is forgotten
+	now = now.Add(time.Minute)
+	mq.evictIdempotencyKeys()
+	require.Equal(t, map[string]int{"order-1": 2}, mq.idempotencyKeys)
+}
+
+func TestJobAvailable(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	mq := NewInMemoryQueue()
+	mq.now = func() time.Time { return now }
+
+	isClosed := func(available <-chan struct{}) bool {
+		select {
+		case <-available:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// check that a scheduled job does not wake consumers until it is due
+	available := mq.JobAvailable()
+	_, err := mq.Enqueue(context.Background(), domain.Job{
+		Type:   domain.JobTypeTimeCritical,
+		Status: domain.JobStatusScheduled,
+		RunAt:  now.Add(time.Minute),
+	})
+	require.Nil(t, err)
+	require.False(t, isClosed(available))
+
+	now = now.Add(time.Minute)
+	_, err = mq.Dequeue(context.Background(), "consumer-1")
+	require.Nil(t, err)
+	require.True(t, isClosed(available))
+
+	// check that a queued job wakes consumers right away
+	available = mq.JobAvailable()
+	require.False(t, isClosed(available))
+
+	_, err = mq.Enqueue(context.Background(), domain.Job{
+		Type:   domain.JobTypeTimeCritical,
+		Status: domain.JobStatusQueued,
+	})
+	require.Nil(t, err)
+	require.True(t, isClosed(available))
+}
+
+func TestConclude_Payload(t *testing.T) {
+	mq := NewInMemoryQueue()
+
+	// set up state
+	consumerID := "consumer-1"
+	job := domain.Job{
+		Type:    domain.JobTypeTimeCritical,
+		Status:  domain.JobStatusQueued,
+		Payload: json.RawMessage(`{"customer":42}`),
+	}
+
+	_, err := mq.Enqueue(context.Background(), job)
+	require.Nil(t, err)
+
+	// check that the payload is handed to the consumer
+	dequeuedJob, err := mq.Dequeue(context.Background(), consumerID)
+	require.Nil(t, err)
+	require.Equal(t, job.Payload, dequeuedJob.Payload)
+
+	// check that the result is stored with the concluded job
+	result := json.RawMessage(`{"reindexed":true}`)
+	err = mq.Conclude(context.Background(), dequeuedJob.ID, consumerID, result)
+	require.Nil(t, err)
+
+	concludedJob, err := mq.FetchJob(context.Background(), dequeuedJob.ID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusConcluded, concludedJob.Status)
+	require.Equal(t, result, concludedJob.Result)
+}
+
+func TestStats(t *testing.T) {
+	mq := NewInMemoryQueue()
+
+	// set up state
+	for i := 0; i < 3; i++ {
+		_, err := mq.Enqueue(context.Background(), domain.Job{
+			Type:   domain.JobTypeTimeCritical,
+			Status: domain.JobStatusQueued,
+		})
+		require.Nil(t, err)
+	}
+
+	_, err := mq.Dequeue(context.Background(), "consumer-1")
+	require.Nil(t, err)
+
+	// check that jobs are counted by status
+	stats, err := mq.Stats(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 3, stats.Total)
+	require.Equal(t, map[string]int{
+		domain.JobStatusQueued:     2,
+		domain.JobStatusInProgress: 1,
+	}, stats.Statuses)
+}
+
+func TestEnqueueBatch_Journal(t *testing.T) {
+	ctx := context.Background()
+	mq := NewInMemoryQueue()
+
+	records := 0
+	var journalErr error
+	mq.journal = func(jobs []domain.Job) error {
+		records++
+		return journalErr
+	}
+
+	newJobs := func() []domain.Job {
+		return []domain.Job{
+			{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued, UniqueKey: "import-1"},
+			{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued},
+		}
+	}
+
+	// check that a batch is journaled at once
+	ids, errs := mq.EnqueueBatch(ctx, newJobs())
+	require.Equal(t, []error{nil, nil}, errs)
+	require.Equal(t, 1, records)
+
+	// check that nothing is added when the journal fails, including the
+	// jobs the batch replaced
+	journalErr = errors.New("disk full")
+	job := newJobs()[0]
+	job.UniquePolicy = domain.UniquePolicyReplace
+	failedIDs, errs := mq.EnqueueBatch(ctx, []domain.Job{job, newJobs()[1]})
+	require.Equal(t, []int{0, 0}, failedIDs)
+	require.Equal(t, []error{journalErr, journalErr}, errs)
+
+	stats, err := mq.Stats(ctx)
+	require.Nil(t, err)
+	require.Equal(t, map[string]int{domain.JobStatusQueued: 2}, stats.Statuses)
+
+	// check that the queue is intact once the journal recovers
+	journalErr = nil
+	for _, want := range ids {
+		dequeuedJob, err := mq.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+		require.Equal(t, want, dequeuedJob.ID)
+	}
+
+	_, err = mq.Dequeue(ctx, "consumer-1")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+
+	id, err := mq.Enqueue(ctx, newJobs()[1])
+	require.Nil(t, err)
+	require.Equal(t, ids[1]+1, id)
+}
+
+func TestJobIndex(t *testing.T) {
+	// set up state
+	index := make(jobIndex)
+	for _, id := range []int{5, 1, 3, 9, 3} {
+		index.add(domain.JobStatusQueued, id)
+	}
+	index.add("", 7)
+
+	// check that the IDs are kept in order without duplicates
+	require.Equal(t, []int{1, 3, 5, 9}, index[domain.JobStatusQueued])
+	require.Len(t, index, 1)
+
+	index.remove(domain.JobStatusQueued, 3)
+	index.remove(domain.JobStatusQueued, 4)
+	require.Equal(t, []int{1, 5, 9}, index[domain.JobStatusQueued])
+
+	// check that a value without jobs is dropped
+	for _, id := range []int{1, 5, 9} {
+		index.remove(domain.JobStatusQueued, id)
+	}
+	require.Len(t, index, 0)
+}
+
+func TestCancelJobs(t *testing.T) {
+	ctx := context.Background()
+	mq := NewInMemoryQueue()
+
+	// set up state
+	ids := make([]int, 0)
+	for _, jobType := range []string{domain.JobTypeTimeCritical, domain.JobTypeNotTimeCritical, domain.JobTypeTimeCritical} {
+		id, err := mq.Enqueue(ctx, domain.Job{Type: jobType, Status: domain.JobStatusQueued})
+		require.Nil(t, err)
+		ids = append(ids, id)
+	}
+
+	dequeuedJob, err := mq.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Nil(t, mq.Conclude(ctx, dequeuedJob.ID, "consumer-1", nil))
+
+	// check that only the active jobs selected by the filter are cancelled
+	count, err := mq.CancelJobs(ctx, domain.JobFilter{Type: domain.JobTypeTimeCritical})
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	jobs, err := mq.ListJobs(ctx, domain.JobFilter{Status: domain.JobStatusCancelled})
+	require.Nil(t, err)
+	require.Len(t, jobs, 1)
+	require.Equal(t, ids[2], jobs[0].ID)
+
+	// check that the cancelled job is no longer dequeued
+	dequeuedJob, err = mq.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Equal(t, ids[1], dequeuedJob.ID)
+
+	_, err = mq.Dequeue(ctx, "consumer-1")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+}
+
+func TestRequeueJobs(t *testing.T) {
+	ctx := context.Background()
+	mq := NewInMemoryQueue()
+
+	// set up state, with jobs held by two consumers
+	for i := 0; i < 3; i++ {
+		_, err := mq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+		require.Nil(t, err)
+	}
+
+	for _, consumerID := range []string{"consumer-1", "consumer-2", "consumer-1"} {
+		_, err := mq.Dequeue(ctx, consumerID)
+		require.Nil(t, err)
+	}
+
+	// check that the jobs of the consumer are requeued at once
+	count, err := mq.RequeueJobs(ctx, domain.JobFilter{ConsumerID: "consumer-1"})
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+
+	stats, err := mq.Stats(ctx)
+	require.Nil(t, err)
+	require.Equal(t, map[string]int{
+		domain.JobStatusQueued:     2,
+		domain.JobStatusInProgress: 1,
+	}, stats.Statuses)
+
+	jobs, err := mq.ListJobs(ctx, domain.JobFilter{ConsumerID: "consumer-1"})
+	require.Nil(t, err)
+	require.Len(t, jobs, 0)
 }
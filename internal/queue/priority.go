@@ -0,0 +1,82 @@
+package queue
+
+import (
+	"container/heap"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+// DefaultTimeCriticalRatio is the number of time critical jobs served in a row
+// before a waiting job that is not time critical gets a turn.
+const DefaultTimeCriticalRatio = 10
+
+// WithPriorityScheduling makes Dequeue serve time critical jobs ahead of jobs
+// that are not time critical. To keep the lower class from starving, a job
+// that is not time critical is served after every ratio time critical jobs
+// while both classes are waiting.
+func WithPriorityScheduling(ratio int) Option {
+	return func(c *config) {
+		if ratio < 1 {
+			ratio = DefaultTimeCriticalRatio
+		}
+
+		c.prioritize = true
+		c.timeCriticalRatio = ratio
+	}
+}
+
+// popNext removes the next job to dequeue from the ready queue and returns its
+// ID. Entries for jobs that are no longer queued, e.g. because they were
+// cancelled, are dropped along the way. The caller must hold the write lock.
+func (q *InMemoryQueue) popNext() (int, bool) {
+	q.dropStale(&q.queue.timeCritical)
+	q.dropStale(&q.queue.notTimeCritical)
+
+	next := q.nextHeap()
+	if next == nil {
+		return 0, false
+	}
+
+	return heap.Pop(next).(queueEntry).id, true
+}
+
+// dropStale pops entries off the heap until its root is a queued job.
+func (q *InMemoryQueue) dropStale(h *jobHeap) {
+	for h.Len() > 0 {
+		job, ok := q.jobs[(*h)[0].id]
+		if ok && job.Status == domain.JobStatusQueued {
+			return
+		}
+
+		heap.Pop(h)
+	}
+}
+
+// nextHeap returns the heap holding the next job to dequeue, or nil if both
+// heaps are empty. Without priority scheduling the job with the highest
+// priority is served regardless of its type.
+func (q *InMemoryQueue) nextHeap() *jobHeap {
+	timeCritical, notTimeCritical := &q.queue.timeCritical, &q.queue.notTimeCritical
+
+	switch {
+	case timeCritical.Len() == 0 && notTimeCritical.Len() == 0:
+		return nil
+	case notTimeCritical.Len() == 0:
+		q.timeCriticalStreak = 0
+		return timeCritical
+	case timeCritical.Len() == 0:
+		q.timeCriticalStreak = 0
+		return notTimeCritical
+	case !q.prioritize:
+		if (*timeCritical)[0].before((*notTimeCritical)[0]) {
+			return timeCritical
+		}
+		return notTimeCritical
+	case q.timeCriticalStreak >= q.timeCriticalRatio:
+		q.timeCriticalStreak = 0
+		return notTimeCritical
+	default:
+		q.timeCriticalStreak++
+		return timeCritical
+	}
+}
@@ -0,0 +1,99 @@
+package queue
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+func TestPriorityScheduling(t *testing.T) {
+	mq := NewInMemoryQueue(WithPriorityScheduling(2))
+
+	// set up state, a backlog of jobs that are not time critical followed by
+	// time critical jobs
+	consumerID := "consumer-1"
+	jobTypes := []string{
+		domain.JobTypeNotTimeCritical,
+		domain.JobTypeNotTimeCritical,
+		domain.JobTypeTimeCritical,
+		domain.JobTypeTimeCritical,
+		domain.JobTypeTimeCritical,
+		domain.JobTypeTimeCritical,
+	}
+	for _, jobType := range jobTypes {
+		_, err := mq.Enqueue(context.Background(), domain.Job{
+			Type:   jobType,
+			Status: domain.JobStatusQueued,
+		})
+		require.Nil(t, err)
+	}
+
+	// check that time critical jobs are served first, with the lower class
+	// served after every two time critical jobs
+	expected := []int{3, 4, 1, 5, 6, 2}
+	for _, expectedID := range expected {
+		job, err := mq.Dequeue(context.Background(), consumerID)
+		require.Nil(t, err)
+		require.Equal(t, expectedID, job.ID)
+	}
+
+	_, err := mq.Dequeue(context.Background(), consumerID)
+	require.Equal(t, domain.ErrQueueEmpty, err)
+}
+
+func TestPriorityScheduling_DequeueBatch(t *testing.T) {
+	mq := NewInMemoryQueue(WithPriorityScheduling(2))
+
+	// set up state
+	jobTypes := []string{
+		domain.JobTypeNotTimeCritical,
+		domain.JobTypeTimeCritical,
+		domain.JobTypeTimeCritical,
+		domain.JobTypeTimeCritical,
+	}
+	for _, jobType := range jobTypes {
+		_, err := mq.Enqueue(context.Background(), domain.Job{
+			Type:   jobType,
+			Status: domain.JobStatusQueued,
+		})
+		require.Nil(t, err)
+	}
+
+	// check that a batch interleaves job types like single dequeues do
+	jobs, err := mq.DequeueBatch(context.Background(), "consumer-1", 4)
+	require.Nil(t, err)
+
+	ids := make([]int, 0, len(jobs))
+	for _, job := range jobs {
+		ids = append(ids, job.ID)
+	}
+	require.Equal(t, []int{2, 3, 1, 4}, ids)
+}
+
+func TestPriorityScheduling_SkipsStaleJobs(t *testing.T) {
+	mq := NewInMemoryQueue(WithPriorityScheduling(1))
+
+	// set up state
+	consumerID := "consumer-1"
+	for _, jobType := range []string{domain.JobTypeNotTimeCritical, domain.JobTypeTimeCritical} {
+		_, err := mq.Enqueue(context.Background(), domain.Job{
+			Type:   jobType,
+			Status: domain.JobStatusQueued,
+		})
+		require.Nil(t, err)
+	}
+
+	// check that cancelled time critical jobs do not hold up the queue
+	err := mq.CancelJob(context.Background(), 2)
+	require.Nil(t, err)
+
+	job, err := mq.Dequeue(context.Background(), consumerID)
+	require.Nil(t, err)
+	require.Equal(t, 1, job.ID)
+
+	_, err = mq.Dequeue(context.Background(), consumerID)
+	require.Equal(t, domain.ErrQueueEmpty, err)
+}
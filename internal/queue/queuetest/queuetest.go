@@ -0,0 +1,1067 @@
+// Package queuetest provides a conformance test suite for job queue
+// implementations. Every storage backend runs it, so producers and consumers
+// see the same behavior whichever backend the service is configured with.
+package queuetest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/handler"
+)
+
+// unknownJobID is a job ID that no queue under test hands out.
+const unknownJobID = 1 << 30
+
+// Factory returns an empty job queue for a test. Queues returned by different
+// calls must not share jobs.
+type Factory func(t *testing.T) handler.JobQueuer
+
+// Run runs the conformance suite against the queues returned by newQueue. Every
+// test runs as a subtest with a queue of its own.
+func Run(t *testing.T, newQueue Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, q handler.JobQueuer)
+	}{
+		{"EnqueueDequeue", testEnqueueDequeue},
+		{"EnqueueBatch", testEnqueueBatch},
+		{"FIFO", testFIFO},
+		{"DequeueBatch", testDequeueBatch},
+		{"Priority", testPriority},
+		{"Scheduled", testScheduled},
+		{"Conclude", testConclude},
+		{"Cancel", testCancel},
+		{"Heartbeat", testHeartbeat},
+		{"Fail", testFail},
+		{"NotFound", testNotFound},
+		{"ConcurrentDequeue", testConcurrentDequeue},
+		{"Idempotency", testIdempotency},
+		{"UniqueKey", testUniqueKey},
+		{"IdempotentMerge", testIdempotentMerge},
+		{"Dependencies", testDependencies},
+		{"Workflow", testWorkflow},
+		{"Batch", testBatch},
+		{"ListJobs", testListJobs},
+		{"Requeue", testRequeue},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newQueue(t))
+		})
+	}
+}
+
+// enqueue adds a queued job of the given type and priority, and returns its ID.
+func enqueue(t *testing.T, q handler.JobQueuer, jobType string, priority int) int {
+	id, err := q.Enqueue(context.Background(), domain.Job{
+		Type:     jobType,
+		Status:   domain.JobStatusQueued,
+		Priority: priority,
+	})
+	require.Nil(t, err)
+
+	return id
+}
+
+func testEnqueueDequeue(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	// set up state
+	payload := json.RawMessage(`{"customer":42}`)
+	jobID, err := q.Enqueue(ctx, domain.Job{
+		Type:    domain.JobTypeTimeCritical,
+		Status:  domain.JobStatusQueued,
+		Payload: payload,
+	})
+	require.Nil(t, err)
+
+	queuedJob, err := q.FetchJob(ctx, jobID)
+	require.Nil(t, err)
+	require.Equal(t, jobID, queuedJob.ID)
+	require.Equal(t, domain.JobStatusQueued, queuedJob.Status)
+	require.Equal(t, domain.JobTypeTimeCritical, queuedJob.Type)
+
+	// check that the dequeued job is leased to the consumer
+	start := time.Now()
+	job, err := q.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Equal(t, jobID, job.ID)
+	require.Equal(t, domain.JobStatusInProgress, job.Status)
+	require.Equal(t, "consumer-1", job.ConsumerID)
+	require.Equal(t, 1, job.Attempts)
+	require.True(t, job.LeaseExpiresAt.After(start))
+	require.JSONEq(t, string(payload), string(job.Payload))
+
+	// check that a leased job is not handed out again
+	_, err = q.Dequeue(ctx, "consumer-2")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+
+	fetchedJob, err := q.FetchJob(ctx, jobID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusInProgress, fetchedJob.Status)
+	require.Equal(t, "consumer-1", fetchedJob.ConsumerID)
+}
+
+func testEnqueueBatch(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	// set up state, with a job that cannot be enqueued between two that can,
+	// and a job that depends on a job enqueued before the batch
+	parentID := enqueue(t, q, domain.JobTypeNotTimeCritical, -5)
+	jobs := []domain.Job{
+		{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued, UniqueKey: "import-1"},
+		{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued, UniqueKey: "import-1"},
+		{Type: domain.JobTypeNotTimeCritical, Status: domain.JobStatusQueued, Priority: 5},
+		{Type: domain.JobTypeNotTimeCritical, Status: domain.JobStatusQueued, DependsOn: []int{parentID}},
+	}
+
+	// check that every job gets its own outcome, in the order they were given
+	ids, errs := q.EnqueueBatch(ctx, jobs)
+	require.Len(t, ids, 4)
+	require.Len(t, errs, 4)
+	require.Nil(t, errs[0])
+	require.True(t, errors.Is(errs[1], domain.ErrDuplicateJob{}))
+	require.Nil(t, errs[2])
+	require.Nil(t, errs[3])
+
+	blockedJob, err := q.FetchJob(ctx, ids[3])
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusBlocked, blockedJob.Status)
+
+	// check that the jobs that were enqueued are dequeued as usual
+	for _, want := range []int{ids[2], ids[0], parentID} {
+		dequeuedJob, err := q.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+		require.Equal(t, want, dequeuedJob.ID)
+	}
+
+	_, err = q.Dequeue(ctx, "consumer-1")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+}
+
+func testFIFO(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	// set up state
+	ids := make([]int, 0)
+	for i := 0; i < 5; i++ {
+		ids = append(ids, enqueue(t, q, domain.JobTypeNotTimeCritical, 0))
+	}
+
+	// check that jobs of the same priority are served in the order they were
+	// enqueued
+	for _, want := range ids {
+		job, err := q.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+		require.Equal(t, want, job.ID)
+	}
+
+	_, err := q.Dequeue(ctx, "consumer-1")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+}
+
+func testDequeueBatch(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	// set up state
+	lowID := enqueue(t, q, domain.JobTypeTimeCritical, 0)
+	highID := enqueue(t, q, domain.JobTypeNotTimeCritical, 5)
+	nextID := enqueue(t, q, domain.JobTypeTimeCritical, 0)
+
+	// check that a batch is claimed in the order jobs are dequeued one by one
+	dequeuedJobs, err := q.DequeueBatch(ctx, "consumer-1", 2)
+	require.Nil(t, err)
+	require.Len(t, dequeuedJobs, 2)
+	require.Equal(t, highID, dequeuedJobs[0].ID)
+	require.Equal(t, lowID, dequeuedJobs[1].ID)
+
+	for _, dequeuedJob := range dequeuedJobs {
+		require.Equal(t, domain.JobStatusInProgress, dequeuedJob.Status)
+		require.Equal(t, "consumer-1", dequeuedJob.ConsumerID)
+		require.Equal(t, 1, dequeuedJob.Attempts)
+		require.False(t, dequeuedJob.LeaseExpiresAt.IsZero())
+	}
+
+	// check that a batch can be smaller than asked for, and that nothing is
+	// claimed from an empty queue
+	dequeuedJobs, err = q.DequeueBatch(ctx, "consumer-2", 5)
+	require.Nil(t, err)
+	require.Len(t, dequeuedJobs, 1)
+	require.Equal(t, nextID, dequeuedJobs[0].ID)
+
+	_, err = q.DequeueBatch(ctx, "consumer-2", 5)
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+
+	// check that the claimed jobs are held by their consumer
+	fetchedJob, err := q.FetchJob(ctx, lowID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusInProgress, fetchedJob.Status)
+	require.Equal(t, "consumer-1", fetchedJob.ConsumerID)
+}
+
+func testPriority(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	// set up state
+	low := enqueue(t, q, domain.JobTypeTimeCritical, 0)
+	high := enqueue(t, q, domain.JobTypeTimeCritical, 10)
+	medium := enqueue(t, q, domain.JobTypeTimeCritical, 5)
+	otherMedium := enqueue(t, q, domain.JobTypeTimeCritical, 5)
+
+	// check that jobs are served by priority, and then in order
+	for _, want := range []int{high, medium, otherMedium, low} {
+		job, err := q.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+		require.Equal(t, want, job.ID)
+	}
+}
+
+func testScheduled(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	// set up state
+	scheduledID, err := q.Enqueue(ctx, domain.Job{
+		Type:   domain.JobTypeTimeCritical,
+		Status: domain.JobStatusScheduled,
+		RunAt:  time.Now().Add(time.Hour),
+	})
+	require.Nil(t, err)
+
+	scheduledJob, err := q.FetchJob(ctx, scheduledID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusScheduled, scheduledJob.Status)
+
+	// check that jobs that are due are served, and jobs that are not stay
+	// invisible
+	dueID, err := q.Enqueue(ctx, domain.Job{
+		Type:   domain.JobTypeTimeCritical,
+		Status: domain.JobStatusQueued,
+		RunAt:  time.Now().Add(-time.Minute),
+	})
+	require.Nil(t, err)
+
+	job, err := q.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Equal(t, dueID, job.ID)
+
+	_, err = q.Dequeue(ctx, "consumer-1")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+}
+
+func testConclude(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	// set up state
+	jobID := enqueue(t, q, domain.JobTypeTimeCritical, 0)
+
+	_, err := q.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+
+	// check that only the consumer holding the job can conclude it
+	err = q.Conclude(ctx, jobID, "consumer-2", nil)
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+
+	fetchedJob, err := q.FetchJob(ctx, jobID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusInProgress, fetchedJob.Status)
+
+	result := json.RawMessage(`{"sent":true}`)
+	require.Nil(t, q.Conclude(ctx, jobID, "consumer-1", result))
+
+	concludedJob, err := q.FetchJob(ctx, jobID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusConcluded, concludedJob.Status)
+	require.JSONEq(t, string(result), string(concludedJob.Result))
+
+	// check that a concluded job is not handed out again
+	_, err = q.Dequeue(ctx, "consumer-1")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+}
+
+func testCancel(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	// set up state
+	queuedID := enqueue(t, q, domain.JobTypeTimeCritical, 0)
+	leasedID := enqueue(t, q, domain.JobTypeTimeCritical, 0)
+	concludedID := enqueue(t, q, domain.JobTypeTimeCritical, 0)
+
+	// check that a queued job is cancelled, and never dequeued
+	require.Nil(t, q.CancelJob(ctx, queuedID))
+
+	cancelledJob, err := q.FetchJob(ctx, queuedID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusCancelled, cancelledJob.Status)
+
+	job, err := q.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Equal(t, leasedID, job.ID)
+
+	job, err = q.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Equal(t, concludedID, job.ID)
+	require.Nil(t, q.Conclude(ctx, concludedID, "consumer-1", nil))
+
+	// check that an in progress job can be cancelled
+	require.Nil(t, q.CancelJob(ctx, leasedID))
+
+	cancelledJob, err = q.FetchJob(ctx, leasedID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusCancelled, cancelledJob.Status)
+
+	// check that a concluded job cannot be cancelled
+	err = q.CancelJob(ctx, concludedID)
+	require.True(t, errors.Is(err, domain.ErrJobStatusTransitionNotAllowed{}))
+
+	concludedJob, err := q.FetchJob(ctx, concludedID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusConcluded, concludedJob.Status)
+
+	_, err = q.Dequeue(ctx, "consumer-1")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+}
+
+func testHeartbeat(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	// set up state
+	jobID := enqueue(t, q, domain.JobTypeTimeCritical, 0)
+
+	leasedJob, err := q.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+
+	// check that only the consumer holding the job can extend its lease
+	_, err = q.Heartbeat(ctx, jobID, "consumer-2", nil)
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+
+	progress := 40
+	job, err := q.Heartbeat(ctx, jobID, "consumer-1", &progress)
+	require.Nil(t, err)
+	require.Equal(t, 40, job.Progress)
+	require.False(t, job.LeaseExpiresAt.Before(leasedJob.LeaseExpiresAt))
+
+	// check that the lease of a concluded job cannot be extended
+	require.Nil(t, q.Conclude(ctx, jobID, "consumer-1", nil))
+
+	_, err = q.Heartbeat(ctx, jobID, "consumer-1", nil)
+	require.True(t, errors.Is(err, domain.ErrJobStatusTransitionNotAllowed{}))
+}
+
+func testFail(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	// set up state
+	retriedID := enqueue(t, q, domain.JobTypeTimeCritical, 0)
+	finalID, err := q.Enqueue(ctx, domain.Job{
+		Type:        domain.JobTypeTimeCritical,
+		Status:      domain.JobStatusQueued,
+		MaxAttempts: 1,
+	})
+	require.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err := q.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+	}
+
+	// check that only the consumer holding the job can fail it
+	_, err = q.Fail(ctx, retriedID, "consumer-2", "boom")
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+
+	// check that a job with attempts left is retried after a backoff
+	retriedJob, err := q.Fail(ctx, retriedID, "consumer-1", "boom")
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusScheduled, retriedJob.Status)
+	require.Equal(t, "boom", retriedJob.LastError)
+	require.Empty(t, retriedJob.ConsumerID)
+	require.False(t, retriedJob.RunAt.IsZero())
+	require.Len(t, retriedJob.Failures, 1)
+	require.Equal(t, 1, retriedJob.Failures[0].Attempt)
+	require.Equal(t, "consumer-1", retriedJob.Failures[0].ConsumerID)
+
+	// check that a job without attempts left is dead-lettered
+	failedJob, err := q.Fail(ctx, finalID, "consumer-1", "boom")
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusFailed, failedJob.Status)
+
+	fetchedJob, err := q.FetchJob(ctx, finalID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusFailed, fetchedJob.Status)
+
+	// check that neither job is handed out while it waits
+	_, err = q.Dequeue(ctx, "consumer-1")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+}
+
+func testNotFound(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	// check that every operation on an unknown job fails with ErrJobNotFound
+	_, err := q.FetchJob(ctx, unknownJobID)
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+
+	err = q.Conclude(ctx, unknownJobID, "consumer-1", nil)
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+
+	err = q.CancelJob(ctx, unknownJobID)
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+
+	_, err = q.Heartbeat(ctx, unknownJobID, "consumer-1", nil)
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+
+	_, err = q.Fail(ctx, unknownJobID, "consumer-1", "boom")
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+
+	// check that an empty queue fails with ErrQueueEmpty
+	_, err = q.Dequeue(ctx, "consumer-1")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+}
+
+func testConcurrentDequeue(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	// set up state
+	const jobCount = 20
+	for i := 0; i < jobCount; i++ {
+		enqueue(t, q, domain.JobTypeTimeCritical, 0)
+	}
+
+	// check that every job is delivered to exactly one consumer
+	var lock sync.Mutex
+	claimed := make(map[int][]string)
+	errs := make([]error, 0)
+
+	var wg sync.WaitGroup
+	for c := 0; c < 4; c++ {
+		consumerID := "consumer-" + strconv.Itoa(c)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				job, err := q.Dequeue(ctx, consumerID)
+
+				lock.Lock()
+				if err == nil {
+					claimed[job.ID] = append(claimed[job.ID], consumerID)
+				} else if !errors.Is(err, domain.ErrQueueEmpty) {
+					errs = append(errs, err)
+				}
+				lock.Unlock()
+
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Empty(t, errs)
+	require.Len(t, claimed, jobCount)
+	for id, consumers := range claimed {
+		require.Len(t, consumers, 1, "job %d delivered to %v", id, consumers)
+	}
+}
+
+func testIdempotency(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	// set up state
+	job := domain.Job{
+		Type:                 domain.JobTypeTimeCritical,
+		Status:               domain.JobStatusQueued,
+		IdempotencyKey:       "order-42",
+		IdempotencyHash:      "hash-1",
+		IdempotencyExpiresAt: time.Now().Add(time.Hour),
+	}
+	jobID, err := q.Enqueue(ctx, job)
+	require.Nil(t, err)
+
+	// check that a retried request returns the job enqueued the first time
+	retriedID, err := q.Enqueue(ctx, job)
+	require.Nil(t, err)
+	require.Equal(t, jobID, retriedID)
+
+	// check that a different request cannot reuse the key
+	reused := job
+	reused.IdempotencyHash = "hash-2"
+	_, err = q.Enqueue(ctx, reused)
+	require.True(t, errors.Is(err, domain.ErrIdempotencyKeyReused{}))
+
+	// check that a different key enqueues a new job
+	other := job
+	other.IdempotencyKey = "order-43"
+	otherID, err := q.Enqueue(ctx, other)
+	require.Nil(t, err)
+	require.NotEqual(t, jobID, otherID)
+
+	// check that the retries did not enqueue more jobs
+	for _, want := range []int{jobID, otherID} {
+		dequeuedJob, err := q.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+		require.Equal(t, want, dequeuedJob.ID)
+	}
+
+	_, err = q.Dequeue(ctx, "consumer-1")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+}
+
+func testUniqueKey(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	// set up state
+	enqueueUnique := func(policy string) (int, error) {
+		return q.Enqueue(ctx, domain.Job{
+			Type:         domain.JobTypeTimeCritical,
+			Status:       domain.JobStatusQueued,
+			UniqueKey:    "reindex-customer-42",
+			UniquePolicy: policy,
+		})
+	}
+
+	jobID, err := enqueueUnique(domain.UniquePolicyReject)
+	require.Nil(t, err)
+
+	// check that another job with the key is rejected or merged
+	_, err = enqueueUnique(domain.UniquePolicyReject)
+	require.True(t, errors.Is(err, domain.ErrDuplicateJob{}))
+
+	mergedID, err := enqueueUnique(domain.UniquePolicyMerge)
+	require.Nil(t, err)
+	require.Equal(t, jobID, mergedID)
+
+	// check that a job that has not started is replaced
+	replacingID, err := enqueueUnique(domain.UniquePolicyReplace)
+	require.Nil(t, err)
+	require.NotEqual(t, jobID, replacingID)
+
+	replacedJob, err := q.FetchJob(ctx, jobID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusCancelled, replacedJob.Status)
+
+	// check that a job in progress is not replaced
+	dequeuedJob, err := q.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Equal(t, replacingID, dequeuedJob.ID)
+	require.Equal(t, "reindex-customer-42", dequeuedJob.UniqueKey)
+
+	_, err = enqueueUnique(domain.UniquePolicyReplace)
+	require.True(t, errors.Is(err, domain.ErrDuplicateJob{}))
+
+	// check that the key is free once the job concluded
+	require.Nil(t, q.Conclude(ctx, replacingID, "consumer-1", nil))
+
+	newID, err := enqueueUnique(domain.UniquePolicyReject)
+	require.Nil(t, err)
+	require.NotEqual(t, replacingID, newID)
+}
+
+func testIdempotentMerge(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	// set up state
+	activeID, err := q.Enqueue(ctx, domain.Job{
+		Type:      domain.JobTypeTimeCritical,
+		Status:    domain.JobStatusQueued,
+		UniqueKey: "reindex-customer-42",
+	})
+	require.Nil(t, err)
+
+	job := domain.Job{
+		Type:                 domain.JobTypeTimeCritical,
+		Status:               domain.JobStatusQueued,
+		UniqueKey:            "reindex-customer-42",
+		UniquePolicy:         domain.UniquePolicyMerge,
+		IdempotencyKey:       "order-42",
+		IdempotencyHash:      "hash-1",
+		IdempotencyExpiresAt: time.Now().Add(time.Hour),
+	}
+
+	// check that a job merged into the active job, and its retries, get the
+	// active job
+	for i := 0; i < 2; i++ {
+		mergedID, err := q.Enqueue(ctx, job)
+		require.Nil(t, err)
+		require.Equal(t, activeID, mergedID)
+	}
+
+	// check that a retry once the active job concluded enqueues the job
+	dequeuedJob, err := q.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Equal(t, activeID, dequeuedJob.ID)
+	require.Nil(t, q.Conclude(ctx, activeID, "consumer-1", nil))
+
+	jobID, err := q.Enqueue(ctx, job)
+	require.Nil(t, err)
+	require.NotEqual(t, activeID, jobID)
+
+	retriedID, err := q.Enqueue(ctx, job)
+	require.Nil(t, err)
+	require.Equal(t, jobID, retriedID)
+
+	enqueuedJob, err := q.FetchJob(ctx, jobID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusQueued, enqueuedJob.Status)
+}
+
+func testDependencies(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	// set up state
+	enqueueDependent := func(policy string, parents ...int) int {
+		id, err := q.Enqueue(ctx, domain.Job{
+			Type:             domain.JobTypeTimeCritical,
+			Status:           domain.JobStatusQueued,
+			DependsOn:        parents,
+			DependencyPolicy: policy,
+		})
+		require.Nil(t, err)
+		return id
+	}
+
+	firstID := enqueue(t, q, domain.JobTypeTimeCritical, 0)
+	secondID := enqueue(t, q, domain.JobTypeTimeCritical, 0)
+	dependentID := enqueueDependent("", firstID, secondID)
+
+	// check that a job cannot depend on an unknown job
+	_, err := q.Enqueue(ctx, domain.Job{
+		Type:      domain.JobTypeTimeCritical,
+		Status:    domain.JobStatusQueued,
+		DependsOn: []int{unknownJobID},
+	})
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+
+	// check that the dependent job is blocked until both jobs concluded
+	dependentJob, err := q.FetchJob(ctx, dependentID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusBlocked, dependentJob.Status)
+	require.Equal(t, []int{firstID, secondID}, dependentJob.DependsOn)
+
+	for _, want := range []int{firstID, secondID} {
+		dequeuedJob, err := q.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+		require.Equal(t, want, dequeuedJob.ID)
+	}
+
+	_, err = q.Dequeue(ctx, "consumer-1")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+
+	require.Nil(t, q.Conclude(ctx, firstID, "consumer-1", nil))
+
+	dependentJob, err = q.FetchJob(ctx, dependentID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusBlocked, dependentJob.Status)
+
+	require.Nil(t, q.Conclude(ctx, secondID, "consumer-1", nil))
+
+	dequeuedJob, err := q.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Equal(t, dependentID, dequeuedJob.ID)
+
+	// check that a job depending on a concluded job is queued right away
+	queuedID := enqueueDependent("", firstID)
+
+	queuedJob, err := q.FetchJob(ctx, queuedID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusQueued, queuedJob.Status)
+
+	// check that cancelling a job cancels its dependents in turn, unless
+	// they are kept blocked
+	parentID := enqueue(t, q, domain.JobTypeTimeCritical, 0)
+	childID := enqueueDependent(domain.DependencyPolicyCancel, parentID)
+	grandchildID := enqueueDependent(domain.DependencyPolicyCancel, childID)
+	keptID := enqueueDependent(domain.DependencyPolicyBlock, parentID)
+
+	require.Nil(t, q.CancelJob(ctx, parentID))
+
+	for id, want := range map[int]string{
+		childID:      domain.JobStatusCancelled,
+		grandchildID: domain.JobStatusCancelled,
+		keptID:       domain.JobStatusBlocked,
+	} {
+		fetchedJob, err := q.FetchJob(ctx, id)
+		require.Nil(t, err)
+		require.Equal(t, want, fetchedJob.Status)
+	}
+}
+
+func testWorkflow(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	workflows, ok := q.(handler.WorkflowQueuer)
+	require.True(t, ok)
+
+	newJob := func(workflowID string) domain.Job {
+		return domain.Job{
+			Type:       domain.JobTypeTimeCritical,
+			Status:     domain.JobStatusQueued,
+			WorkflowID: workflowID,
+		}
+	}
+
+	// set up state
+	ids, err := workflows.EnqueueWorkflow(ctx, []domain.WorkflowJob{
+		{Job: newJob("workflow-1")},
+		{Job: newJob("workflow-1"), Parents: []int{0}},
+	})
+	require.Nil(t, err)
+	require.Len(t, ids, 2)
+	firstID, secondID := ids[0], ids[1]
+
+	enqueue(t, q, domain.JobTypeTimeCritical, 0)
+
+	// check that the jobs of the workflow are listed in the order they were
+	// enqueued
+	jobs, err := workflows.ListWorkflowJobs(ctx, "workflow-1")
+	require.Nil(t, err)
+	require.Len(t, jobs, 2)
+	require.Equal(t, firstID, jobs[0].ID)
+	require.Equal(t, secondID, jobs[1].ID)
+	require.Equal(t, []int{firstID}, jobs[1].DependsOn)
+	require.Equal(t, domain.JobStatusBlocked, jobs[1].Status)
+	require.Equal(t, domain.JobStatusQueued, domain.WorkflowStatus(jobs))
+
+	// check that the workflow concludes with its last job
+	for _, want := range []int{firstID, secondID} {
+		dequeuedJob, err := q.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+		require.Equal(t, want, dequeuedJob.ID)
+		require.Nil(t, q.Conclude(ctx, want, "consumer-1", nil))
+	}
+
+	jobs, err = workflows.ListWorkflowJobs(ctx, "workflow-1")
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusConcluded, domain.WorkflowStatus(jobs))
+
+	// check that a workflow waiting for a job outside of it is blocked
+	inProgress, err := q.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+
+	waiting := newJob("workflow-2")
+	waiting.DependsOn = []int{inProgress.ID}
+	_, err = workflows.EnqueueWorkflow(ctx, []domain.WorkflowJob{{Job: waiting}})
+	require.Nil(t, err)
+
+	jobs, err = workflows.ListWorkflowJobs(ctx, "workflow-2")
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusBlocked, domain.WorkflowStatus(jobs))
+
+	// check that a job merged into an earlier job of the workflow gets its ID
+	merged := newJob("workflow-3")
+	merged.UniqueKey = "report"
+	merged.UniquePolicy = domain.UniquePolicyMerge
+	ids, err = workflows.EnqueueWorkflow(ctx, []domain.WorkflowJob{{Job: merged}, {Job: merged}})
+	require.Nil(t, err)
+	require.Equal(t, ids[0], ids[1])
+
+	// check that nothing is added if a job of the workflow is rejected
+	stats, ok := q.(handler.StatsReporter)
+	require.True(t, ok)
+
+	before, err := stats.Stats(ctx)
+	require.Nil(t, err)
+
+	rejected := newJob("workflow-4")
+	rejected.UniqueKey = "report"
+	_, err = workflows.EnqueueWorkflow(ctx, []domain.WorkflowJob{
+		{Job: newJob("workflow-4")},
+		{Job: rejected, Parents: []int{0}},
+	})
+	require.True(t, errors.Is(err, domain.ErrDuplicateJob{}))
+
+	after, err := stats.Stats(ctx)
+	require.Nil(t, err)
+	require.Equal(t, before, after)
+
+	_, err = workflows.ListWorkflowJobs(ctx, "workflow-4")
+	require.True(t, errors.Is(err, domain.ErrWorkflowNotFound{}))
+
+	// check that an unknown workflow is not found
+	_, err = workflows.ListWorkflowJobs(ctx, "workflow-5")
+	require.True(t, errors.Is(err, domain.ErrWorkflowNotFound{}))
+}
+
+func testBatch(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	workflows, ok := q.(handler.WorkflowQueuer)
+	require.True(t, ok)
+	deadLetters, ok := q.(handler.DeadLetterQueuer)
+	require.True(t, ok)
+
+	// enqueueBatch enqueues a follow-up job that waits for the batch, and the
+	// jobs of the batch
+	enqueueBatch := func(batchID string, policy string, members []domain.Job) (int, []int) {
+		followUpID, err := q.Enqueue(ctx, domain.Job{
+			Type:             domain.JobTypeNotTimeCritical,
+			Status:           domain.JobStatusQueued,
+			DependencyPolicy: policy,
+			WorkflowID:       batchID,
+			BatchRemaining:   len(members),
+		})
+		require.Nil(t, err)
+
+		for i := range members {
+			members[i].Status = domain.JobStatusQueued
+			members[i].WorkflowID = batchID
+			members[i].BatchFollowUp = followUpID
+		}
+		ids, errs := q.EnqueueBatch(ctx, members)
+		for _, err := range errs {
+			require.Nil(t, err)
+		}
+
+		return followUpID, ids
+	}
+
+	followUpStatus := func(id int, want string, remaining int) {
+		followUp, err := q.FetchJob(ctx, id)
+		require.Nil(t, err)
+		require.Equal(t, want, followUp.Status)
+		require.Equal(t, remaining, followUp.BatchRemaining)
+	}
+
+	// set up state
+	followUpID, ids := enqueueBatch("batch-1", domain.DependencyPolicyBlock, []domain.Job{
+		{Type: domain.JobTypeTimeCritical},
+		{Type: domain.JobTypeTimeCritical},
+		{Type: domain.JobTypeTimeCritical, MaxAttempts: 1},
+	})
+
+	// check that the batch is listed with its follow-up job, which waits for
+	// every job of the batch
+	jobs, err := workflows.ListWorkflowJobs(ctx, "batch-1")
+	require.Nil(t, err)
+	require.Len(t, jobs, 4)
+	statuses := make(map[string]int)
+	for _, job := range jobs {
+		statuses[job.Status]++
+	}
+	require.Equal(t, map[string]int{domain.JobStatusBlocked: 1, domain.JobStatusQueued: 3}, statuses)
+	followUpStatus(followUpID, domain.JobStatusBlocked, 3)
+
+	for _, want := range ids {
+		dequeuedJob, err := q.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+		require.Equal(t, want, dequeuedJob.ID)
+	}
+
+	_, err = q.Dequeue(ctx, "consumer-1")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+
+	// check that every concluded job is counted once
+	require.Nil(t, q.Conclude(ctx, ids[0], "consumer-1", nil))
+	followUpStatus(followUpID, domain.JobStatusBlocked, 2)
+
+	_, err = q.Heartbeat(ctx, ids[1], "consumer-1", nil)
+	require.Nil(t, err)
+	followUpStatus(followUpID, domain.JobStatusBlocked, 2)
+
+	// check that a follow-up job kept blocked waits for a dead-lettered job
+	// to be redriven and conclude
+	_, err = q.Fail(ctx, ids[2], "consumer-1", "boom")
+	require.Nil(t, err)
+	require.Nil(t, q.Conclude(ctx, ids[1], "consumer-1", nil))
+	followUpStatus(followUpID, domain.JobStatusBlocked, 1)
+
+	require.Nil(t, deadLetters.Redrive(ctx, ids[2]))
+	dequeuedJob, err := q.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Equal(t, ids[2], dequeuedJob.ID)
+
+	// check that the follow-up job is released by the last job to conclude
+	require.Nil(t, q.Conclude(ctx, ids[2], "consumer-1", nil))
+	followUpStatus(followUpID, domain.JobStatusQueued, 0)
+
+	dequeuedJob, err = q.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Equal(t, followUpID, dequeuedJob.ID)
+
+	// check that cancelling a job of a batch cancels its follow-up job
+	followUpID, ids = enqueueBatch("batch-2", "", []domain.Job{
+		{Type: domain.JobTypeTimeCritical},
+		{Type: domain.JobTypeTimeCritical},
+	})
+
+	require.Nil(t, q.CancelJob(ctx, ids[0]))
+	followUp, err := q.FetchJob(ctx, followUpID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusCancelled, followUp.Status)
+
+	dequeuedJob, err = q.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Equal(t, ids[1], dequeuedJob.ID)
+	require.Nil(t, q.Conclude(ctx, ids[1], "consumer-1", nil))
+
+	followUp, err = q.FetchJob(ctx, followUpID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusCancelled, followUp.Status)
+
+	// check that dead-lettering a job of a batch cancels its follow-up job
+	followUpID, ids = enqueueBatch("batch-3", "", []domain.Job{
+		{Type: domain.JobTypeTimeCritical, MaxAttempts: 1},
+	})
+
+	dequeuedJob, err = q.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Equal(t, ids[0], dequeuedJob.ID)
+
+	_, err = q.Fail(ctx, ids[0], "consumer-1", "boom")
+	require.Nil(t, err)
+	followUp, err = q.FetchJob(ctx, followUpID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusCancelled, followUp.Status)
+
+	// check that a job cancelled while in progress cannot be concluded, and
+	// is not counted as concluded by the follow-up job
+	followUpID, ids = enqueueBatch("batch-4", domain.DependencyPolicyBlock, []domain.Job{
+		{Type: domain.JobTypeTimeCritical},
+		{Type: domain.JobTypeTimeCritical},
+	})
+
+	for _, want := range ids {
+		dequeuedJob, err := q.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+		require.Equal(t, want, dequeuedJob.ID)
+	}
+
+	require.Nil(t, q.CancelJob(ctx, ids[0]))
+	err = q.Conclude(ctx, ids[0], "consumer-1", nil)
+	require.True(t, errors.Is(err, domain.ErrJobStatusTransitionNotAllowed{}))
+	followUpStatus(followUpID, domain.JobStatusBlocked, 2)
+
+	require.Nil(t, q.Conclude(ctx, ids[1], "consumer-1", nil))
+	followUpStatus(followUpID, domain.JobStatusBlocked, 1)
+}
+
+func testListJobs(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	lister, ok := q.(handler.JobLister)
+	require.True(t, ok)
+
+	// set up state, with jobs created on either side of a point in time
+	before := time.Now()
+	firstID := enqueue(t, q, domain.JobTypeTimeCritical, 0)
+	secondID := enqueue(t, q, domain.JobTypeNotTimeCritical, 0)
+	thirdID := enqueue(t, q, domain.JobTypeTimeCritical, 0)
+
+	time.Sleep(10 * time.Millisecond)
+	middle := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	fourthID := enqueue(t, q, domain.JobTypeTimeCritical, 0)
+
+	dequeuedJob, err := q.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Equal(t, firstID, dequeuedJob.ID)
+
+	// check that every job is listed by ID, with the time it was created
+	jobs, err := lister.ListJobs(ctx, domain.JobFilter{})
+	require.Nil(t, err)
+	require.Len(t, jobs, 4)
+	for i, want := range []int{firstID, secondID, thirdID, fourthID} {
+		require.Equal(t, want, jobs[i].ID)
+		require.False(t, jobs[i].CreatedAt.Before(before))
+	}
+
+	// check that jobs are filtered by their fields
+	filters := []struct {
+		filter domain.JobFilter
+		want   []int
+	}{
+		{domain.JobFilter{Status: domain.JobStatusQueued}, []int{secondID, thirdID, fourthID}},
+		{domain.JobFilter{Status: domain.JobStatusInProgress}, []int{firstID}},
+		{domain.JobFilter{Status: domain.JobStatusCancelled}, []int{}},
+		{domain.JobFilter{Type: domain.JobTypeTimeCritical}, []int{firstID, thirdID, fourthID}},
+		{domain.JobFilter{ConsumerID: "consumer-1"}, []int{firstID}},
+		{domain.JobFilter{CreatedBefore: middle}, []int{firstID, secondID, thirdID}},
+		{domain.JobFilter{CreatedAfter: middle}, []int{fourthID}},
+		{domain.JobFilter{Status: domain.JobStatusQueued, Type: domain.JobTypeTimeCritical, CreatedBefore: middle}, []int{thirdID}},
+	}
+	for _, f := range filters {
+		jobs, err := lister.ListJobs(ctx, f.filter)
+		require.Nil(t, err)
+
+		ids := make([]int, 0, len(jobs))
+		for _, job := range jobs {
+			ids = append(ids, job.ID)
+		}
+		require.Equal(t, f.want, ids)
+	}
+
+	// check that pages continue after the last job of the previous page
+	filter := domain.JobFilter{Type: domain.JobTypeTimeCritical, Limit: 2}
+	jobs, err = lister.ListJobs(ctx, filter)
+	require.Nil(t, err)
+	require.Len(t, jobs, 2)
+	require.Equal(t, firstID, jobs[0].ID)
+	require.Equal(t, thirdID, jobs[1].ID)
+
+	filter.AfterID = jobs[1].ID
+	jobs, err = lister.ListJobs(ctx, filter)
+	require.Nil(t, err)
+	require.Len(t, jobs, 1)
+	require.Equal(t, fourthID, jobs[0].ID)
+
+	filter.AfterID = jobs[0].ID
+	jobs, err = lister.ListJobs(ctx, filter)
+	require.Nil(t, err)
+	require.Len(t, jobs, 0)
+}
+
+func testRequeue(t *testing.T, q handler.JobQueuer) {
+	ctx := context.Background()
+
+	requeuer, ok := q.(handler.JobRequeuer)
+	require.True(t, ok)
+
+	// set up state
+	firstID := enqueue(t, q, domain.JobTypeTimeCritical, 0)
+	secondID := enqueue(t, q, domain.JobTypeTimeCritical, 0)
+
+	dequeuedJob, err := q.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+	require.Equal(t, firstID, dequeuedJob.ID)
+
+	// check that only in progress jobs can be requeued
+	err = requeuer.RequeueJob(ctx, secondID)
+	require.True(t, errors.Is(err, domain.ErrJobStatusTransitionNotAllowed{}))
+
+	err = requeuer.RequeueJob(ctx, unknownJobID)
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+
+	// check that a requeued job is released from its consumer, and keeps its
+	// place ahead of newer jobs
+	require.Nil(t, requeuer.RequeueJob(ctx, firstID))
+
+	requeuedJob, err := q.FetchJob(ctx, firstID)
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusQueued, requeuedJob.Status)
+	require.Empty(t, requeuedJob.ConsumerID)
+	require.True(t, requeuedJob.LeaseExpiresAt.IsZero())
+	require.Len(t, requeuedJob.Failures, 1)
+	require.Equal(t, "consumer-1", requeuedJob.Failures[0].ConsumerID)
+
+	dequeuedJob, err = q.Dequeue(ctx, "consumer-2")
+	require.Nil(t, err)
+	require.Equal(t, firstID, dequeuedJob.ID)
+	require.Equal(t, 2, dequeuedJob.Attempts)
+
+	// check that the old consumer can no longer conclude the job
+	err = q.Conclude(ctx, firstID, "consumer-1", nil)
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+}
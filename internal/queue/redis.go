@@ -0,0 +1,1913 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rs/zerolog"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+// redisQueuesKey holds the names of the queues stored in Redis.
+const redisQueuesKey = "sjq:queues"
+
+// maxRedisRetries is the number of times a change to a job is retried when
+// another consumer or service instance changed the job at the same time.
+const maxRedisRetries = 10
+
+// redisListChunk is the number of jobs ListJobs reads from an index in a single
+// round trip, and the number of job IDs indexed at once for a queue stored
+// before it had the indexes.
+const redisListChunk = 500
+
+// errRedisConflict indicates a job changed while it was being modified.
+var errRedisConflict = errors.New("job changed concurrently")
+
+// The scripts below build the keys of jobs and status indexes from prefixes
+// passed in ARGV, as the jobs a script touches are only known once it runs.
+// Redis Cluster only allows a script to use keys in the slot of its KEYS, so
+// this relies on every key of a queue starting with the queue's prefix,
+// sjq:{name}:, whose hash tag puts them all in the same slot. Keys built by a
+// script must always start with the prefix.
+
+// redisDequeueScript promotes scheduled jobs that are due to the ready sets,
+// and then claims up to a number of jobs at the head of the ready sets for a
+// consumer. Ready sets are scored by negated priority, and job IDs are zero
+// padded, so the head of a set is the job with the highest priority that was
+// enqueued first.
+//
+// KEYS: ready time critical, ready not time critical, delayed, leases, stats
+// ARGV: now score, job key prefix, time critical ratio (0 to serve the head
+// with the highest priority), consumer ID, lease expiry, lease score, time
+// critical job type, the scheduled, queued and in progress statuses, the time
+// critical streak, the maximum number of jobs to claim, and the status index
+// key prefix
+//
+// It returns the time critical streak after claiming, and the claimed jobs.
+var redisDequeueScript = redis.NewScript(5, `
+local now, prefix, ratio = ARGV[1], ARGV[2], tonumber(ARGV[3])
+local timeCritical, scheduled, queued, inProgress = ARGV[7], ARGV[8], ARGV[9], ARGV[10]
+local streak, max, statusPrefix = tonumber(ARGV[11]), tonumber(ARGV[12]), ARGV[13]
+
+local function setStatus(id, key, from, to)
+	redis.call('HSET', key, 'status', to)
+	redis.call('HINCRBY', key, 'version', 1)
+	redis.call('HINCRBY', KEYS[5], from, -1)
+	redis.call('HINCRBY', KEYS[5], to, 1)
+	redis.call('ZREM', statusPrefix .. from, id)
+	redis.call('ZADD', statusPrefix .. to, tonumber(id), id)
+end
+
+for _, id in ipairs(redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', now)) do
+	redis.call('ZREM', KEYS[3], id)
+
+	local key = prefix .. id
+	if redis.call('HGET', key, 'status') == scheduled then
+		setStatus(id, key, scheduled, queued)
+		redis.call('HSET', key, 'run_at', '0')
+
+		local ready = KEYS[2]
+		if redis.call('HGET', key, 'type') == timeCritical then
+			ready = KEYS[1]
+		end
+		redis.call('ZADD', ready, -tonumber(redis.call('HGET', key, 'priority')), id)
+	end
+end
+
+local claimed = {}
+while #claimed < max do
+	local heads = {}
+	for i = 1, 2 do
+		local head = redis.call('ZRANGE', KEYS[i], 0, 0, 'WITHSCORES')
+		if head[1] then
+			heads[i] = {id = head[1], score = tonumber(head[2])}
+		end
+	end
+
+	-- the streak only counts time critical jobs served while both sets have
+	-- jobs waiting
+	local pick
+	if heads[1] and heads[2] then
+		if ratio > 0 then
+			if streak >= ratio then
+				pick = 2
+				streak = 0
+			else
+				pick = 1
+				streak = streak + 1
+			end
+		elseif heads[1].score < heads[2].score or (heads[1].score == heads[2].score and heads[1].id < heads[2].id) then
+			pick = 1
+		else
+			pick = 2
+		end
+	elseif heads[1] then
+		pick = 1
+		streak = 0
+	elseif heads[2] then
+		pick = 2
+		streak = 0
+	else
+		break
+	end
+
+	local id = heads[pick].id
+	local key = prefix .. id
+	redis.call('ZREM', KEYS[pick], id)
+	setStatus(id, key, queued, inProgress)
+	redis.call('HSET', key, 'consumer_id', ARGV[4], 'lease_expires_at', ARGV[5], 'run_at', '0')
+	redis.call('HINCRBY', key, 'attempts', 1)
+	redis.call('ZADD', KEYS[4], ARGV[6], id)
+
+	claimed[#claimed + 1] = redis.call('HGETALL', key)
+end
+
+return {streak, claimed}
+`)
+
+// redisSaveScript stores the state of a job if the job did not change since it
+// was read, and moves the job to the index for its new status. The change of a
+// job of a batch is counted by the follow-up job of the batch while it is
+// blocked, which changes the version of the follow-up job.
+//
+// KEYS: job, stats, and the ready time critical, ready not time critical,
+// delayed, leases, dead-letter and blocked indexes, and the batch follow-up job
+// (the job itself for none)
+// ARGV: expected version, member, index to add the job to (a KEYS position, or
+// 0 for none), index score, status, status index key prefix, followed by field
+// and value pairs
+var redisSaveScript = redis.NewScript(9, `
+local version = redis.call('HGET', KEYS[1], 'version') or '0'
+if version ~= ARGV[1] then
+	return 0
+end
+
+local member, index, score, status = ARGV[2], tonumber(ARGV[3]), ARGV[4], ARGV[5]
+
+local previous = redis.call('HGET', KEYS[1], 'status')
+if previous then
+	redis.call('HINCRBY', KEYS[2], previous, -1)
+	redis.call('ZREM', ARGV[6] .. previous, member)
+end
+redis.call('HINCRBY', KEYS[2], status, 1)
+redis.call('ZADD', ARGV[6] .. status, tonumber(member), member)
+
+-- see batchProgress
+if KEYS[9] ~= KEYS[1] and status ~= previous and redis.call('HGET', KEYS[9], 'status') == 'BLOCKED' then
+	local field
+	if status == 'CONCLUDED' then
+		field = 'batch_remaining'
+	elseif status == 'CANCELLED' or status == 'FAILED' then
+		field = 'batch_failed'
+	end
+	if field then
+		redis.call('HINCRBY', KEYS[9], field, field == 'batch_remaining' and -1 or 1)
+		redis.call('HINCRBY', KEYS[9], 'version', 1)
+	end
+end
+
+for i = 3, 8 do
+	redis.call('ZREM', KEYS[i], member)
+end
+if index > 0 then
+	redis.call('ZADD', KEYS[index], score, member)
+end
+
+for i = 7, #ARGV, 2 do
+	redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+end
+redis.call('HSET', KEYS[1], 'status', status, 'version', tonumber(version) + 1)
+
+return 1
+`)
+
+// redisEnqueueScript adds jobs to the queue at once, unless the idempotency or
+// unique key of one of them is held by another job, including a job added
+// earlier by the same call. The keys are checked and claimed along with storing
+// the jobs, so a job is never visible through its keys before it is stored. It
+// returns the kind of key that is held, the position of the job it keeps from
+// being added (counting from 1) and the value stored for the key, or "saved".
+//
+// KEYS: stats, the ready time critical, ready not time critical, delayed,
+// leases, dead-letter and blocked indexes, and the index of every job, followed
+// by the job, idempotency, unique and workflow keys of every job
+// ARGV: job key prefix, the active statuses (4), and the status index key
+// prefix, followed by, for every job, its idempotency value (empty for none)
+// and expiry in milliseconds, 1 to claim its unique key, 1 to add it to its
+// workflow, its ID, member, index (a KEYS position, or 0 for none), index
+// score, status, and the number of field and value pairs that follow
+var redisEnqueueScript = redis.NewScript(-1, `
+local prefix, statusPrefix = ARGV[1], ARGV[6]
+local active = {}
+for i = 2, 5 do
+	active[ARGV[i]] = true
+end
+
+local jobs, a = {}, 7
+for k = 9, #KEYS, 4 do
+	jobs[#jobs + 1] = {
+		key = KEYS[k], idempotencyKey = KEYS[k + 1], uniqueKey = KEYS[k + 2], workflowKey = KEYS[k + 3],
+		idempotency = ARGV[a], ttl = ARGV[a + 1], unique = ARGV[a + 2], workflow = ARGV[a + 3],
+		id = ARGV[a + 4], member = ARGV[a + 5], index = tonumber(ARGV[a + 6]), score = ARGV[a + 7],
+		status = ARGV[a + 8], fields = a + 10,
+	}
+	a = a + 10 + tonumber(ARGV[a + 9]) * 2
+	jobs[#jobs].last = a - 1
+end
+
+-- check the keys of every job before any job is stored
+local idempotency, unique = {}, {}
+for i, job in ipairs(jobs) do
+	if job.idempotency ~= '' then
+		local held = idempotency[job.idempotencyKey] or redis.call('GET', job.idempotencyKey)
+		if held then
+			return {'idempotency', tostring(i), held}
+		end
+		idempotency[job.idempotencyKey] = job.idempotency
+	end
+
+	if job.unique == '1' then
+		local held = unique[job.uniqueKey]
+		if held == nil then
+			held = redis.call('GET', job.uniqueKey)
+			if held and not active[redis.call('HGET', prefix .. held, 'status')] then
+				held = false
+			end
+		end
+		if held then
+			return {'unique', tostring(i), held}
+		end
+		unique[job.uniqueKey] = active[job.status] and job.member or false
+	end
+end
+
+for _, job in ipairs(jobs) do
+	if job.idempotency ~= '' then
+		redis.call('SET', job.idempotencyKey, job.idempotency, 'PX', job.ttl)
+	end
+	if job.unique == '1' then
+		redis.call('SET', job.uniqueKey, job.member)
+	end
+	if job.workflow == '1' then
+		redis.call('ZADD', job.workflowKey, job.id, job.member)
+	end
+
+	redis.call('HINCRBY', KEYS[1], job.status, 1)
+	if job.index > 0 then
+		redis.call('ZADD', KEYS[job.index], job.score, job.member)
+	end
+	redis.call('ZADD', KEYS[8], job.id, job.member)
+	redis.call('ZADD', statusPrefix .. job.status, job.id, job.member)
+	for f = job.fields, job.last, 2 do
+		redis.call('HSET', job.key, ARGV[f], ARGV[f + 1])
+	end
+	redis.call('HSET', job.key, 'status', job.status, 'version', 1)
+end
+
+return {'saved'}
+`)
+
+// redisIndexScript adds jobs stored before the queue had the index of every job
+// and the status indexes to them.
+//
+// KEYS: the index of every job
+// ARGV: job key prefix, status index key prefix, and the first and last job ID
+var redisIndexScript = redis.NewScript(1, `
+for id = tonumber(ARGV[3]), tonumber(ARGV[4]) do
+	local member = string.format('%020d', id)
+	local status = redis.call('HGET', ARGV[1] .. member, 'status')
+	if status then
+		redis.call('ZADD', KEYS[1], id, member)
+		redis.call('ZADD', ARGV[2] .. status, id, member)
+	end
+end
+`)
+
+// RedisQueue is a job queue stored in Redis, which lets several service
+// instances share the same queue. Every job is a hash, and sorted sets index the
+// jobs that are ready, scheduled, leased and dead-lettered, as well as every job
+// and the jobs with each status, so jobs can be listed by ID. All keys of a
+// queue share a hash tag, so a queue lives on a single node of a Redis cluster.
+type RedisQueue struct {
+	config
+
+	pool *redis.Pool
+	name string
+
+	// prefix is the prefix of every key of the queue, its hash tag keeps
+	// the keys the scripts build in the slot of their KEYS
+	prefix string
+
+	// timeCriticalStreak counts the time critical jobs served in a row by
+	// this instance with priority scheduling
+	timeCriticalStreak int
+
+	lock sync.Mutex
+}
+
+// NewRedisQueue returns the named job queue stored in Redis, and records the
+// queue's name so it is listed by ListRedisQueues.
+func NewRedisQueue(ctx context.Context, pool *redis.Pool, name string, opts ...Option) (*RedisQueue, error) {
+	q := &RedisQueue{
+		config: newConfig(opts),
+		pool:   pool,
+		name:   name,
+		prefix: fmt.Sprintf("sjq:{%s}:", name),
+		lock:   sync.Mutex{},
+	}
+
+	conn, err := pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Do("SADD", redisQueuesKey, name); err != nil {
+		return nil, err
+	}
+
+	if err := q.index(conn); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// index adds the jobs of a queue stored before it had the index of every job
+// and the status indexes to them, in chunks so Redis is not blocked for long.
+// Jobs changed in the meantime keep their indexes up to date themselves. Once
+// every job is indexed the queue is marked, so this only runs once.
+func (q *RedisQueue) index(conn redis.Conn) error {
+	indexed, err := redis.Bool(conn.Do("EXISTS", q.key("indexed")))
+	if err != nil || indexed {
+		return err
+	}
+
+	maxID, err := redis.Int(conn.Do("GET", q.prefix+"next_id"))
+	if err != nil && !errors.Is(err, redis.ErrNil) {
+		return err
+	}
+
+	for first := 1; first <= maxID; first += redisListChunk {
+		last := first + redisListChunk - 1
+		if last > maxID {
+			last = maxID
+		}
+
+		_, err := redisIndexScript.Do(conn, q.key("jobs"), q.prefix+"job:", q.key("status", ""), first, last)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = conn.Do("SET", q.key("indexed"), 1)
+	return err
+}
+
+// ListRedisQueues returns the names of the queues stored in Redis.
+func ListRedisQueues(ctx context.Context, pool *redis.Pool) ([]string, error) {
+	conn, err := pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("SMEMBERS", redisQueuesKey))
+}
+
+// Enqueue adds a job to the queue, and returns the ID of the job. Jobs with a
+// RunAt in the future are scheduled, and stay invisible to Dequeue until then.
+// A job with the idempotency key of a job enqueued earlier is not added, the ID
+// of the earlier job is returned instead. A job with the unique key of an
+// active job is handled according to its unique policy. A job that depends on
+// other jobs is blocked until they concluded.
+func (q *RedisQueue) Enqueue(ctx context.Context, job domain.Job) (int, error) {
+	ids, err := q.EnqueueWorkflow(ctx, []domain.WorkflowJob{{Job: job}})
+	if err != nil {
+		return 0, err
+	}
+
+	return ids[0], nil
+}
+
+// EnqueueWorkflow adds the jobs of a workflow to the queue with a single
+// script, and returns the IDs of the jobs in the order they were given. Either
+// every job is added, or none of them if one cannot be added. Only an active
+// job replaced by a job of the workflow stays cancelled.
+func (q *RedisQueue) EnqueueWorkflow(ctx context.Context, jobs []domain.WorkflowJob) ([]int, error) {
+	conn, err := q.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	firstID, err := q.allocate(conn, len(jobs))
+	if err != nil {
+		return nil, err
+	}
+
+	return q.enqueue(ctx, conn, q.newEnqueue(jobs, firstID))
+}
+
+// enqueue adds jobs to the queue with a single script, planning them again
+// after a conflict, and returns their IDs in the order they were given.
+func (q *RedisQueue) enqueue(ctx context.Context, conn redis.Conn, e *redisEnqueue) ([]int, error) {
+	for i := 0; i < maxRedisRetries+len(e.jobs); i++ {
+		args, err := q.plan(conn, e)
+		if err != nil {
+			return nil, err
+		}
+
+		reply, err := redisEnqueueScript.Do(conn, args...)
+		saved, err := q.enqueued(ctx, conn, e, reply, err)
+		if err != nil {
+			return nil, err
+		}
+		if saved {
+			return e.ids(), nil
+		}
+	}
+
+	return nil, errRedisConflict
+}
+
+// redisEnqueue holds the jobs added to the queue by a single redisEnqueueScript
+// call, see enqueue.
+type redisEnqueue struct {
+	// jobs are the prepared jobs, with the IDs they are added with
+	jobs []domain.WorkflowJob
+
+	// resolved holds the IDs of the jobs that are not added, by their
+	// position, as they were enqueued earlier or merged into an active job
+	resolved map[int]int
+
+	// replaced holds the positions of the jobs that are cancelled, as a later
+	// job with the same unique key replaces them
+	replaced map[int]bool
+
+	// planned holds the jobs in the state they are stored in, and positions
+	// holds the position of each of them
+	planned   []domain.Job
+	positions []int
+}
+
+// allocate reserves n consecutive job IDs, and returns the first of them.
+func (q *RedisQueue) allocate(conn redis.Conn, n int) (int, error) {
+	lastID, err := redis.Int(conn.Do("INCRBY", q.prefix+"next_id", n))
+	if err != nil {
+		return 0, err
+	}
+
+	return lastID - n + 1, nil
+}
+
+// newEnqueue prepares jobs to be added together, with consecutive IDs from the
+// first ID on.
+func (q *RedisQueue) newEnqueue(jobs []domain.WorkflowJob, firstID int) *redisEnqueue {
+	e := &redisEnqueue{
+		jobs:     make([]domain.WorkflowJob, len(jobs)),
+		resolved: make(map[int]int),
+		replaced: make(map[int]bool),
+	}
+
+	for i, workflowJob := range jobs {
+		workflowJob.Job = q.prepare(workflowJob.Job)
+		workflowJob.ID = firstID + i
+		e.jobs[i] = workflowJob
+	}
+
+	return e
+}
+
+// id returns the ID of the job at a position, or of the job it resolved to.
+func (e *redisEnqueue) id(position int) int {
+	if id, ok := e.resolved[position]; ok {
+		return id
+	}
+
+	return e.jobs[position].ID
+}
+
+// ids returns the IDs of the jobs, or of the jobs they resolved to.
+func (e *redisEnqueue) ids() []int {
+	ids := make([]int, len(e.jobs))
+	for i := range e.jobs {
+		ids[i] = e.id(i)
+	}
+
+	return ids
+}
+
+// prepare stamps a job with the time it is enqueued, and holds it back if it
+// is scheduled.
+func (q *RedisQueue) prepare(job domain.Job) domain.Job {
+	job.CreatedAt = q.now()
+
+	// hold scheduled jobs back until they are due
+	if job.RunAt.After(q.now()) {
+		job.Status = domain.JobStatusScheduled
+	} else {
+		if job.Status == domain.JobStatusScheduled {
+			job.Status = domain.JobStatusQueued
+		}
+		job.RunAt = time.Time{}
+	}
+
+	// hold a batch follow-up job back until the jobs of its batch concluded
+	if job.BatchRemaining > 0 {
+		job = resolveDependencies(job, nil, q.now())
+	}
+
+	return job
+}
+
+// plan works out the state the jobs that are still to be added are stored in,
+// and returns the arguments of redisEnqueueScript. Jobs are registered with the
+// jobs they depend on before their state is read, see settleAdded. Jobs that do
+// not depend on other jobs are planned without a round trip.
+func (q *RedisQueue) plan(conn redis.Conn, e *redisEnqueue) ([]interface{}, error) {
+	e.planned, e.positions = e.planned[:0], e.positions[:0]
+
+	ids := make([]int, 0, len(e.jobs))
+	added := make(map[int]bool, len(e.jobs))
+	for i, workflowJob := range e.jobs {
+		job, err := workflowDependencies(workflowJob, ids)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, e.id(i))
+
+		if _, ok := e.resolved[i]; !ok {
+			e.planned = append(e.planned, job)
+			e.positions = append(e.positions, i)
+			added[job.ID] = true
+		}
+	}
+
+	// read the jobs that were added before, once every job is registered
+	// with them
+	existing := make([]int, 0)
+	for _, job := range e.planned {
+		for _, id := range job.DependsOn {
+			if !added[id] {
+				existing = append(existing, id)
+			}
+		}
+	}
+	if err := q.register(conn, e.planned); err != nil {
+		return nil, err
+	}
+
+	parents := make(map[int]domain.Job, len(e.planned))
+	if len(existing) > 0 {
+		fetched, err := q.fetchAll(conn, existing)
+		if err != nil {
+			return nil, err
+		}
+		parents = fetched
+	}
+
+	for i, job := range e.planned {
+		switch {
+		case e.replaced[e.positions[i]]:
+			job.Status = domain.JobStatusCancelled
+		case len(job.DependsOn) > 0:
+			jobParents := make([]domain.Job, 0, len(job.DependsOn))
+			for _, id := range job.DependsOn {
+				parent, ok := parents[id]
+				if !ok {
+					return nil, domain.ErrJobNotFound{JobID: id}
+				}
+				jobParents = append(jobParents, parent)
+			}
+			job = resolveDependencies(job, jobParents, q.now())
+		}
+
+		e.planned[i] = job
+		parents[job.ID] = job
+	}
+
+	return q.enqueueArgs(e.planned)
+}
+
+// register adds jobs to the dependents of the jobs they depend on in a single
+// round trip.
+func (q *RedisQueue) register(conn redis.Conn, jobs []domain.Job) error {
+	sent := 0
+	for _, job := range jobs {
+		for _, id := range job.DependsOn {
+			if err := conn.Send("SADD", q.key("dependents", member(id)), member(job.ID)); err != nil {
+				return err
+			}
+			sent++
+		}
+	}
+	if sent == 0 {
+		return nil
+	}
+
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	// every reply is received, even after an error, so none is left behind
+	// on the connection
+	var firstErr error
+	for i := 0; i < sent; i++ {
+		if _, err := conn.Receive(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// enqueueArgs returns the number of keys, the keys and the arguments of
+// redisEnqueueScript for jobs.
+func (q *RedisQueue) enqueueArgs(jobs []domain.Job) ([]interface{}, error) {
+	keys := []interface{}{
+		q.key("stats"),
+		q.key("ready", domain.JobTypeTimeCritical),
+		q.key("ready", domain.JobTypeNotTimeCritical),
+		q.key("delayed"),
+		q.key("leases"),
+		q.key("dead"),
+		q.key("blocked"),
+		q.key("jobs"),
+	}
+	args := []interface{}{
+		q.prefix + "job:",
+		domain.JobStatusBlocked,
+		domain.JobStatusScheduled,
+		domain.JobStatusQueued,
+		domain.JobStatusInProgress,
+		q.key("status", ""),
+	}
+
+	flag := func(set bool) string {
+		if set {
+			return "1"
+		}
+		return "0"
+	}
+
+	for _, job := range jobs {
+		fields, err := redisFields(job)
+		if err != nil {
+			return nil, err
+		}
+
+		// a key that already expired does not need to be remembered
+		idempotency, ttl := "", job.IdempotencyExpiresAt.Sub(q.now())
+		if job.IdempotencyKey != "" && ttl >= time.Millisecond {
+			idempotency = strconv.Itoa(job.ID) + ":" + job.IdempotencyHash
+		}
+
+		// the indexes come after the stats
+		index, indexScore := redisIndex(job)
+		if index > 0 {
+			index++
+		}
+
+		keys = append(keys,
+			q.jobKey(job.ID),
+			q.key("idempotency", job.IdempotencyKey),
+			q.key("unique", job.UniqueKey),
+			q.key("workflow", job.WorkflowID),
+		)
+		args = append(args,
+			idempotency,
+			int64(ttl/time.Millisecond),
+			flag(job.UniqueKey != ""),
+			flag(job.WorkflowID != ""),
+			job.ID,
+			member(job.ID),
+			index,
+			indexScore,
+			job.Status,
+			len(fields)/2,
+		)
+		args = append(args, fields...)
+	}
+
+	return append(append([]interface{}{len(keys)}, keys...), args...), nil
+}
+
+// enqueued handles the reply of redisEnqueueScript, and reports whether the
+// jobs were saved. A job whose idempotency key is held resolves to the job
+// holding the key. A job that conflicts with the active job holding its unique
+// key is handled according to its unique policy. The jobs are planned again
+// after a conflict.
+func (q *RedisQueue) enqueued(ctx context.Context, conn redis.Conn, e *redisEnqueue, reply interface{}, err error) (bool, error) {
+	values, err := redis.Strings(reply, err)
+	if err != nil {
+		return false, err
+	}
+
+	if values[0] == "saved" {
+		q.settleAdded(ctx, e)
+		return true, nil
+	}
+
+	n, err := strconv.Atoi(values[1])
+	if err != nil {
+		return false, err
+	}
+	job, position := e.planned[n-1], e.positions[n-1]
+
+	if values[0] == "idempotency" {
+		id, err := idempotentJobID(job, values[2])
+		if err != nil {
+			return false, err
+		}
+
+		e.resolved[position] = id
+		return false, nil
+	}
+
+	activeID, err := strconv.Atoi(values[2])
+	if err != nil {
+		return false, err
+	}
+
+	// the key may be held by a job added earlier by the same call
+	for i, planned := range e.planned[:n-1] {
+		if planned.ID != activeID {
+			continue
+		}
+
+		merged, _, err := resolveUniqueKey(job, planned)
+		if err != nil {
+			return false, err
+		}
+
+		if merged {
+			e.resolved[position] = activeID
+		} else {
+			e.replaced[e.positions[i]] = true
+		}
+		return false, nil
+	}
+
+	activeJob, version, err := q.fetch(conn, activeID)
+	if err != nil {
+		return false, err
+	}
+
+	// the active job may have finished since the key was checked, and
+	// otherwise is cancelled if it is replaced
+	if !domain.ActiveJobStatuses[activeJob.Status] {
+		return false, nil
+	}
+
+	merged, activeJob, err := resolveUniqueKey(job, activeJob)
+	if err != nil {
+		return false, err
+	}
+
+	if merged {
+		e.resolved[position] = activeJob.ID
+		return false, nil
+	}
+
+	err = q.save(conn, activeJob, version)
+	if errors.Is(err, errRedisConflict) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	q.settleDependents(ctx, activeJob)
+
+	return false, nil
+}
+
+// settleAdded settles the added jobs that are blocked on jobs added before
+// them. A job is registered with those jobs before their state is read, and
+// settled again once it is stored, as a job they settle before then is not
+// found. Jobs that fail to settle are settled by the reaper.
+func (q *RedisQueue) settleAdded(ctx context.Context, e *redisEnqueue) {
+	added := make(map[int]bool, len(e.planned))
+	for _, job := range e.planned {
+		added[job.ID] = true
+	}
+
+	for _, job := range e.planned {
+		if job.Status != domain.JobStatusBlocked {
+			continue
+		}
+
+		for _, id := range job.DependsOn {
+			if !added[id] {
+				_ = q.settle(ctx, job.ID)
+				break
+			}
+		}
+	}
+}
+
+// idempotentJobID returns the ID of the job that holds the idempotency key of a
+// job, given the value stored with the key.
+func idempotentJobID(job domain.Job, value string) (int, error) {
+	fields := strings.SplitN(value, ":", 2)
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("invalid idempotency key %q", value)
+	}
+
+	if fields[1] != job.IdempotencyHash {
+		return 0, domain.ErrIdempotencyKeyReused{Key: job.IdempotencyKey}
+	}
+
+	return strconv.Atoi(fields[0])
+}
+
+// parents returns the jobs a job depends on. The jobs are fetched in a single
+// round trip, as a job can depend on every job of a large batch.
+func (q *RedisQueue) parents(conn redis.Conn, job domain.Job) ([]domain.Job, error) {
+	jobs, err := q.fetchAll(conn, job.DependsOn)
+	if err != nil {
+		return nil, err
+	}
+
+	parents := make([]domain.Job, 0, len(job.DependsOn))
+	for _, id := range job.DependsOn {
+		parent, ok := jobs[id]
+		if !ok {
+			return nil, domain.ErrJobNotFound{JobID: id}
+		}
+		parents = append(parents, parent)
+	}
+
+	return parents, nil
+}
+
+// settleDependents releases or cancels the blocked jobs that depend on a job
+// that is no longer active, and the follow-up job of its batch. Cancelled jobs
+// settle their own dependents in turn. Jobs that fail to settle are settled by
+// the reaper.
+func (q *RedisQueue) settleDependents(ctx context.Context, job domain.Job) {
+	if domain.ActiveJobStatuses[job.Status] {
+		return
+	}
+
+	// the follow-up job counted the change when the job was saved
+	if job.BatchFollowUp != 0 {
+		_ = q.settle(ctx, job.BatchFollowUp)
+	}
+
+	conn, err := q.pool.GetContext(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	members, err := redis.Strings(conn.Do("SMEMBERS", q.key("dependents", member(job.ID))))
+	if err != nil {
+		return
+	}
+
+	for _, m := range members {
+		id, err := strconv.Atoi(m)
+		if err != nil {
+			continue
+		}
+		_ = q.settle(ctx, id)
+	}
+}
+
+// settleBlockedJobs settles every blocked job.
+func (q *RedisQueue) settleBlockedJobs(ctx context.Context) error {
+	conn, err := q.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	blocked, err := q.indexed(conn, "blocked", "+inf")
+	conn.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range blocked {
+		if err := q.settle(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// settle releases or cancels a blocked job once the jobs it depends on allow
+// it.
+func (q *RedisQueue) settle(ctx context.Context, jobID int) error {
+	conn, err := q.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = q.modify(ctx, jobID, func(job domain.Job) (domain.Job, error) {
+		if job.Status != domain.JobStatusBlocked {
+			return domain.Job{}, errNotBlocked
+		}
+
+		parents, err := q.parents(conn, job)
+		if err != nil {
+			return domain.Job{}, err
+		}
+
+		job = resolveDependencies(job, parents, q.now())
+		if job.Status == domain.JobStatusBlocked {
+			return domain.Job{}, errNotBlocked
+		}
+
+		return job, nil
+	})
+	if errors.Is(err, errNotBlocked) || errors.Is(err, domain.ErrJobNotFound{}) {
+		return nil
+	}
+
+	return err
+}
+
+// errNotBlocked indicates a job does not need to be settled.
+var errNotBlocked = errors.New("job not blocked")
+
+// EnqueueBatch adds jobs to the queue, and returns the ID of every job or the
+// error that kept it from being added, in the order the jobs were given. Every
+// job is added by its own script, so a job that fails does not keep the other
+// jobs from being added. The scripts of consecutive jobs that do not depend on
+// other jobs are sent in a single round trip.
+func (q *RedisQueue) EnqueueBatch(ctx context.Context, jobs []domain.Job) ([]int, []error) {
+	ids := make([]int, len(jobs))
+	errs := make([]error, len(jobs))
+
+	// failAll reports an error that kept every job from being added
+	failAll := func(err error) ([]int, []error) {
+		for i := range errs {
+			ids[i], errs[i] = 0, err
+		}
+		return ids, errs
+	}
+
+	conn, err := q.pool.GetContext(ctx)
+	if err != nil {
+		return failAll(err)
+	}
+	defer conn.Close()
+
+	firstID, err := q.allocate(conn, len(jobs))
+	if err != nil {
+		return failAll(err)
+	}
+
+	// a job that depends on other jobs is added on its own, as it can depend
+	// on a job of the batch added before it
+	for start := 0; start < len(jobs); {
+		end := start
+		for end < len(jobs) && len(jobs[end].DependsOn) == 0 {
+			end++
+		}
+
+		if end == start {
+			e := q.newEnqueue([]domain.WorkflowJob{{Job: jobs[start]}}, firstID+start)
+			if enqueued, err := q.enqueue(ctx, conn, e); err != nil {
+				errs[start] = err
+			} else {
+				ids[start] = enqueued[0]
+			}
+			start++
+			continue
+		}
+
+		q.enqueuePipelined(ctx, conn, jobs[start:end], firstID+start, ids[start:end], errs[start:end])
+		start = end
+	}
+
+	return ids, errs
+}
+
+// enqueuePipelined adds jobs that do not depend on other jobs with a script
+// each, sending every script in a single round trip, and stores the ID of every
+// job or the error that kept it from being added. Jobs whose keys are held by
+// other jobs are handled one by one afterwards.
+func (q *RedisQueue) enqueuePipelined(ctx context.Context, conn redis.Conn, jobs []domain.Job, firstID int, ids []int, errs []error) {
+	failAll := func(err error) {
+		for i := range errs {
+			ids[i], errs[i] = 0, err
+		}
+	}
+
+	// the script is loaded once, and then called by its hash
+	if err := redisEnqueueScript.Load(conn); err != nil {
+		failAll(err)
+		return
+	}
+
+	enqueues := make([]*redisEnqueue, len(jobs))
+	for i, job := range jobs {
+		enqueues[i] = q.newEnqueue([]domain.WorkflowJob{{Job: job}}, firstID+i)
+
+		args, err := q.plan(conn, enqueues[i])
+		if err == nil {
+			err = redisEnqueueScript.SendHash(conn, args...)
+		}
+		if err != nil {
+			failAll(err)
+			return
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		failAll(err)
+		return
+	}
+
+	// every reply is received before a conflict is handled, so none is left
+	// behind on the connection
+	replies := make([]interface{}, len(jobs))
+	replyErrs := make([]error, len(jobs))
+	for i := range jobs {
+		replies[i], replyErrs[i] = conn.Receive()
+	}
+
+	for i, e := range enqueues {
+		saved, err := q.enqueued(ctx, conn, e, replies[i], replyErrs[i])
+		if err == nil && !saved {
+			_, err = q.enqueue(ctx, conn, e)
+		}
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		ids[i] = e.ids()[0]
+	}
+}
+
+// Dequeue claims a job from the queue. Jobs are served by priority, and then in
+// the order they were enqueued. With priority scheduling, time critical jobs
+// are served first. The job is claimed by a Lua script, so concurrent
+// consumers, including ones connected to other service instances, never
+// receive the same job.
+func (q *RedisQueue) Dequeue(ctx context.Context, consumerID string) (domain.Job, error) {
+	jobs, err := q.DequeueBatch(ctx, consumerID, 1)
+	if err != nil {
+		return domain.Job{}, err
+	}
+
+	return jobs[0], nil
+}
+
+// DequeueBatch claims up to max jobs from the queue, in the order Dequeue would
+// claim them one by one. The jobs are claimed by a single run of the Lua
+// script.
+func (q *RedisQueue) DequeueBatch(ctx context.Context, consumerID string, max int) ([]domain.Job, error) {
+	conn, err := q.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	now := q.now()
+
+	// the script picks the ready set to serve from the time critical streak,
+	// the head with the highest priority is served without priority
+	// scheduling
+	ratio, streak := 0, 0
+	if q.prioritize {
+		q.lock.Lock()
+		ratio, streak = q.timeCriticalRatio, q.timeCriticalStreak
+		q.lock.Unlock()
+	}
+
+	leaseExpiresAt := now.Add(q.visibilityTimeout)
+	reply, err := redis.Values(redisDequeueScript.Do(conn,
+		q.key("ready", domain.JobTypeTimeCritical),
+		q.key("ready", domain.JobTypeNotTimeCritical),
+		q.key("delayed"),
+		q.key("leases"),
+		q.key("stats"),
+		score(now),
+		q.prefix+"job:",
+		ratio,
+		consumerID,
+		nanos(leaseExpiresAt),
+		score(leaseExpiresAt),
+		domain.JobTypeTimeCritical,
+		domain.JobStatusScheduled,
+		domain.JobStatusQueued,
+		domain.JobStatusInProgress,
+		streak,
+		max,
+		q.key("status", ""),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var claimedStreak int
+	var replies []interface{}
+	if _, err := redis.Scan(reply, &claimedStreak, &replies); err != nil {
+		return nil, err
+	}
+
+	if len(replies) == 0 {
+		return nil, domain.ErrQueueEmpty
+	}
+
+	jobs := make([]domain.Job, 0, len(replies))
+	for _, reply := range replies {
+		fields, err := redis.StringMap(reply, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		job, err := jobFromHash(fields)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	if q.prioritize {
+		q.lock.Lock()
+		q.timeCriticalStreak = claimedStreak
+		q.lock.Unlock()
+	}
+
+	return jobs, nil
+}
+
+// Conclude finishes execution on the job, and stores the result reported by
+// the consumer.
+func (q *RedisQueue) Conclude(ctx context.Context, jobID int, consumerID string, result json.RawMessage) error {
+	_, err := q.modify(ctx, jobID, func(job domain.Job) (domain.Job, error) {
+		// only the consumer that dequeued the job is allowed to conclude it
+		if job.ConsumerID != consumerID {
+			return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+		}
+
+		if job.Status != domain.JobStatusInProgress {
+			return domain.Job{}, domain.ErrJobStatusTransitionNotAllowed{JobID: jobID}
+		}
+
+		job.Status = domain.JobStatusConcluded
+		job.Result = result
+
+		return job, nil
+	})
+
+	return err
+}
+
+// Fail reports that a consumer was unable to process a job. The job is retried
+// after a backoff, unless it has run out of attempts, in which case it is moved
+// to the dead-letter queue.
+func (q *RedisQueue) Fail(ctx context.Context, jobID int, consumerID string, reason string) (domain.Job, error) {
+	return q.modify(ctx, jobID, func(job domain.Job) (domain.Job, error) {
+		// only the consumer that dequeued the job is allowed to fail it
+		if job.ConsumerID != consumerID {
+			return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+		}
+
+		if job.Status != domain.JobStatusInProgress {
+			return domain.Job{}, domain.ErrJobStatusTransitionNotAllowed{JobID: jobID}
+		}
+
+		now := q.now()
+		policy := q.retryPolicyFor(job)
+
+		job = recordFailure(job, reason, now)
+
+		if job.Attempts >= policy.MaxAttempts {
+			job.Status = domain.JobStatusFailed
+			job.DeadLetteredAt = now
+
+			return job, nil
+		}
+
+		// hold the job back until the backoff has passed
+		job.Status = domain.JobStatusScheduled
+		job.RunAt = now.Add(policy.Backoff(job.Attempts, q.random()))
+
+		return job, nil
+	})
+}
+
+// Heartbeat extends the lease on an in progress job by the visibility timeout,
+// and records the progress reported by the consumer if one is given.
+func (q *RedisQueue) Heartbeat(ctx context.Context, jobID int, consumerID string, progress *int) (domain.Job, error) {
+	return q.modify(ctx, jobID, func(job domain.Job) (domain.Job, error) {
+		// only the consumer that dequeued the job is allowed to extend its lease
+		if job.ConsumerID != consumerID {
+			return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+		}
+
+		if job.Status != domain.JobStatusInProgress {
+			return domain.Job{}, domain.ErrJobStatusTransitionNotAllowed{JobID: jobID}
+		}
+
+		job.LeaseExpiresAt = q.now().Add(q.visibilityTimeout)
+		if progress != nil {
+			job.Progress = *progress
+		}
+
+		return job, nil
+	})
+}
+
+// FetchJob returns a job definition for the given job ID.
+func (q *RedisQueue) FetchJob(ctx context.Context, jobID int) (domain.Job, error) {
+	conn, err := q.pool.GetContext(ctx)
+	if err != nil {
+		return domain.Job{}, err
+	}
+	defer conn.Close()
+
+	job, _, err := q.fetch(conn, jobID)
+
+	return job, err
+}
+
+// CancelJob cancels a job that has not yet been concluded.
+func (q *RedisQueue) CancelJob(ctx context.Context, jobID int) error {
+	_, err := q.modify(ctx, jobID, func(job domain.Job) (domain.Job, error) {
+		if job.Status == domain.JobStatusConcluded {
+			return domain.Job{}, domain.ErrJobStatusTransitionNotAllowed{JobID: jobID}
+		}
+
+		job.Status = domain.JobStatusCancelled
+
+		return job, nil
+	})
+
+	return err
+}
+
+// RequeueJob returns an in progress job to the queue, e.g. because its consumer
+// is known to be gone, without waiting for its lease to expire. The attempt is
+// recorded as failed, but the job is not dead-lettered even if it ran out of
+// attempts.
+func (q *RedisQueue) RequeueJob(ctx context.Context, jobID int) error {
+	_, err := q.modify(ctx, jobID, func(job domain.Job) (domain.Job, error) {
+		if job.Status != domain.JobStatusInProgress {
+			return domain.Job{}, domain.ErrJobStatusTransitionNotAllowed{JobID: jobID}
+		}
+
+		job = recordFailure(job, requeueReason, q.now())
+		job.Status = domain.JobStatusQueued
+
+		return job, nil
+	})
+
+	return err
+}
+
+// ListDeadLetters returns the jobs in the dead-letter queue, oldest first.
+func (q *RedisQueue) ListDeadLetters(ctx context.Context) ([]domain.Job, error) {
+	conn, err := q.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ids, err := q.indexed(conn, "dead", "+inf")
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]domain.Job, 0, len(ids))
+	for _, id := range ids {
+		job, _, err := q.fetch(conn, id)
+		if errors.Is(err, domain.ErrJobNotFound{}) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// FetchDeadLetter returns a job from the dead-letter queue, including its
+// failure history.
+func (q *RedisQueue) FetchDeadLetter(ctx context.Context, jobID int) (domain.Job, error) {
+	job, err := q.FetchJob(ctx, jobID)
+	if err != nil {
+		return domain.Job{}, err
+	}
+
+	if job.Status != domain.JobStatusFailed {
+		return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+	}
+
+	return job, nil
+}
+
+// Redrive moves a job from the dead-letter queue back into the queue with a
+// fresh set of attempts. The failure history is kept.
+func (q *RedisQueue) Redrive(ctx context.Context, jobID int) error {
+	_, err := q.modify(ctx, jobID, func(job domain.Job) (domain.Job, error) {
+		if job.Status != domain.JobStatusFailed {
+			return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+		}
+
+		job.Status = domain.JobStatusQueued
+		job.Attempts = 0
+		job.DeadLetteredAt = time.Time{}
+
+		return job, nil
+	})
+
+	return err
+}
+
+// RedriveAll moves every job in the dead-letter queue back into the queue, and
+// returns the number of jobs redriven.
+func (q *RedisQueue) RedriveAll(ctx context.Context) (int, error) {
+	deadLetters, err := q.ListDeadLetters(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, job := range deadLetters {
+		err := q.Redrive(ctx, job.ID)
+		if errors.Is(err, domain.ErrJobNotFound{}) {
+			// redriven or cancelled in the meantime
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// Stats returns the number of jobs tracked by the queue, broken down by status.
+func (q *RedisQueue) Stats(ctx context.Context) (domain.QueueStats, error) {
+	conn, err := q.pool.GetContext(ctx)
+	if err != nil {
+		return domain.QueueStats{}, err
+	}
+	defer conn.Close()
+
+	counts, err := redis.IntMap(conn.Do("HGETALL", q.key("stats")))
+	if err != nil {
+		return domain.QueueStats{}, err
+	}
+
+	stats := domain.QueueStats{
+		Statuses: make(map[string]int),
+	}
+	for status, count := range counts {
+		if count == 0 {
+			continue
+		}
+		stats.Statuses[status] = count
+		stats.Total += count
+	}
+
+	return stats, nil
+}
+
+// ListWorkflowJobs returns the jobs of a workflow in the order they were
+// enqueued.
+func (q *RedisQueue) ListWorkflowJobs(ctx context.Context, workflowID string) ([]domain.Job, error) {
+	conn, err := q.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ids, err := q.indexed(conn, "workflow:"+workflowID, "+inf")
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]domain.Job, 0, len(ids))
+	for _, id := range ids {
+		job, _, err := q.fetch(conn, id)
+		if errors.Is(err, domain.ErrJobNotFound{}) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	if len(jobs) == 0 {
+		return nil, domain.ErrWorkflowNotFound{WorkflowID: workflowID}
+	}
+
+	return jobs, nil
+}
+
+// ListJobs returns the jobs selected by the filter, ordered by ID. Jobs are read
+// in chunks from the index of the jobs with the status of the filter, or of
+// every job, starting after the ID of the filter, until the limit is reached or
+// the index has no job with a higher ID.
+func (q *RedisQueue) ListJobs(ctx context.Context, filter domain.JobFilter) ([]domain.Job, error) {
+	conn, err := q.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	index := q.key("jobs")
+	if filter.Status != "" {
+		index = q.key("status", filter.Status)
+	}
+
+	jobs := make([]domain.Job, 0)
+	for after := filter.AfterID; filter.Limit <= 0 || len(jobs) < filter.Limit; {
+		members, err := redis.Strings(conn.Do("ZRANGEBYSCORE", index, fmt.Sprintf("(%d", after), "+inf", "LIMIT", 0, redisListChunk))
+		if err != nil {
+			return nil, err
+		}
+
+		ids := make([]int, 0, len(members))
+		for _, m := range members {
+			id, err := strconv.Atoi(m)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+
+		chunk, err := q.fetchAll(conn, ids)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range ids {
+			if filter.Limit > 0 && len(jobs) >= filter.Limit {
+				break
+			}
+
+			if job, ok := chunk[id]; ok && filter.Matches(job) {
+				jobs = append(jobs, job)
+			}
+		}
+
+		if len(ids) < redisListChunk {
+			break
+		}
+		after = ids[len(ids)-1]
+	}
+
+	return jobs, nil
+}
+
+// RunReaper periodically returns in progress jobs with an expired lease to the
+// queue, and moves scheduled jobs to the queue once they are due. It also
+// settles blocked jobs whose dependencies changed without settling them, e.g.
+// because the instance that changed them stopped. It blocks until the context
+// is cancelled. Several service instances can run the reaper at the same time.
+func (q *RedisQueue) RunReaper(ctx context.Context, interval time.Duration, log zerolog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := q.reapExpiredLeases(ctx); err != nil {
+				log.Error().Err(err).Str("queue", q.name).Msg("unable to reap expired leases")
+			}
+
+			if err := q.settleBlockedJobs(ctx); err != nil {
+				log.Error().Err(err).Str("queue", q.name).Msg("unable to settle blocked jobs")
+			}
+		}
+	}
+}
+
+// reapExpiredLeases puts in progress jobs whose lease has expired back in the
+// queue so another consumer can pick them up. A lost lease counts as a failed
+// attempt, so jobs that keep losing their lease are eventually dead-lettered.
+// It returns the number of jobs that were reaped. Scheduled jobs that are due
+// are promoted by Dequeue.
+func (q *RedisQueue) reapExpiredLeases(ctx context.Context) (int, error) {
+	conn, err := q.pool.GetContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	now := q.now()
+	expired, err := q.indexed(conn, "leases", strconv.FormatInt(score(now), 10))
+	conn.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	reaped := 0
+	for _, id := range expired {
+		_, err := q.modify(ctx, id, func(job domain.Job) (domain.Job, error) {
+			// the job was concluded or its lease extended in the meantime
+			if job.Status != domain.JobStatusInProgress || job.LeaseExpiresAt.After(now) {
+				return domain.Job{}, errNotExpired
+			}
+
+			job = recordFailure(job, "lease expired", now)
+
+			if job.Attempts >= q.retryPolicyFor(job).MaxAttempts {
+				job.Status = domain.JobStatusFailed
+				job.DeadLetteredAt = now
+			} else {
+				job.Status = domain.JobStatusQueued
+			}
+
+			return job, nil
+		})
+		if errors.Is(err, errNotExpired) || errors.Is(err, domain.ErrJobNotFound{}) {
+			continue
+		}
+		if err != nil {
+			return reaped, err
+		}
+		reaped++
+	}
+
+	return reaped, nil
+}
+
+// errNotExpired indicates a job's lease no longer needs to be reaped.
+var errNotExpired = errors.New("lease not expired")
+
+// modify applies fn to a job, and stores the job fn returns if the job did not
+// change in the meantime. Otherwise fn is applied again to the latest state of
+// the job.
+func (q *RedisQueue) modify(ctx context.Context, jobID int, fn func(job domain.Job) (domain.Job, error)) (domain.Job, error) {
+	conn, err := q.pool.GetContext(ctx)
+	if err != nil {
+		return domain.Job{}, err
+	}
+	defer conn.Close()
+
+	for i := 0; i < maxRedisRetries; i++ {
+		// check if the job is defined
+		job, version, err := q.fetch(conn, jobID)
+		if err != nil {
+			return domain.Job{}, err
+		}
+
+		job, err = fn(job)
+		if err != nil {
+			return domain.Job{}, err
+		}
+
+		err = q.save(conn, job, version)
+		if errors.Is(err, errRedisConflict) {
+			continue
+		}
+		if err != nil {
+			return domain.Job{}, err
+		}
+		q.settleDependents(ctx, job)
+
+		return job, nil
+	}
+
+	return domain.Job{}, errRedisConflict
+}
+
+// fetch returns a job along with its version.
+func (q *RedisQueue) fetch(conn redis.Conn, jobID int) (domain.Job, int, error) {
+	fields, err := redis.StringMap(conn.Do("HGETALL", q.jobKey(jobID)))
+	if err != nil {
+		return domain.Job{}, 0, err
+	}
+
+	if len(fields) == 0 {
+		return domain.Job{}, 0, domain.ErrJobNotFound{JobID: jobID}
+	}
+
+	job, err := jobFromHash(fields)
+	if err != nil {
+		return domain.Job{}, 0, err
+	}
+
+	version, err := strconv.Atoi(fields["version"])
+	if err != nil {
+		return domain.Job{}, 0, err
+	}
+
+	return job, version, nil
+}
+
+// save stores a job if its version still matches, and indexes it by its
+// status.
+func (q *RedisQueue) save(conn redis.Conn, job domain.Job, version int) error {
+	args, err := q.saveArgs(job, version)
+	if err != nil {
+		return err
+	}
+
+	saved, err := redis.Int(redisSaveScript.Do(conn, args...))
+	if err != nil {
+		return err
+	}
+
+	if saved == 0 {
+		return errRedisConflict
+	}
+
+	return nil
+}
+
+// saveArgs returns the keys and arguments of redisSaveScript for a job.
+func (q *RedisQueue) saveArgs(job domain.Job, version int) ([]interface{}, error) {
+	fields, err := redisFields(job)
+	if err != nil {
+		return nil, err
+	}
+
+	// the indexes come after the job and the stats
+	index, indexScore := redisIndex(job)
+	if index > 0 {
+		index += 2
+	}
+
+	followUp := job.ID
+	if job.BatchFollowUp != 0 {
+		followUp = job.BatchFollowUp
+	}
+
+	args := []interface{}{
+		q.jobKey(job.ID),
+		q.key("stats"),
+		q.key("ready", domain.JobTypeTimeCritical),
+		q.key("ready", domain.JobTypeNotTimeCritical),
+		q.key("delayed"),
+		q.key("leases"),
+		q.key("dead"),
+		q.key("blocked"),
+		q.jobKey(followUp),
+		version,
+		member(job.ID),
+		index,
+		indexScore,
+		job.Status,
+		q.key("status", ""),
+	}
+
+	return append(args, fields...), nil
+}
+
+// redisIndex returns the position of the index for a job's status among the
+// ready time critical, ready not time critical, delayed, leases, dead-letter
+// and blocked indexes, counting from 1, or 0 if the job is not indexed, along
+// with the job's score in the index.
+func redisIndex(job domain.Job) (int, int64) {
+	switch job.Status {
+	case domain.JobStatusQueued:
+		if job.Type == domain.JobTypeTimeCritical {
+			return 1, int64(-job.Priority)
+		}
+		return 2, int64(-job.Priority)
+	case domain.JobStatusScheduled:
+		return 3, score(job.RunAt)
+	case domain.JobStatusInProgress:
+		return 4, score(job.LeaseExpiresAt)
+	case domain.JobStatusFailed:
+		return 5, score(job.DeadLetteredAt)
+	case domain.JobStatusBlocked:
+		return 6, int64(job.ID)
+	}
+
+	return 0, 0
+}
+
+// redisFields returns the field and value pairs a job is stored with, except
+// for its status and version.
+func redisFields(job domain.Job) ([]interface{}, error) {
+	failures, err := json.Marshal(job.Failures)
+	if err != nil {
+		return nil, err
+	}
+
+	dependsOn, err := json.Marshal(job.DependsOn)
+	if err != nil {
+		return nil, err
+	}
+
+	return []interface{}{
+		"id", job.ID,
+		"type", job.Type,
+		"priority", job.Priority,
+		"payload", string(job.Payload),
+		"result", string(job.Result),
+		"consumer_id", job.ConsumerID,
+		"lease_expires_at", nanos(job.LeaseExpiresAt),
+		"progress", job.Progress,
+		"attempts", job.Attempts,
+		"max_attempts", job.MaxAttempts,
+		"last_error", job.LastError,
+		"failures", string(failures),
+		"run_at", nanos(job.RunAt),
+		"dead_lettered_at", nanos(job.DeadLetteredAt),
+		"unique_key", job.UniqueKey,
+		"depends_on", string(dependsOn),
+		"dependency_policy", job.DependencyPolicy,
+		"workflow_id", job.WorkflowID,
+		"batch_follow_up", job.BatchFollowUp,
+		"batch_remaining", job.BatchRemaining,
+		"batch_failed", job.BatchFailed,
+		"created_at", nanos(job.CreatedAt),
+	}, nil
+}
+
+// fetchAll returns the jobs with the given IDs in a single round trip. Jobs that
+// do not exist are left out.
+func (q *RedisQueue) fetchAll(conn redis.Conn, ids []int) (map[int]domain.Job, error) {
+	for _, id := range ids {
+		if err := conn.Send("HGETALL", q.jobKey(id)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	// every reply is received, even after an error, so none is left behind
+	// on the connection
+	var firstErr error
+	jobs := make(map[int]domain.Job, len(ids))
+	for range ids {
+		fields, err := redis.StringMap(conn.Receive())
+		if err != nil || len(fields) == 0 {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		job, err := jobFromHash(fields)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		jobs[job.ID] = job
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return jobs, nil
+}
+
+// indexed returns the IDs of the jobs in an index with a score up to max, in
+// order.
+func (q *RedisQueue) indexed(conn redis.Conn, index string, max string) ([]int, error) {
+	members, err := redis.Strings(conn.Do("ZRANGEBYSCORE", q.key(index), "-inf", max))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(members))
+	for _, m := range members {
+		id, err := strconv.Atoi(m)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// key returns the key of one of the queue's data structures.
+func (q *RedisQueue) key(parts ...string) string {
+	key := q.prefix
+	for i, part := range parts {
+		if i > 0 {
+			key += ":"
+		}
+		key += part
+	}
+
+	return key
+}
+
+// jobKey returns the key of the hash holding a job.
+func (q *RedisQueue) jobKey(jobID int) string {
+	return q.prefix + "job:" + member(jobID)
+}
+
+// member returns a job ID zero padded, so jobs with the same score in a sorted
+// set are ordered by ID.
+func member(jobID int) string {
+	return fmt.Sprintf("%020d", jobID)
+}
+
+// score converts a time into a sorted set score. Scores are floating point
+// numbers, microseconds keep them exact.
+func score(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+// jobFromHash reads a job from the fields of its hash.
+func jobFromHash(fields map[string]string) (domain.Job, error) {
+	job := domain.Job{
+		Type:       fields["type"],
+		Status:     fields["status"],
+		ConsumerID: fields["consumer_id"],
+		LastError:  fields["last_error"],
+		UniqueKey:  fields["unique_key"],
+
+		DependencyPolicy: fields["dependency_policy"],
+		WorkflowID:       fields["workflow_id"],
+	}
+
+	if payload := fields["payload"]; payload != "" {
+		job.Payload = json.RawMessage(payload)
+	}
+	if result := fields["result"]; result != "" {
+		job.Result = json.RawMessage(result)
+	}
+	if err := json.Unmarshal([]byte(fields["failures"]), &job.Failures); err != nil {
+		return domain.Job{}, err
+	}
+	if dependsOn := fields["depends_on"]; dependsOn != "" {
+		if err := json.Unmarshal([]byte(dependsOn), &job.DependsOn); err != nil {
+			return domain.Job{}, err
+		}
+	}
+
+	ints := map[string]*int{
+		"id":           &job.ID,
+		"priority":     &job.Priority,
+		"progress":     &job.Progress,
+		"attempts":     &job.Attempts,
+		"max_attempts": &job.MaxAttempts,
+	}
+	for field, value := range ints {
+		n, err := strconv.Atoi(fields[field])
+		if err != nil {
+			return domain.Job{}, fmt.Errorf("invalid %s: %w", field, err)
+		}
+		*value = n
+	}
+
+	times := map[string]*time.Time{
+		"lease_expires_at": &job.LeaseExpiresAt,
+		"run_at":           &job.RunAt,
+		"dead_lettered_at": &job.DeadLetteredAt,
+	}
+	for field, value := range times {
+		n, err := strconv.ParseInt(fields[field], 10, 64)
+		if err != nil {
+			return domain.Job{}, fmt.Errorf("invalid %s: %w", field, err)
+		}
+		*value = fromNanos(n)
+	}
+
+	// jobs saved before batches were added have no batch fields
+	batch := map[string]*int{
+		"batch_follow_up": &job.BatchFollowUp,
+		"batch_remaining": &job.BatchRemaining,
+		"batch_failed":    &job.BatchFailed,
+	}
+	for field, value := range batch {
+		if fields[field] == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(fields[field])
+		if err != nil {
+			return domain.Job{}, fmt.Errorf("invalid %s: %w", field, err)
+		}
+		*value = n
+	}
+
+	// jobs saved before creation times were recorded have none
+	if createdAt := fields["created_at"]; createdAt != "" {
+		n, err := strconv.ParseInt(createdAt, 10, 64)
+		if err != nil {
+			return domain.Job{}, fmt.Errorf("invalid created_at: %w", err)
+		}
+		job.CreatedAt = fromNanos(n)
+	}
+
+	return job, nil
+}
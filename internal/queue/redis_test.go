@@ -0,0 +1,382 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/handler"
+	"github.com/bkrebsbach/simple-job-queue/internal/queue/queuetest"
+)
+
+// newTestRedisQueue returns a queue stored in an in-process Redis server.
+func newTestRedisQueue(t *testing.T, opts ...Option) (*RedisQueue, *redis.Pool) {
+	server, err := miniredis.Run()
+	require.Nil(t, err)
+	t.Cleanup(server.Close)
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", server.Addr())
+		},
+	}
+	t.Cleanup(func() { _ = pool.Close() })
+
+	rq, err := NewRedisQueue(context.Background(), pool, "jobs", opts...)
+	require.Nil(t, err)
+
+	return rq, pool
+}
+
+func TestRedisQueue_Conformance(t *testing.T) {
+	queuetest.Run(t, func(t *testing.T) handler.JobQueuer {
+		rq, _ := newTestRedisQueue(t)
+		return rq
+	})
+}
+
+func TestRedisQueue_EnqueueDequeue(t *testing.T) {
+	ctx := context.Background()
+	rq, pool := newTestRedisQueue(t)
+
+	// set up state
+	payload := json.RawMessage(`{"customer":42}`)
+	ids := make([]int, 0)
+	for _, job := range []domain.Job{
+		{Type: domain.JobTypeNotTimeCritical, Priority: 0},
+		{Type: domain.JobTypeTimeCritical, Priority: 5},
+		{Type: domain.JobTypeTimeCritical, Priority: 0},
+		{Type: domain.JobTypeNotTimeCritical, Priority: 5},
+	} {
+		job.Status = domain.JobStatusQueued
+		job.Payload = payload
+
+		id, err := rq.Enqueue(ctx, job)
+		require.Nil(t, err)
+		ids = append(ids, id)
+	}
+
+	// check that jobs of every type are served by priority, and then in order
+	for _, want := range []int{ids[1], ids[3], ids[0], ids[2]} {
+		job, err := rq.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+		require.Equal(t, want, job.ID)
+		require.Equal(t, domain.JobStatusInProgress, job.Status)
+		require.Equal(t, "consumer-1", job.ConsumerID)
+		require.Equal(t, 1, job.Attempts)
+		require.Equal(t, payload, job.Payload)
+	}
+
+	_, err := rq.Dequeue(ctx, "consumer-1")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+
+	// check that only the consumer holding the job can conclude it
+	err = rq.Conclude(ctx, ids[0], "consumer-2", nil)
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+
+	result := json.RawMessage(`{"reindexed":true}`)
+	require.Nil(t, rq.Conclude(ctx, ids[0], "consumer-1", result))
+
+	concludedJob, err := rq.FetchJob(ctx, ids[0])
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusConcluded, concludedJob.Status)
+	require.Equal(t, result, concludedJob.Result)
+
+	// check that concluded jobs cannot be cancelled
+	err = rq.CancelJob(ctx, ids[0])
+	require.True(t, errors.Is(err, domain.ErrJobStatusTransitionNotAllowed{}))
+	require.Nil(t, rq.CancelJob(ctx, ids[1]))
+
+	_, err = rq.FetchJob(ctx, 100)
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+
+	stats, err := rq.Stats(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 4, stats.Total)
+	require.Equal(t, map[string]int{
+		domain.JobStatusConcluded:  1,
+		domain.JobStatusCancelled:  1,
+		domain.JobStatusInProgress: 2,
+	}, stats.Statuses)
+
+	names, err := ListRedisQueues(ctx, pool)
+	require.Nil(t, err)
+	require.Equal(t, []string{"jobs"}, names)
+}
+
+func TestRedisQueue_CancelQueued(t *testing.T) {
+	ctx := context.Background()
+	rq, _ := newTestRedisQueue(t)
+
+	// set up state
+	jobID, err := rq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+	require.Nil(t, err)
+
+	// check that a cancelled job is never dequeued
+	require.Nil(t, rq.CancelJob(ctx, jobID))
+
+	_, err = rq.Dequeue(ctx, "consumer-1")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+}
+
+func TestRedisQueue_ConcurrentDequeue(t *testing.T) {
+	ctx := context.Background()
+	rq, _ := newTestRedisQueue(t)
+
+	// set up state
+	const jobCount = 20
+	for i := 0; i < jobCount; i++ {
+		_, err := rq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+		require.Nil(t, err)
+	}
+
+	// check that every job is claimed by exactly one consumer
+	var lock sync.Mutex
+	claimed := make(map[int]string)
+	var wg sync.WaitGroup
+	for c := 0; c < 4; c++ {
+		consumerID := "consumer-" + strconv.Itoa(c)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				job, err := rq.Dequeue(ctx, consumerID)
+				if errors.Is(err, domain.ErrQueueEmpty) {
+					return
+				}
+				require.Nil(t, err)
+
+				lock.Lock()
+				_, ok := claimed[job.ID]
+				require.False(t, ok, "job %d claimed twice", job.ID)
+				claimed[job.ID] = consumerID
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Len(t, claimed, jobCount)
+}
+
+func TestRedisQueue_FailAndRedrive(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	rq, _ := newTestRedisQueue(t, WithRetryPolicy(RetryPolicy{
+		MaxAttempts:    2,
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Minute,
+		Multiplier:     2,
+	}))
+	rq.now = func() time.Time { return now }
+
+	// set up state
+	jobID, err := rq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+	require.Nil(t, err)
+
+	_, err = rq.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+
+	// check that the first failure schedules a retry after the backoff
+	failedJob, err := rq.Fail(ctx, jobID, "consumer-1", "boom")
+	require.Nil(t, err)
+	require.Equal(t, domain.JobStatusScheduled, failedJob.Status)
+	require.Equal(t, now.Add(time.Second), failedJob.RunAt)
+
+	_, err = rq.Dequeue(ctx, "consumer-1")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+
+	// check that the retried job is dequeued once due, and dead-lettered when
+	// its lease expires on the last attempt
+	now = now.Add(time.Second)
+	retriedJob, err := rq.Dequeue(ctx, "consumer-2")
+	require.Nil(t, err)
+	require.Equal(t, 2, retriedJob.Attempts)
+	require.True(t, retriedJob.RunAt.IsZero())
+
+	reaped, err := rq.reapExpiredLeases(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 0, reaped)
+
+	now = now.Add(rq.visibilityTimeout)
+	reaped, err = rq.reapExpiredLeases(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 1, reaped)
+
+	deadLetters, err := rq.ListDeadLetters(ctx)
+	require.Nil(t, err)
+	require.Len(t, deadLetters, 1)
+	require.Equal(t, domain.JobStatusFailed, deadLetters[0].Status)
+	require.Equal(t, []domain.Failure{
+		{Attempt: 1, ConsumerID: "consumer-1", Error: "boom", FailedAt: now.Add(-rq.visibilityTimeout - time.Second)},
+		{Attempt: 2, ConsumerID: "consumer-2", Error: "lease expired", FailedAt: now},
+	}, deadLetters[0].Failures)
+
+	// check that redriven jobs get a fresh set of attempts
+	count, err := rq.RedriveAll(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	_, err = rq.FetchDeadLetter(ctx, jobID)
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+
+	redrivenJob, err := rq.Dequeue(ctx, "consumer-3")
+	require.Nil(t, err)
+	require.Equal(t, 1, redrivenJob.Attempts)
+}
+
+func TestRedisQueue_Heartbeat(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	rq, _ := newTestRedisQueue(t, WithVisibilityTimeout(time.Minute))
+	rq.now = func() time.Time { return now }
+
+	// set up state
+	jobID, err := rq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+	require.Nil(t, err)
+
+	_, err = rq.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+
+	// check that the lease is extended and progress is recorded
+	now = now.Add(50 * time.Second)
+	progress := 40
+	leasedJob, err := rq.Heartbeat(ctx, jobID, "consumer-1", &progress)
+	require.Nil(t, err)
+	require.Equal(t, now.Add(time.Minute), leasedJob.LeaseExpiresAt)
+	require.Equal(t, 40, leasedJob.Progress)
+
+	now = now.Add(30 * time.Second)
+	reaped, err := rq.reapExpiredLeases(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 0, reaped)
+
+	// check that other consumers cannot extend the lease
+	_, err = rq.Heartbeat(ctx, jobID, "consumer-2", nil)
+	require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+}
+
+func TestRedisQueue_PriorityScheduling(t *testing.T) {
+	ctx := context.Background()
+	rq, _ := newTestRedisQueue(t, WithPriorityScheduling(2))
+
+	// set up state
+	types := []string{
+		domain.JobTypeNotTimeCritical,
+		domain.JobTypeNotTimeCritical,
+		domain.JobTypeTimeCritical,
+		domain.JobTypeTimeCritical,
+		domain.JobTypeTimeCritical,
+	}
+	for _, jobType := range types {
+		_, err := rq.Enqueue(ctx, domain.Job{Type: jobType, Status: domain.JobStatusQueued})
+		require.Nil(t, err)
+	}
+
+	// check that one job that is not time critical is served after every two
+	// time critical jobs
+	served := make([]string, 0)
+	for range types {
+		job, err := rq.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+		served = append(served, job.Type)
+	}
+	require.Equal(t, []string{
+		domain.JobTypeTimeCritical,
+		domain.JobTypeTimeCritical,
+		domain.JobTypeNotTimeCritical,
+		domain.JobTypeTimeCritical,
+		domain.JobTypeNotTimeCritical,
+	}, served)
+}
+
+func TestRedisQueue_PriorityScheduling_StreakReset(t *testing.T) {
+	ctx := context.Background()
+	rq, _ := newTestRedisQueue(t, WithPriorityScheduling(2))
+
+	// set up state: time critical jobs served while no other job waits
+	for i := 0; i < 3; i++ {
+		_, err := rq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+		require.Nil(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		_, err := rq.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+	}
+
+	types := []string{
+		domain.JobTypeNotTimeCritical,
+		domain.JobTypeTimeCritical,
+		domain.JobTypeTimeCritical,
+		domain.JobTypeTimeCritical,
+	}
+	for _, jobType := range types {
+		_, err := rq.Enqueue(ctx, domain.Job{Type: jobType, Status: domain.JobStatusQueued})
+		require.Nil(t, err)
+	}
+
+	// check that the streak only counts jobs served while both classes were
+	// waiting, like the in-memory queue
+	served := make([]int, 0)
+	for range types {
+		job, err := rq.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+		served = append(served, job.ID)
+	}
+	require.Equal(t, []int{5, 6, 4, 7}, served)
+}
+
+func TestRedisQueue_IndexStoredJobs(t *testing.T) {
+	ctx := context.Background()
+	rq, pool := newTestRedisQueue(t)
+
+	// set up state
+	ids := make([]int, 0)
+	for i := 0; i < 3; i++ {
+		id, err := rq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+		require.Nil(t, err)
+		ids = append(ids, id)
+	}
+
+	_, err := rq.Dequeue(ctx, "consumer-1")
+	require.Nil(t, err)
+
+	conn := pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("DEL", rq.key("indexed"), rq.key("jobs"),
+		rq.key("status", domain.JobStatusQueued), rq.key("status", domain.JobStatusInProgress))
+	require.Nil(t, err)
+
+	// check that the jobs of a queue stored without the indexes are listed
+	// once the queue is opened again
+	rq, err = NewRedisQueue(ctx, pool, "jobs")
+	require.Nil(t, err)
+
+	jobs, err := rq.ListJobs(ctx, domain.JobFilter{})
+	require.Nil(t, err)
+	require.Len(t, jobs, 3)
+
+	jobs, err = rq.ListJobs(ctx, domain.JobFilter{Status: domain.JobStatusQueued, AfterID: ids[1]})
+	require.Nil(t, err)
+	require.Len(t, jobs, 1)
+	require.Equal(t, ids[2], jobs[0].ID)
+
+	// check that the indexes follow the status of a job
+	require.Nil(t, rq.CancelJob(ctx, ids[1]))
+
+	jobs, err = rq.ListJobs(ctx, domain.JobFilter{Status: domain.JobStatusQueued})
+	require.Nil(t, err)
+	require.Len(t, jobs, 1)
+	require.Equal(t, ids[2], jobs[0].ID)
+}
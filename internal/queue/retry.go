@@ -0,0 +1,71 @@
+package queue
+
+import (
+	"math"
+	"time"
+)
+
+// DefaultRetryPolicy is the retry policy applied to job types without a policy
+// of their own.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: time.Second,
+	MaxBackoff:     5 * time.Minute,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// RetryPolicy defines how many times a failed job is attempted, and how long
+// the queue waits before making it available again.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a job is dequeued before a failure
+	// is considered final. Jobs may override it with their own MaxAttempts.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry. Each following
+	// retry waits Multiplier times longer, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+
+	// Jitter is the fraction of the delay that is randomized, so jobs that
+	// failed together do not all retry at the same time.
+	Jitter float64
+}
+
+// Backoff returns the delay before the given attempt is retried. The random
+// value is expected to be in [0, 1) and spreads the delay by the policy's
+// jitter.
+func (p RetryPolicy) Backoff(attempt int, random float64) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	delay := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+
+	// spread the delay evenly across [delay - jitter, delay + jitter]
+	delay += delay * p.Jitter * (2*random - 1)
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+
+	return time.Duration(delay)
+}
+
+// WithRetryPolicy sets the retry policy for job types that do not have their
+// own policy.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *config) {
+		c.retryPolicy = policy
+	}
+}
+
+// WithJobTypeRetryPolicy sets the retry policy for a single job type.
+func WithJobTypeRetryPolicy(jobType string, policy RetryPolicy) Option {
+	return func(c *config) {
+		c.typeRetryPolicies[jobType] = policy
+	}
+}
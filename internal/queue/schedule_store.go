@@ -0,0 +1,178 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/schedule"
+)
+
+// redisSchedulesKey is the hash holding the scheduler state shared by every
+// service instance, along with its version.
+const redisSchedulesKey = "sjq:schedules"
+
+// redisSaveSchedulesScript saves the scheduler state if the saved state is the
+// version before it.
+//
+// KEYS: the scheduler state
+// ARGV: version, and the state
+var redisSaveSchedulesScript = redis.NewScript(1, `
+local version = tonumber(redis.call('HGET', KEYS[1], 'version') or '0')
+if version + 1 ~= tonumber(ARGV[1]) then
+	return 0
+end
+
+redis.call('HSET', KEYS[1], 'version', ARGV[1], 'state', ARGV[2])
+return 1
+`)
+
+// RedisScheduleStore stores the schedules in Redis, shared by the service
+// instances using the same Redis server.
+type RedisScheduleStore struct {
+	pool *redis.Pool
+}
+
+// NewRedisScheduleStore returns a schedule store in Redis.
+func NewRedisScheduleStore(pool *redis.Pool) *RedisScheduleStore {
+	return &RedisScheduleStore{pool: pool}
+}
+
+// Load reads the scheduler state, returning an empty state if nothing has been
+// saved yet.
+func (s *RedisScheduleStore) Load() (schedule.State, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("HGET", redisSchedulesKey, "state"))
+	if errors.Is(err, redis.ErrNil) {
+		return schedule.State{}, nil
+	}
+	if err != nil {
+		return schedule.State{}, err
+	}
+
+	var state schedule.State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return schedule.State{}, err
+	}
+
+	return state, nil
+}
+
+// Save writes the scheduler state, unless another instance saved a state in
+// the meantime.
+func (s *RedisScheduleStore) Save(state schedule.State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	saved, err := redis.Bool(redisSaveSchedulesScript.Do(conn, redisSchedulesKey, state.Version, data))
+	if err != nil {
+		return err
+	}
+	if !saved {
+		return schedule.ErrStateChanged
+	}
+
+	return nil
+}
+
+// SQLScheduleStore stores the schedules in the database of the SQL job queue,
+// shared by the service instances using the same database.
+type SQLScheduleStore struct {
+	db *sql.DB
+}
+
+// NewSQLScheduleStore returns a schedule store in a database migrated with
+// MigrateSQL.
+func NewSQLScheduleStore(db *sql.DB) *SQLScheduleStore {
+	return &SQLScheduleStore{db: db}
+}
+
+// Load reads the scheduler state, returning an empty state if nothing has been
+// saved yet.
+func (s *SQLScheduleStore) Load() (schedule.State, error) {
+	var data string
+	err := s.db.QueryRowContext(context.Background(), `SELECT state FROM schedules WHERE id = 1`).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return schedule.State{}, nil
+	}
+	if err != nil {
+		return schedule.State{}, err
+	}
+
+	var state schedule.State
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return schedule.State{}, err
+	}
+
+	return state, nil
+}
+
+// Save writes the scheduler state, unless another instance saved a state in
+// the meantime. The first state is inserted, and every later state replaces
+// the version before it.
+func (s *SQLScheduleStore) Save(state schedule.State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	var result sql.Result
+	if state.Version == 1 {
+		result, err = s.db.ExecContext(context.Background(),
+			`INSERT INTO schedules (id, version, state) VALUES (1, $1, $2) ON CONFLICT (id) DO NOTHING`,
+			state.Version, string(data))
+	} else {
+		result, err = s.db.ExecContext(context.Background(),
+			`UPDATE schedules SET version = $1, state = $2 WHERE id = 1 AND version = $3`,
+			state.Version, string(data), state.Version-1)
+	}
+	if err != nil {
+		return err
+	}
+
+	saved, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if saved == 0 {
+		return schedule.ErrStateChanged
+	}
+
+	return nil
+}
+
+// clusterScheduleStore stores the schedules in the state replicated by a
+// cluster. Only the leader can save them.
+type clusterScheduleStore struct {
+	cluster *Cluster
+}
+
+// ScheduleStore returns a store that replicates the schedules to every node of
+// the cluster, so they survive a change of leader.
+func (c *Cluster) ScheduleStore() schedule.Store {
+	return clusterScheduleStore{cluster: c}
+}
+
+// Load returns the scheduler state applied on this node, which is only
+// guaranteed to be current on the leader.
+func (s clusterScheduleStore) Load() (schedule.State, error) {
+	return s.cluster.fsm.scheduleState(), nil
+}
+
+// Save applies the scheduler state through the Raft log, unless another
+// state was applied in the meantime.
+func (s clusterScheduleStore) Save(state schedule.State) error {
+	_, err := s.cluster.apply(context.Background(), command{Op: opSaveSchedules, Schedules: &state})
+
+	return err
+}
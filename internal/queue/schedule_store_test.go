@@ -0,0 +1,86 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/schedule"
+)
+
+// testScheduleStore checks that a store only saves a state based on the latest
+// saved state. The store may hold a state saved earlier, e.g. in a shared
+// database.
+func testScheduleStore(t *testing.T, store schedule.Store) {
+	// set up state
+	saved, err := store.Load()
+	require.Nil(t, err)
+
+	state := schedule.State{
+		MaxID: saved.MaxID + 1,
+		Schedules: []domain.Schedule{{
+			ID:        saved.MaxID + 1,
+			Type:      domain.JobTypeTimeCritical,
+			Payload:   []byte(`{"customer":42}`),
+			Cron:      "@hourly",
+			NextRunAt: time.Date(2020, 1, 1, 11, 0, 0, 0, time.UTC),
+			CreatedAt: time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC),
+		}},
+		Version: saved.Version + 1,
+	}
+
+	// check that the next version is saved and loaded
+	require.Nil(t, store.Save(state))
+
+	loaded, err := store.Load()
+	require.Nil(t, err)
+	require.Equal(t, state, loaded)
+
+	// check that a state that is not the next version is rejected
+	require.True(t, errors.Is(store.Save(state), schedule.ErrStateChanged))
+
+	skipped := state
+	skipped.Version += 2
+	require.True(t, errors.Is(store.Save(skipped), schedule.ErrStateChanged))
+
+	next := state
+	next.Schedules = nil
+	next.Version++
+	require.Nil(t, store.Save(next))
+
+	loaded, err = store.Load()
+	require.Nil(t, err)
+	require.Equal(t, next.Version, loaded.Version)
+	require.Empty(t, loaded.Schedules)
+}
+
+func TestRedisScheduleStore(t *testing.T) {
+	_, pool := newTestRedisQueue(t)
+	testScheduleStore(t, NewRedisScheduleStore(pool))
+}
+
+func TestSQLScheduleStore(t *testing.T) {
+	forEachSQLDialect(t, func(t *testing.T, newQueue func(opts ...Option) *SQLQueue) {
+		testScheduleStore(t, NewSQLScheduleStore(newQueue().db))
+	})
+}
+
+func TestClusterScheduleStore(t *testing.T) {
+	tc := newTestCluster(t, 3)
+	leader := tc.leader(t)
+	testScheduleStore(t, leader.ScheduleStore())
+
+	// check that the schedules are replicated to every node
+	want, err := leader.ScheduleStore().Load()
+	require.Nil(t, err)
+
+	for _, node := range tc.nodes {
+		require.Eventually(t, func() bool {
+			state, err := node.ScheduleStore().Load()
+			return err == nil && state.Version == want.Version
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+}
@@ -0,0 +1,152 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+const (
+	snapshotPrefix = "snapshot-"
+	snapshotExt    = ".json"
+)
+
+// snapshot defines the state of a durable queue written to disk. It covers the
+// write-ahead log up to and including Segment.
+type snapshot struct {
+	Segment int          `json:"segment"`
+	MaxID   int          `json:"maxID"`
+	Jobs    []domain.Job `json:"jobs"`
+}
+
+// snapshotPath returns the path of the snapshot covering the given segment.
+func snapshotPath(dir string, segment int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%020d%s", snapshotPrefix, segment, snapshotExt))
+}
+
+// writeSnapshot atomically writes a snapshot to dir, by writing it to a
+// temporary file that is renamed once it is synced to disk.
+func writeSnapshot(dir string, s snapshot) error {
+	sort.Slice(s.Jobs, func(i, j int) bool {
+		return s.Jobs[i].ID < s.Jobs[j].ID
+	})
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	path := snapshotPath(dir, s.Segment)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// the rename has to be on disk before the log it replaces is removed
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// loadLatestSnapshot returns the most recent snapshot in dir, or an empty
+// snapshot if there is none.
+func loadLatestSnapshot(dir string) (snapshot, error) {
+	segments, err := listSnapshots(dir)
+	if err != nil {
+		return snapshot{}, err
+	}
+
+	if len(segments) == 0 {
+		return snapshot{}, nil
+	}
+
+	path := snapshotPath(dir, segments[len(segments)-1])
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return snapshot{}, err
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return snapshot{}, fmt.Errorf("unable to load %s: %w", path, err)
+	}
+
+	return s, nil
+}
+
+// removeSnapshotsBefore removes the snapshots older than the one covering the
+// given segment.
+func removeSnapshotsBefore(dir string, segment int) error {
+	segments, err := listSnapshots(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		if s >= segment {
+			continue
+		}
+
+		if err := os.Remove(snapshotPath(dir, s)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listSnapshots returns the segments covered by the snapshots in dir in
+// ascending order.
+func listSnapshots(dir string) ([]int, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]int, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotExt) {
+			continue
+		}
+
+		segment, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotExt))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Ints(segments)
+
+	return segments, nil
+}
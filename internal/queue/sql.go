@@ -0,0 +1,1424 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+// SQLDialect describes how a database differs from the SQL the queue is
+// written in.
+type SQLDialect struct {
+	// idColumn defines an auto incrementing primary key that never reuses IDs
+	idColumn string
+
+	// skipLocked is appended to queries claiming rows, so concurrent
+	// consumers skip rows claimed by another transaction instead of waiting
+	skipLocked string
+
+	// forUpdate is appended to queries reading a row that is about to change
+	forUpdate string
+
+	// lockMigrations serializes migrations between service instances
+	lockMigrations string
+}
+
+var (
+	// PostgresDialect is the dialect for PostgreSQL. Rows are claimed with
+	// SELECT ... FOR UPDATE SKIP LOCKED, so any number of service instances
+	// can share the database.
+	PostgresDialect = SQLDialect{
+		idColumn:       "BIGSERIAL PRIMARY KEY",
+		skipLocked:     "FOR UPDATE SKIP LOCKED",
+		forUpdate:      "FOR UPDATE",
+		lockMigrations: "LOCK TABLE schema_migrations IN EXCLUSIVE MODE",
+	}
+
+	// SQLiteDialect is the dialect for SQLite. SQLite serializes writes, so
+	// rows do not need to be locked, but the database must be opened with a
+	// single connection, and by a single service instance.
+	SQLiteDialect = SQLDialect{
+		idColumn: "INTEGER PRIMARY KEY AUTOINCREMENT",
+	}
+)
+
+// jobFields are the columns holding the state of a job, in the order of
+// jobValues.
+var jobFields = []string{
+	"type", "status", "priority", "payload", "result", "consumer_id", "lease_expires_at", "progress",
+	"attempts", "max_attempts", "last_error", "failures", "run_at", "dead_lettered_at", "unique_key",
+	"depends_on", "dependency_policy", "workflow_id", "batch_follow_up", "batch_remaining", "batch_failed",
+	"created_at",
+}
+
+// jobColumns are the columns read by scanJob.
+var jobColumns = "id, " + strings.Join(jobFields, ", ")
+
+// SQLQueue is a job queue stored in a relational database, which lets several
+// service instances share the same queue. Each named queue is a set of rows in
+// the same jobs table.
+type SQLQueue struct {
+	config
+
+	db      *sql.DB
+	dialect SQLDialect
+	name    string
+
+	// timeCriticalStreak counts the time critical jobs served in a row by
+	// this instance with priority scheduling
+	timeCriticalStreak int
+
+	lock sync.Mutex
+}
+
+// NewSQLQueue returns the named job queue stored in db. The schema must have
+// been created with MigrateSQL.
+func NewSQLQueue(db *sql.DB, dialect SQLDialect, name string, opts ...Option) *SQLQueue {
+	return &SQLQueue{
+		config:  newConfig(opts),
+		db:      db,
+		dialect: dialect,
+		name:    name,
+		lock:    sync.Mutex{},
+	}
+}
+
+// ListSQLQueues returns the names of the queues that have jobs in db.
+func ListSQLQueues(ctx context.Context, db *sql.DB) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT DISTINCT queue_name FROM jobs ORDER BY queue_name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+// Enqueue adds a job to the queue, and returns the ID of the job. Jobs with a
+// RunAt in the future are scheduled, and stay invisible to Dequeue until then.
+// A job with the idempotency key of a job enqueued earlier is not added, the ID
+// of the earlier job is returned instead. A job with the unique key of an
+// active job is handled according to its unique policy. A job that depends on
+// other jobs is blocked until they concluded.
+func (q *SQLQueue) Enqueue(ctx context.Context, job domain.Job) (int, error) {
+	job = q.prepare(job)
+
+	if job.IdempotencyKey == "" && job.UniqueKey == "" && len(job.DependsOn) == 0 {
+		return q.insert(ctx, q.db, job)
+	}
+
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := q.enqueue(ctx, tx, job)
+	if err != nil {
+		return id, err
+	}
+
+	return id, tx.Commit()
+}
+
+// prepare stamps a job with the time it is enqueued, and holds it back if it
+// is scheduled.
+func (q *SQLQueue) prepare(job domain.Job) domain.Job {
+	job.CreatedAt = q.now()
+
+	// hold scheduled jobs back until they are due
+	if job.RunAt.After(q.now()) {
+		job.Status = domain.JobStatusScheduled
+	} else {
+		if job.Status == domain.JobStatusScheduled {
+			job.Status = domain.JobStatusQueued
+		}
+		job.RunAt = time.Time{}
+	}
+
+	// hold a batch follow-up job back until the jobs of its batch concluded
+	if job.BatchRemaining > 0 {
+		job = resolveDependencies(job, nil, q.now())
+	}
+
+	return job
+}
+
+// enqueue adds a prepared job to the queue in a transaction, and returns the ID
+// of the job, or of the job it was merged into.
+func (q *SQLQueue) enqueue(ctx context.Context, tx *sql.Tx, job domain.Job) (int, error) {
+	// a repeated request gets the job it enqueued the first time
+	if job.IdempotencyKey != "" {
+		id, claimed, err := q.claimIdempotencyKey(ctx, tx, job)
+		if err != nil || !claimed {
+			return id, err
+		}
+	}
+
+	// only one active job may hold a unique key. A merged job gives up the
+	// idempotency key it claimed, so a retry is merged again
+	if job.UniqueKey != "" {
+		id, err := q.claimUniqueKey(ctx, tx, job)
+		if err != nil {
+			return id, err
+		}
+
+		if id != 0 && job.IdempotencyKey != "" {
+			_, err = tx.ExecContext(ctx,
+				`DELETE FROM idempotency_keys WHERE queue_name = $1 AND idempotency_key = $2`,
+				q.name, job.IdempotencyKey,
+			)
+		}
+		if err != nil || id != 0 {
+			return id, err
+		}
+	}
+
+	// hold the job back until the jobs it depends on concluded, which are
+	// locked so they cannot change before the job is registered with them
+	if len(job.DependsOn) > 0 {
+		parents, err := q.parents(ctx, tx, job, q.dialect.forUpdate)
+		if err != nil {
+			return 0, err
+		}
+		job = resolveDependencies(job, parents, q.now())
+	}
+
+	id, err := q.insert(ctx, tx, job)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, parentID := range job.DependsOn {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO job_dependencies (queue_name, parent_id, job_id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+			q.name, parentID, id,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if job.IdempotencyKey != "" {
+		_, err = tx.ExecContext(ctx,
+			`UPDATE idempotency_keys SET job_id = $1 WHERE queue_name = $2 AND idempotency_key = $3`,
+			id, q.name, job.IdempotencyKey,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if job.UniqueKey != "" {
+		_, err = tx.ExecContext(ctx,
+			`UPDATE unique_keys SET job_id = $1 WHERE queue_name = $2 AND unique_key = $3`,
+			id, q.name, job.UniqueKey,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return id, nil
+}
+
+// claimIdempotencyKey claims the job's idempotency key, unless it was used by
+// a job enqueued earlier and has not expired, in which case it returns the ID
+// of the earlier job. The key is claimed by inserting it, so concurrent
+// requests with the same key wait for each other.
+func (q *SQLQueue) claimIdempotencyKey(ctx context.Context, tx *sql.Tx, job domain.Job) (int, bool, error) {
+	// claim the key, or take over a key that expired
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO idempotency_keys (queue_name, idempotency_key, request_hash, job_id, expires_at)
+		VALUES ($1, $2, $3, 0, $4)
+		ON CONFLICT (queue_name, idempotency_key) DO UPDATE
+		SET request_hash = excluded.request_hash, job_id = 0, expires_at = excluded.expires_at
+		WHERE idempotency_keys.expires_at <= $5`,
+		q.name, job.IdempotencyKey, job.IdempotencyHash, nanos(job.IdempotencyExpiresAt), nanos(q.now()),
+	)
+	if err != nil {
+		return 0, false, err
+	}
+
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return 0, false, err
+	}
+	if claimed > 0 {
+		return 0, true, nil
+	}
+
+	var id int
+	var hash string
+	err = tx.QueryRowContext(ctx,
+		`SELECT job_id, request_hash FROM idempotency_keys WHERE queue_name = $1 AND idempotency_key = $2`,
+		q.name, job.IdempotencyKey,
+	).Scan(&id, &hash)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if hash != job.IdempotencyHash {
+		return 0, false, domain.ErrIdempotencyKeyReused{Key: job.IdempotencyKey}
+	}
+
+	return id, false, nil
+}
+
+// claimUniqueKey locks the job's unique key, and applies the job's unique
+// policy if an active job holds the key. It returns the ID of the active job if
+// the job is merged into it. Concurrent requests with the same key wait for
+// each other on the lock until the transaction ends.
+func (q *SQLQueue) claimUniqueKey(ctx context.Context, tx *sql.Tx, job domain.Job) (int, error) {
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO unique_keys (queue_name, unique_key, job_id) VALUES ($1, $2, 0) ON CONFLICT DO NOTHING`,
+		q.name, job.UniqueKey,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var activeID int
+	err = tx.QueryRowContext(ctx,
+		`SELECT job_id FROM unique_keys WHERE queue_name = $1 AND unique_key = $2 `+q.dialect.forUpdate,
+		q.name, job.UniqueKey,
+	).Scan(&activeID)
+	if err != nil {
+		return 0, err
+	}
+
+	// the last job enqueued with the key may have finished since
+	activeJob, err := scanJob(tx.QueryRowContext(ctx,
+		fmt.Sprintf(`SELECT %s FROM jobs WHERE id = $1 AND queue_name = $2`, jobColumns),
+		activeID, q.name,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !domain.ActiveJobStatuses[activeJob.Status] {
+		return 0, nil
+	}
+
+	merged, activeJob, err := resolveUniqueKey(job, activeJob)
+	if err != nil || merged {
+		return activeJob.ID, err
+	}
+
+	return 0, q.update(ctx, tx, activeJob)
+}
+
+// insert adds a job to the jobs table, and returns its ID.
+func (q *SQLQueue) insert(ctx context.Context, db rowQuerier, job domain.Job) (int, error) {
+	values, err := jobValues(job)
+	if err != nil {
+		return 0, err
+	}
+
+	query := fmt.Sprintf(
+		`INSERT INTO jobs (queue_name, %s) VALUES ($1, %s) RETURNING id`,
+		strings.Join(jobFields, ", "),
+		placeholders(2, len(jobFields)),
+	)
+
+	var id int
+	err = db.QueryRowContext(ctx, query, append([]interface{}{q.name}, values...)...).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// EnqueueBatch adds jobs to the queue in a single transaction, and returns the
+// ID of every job or the error that kept it from being added, in the order the
+// jobs were given. Every job is added under a savepoint of its own, so a job
+// that fails does not keep the other jobs from being added.
+func (q *SQLQueue) EnqueueBatch(ctx context.Context, jobs []domain.Job) ([]int, []error) {
+	ids := make([]int, len(jobs))
+	errs := make([]error, len(jobs))
+
+	// failAll reports an error that kept every job from being added
+	failAll := func(err error) ([]int, []error) {
+		for i := range errs {
+			ids[i], errs[i] = 0, err
+		}
+		return ids, errs
+	}
+
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return failAll(err)
+	}
+	defer tx.Rollback()
+
+	for i, job := range jobs {
+		if _, err := tx.ExecContext(ctx, `SAVEPOINT enqueue_job`); err != nil {
+			return failAll(err)
+		}
+
+		ids[i], errs[i] = q.enqueue(ctx, tx, q.prepare(job))
+
+		// undo what the job changed before it failed
+		if errs[i] != nil {
+			ids[i] = 0
+			if _, err := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT enqueue_job`); err != nil {
+				return failAll(err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `RELEASE SAVEPOINT enqueue_job`); err != nil {
+			return failAll(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return failAll(err)
+	}
+
+	return ids, errs
+}
+
+// Dequeue claims a job from the queue. Jobs are served by priority, and then in
+// the order they were enqueued. With priority scheduling, time critical jobs
+// are served first. The job is claimed atomically, so concurrent consumers,
+// including ones connected to other service instances, never receive the same
+// job.
+func (q *SQLQueue) Dequeue(ctx context.Context, consumerID string) (domain.Job, error) {
+	jobs, err := q.DequeueBatch(ctx, consumerID, 1)
+	if err != nil {
+		return domain.Job{}, err
+	}
+
+	return jobs[0], nil
+}
+
+// DequeueBatch claims up to max jobs from the queue in a single transaction.
+// Jobs are served in the same order as Dequeue serves them one at a time.
+func (q *SQLQueue) DequeueBatch(ctx context.Context, consumerID string, max int) ([]domain.Job, error) {
+	now := q.now()
+
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// the batch is served from the first max claimable jobs of each type
+	timeCritical, err := q.claimable(ctx, tx, domain.JobTypeTimeCritical, now, max)
+	if err != nil {
+		return nil, err
+	}
+
+	notTimeCritical, err := q.claimable(ctx, tx, domain.JobTypeNotTimeCritical, now, max)
+	if err != nil {
+		return nil, err
+	}
+
+	q.lock.Lock()
+	ids, streak := q.interleave(timeCritical, notTimeCritical, q.timeCriticalStreak, max)
+	q.lock.Unlock()
+
+	if len(ids) == 0 {
+		return nil, domain.ErrQueueEmpty
+	}
+
+	args := []interface{}{domain.JobStatusInProgress, consumerID, nanos(now.Add(q.visibilityTimeout))}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		fmt.Sprintf(`
+			UPDATE jobs
+			SET status = $1, consumer_id = $2, lease_expires_at = $3, attempts = attempts + 1, run_at = 0
+			WHERE id IN (%s)
+			RETURNING %s`,
+			placeholders(4, len(ids)),
+			jobColumns,
+		),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs, err := scanJobs(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// rows are returned in no particular order
+	order := make(map[int]int, len(ids))
+	for i, id := range ids {
+		order[id] = i
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return order[jobs[i].ID] < order[jobs[j].ID]
+	})
+
+	if q.prioritize {
+		q.lock.Lock()
+		q.timeCriticalStreak = streak
+		q.lock.Unlock()
+	}
+
+	return jobs, nil
+}
+
+// claimable returns up to max jobs of the type that can be claimed, in
+// the order they are served. Scheduled jobs that are due are claimed along
+// with queued jobs, where retried jobs keep their place ahead of newer jobs of
+// the same priority.
+func (q *SQLQueue) claimable(ctx context.Context, tx *sql.Tx, jobType string, now time.Time, max int) ([]queueEntry, error) {
+	query := fmt.Sprintf(`
+		SELECT id, priority FROM jobs
+		WHERE queue_name = $1 AND type = $2 AND (status = $3 OR (status = $4 AND run_at <= $5))
+		ORDER BY priority DESC, id
+		LIMIT $6
+		%s`,
+		q.dialect.skipLocked,
+	)
+
+	rows, err := tx.QueryContext(ctx, query,
+		q.name, jobType, domain.JobStatusQueued, domain.JobStatusScheduled, nanos(now), max,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []queueEntry
+	for rows.Next() {
+		var entry queueEntry
+		if err := rows.Scan(&entry.id, &entry.priority); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// interleave picks up to max jobs from the claimable jobs of each type, the
+// way the in-memory queue picks between its ready heaps, and returns their IDs
+// along with the time critical streak after serving them.
+func (q *SQLQueue) interleave(timeCritical, notTimeCritical []queueEntry, streak int, max int) ([]int, int) {
+	ids := make([]int, 0, max)
+	for len(ids) < max {
+		pickTimeCritical := false
+
+		switch {
+		case len(timeCritical) == 0 && len(notTimeCritical) == 0:
+			return ids, streak
+		case len(notTimeCritical) == 0:
+			streak = 0
+			pickTimeCritical = true
+		case len(timeCritical) == 0:
+			streak = 0
+		case !q.prioritize:
+			pickTimeCritical = timeCritical[0].before(notTimeCritical[0])
+		case streak >= q.timeCriticalRatio:
+			streak = 0
+		default:
+			streak++
+			pickTimeCritical = true
+		}
+
+		if pickTimeCritical {
+			ids = append(ids, timeCritical[0].id)
+			timeCritical = timeCritical[1:]
+		} else {
+			ids = append(ids, notTimeCritical[0].id)
+			notTimeCritical = notTimeCritical[1:]
+		}
+	}
+
+	return ids, streak
+}
+
+// Conclude finishes execution on the job, and stores the result reported by
+// the consumer.
+func (q *SQLQueue) Conclude(ctx context.Context, jobID int, consumerID string, result json.RawMessage) error {
+	_, err := q.modify(ctx, jobID, func(job domain.Job) (domain.Job, error) {
+		// only the consumer that dequeued the job is allowed to conclude it
+		if job.ConsumerID != consumerID {
+			return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+		}
+
+		if job.Status != domain.JobStatusInProgress {
+			return domain.Job{}, domain.ErrJobStatusTransitionNotAllowed{JobID: jobID}
+		}
+
+		job.Status = domain.JobStatusConcluded
+		job.Result = result
+
+		return job, nil
+	})
+
+	return err
+}
+
+// Fail reports that a consumer was unable to process a job. The job is retried
+// after a backoff, unless it has run out of attempts, in which case it is moved
+// to the dead-letter queue.
+func (q *SQLQueue) Fail(ctx context.Context, jobID int, consumerID string, reason string) (domain.Job, error) {
+	return q.modify(ctx, jobID, func(job domain.Job) (domain.Job, error) {
+		// only the consumer that dequeued the job is allowed to fail it
+		if job.ConsumerID != consumerID {
+			return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+		}
+
+		if job.Status != domain.JobStatusInProgress {
+			return domain.Job{}, domain.ErrJobStatusTransitionNotAllowed{JobID: jobID}
+		}
+
+		now := q.now()
+		policy := q.retryPolicyFor(job)
+
+		job = recordFailure(job, reason, now)
+
+		if job.Attempts >= policy.MaxAttempts {
+			job.Status = domain.JobStatusFailed
+			job.DeadLetteredAt = now
+
+			return job, nil
+		}
+
+		// hold the job back until the backoff has passed
+		job.Status = domain.JobStatusScheduled
+		job.RunAt = now.Add(policy.Backoff(job.Attempts, q.random()))
+
+		return job, nil
+	})
+}
+
+// Heartbeat extends the lease on an in progress job by the visibility timeout,
+// and records the progress reported by the consumer if one is given.
+func (q *SQLQueue) Heartbeat(ctx context.Context, jobID int, consumerID string, progress *int) (domain.Job, error) {
+	return q.modify(ctx, jobID, func(job domain.Job) (domain.Job, error) {
+		// only the consumer that dequeued the job is allowed to extend its lease
+		if job.ConsumerID != consumerID {
+			return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+		}
+
+		if job.Status != domain.JobStatusInProgress {
+			return domain.Job{}, domain.ErrJobStatusTransitionNotAllowed{JobID: jobID}
+		}
+
+		job.LeaseExpiresAt = q.now().Add(q.visibilityTimeout)
+		if progress != nil {
+			job.Progress = *progress
+		}
+
+		return job, nil
+	})
+}
+
+// FetchJob returns a job definition for the given job ID.
+func (q *SQLQueue) FetchJob(ctx context.Context, jobID int) (domain.Job, error) {
+	query := fmt.Sprintf(`SELECT %s FROM jobs WHERE id = $1 AND queue_name = $2`, jobColumns)
+
+	job, err := scanJob(q.db.QueryRowContext(ctx, query, jobID, q.name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+	}
+
+	return job, err
+}
+
+// CancelJob cancels a job that has not yet been concluded.
+func (q *SQLQueue) CancelJob(ctx context.Context, jobID int) error {
+	_, err := q.modify(ctx, jobID, func(job domain.Job) (domain.Job, error) {
+		if job.Status == domain.JobStatusConcluded {
+			return domain.Job{}, domain.ErrJobStatusTransitionNotAllowed{JobID: jobID}
+		}
+
+		job.Status = domain.JobStatusCancelled
+
+		return job, nil
+	})
+
+	return err
+}
+
+// RequeueJob returns an in progress job to the queue, e.g. because its consumer
+// is known to be gone, without waiting for its lease to expire. The attempt is
+// recorded as failed, but the job is not dead-lettered even if it ran out of
+// attempts.
+func (q *SQLQueue) RequeueJob(ctx context.Context, jobID int) error {
+	_, err := q.modify(ctx, jobID, func(job domain.Job) (domain.Job, error) {
+		if job.Status != domain.JobStatusInProgress {
+			return domain.Job{}, domain.ErrJobStatusTransitionNotAllowed{JobID: jobID}
+		}
+
+		job = recordFailure(job, requeueReason, q.now())
+		job.Status = domain.JobStatusQueued
+
+		return job, nil
+	})
+
+	return err
+}
+
+// ListDeadLetters returns the jobs in the dead-letter queue, oldest first.
+func (q *SQLQueue) ListDeadLetters(ctx context.Context) ([]domain.Job, error) {
+	query := fmt.Sprintf(
+		`SELECT %s FROM jobs WHERE queue_name = $1 AND status = $2 ORDER BY dead_lettered_at, id`,
+		jobColumns,
+	)
+
+	rows, err := q.db.QueryContext(ctx, query, q.name, domain.JobStatusFailed)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanJobs(rows)
+}
+
+// FetchDeadLetter returns a job from the dead-letter queue, including its
+// failure history.
+func (q *SQLQueue) FetchDeadLetter(ctx context.Context, jobID int) (domain.Job, error) {
+	job, err := q.FetchJob(ctx, jobID)
+	if err != nil {
+		return domain.Job{}, err
+	}
+
+	if job.Status != domain.JobStatusFailed {
+		return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+	}
+
+	return job, nil
+}
+
+// Redrive moves a job from the dead-letter queue back into the queue with a
+// fresh set of attempts. The failure history is kept.
+func (q *SQLQueue) Redrive(ctx context.Context, jobID int) error {
+	_, err := q.modify(ctx, jobID, func(job domain.Job) (domain.Job, error) {
+		if job.Status != domain.JobStatusFailed {
+			return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+		}
+
+		job.Status = domain.JobStatusQueued
+		job.Attempts = 0
+		job.DeadLetteredAt = time.Time{}
+
+		return job, nil
+	})
+
+	return err
+}
+
+// RedriveAll moves every job in the dead-letter queue back into the queue, and
+// returns the number of jobs redriven.
+func (q *SQLQueue) RedriveAll(ctx context.Context) (int, error) {
+	result, err := q.db.ExecContext(ctx,
+		`UPDATE jobs SET status = $1, attempts = 0, dead_lettered_at = 0 WHERE queue_name = $2 AND status = $3`,
+		domain.JobStatusQueued, q.name, domain.JobStatusFailed,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := result.RowsAffected()
+
+	return int(count), err
+}
+
+// Stats returns the number of jobs tracked by the queue, broken down by status.
+func (q *SQLQueue) Stats(ctx context.Context) (domain.QueueStats, error) {
+	rows, err := q.db.QueryContext(ctx,
+		`SELECT status, COUNT(*) FROM jobs WHERE queue_name = $1 GROUP BY status`,
+		q.name,
+	)
+	if err != nil {
+		return domain.QueueStats{}, err
+	}
+	defer rows.Close()
+
+	stats := domain.QueueStats{
+		Statuses: make(map[string]int),
+	}
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return domain.QueueStats{}, err
+		}
+		stats.Statuses[status] = count
+		stats.Total += count
+	}
+
+	return stats, rows.Err()
+}
+
+// EnqueueWorkflow adds the jobs of a workflow to the queue in a single
+// transaction, and returns the IDs of the jobs in the order they were given.
+// Either every job is added, or none of them if one cannot be added.
+func (q *SQLQueue) EnqueueWorkflow(ctx context.Context, jobs []domain.WorkflowJob) ([]int, error) {
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids := make([]int, 0, len(jobs))
+	for _, workflowJob := range jobs {
+		job, err := workflowDependencies(workflowJob, ids)
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := q.enqueue(ctx, tx, q.prepare(job))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// ListWorkflowJobs returns the jobs of a workflow in the order they were
+// enqueued.
+func (q *SQLQueue) ListWorkflowJobs(ctx context.Context, workflowID string) ([]domain.Job, error) {
+	rows, err := q.db.QueryContext(ctx,
+		fmt.Sprintf(`SELECT %s FROM jobs WHERE queue_name = $1 AND workflow_id = $2 ORDER BY id`, jobColumns),
+		q.name, workflowID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs, err := scanJobs(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(jobs) == 0 {
+		return nil, domain.ErrWorkflowNotFound{WorkflowID: workflowID}
+	}
+
+	return jobs, nil
+}
+
+// ListJobs returns the jobs selected by the filter, ordered by ID.
+func (q *SQLQueue) ListJobs(ctx context.Context, filter domain.JobFilter) ([]domain.Job, error) {
+	where, args := q.filterJobs(filter)
+
+	query := fmt.Sprintf(`SELECT %s FROM jobs WHERE %s ORDER BY id`, jobColumns, where)
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanJobs(rows)
+}
+
+// CancelJobs cancels every active job selected by the filter in a single
+// transaction, and returns the number of jobs cancelled.
+func (q *SQLQueue) CancelJobs(ctx context.Context, filter domain.JobFilter) (int, error) {
+	return q.modifyAll(ctx, filter, func(job domain.Job) (domain.Job, bool) {
+		if !domain.ActiveJobStatuses[job.Status] {
+			return domain.Job{}, false
+		}
+
+		job.Status = domain.JobStatusCancelled
+
+		return job, true
+	})
+}
+
+// RequeueJobs returns every in progress job selected by the filter to the queue
+// in a single transaction, and returns the number of jobs requeued.
+func (q *SQLQueue) RequeueJobs(ctx context.Context, filter domain.JobFilter) (int, error) {
+	now := q.now()
+
+	return q.modifyAll(ctx, filter, func(job domain.Job) (domain.Job, bool) {
+		if job.Status != domain.JobStatusInProgress {
+			return domain.Job{}, false
+		}
+
+		job = recordFailure(job, requeueReason, now)
+		job.Status = domain.JobStatusQueued
+
+		return job, true
+	})
+}
+
+// filterJobs returns the condition selecting the jobs of the queue that match
+// a filter, along with its parameters.
+func (q *SQLQueue) filterJobs(filter domain.JobFilter) (string, []interface{}) {
+	conditions := []string{"queue_name = $1", "id > $2"}
+	args := []interface{}{q.name, filter.AfterID}
+
+	// where adds a condition on the next parameter
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.Status != "" {
+		where("status = $%d", filter.Status)
+	}
+	if filter.Type != "" {
+		where("type = $%d", filter.Type)
+	}
+	if filter.ConsumerID != "" {
+		where("consumer_id = $%d", filter.ConsumerID)
+	}
+	if !filter.CreatedAfter.IsZero() {
+		where("created_at > $%d", nanos(filter.CreatedAfter))
+	}
+	if !filter.CreatedBefore.IsZero() {
+		where("created_at < $%d", nanos(filter.CreatedBefore))
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+// RunReaper periodically returns in progress jobs with an expired lease to the
+// queue, and moves scheduled jobs to the queue once they are due. It blocks
+// until the context is cancelled. Several service instances can run the reaper
+// at the same time.
+func (q *SQLQueue) RunReaper(ctx context.Context, interval time.Duration, log zerolog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := q.reapExpiredLeases(ctx); err != nil {
+				log.Error().Err(err).Str("queue", q.name).Msg("unable to reap expired leases")
+			}
+
+			if err := q.promoteDueJobs(ctx); err != nil {
+				log.Error().Err(err).Str("queue", q.name).Msg("unable to promote scheduled jobs")
+			}
+
+			if err := q.removeExpiredIdempotencyKeys(ctx); err != nil {
+				log.Error().Err(err).Str("queue", q.name).Msg("unable to remove expired idempotency keys")
+			}
+
+			if err := q.removeSettledDependencies(ctx); err != nil {
+				log.Error().Err(err).Str("queue", q.name).Msg("unable to remove settled dependencies")
+			}
+		}
+	}
+}
+
+// reapExpiredLeases puts in progress jobs whose lease has expired back in the
+// queue so another consumer can pick them up. A lost lease counts as a failed
+// attempt, so jobs that keep losing their lease are eventually dead-lettered.
+// It returns the number of jobs that were reaped.
+func (q *SQLQueue) reapExpiredLeases(ctx context.Context) (int, error) {
+	now := q.now()
+
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf(
+		`SELECT %s FROM jobs WHERE queue_name = $1 AND status = $2 AND lease_expires_at <= $3 ORDER BY id %s`,
+		jobColumns,
+		q.dialect.skipLocked,
+	)
+
+	rows, err := tx.QueryContext(ctx, query, q.name, domain.JobStatusInProgress, nanos(now))
+	if err != nil {
+		return 0, err
+	}
+
+	expired, err := scanJobs(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, job := range expired {
+		job = recordFailure(job, "lease expired", now)
+
+		if job.Attempts >= q.retryPolicyFor(job).MaxAttempts {
+			job.Status = domain.JobStatusFailed
+			job.DeadLetteredAt = now
+		} else {
+			job.Status = domain.JobStatusQueued
+		}
+
+		if err := q.update(ctx, tx, job); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(expired), tx.Commit()
+}
+
+// promoteDueJobs moves scheduled jobs that are due to the queue. Dequeue claims
+// due jobs either way, this keeps their status up to date.
+func (q *SQLQueue) promoteDueJobs(ctx context.Context) error {
+	_, err := q.db.ExecContext(ctx,
+		`UPDATE jobs SET status = $1, run_at = 0 WHERE queue_name = $2 AND status = $3 AND run_at <= $4`,
+		domain.JobStatusQueued, q.name, domain.JobStatusScheduled, nanos(q.now()),
+	)
+
+	return err
+}
+
+// removeExpiredIdempotencyKeys deletes the idempotency keys that expired, the
+// jobs they enqueued are kept.
+func (q *SQLQueue) removeExpiredIdempotencyKeys(ctx context.Context) error {
+	_, err := q.db.ExecContext(ctx,
+		`DELETE FROM idempotency_keys WHERE queue_name = $1 AND expires_at <= $2`,
+		q.name, nanos(q.now()),
+	)
+
+	return err
+}
+
+// removeSettledDependencies deletes the dependencies of jobs that are no longer
+// blocked. Jobs are only blocked when they are enqueued, so the dependencies
+// are not needed again.
+func (q *SQLQueue) removeSettledDependencies(ctx context.Context) error {
+	_, err := q.db.ExecContext(ctx, `
+		DELETE FROM job_dependencies WHERE queue_name = $1 AND job_id IN (
+			SELECT id FROM jobs WHERE queue_name = $1 AND status <> $2
+		)`,
+		q.name, domain.JobStatusBlocked,
+	)
+
+	return err
+}
+
+// modify applies fn to a job in a transaction, with the job's row locked, and
+// stores the job fn returns.
+func (q *SQLQueue) modify(ctx context.Context, jobID int, fn func(job domain.Job) (domain.Job, error)) (domain.Job, error) {
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return domain.Job{}, err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf(`SELECT %s FROM jobs WHERE id = $1 AND queue_name = $2 %s`, jobColumns, q.dialect.forUpdate)
+
+	// check if the job is defined
+	job, err := scanJob(tx.QueryRowContext(ctx, query, jobID, q.name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.Job{}, domain.ErrJobNotFound{JobID: jobID}
+	}
+	if err != nil {
+		return domain.Job{}, err
+	}
+
+	job, err = fn(job)
+	if err != nil {
+		return domain.Job{}, err
+	}
+
+	if err := q.update(ctx, tx, job); err != nil {
+		return domain.Job{}, err
+	}
+
+	return job, tx.Commit()
+}
+
+// modifyAll applies fn to every job selected by a filter in a transaction, with
+// the jobs' rows locked, and stores the jobs fn changes. It returns the number
+// of jobs changed.
+func (q *SQLQueue) modifyAll(ctx context.Context, filter domain.JobFilter, fn func(job domain.Job) (domain.Job, bool)) (int, error) {
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	filter.AfterID = 0
+	where, args := q.filterJobs(filter)
+	query := fmt.Sprintf(`SELECT %s FROM jobs WHERE %s ORDER BY id %s`, jobColumns, where, q.dialect.forUpdate)
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	jobs, err := scanJobs(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, job := range jobs {
+		job, ok := fn(job)
+		if !ok {
+			continue
+		}
+
+		if err := q.update(ctx, tx, job); err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	return count, tx.Commit()
+}
+
+// update stores the state of a job.
+func (q *SQLQueue) update(ctx context.Context, tx *sql.Tx, job domain.Job) error {
+	values, err := jobValues(job)
+	if err != nil {
+		return err
+	}
+
+	assignments := make([]string, 0, len(jobFields))
+	for i, field := range jobFields {
+		assignments = append(assignments, fmt.Sprintf("%s = $%d", field, i+1))
+	}
+
+	query := fmt.Sprintf(
+		`UPDATE jobs SET %s WHERE id = $%d`,
+		strings.Join(assignments, ", "),
+		len(jobFields)+1,
+	)
+
+	// the follow-up job of a batch counts the changes of the jobs of the batch
+	previous := ""
+	if job.BatchFollowUp != 0 {
+		err := tx.QueryRowContext(ctx, `SELECT status FROM jobs WHERE id = $1`, job.ID).Scan(&previous)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, query, append(values, job.ID)...); err != nil {
+		return err
+	}
+
+	if job.BatchFollowUp != 0 {
+		if err := q.settleBatch(ctx, tx, job, previous); err != nil {
+			return err
+		}
+	}
+
+	return q.settleDependents(ctx, tx, job)
+}
+
+// settleBatch counts the change of a job of a batch from the previous status
+// with the follow-up job of the batch, and releases or cancels the follow-up
+// job once the count allows it. The count is changed by a single statement,
+// so the jobs of a batch that change at once all count.
+func (q *SQLQueue) settleBatch(ctx context.Context, tx *sql.Tx, job domain.Job, previous string) error {
+	remaining, failed := batchProgress(previous, job.Status)
+	if remaining == 0 && failed == 0 {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		UPDATE jobs SET batch_remaining = batch_remaining + $1, batch_failed = batch_failed + $2
+		WHERE queue_name = $3 AND id = $4 AND status = $5`,
+		remaining, failed, q.name, job.BatchFollowUp, domain.JobStatusBlocked,
+	)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(`SELECT %s FROM jobs WHERE queue_name = $1 AND id = $2 AND status = $3 %s`, jobColumns, q.dialect.forUpdate)
+	followUp, err := scanJob(tx.QueryRowContext(ctx, query, q.name, job.BatchFollowUp, domain.JobStatusBlocked))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	followUp = resolveDependencies(followUp, nil, q.now())
+	if followUp.Status == domain.JobStatusBlocked {
+		return nil
+	}
+
+	return q.update(ctx, tx, followUp)
+}
+
+// parents returns the jobs a job depends on, reading them with the given
+// locking clause.
+func (q *SQLQueue) parents(ctx context.Context, tx *sql.Tx, job domain.Job, lock string) ([]domain.Job, error) {
+	ids := make([]interface{}, 0, len(job.DependsOn))
+	for _, id := range job.DependsOn {
+		ids = append(ids, id)
+	}
+
+	query := fmt.Sprintf(
+		`SELECT %s FROM jobs WHERE queue_name = $1 AND id IN (%s) ORDER BY id %s`,
+		jobColumns,
+		placeholders(2, len(ids)),
+		lock,
+	)
+
+	rows, err := tx.QueryContext(ctx, query, append([]interface{}{q.name}, ids...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs, err := scanJobs(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[int]domain.Job, len(jobs))
+	for _, parent := range jobs {
+		found[parent.ID] = parent
+	}
+
+	parents := make([]domain.Job, 0, len(job.DependsOn))
+	for _, id := range job.DependsOn {
+		parent, ok := found[id]
+		if !ok {
+			return nil, domain.ErrJobNotFound{JobID: id}
+		}
+		parents = append(parents, parent)
+	}
+
+	return parents, nil
+}
+
+// settleDependents releases or cancels the blocked jobs that depend on a job
+// that is no longer active. Cancelled jobs settle their own dependents in turn,
+// as they are stored with update. The blocked jobs are locked, so concurrent
+// changes to the jobs they depend on see each other's change.
+func (q *SQLQueue) settleDependents(ctx context.Context, tx *sql.Tx, job domain.Job) error {
+	if domain.ActiveJobStatuses[job.Status] {
+		return nil
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s FROM jobs
+		WHERE queue_name = $1 AND status = $2 AND id IN (
+			SELECT job_id FROM job_dependencies WHERE queue_name = $1 AND parent_id = $3
+		)
+		ORDER BY id
+		%s`,
+		jobColumns,
+		q.dialect.forUpdate,
+	)
+
+	rows, err := tx.QueryContext(ctx, query, q.name, domain.JobStatusBlocked, job.ID)
+	if err != nil {
+		return err
+	}
+
+	dependents, err := scanJobs(rows)
+	if err != nil {
+		return err
+	}
+
+	for _, dependent := range dependents {
+		parents, err := q.parents(ctx, tx, dependent, "")
+		if err != nil {
+			return err
+		}
+
+		dependent = resolveDependencies(dependent, parents, q.now())
+		if dependent.Status == domain.JobStatusBlocked {
+			continue
+		}
+
+		if err := q.update(ctx, tx, dependent); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// jobValues returns the values of the jobFields columns for a job.
+func jobValues(job domain.Job) ([]interface{}, error) {
+	failures, err := json.Marshal(job.Failures)
+	if err != nil {
+		return nil, err
+	}
+
+	dependsOn, err := json.Marshal(job.DependsOn)
+	if err != nil {
+		return nil, err
+	}
+
+	return []interface{}{
+		job.Type,
+		job.Status,
+		job.Priority,
+		nullableJSON(job.Payload),
+		nullableJSON(job.Result),
+		job.ConsumerID,
+		nanos(job.LeaseExpiresAt),
+		job.Progress,
+		job.Attempts,
+		job.MaxAttempts,
+		job.LastError,
+		string(failures),
+		nanos(job.RunAt),
+		nanos(job.DeadLetteredAt),
+		job.UniqueKey,
+		string(dependsOn),
+		job.DependencyPolicy,
+		job.WorkflowID,
+		job.BatchFollowUp,
+		job.BatchRemaining,
+		job.BatchFailed,
+		nanos(job.CreatedAt),
+	}, nil
+}
+
+// rowQuerier is implemented by *sql.DB and *sql.Tx.
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanJob reads a job from a row holding the jobColumns columns.
+func scanJob(row rowScanner) (domain.Job, error) {
+	var job domain.Job
+	var payload, result sql.NullString
+	var failures, dependsOn string
+	var leaseExpiresAt, runAt, deadLetteredAt, createdAt int64
+
+	err := row.Scan(
+		&job.ID,
+		&job.Type,
+		&job.Status,
+		&job.Priority,
+		&payload,
+		&result,
+		&job.ConsumerID,
+		&leaseExpiresAt,
+		&job.Progress,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.LastError,
+		&failures,
+		&runAt,
+		&deadLetteredAt,
+		&job.UniqueKey,
+		&dependsOn,
+		&job.DependencyPolicy,
+		&job.WorkflowID,
+		&job.BatchFollowUp,
+		&job.BatchRemaining,
+		&job.BatchFailed,
+		&createdAt,
+	)
+	if err != nil {
+		return domain.Job{}, err
+	}
+
+	if payload.Valid {
+		job.Payload = json.RawMessage(payload.String)
+	}
+	if result.Valid {
+		job.Result = json.RawMessage(result.String)
+	}
+	if err := json.Unmarshal([]byte(failures), &job.Failures); err != nil {
+		return domain.Job{}, err
+	}
+	if err := json.Unmarshal([]byte(dependsOn), &job.DependsOn); err != nil {
+		return domain.Job{}, err
+	}
+	job.LeaseExpiresAt = fromNanos(leaseExpiresAt)
+	job.RunAt = fromNanos(runAt)
+	job.DeadLetteredAt = fromNanos(deadLetteredAt)
+	job.CreatedAt = fromNanos(createdAt)
+
+	return job, nil
+}
+
+// scanJobs reads every job from rows holding the jobColumns columns, and
+// closes the rows.
+func scanJobs(rows *sql.Rows) ([]domain.Job, error) {
+	defer rows.Close()
+
+	jobs := make([]domain.Job, 0)
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// placeholders returns n comma separated placeholders, numbered from first.
+func placeholders(first, n int) string {
+	params := make([]string, 0, n)
+	for i := first; i < first+n; i++ {
+		params = append(params, fmt.Sprintf("$%d", i))
+	}
+
+	return strings.Join(params, ", ")
+}
+
+// nullableJSON stores empty raw JSON as NULL.
+func nullableJSON(raw json.RawMessage) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+
+	return string(raw)
+}
+
+// nanos stores a time as nanoseconds since the Unix epoch, and the zero time as
+// 0, which keeps times comparable across databases.
+func nanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+// fromNanos restores a time stored by nanos.
+func fromNanos(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, n).UTC()
+}
@@ -0,0 +1,111 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// sqlMigrations defines the schema of the SQL job queue. Migrations are applied
+// in order and must never change once released, add a new migration instead.
+// $ID_COLUMN is replaced with the dialect's auto incrementing primary key.
+var sqlMigrations = []string{
+	`CREATE TABLE jobs (
+		id $ID_COLUMN,
+		queue_name TEXT NOT NULL,
+		type TEXT NOT NULL,
+		status TEXT NOT NULL,
+		priority INTEGER NOT NULL DEFAULT 0,
+		payload TEXT,
+		result TEXT,
+		consumer_id TEXT NOT NULL DEFAULT '',
+		lease_expires_at BIGINT NOT NULL DEFAULT 0,
+		progress INTEGER NOT NULL DEFAULT 0,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		max_attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		failures TEXT NOT NULL DEFAULT 'null',
+		run_at BIGINT NOT NULL DEFAULT 0,
+		dead_lettered_at BIGINT NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX jobs_queue_status_idx ON jobs (queue_name, status, priority DESC, id)`,
+	`CREATE TABLE schedules (
+		id INTEGER PRIMARY KEY,
+		version INTEGER NOT NULL,
+		state TEXT NOT NULL
+	)`,
+	`CREATE TABLE idempotency_keys (
+		queue_name TEXT NOT NULL,
+		idempotency_key TEXT NOT NULL,
+		request_hash TEXT NOT NULL,
+		job_id BIGINT NOT NULL,
+		expires_at BIGINT NOT NULL,
+		PRIMARY KEY (queue_name, idempotency_key)
+	)`,
+	`ALTER TABLE jobs ADD COLUMN unique_key TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE unique_keys (
+		queue_name TEXT NOT NULL,
+		unique_key TEXT NOT NULL,
+		job_id BIGINT NOT NULL,
+		PRIMARY KEY (queue_name, unique_key)
+	)`,
+	`ALTER TABLE jobs ADD COLUMN depends_on TEXT NOT NULL DEFAULT 'null'`,
+	`ALTER TABLE jobs ADD COLUMN dependency_policy TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE jobs ADD COLUMN workflow_id TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX jobs_workflow_idx ON jobs (queue_name, workflow_id)`,
+	`CREATE TABLE job_dependencies (
+		queue_name TEXT NOT NULL,
+		parent_id BIGINT NOT NULL,
+		job_id BIGINT NOT NULL,
+		PRIMARY KEY (parent_id, job_id)
+	)`,
+	`CREATE INDEX job_dependencies_queue_idx ON job_dependencies (queue_name, parent_id)`,
+	`ALTER TABLE jobs ADD COLUMN batch_follow_up BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE jobs ADD COLUMN batch_remaining INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE jobs ADD COLUMN batch_failed INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE jobs ADD COLUMN created_at BIGINT NOT NULL DEFAULT 0`,
+	`CREATE INDEX jobs_created_idx ON jobs (queue_name, created_at)`,
+	`CREATE INDEX jobs_consumer_idx ON jobs (queue_name, consumer_id, id)`,
+}
+
+// MigrateSQL creates or upgrades the job queue schema. It is safe to call from
+// several service instances at once.
+func MigrateSQL(ctx context.Context, db *sql.DB, dialect SQLDialect) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// instances that start at the same time wait for each other here, and
+	// then see the migrations that were applied in the meantime
+	if dialect.lockMigrations != "" {
+		if _, err := tx.ExecContext(ctx, dialect.lockMigrations); err != nil {
+			return err
+		}
+	}
+
+	var version int
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqlMigrations); i++ {
+		migration := strings.ReplaceAll(sqlMigrations[i], "$ID_COLUMN", dialect.idColumn)
+		if _, err := tx.ExecContext(ctx, migration); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,552 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/handler"
+	"github.com/bkrebsbach/simple-job-queue/internal/queue/queuetest"
+)
+
+// forEachSQLDialect runs a test against SQLite, and against PostgreSQL when
+// POSTGRES_TEST_DSN is set. Every test uses its own named queue, so tests do
+// not see each other's jobs in a shared database.
+func forEachSQLDialect(t *testing.T, test func(t *testing.T, newQueue func(opts ...Option) *SQLQueue)) {
+	t.Run("sqlite", func(t *testing.T) {
+		db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "jobs.db"))
+		require.Nil(t, err)
+		db.SetMaxOpenConns(1)
+		defer db.Close()
+
+		require.Nil(t, MigrateSQL(context.Background(), db, SQLiteDialect))
+
+		queueName := t.Name()
+		test(t, func(opts ...Option) *SQLQueue {
+			return NewSQLQueue(db, SQLiteDialect, nextQueueName(&queueName), opts...)
+		})
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv("POSTGRES_TEST_DSN")
+		if dsn == "" {
+			t.Skip("POSTGRES_TEST_DSN is not set")
+		}
+
+		db, err := sql.Open("postgres", dsn)
+		require.Nil(t, err)
+		defer db.Close()
+
+		require.Nil(t, MigrateSQL(context.Background(), db, PostgresDialect))
+
+		queueName := t.Name() + "-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		test(t, func(opts ...Option) *SQLQueue {
+			return NewSQLQueue(db, PostgresDialect, nextQueueName(&queueName), opts...)
+		})
+	})
+}
+
+// nextQueueName returns the queue name, and changes it so queues created later
+// in the same test do not share jobs.
+func nextQueueName(name *string) string {
+	current := *name
+	*name = current + "+"
+
+	return current
+}
+
+func TestSQLQueue_Conformance(t *testing.T) {
+	forEachSQLDialect(t, func(t *testing.T, newQueue func(opts ...Option) *SQLQueue) {
+		queuetest.Run(t, func(t *testing.T) handler.JobQueuer {
+			return newQueue()
+		})
+	})
+}
+
+func TestSQLQueue_EnqueueDequeue(t *testing.T) {
+	forEachSQLDialect(t, func(t *testing.T, newQueue func(opts ...Option) *SQLQueue) {
+		ctx := context.Background()
+		sq := newQueue()
+
+		// set up state
+		payload := json.RawMessage(`{"customer":42}`)
+		ids := make([]int, 0)
+		for _, priority := range []int{0, 5, 0} {
+			id, err := sq.Enqueue(ctx, domain.Job{
+				Type:     domain.JobTypeTimeCritical,
+				Status:   domain.JobStatusQueued,
+				Priority: priority,
+				Payload:  payload,
+			})
+			require.Nil(t, err)
+			ids = append(ids, id)
+		}
+
+		// check that jobs are served by priority, and then in order
+		for _, want := range []int{ids[1], ids[0], ids[2]} {
+			job, err := sq.Dequeue(ctx, "consumer-1")
+			require.Nil(t, err)
+			require.Equal(t, want, job.ID)
+			require.Equal(t, domain.JobStatusInProgress, job.Status)
+			require.Equal(t, "consumer-1", job.ConsumerID)
+			require.Equal(t, 1, job.Attempts)
+			require.Equal(t, payload, job.Payload)
+		}
+
+		_, err := sq.Dequeue(ctx, "consumer-1")
+		require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+
+		// check that only the consumer holding the job can conclude it
+		err = sq.Conclude(ctx, ids[0], "consumer-2", nil)
+		require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+
+		result := json.RawMessage(`{"reindexed":true}`)
+		require.Nil(t, sq.Conclude(ctx, ids[0], "consumer-1", result))
+
+		concludedJob, err := sq.FetchJob(ctx, ids[0])
+		require.Nil(t, err)
+		require.Equal(t, domain.JobStatusConcluded, concludedJob.Status)
+		require.Equal(t, result, concludedJob.Result)
+
+		// check that concluded jobs cannot be cancelled
+		err = sq.CancelJob(ctx, ids[0])
+		require.True(t, errors.Is(err, domain.ErrJobStatusTransitionNotAllowed{}))
+		require.Nil(t, sq.CancelJob(ctx, ids[1]))
+
+		stats, err := sq.Stats(ctx)
+		require.Nil(t, err)
+		require.Equal(t, 3, stats.Total)
+		require.Equal(t, map[string]int{
+			domain.JobStatusConcluded:  1,
+			domain.JobStatusCancelled:  1,
+			domain.JobStatusInProgress: 1,
+		}, stats.Statuses)
+	})
+}
+
+func TestSQLQueue_ConcurrentDequeue(t *testing.T) {
+	forEachSQLDialect(t, func(t *testing.T, newQueue func(opts ...Option) *SQLQueue) {
+		ctx := context.Background()
+		sq := newQueue()
+
+		// set up state
+		const jobCount = 20
+		for i := 0; i < jobCount; i++ {
+			_, err := sq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+			require.Nil(t, err)
+		}
+
+		// check that every job is claimed by exactly one consumer
+		var lock sync.Mutex
+		claimed := make(map[int]string)
+		var wg sync.WaitGroup
+		for c := 0; c < 4; c++ {
+			consumerID := "consumer-" + strconv.Itoa(c)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for {
+					job, err := sq.Dequeue(ctx, consumerID)
+					if errors.Is(err, domain.ErrQueueEmpty) {
+						return
+					}
+					require.Nil(t, err)
+
+					lock.Lock()
+					_, ok := claimed[job.ID]
+					require.False(t, ok, "job %d claimed twice", job.ID)
+					claimed[job.ID] = consumerID
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		require.Len(t, claimed, jobCount)
+	})
+}
+
+func TestSQLQueue_Scheduled(t *testing.T) {
+	forEachSQLDialect(t, func(t *testing.T, newQueue func(opts ...Option) *SQLQueue) {
+		ctx := context.Background()
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		sq := newQueue()
+		sq.now = func() time.Time { return now }
+
+		// set up state
+		jobID, err := sq.Enqueue(ctx, domain.Job{
+			Type:   domain.JobTypeTimeCritical,
+			Status: domain.JobStatusQueued,
+			RunAt:  now.Add(time.Minute),
+		})
+		require.Nil(t, err)
+
+		// check that the job is invisible until it is due
+		_, err = sq.Dequeue(ctx, "consumer-1")
+		require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+
+		now = now.Add(time.Minute)
+		require.Nil(t, sq.promoteDueJobs(ctx))
+
+		queuedJob, err := sq.FetchJob(ctx, jobID)
+		require.Nil(t, err)
+		require.Equal(t, domain.JobStatusQueued, queuedJob.Status)
+		require.True(t, queuedJob.RunAt.IsZero())
+
+		dequeuedJob, err := sq.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+		require.Equal(t, jobID, dequeuedJob.ID)
+	})
+}
+
+func TestSQLQueue_IdempotencyKeyExpires(t *testing.T) {
+	forEachSQLDialect(t, func(t *testing.T, newQueue func(opts ...Option) *SQLQueue) {
+		ctx := context.Background()
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		sq := newQueue()
+		sq.now = func() time.Time { return now }
+
+		// set up state
+		job := domain.Job{
+			Type:                 domain.JobTypeTimeCritical,
+			Status:               domain.JobStatusQueued,
+			IdempotencyKey:       "order-42",
+			IdempotencyHash:      "hash-1",
+			IdempotencyExpiresAt: now.Add(time.Hour),
+		}
+		jobID, err := sq.Enqueue(ctx, job)
+		require.Nil(t, err)
+
+		// check that the key can be reused once it expired
+		now = now.Add(time.Hour)
+		job.IdempotencyHash = "hash-2"
+		job.IdempotencyExpiresAt = now.Add(time.Hour)
+		newJobID, err := sq.Enqueue(ctx, job)
+		require.Nil(t, err)
+		require.NotEqual(t, jobID, newJobID)
+
+		retriedID, err := sq.Enqueue(ctx, job)
+		require.Nil(t, err)
+		require.Equal(t, newJobID, retriedID)
+
+		// check that expired keys are removed
+		now = now.Add(time.Hour)
+		require.Nil(t, sq.removeExpiredIdempotencyKeys(ctx))
+
+		var count int
+		require.Nil(t, sq.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM idempotency_keys WHERE queue_name = $1`, sq.name).Scan(&count))
+		require.Equal(t, 0, count)
+	})
+}
+
+func TestSQLQueue_FailAndRedrive(t *testing.T) {
+	forEachSQLDialect(t, func(t *testing.T, newQueue func(opts ...Option) *SQLQueue) {
+		ctx := context.Background()
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		sq := newQueue(WithRetryPolicy(RetryPolicy{
+			MaxAttempts:    2,
+			InitialBackoff: time.Second,
+			MaxBackoff:     time.Minute,
+			Multiplier:     2,
+		}))
+		sq.now = func() time.Time { return now }
+
+		// set up state
+		jobID, err := sq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+		require.Nil(t, err)
+
+		_, err = sq.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+
+		// check that the first failure schedules a retry after the backoff
+		failedJob, err := sq.Fail(ctx, jobID, "consumer-1", "boom")
+		require.Nil(t, err)
+		require.Equal(t, domain.JobStatusScheduled, failedJob.Status)
+		require.Equal(t, now.Add(time.Second), failedJob.RunAt)
+
+		_, err = sq.Dequeue(ctx, "consumer-1")
+		require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+
+		// check that the retried job is dequeued once due, and dead-lettered
+		// when its lease expires on the last attempt
+		now = now.Add(time.Second)
+		retriedJob, err := sq.Dequeue(ctx, "consumer-2")
+		require.Nil(t, err)
+		require.Equal(t, 2, retriedJob.Attempts)
+
+		now = now.Add(sq.visibilityTimeout)
+		reaped, err := sq.reapExpiredLeases(ctx)
+		require.Nil(t, err)
+		require.Equal(t, 1, reaped)
+
+		deadLetters, err := sq.ListDeadLetters(ctx)
+		require.Nil(t, err)
+		require.Len(t, deadLetters, 1)
+		require.Equal(t, domain.JobStatusFailed, deadLetters[0].Status)
+		require.Equal(t, []domain.Failure{
+			{Attempt: 1, ConsumerID: "consumer-1", Error: "boom", FailedAt: now.Add(-sq.visibilityTimeout - time.Second)},
+			{Attempt: 2, ConsumerID: "consumer-2", Error: "lease expired", FailedAt: now},
+		}, deadLetters[0].Failures)
+
+		// check that a redriven job gets a fresh set of attempts
+		require.Nil(t, sq.Redrive(ctx, jobID))
+
+		_, err = sq.FetchDeadLetter(ctx, jobID)
+		require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+
+		redrivenJob, err := sq.Dequeue(ctx, "consumer-3")
+		require.Nil(t, err)
+		require.Equal(t, 1, redrivenJob.Attempts)
+	})
+}
+
+func TestSQLQueue_Heartbeat(t *testing.T) {
+	forEachSQLDialect(t, func(t *testing.T, newQueue func(opts ...Option) *SQLQueue) {
+		ctx := context.Background()
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		sq := newQueue(WithVisibilityTimeout(time.Minute))
+		sq.now = func() time.Time { return now }
+
+		// set up state
+		jobID, err := sq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+		require.Nil(t, err)
+
+		_, err = sq.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+
+		// check that the lease is extended and progress is recorded
+		now = now.Add(50 * time.Second)
+		progress := 40
+		leasedJob, err := sq.Heartbeat(ctx, jobID, "consumer-1", &progress)
+		require.Nil(t, err)
+		require.Equal(t, now.Add(time.Minute), leasedJob.LeaseExpiresAt)
+		require.Equal(t, 40, leasedJob.Progress)
+
+		now = now.Add(30 * time.Second)
+		reaped, err := sq.reapExpiredLeases(ctx)
+		require.Nil(t, err)
+		require.Equal(t, 0, reaped)
+
+		// check that other consumers cannot extend the lease
+		_, err = sq.Heartbeat(ctx, jobID, "consumer-2", nil)
+		require.True(t, errors.Is(err, domain.ErrJobNotFound{}))
+	})
+}
+
+func TestSQLQueue_PriorityScheduling(t *testing.T) {
+	forEachSQLDialect(t, func(t *testing.T, newQueue func(opts ...Option) *SQLQueue) {
+		ctx := context.Background()
+		sq := newQueue(WithPriorityScheduling(2))
+
+		// set up state
+		types := []string{
+			domain.JobTypeNotTimeCritical,
+			domain.JobTypeNotTimeCritical,
+			domain.JobTypeTimeCritical,
+			domain.JobTypeTimeCritical,
+			domain.JobTypeTimeCritical,
+		}
+		for _, jobType := range types {
+			_, err := sq.Enqueue(ctx, domain.Job{Type: jobType, Status: domain.JobStatusQueued})
+			require.Nil(t, err)
+		}
+
+		// check that one job that is not time critical is served after every
+		// two time critical jobs
+		served := make([]string, 0)
+		for range types {
+			job, err := sq.Dequeue(ctx, "consumer-1")
+			require.Nil(t, err)
+			served = append(served, job.Type)
+		}
+		require.Equal(t, []string{
+			domain.JobTypeTimeCritical,
+			domain.JobTypeTimeCritical,
+			domain.JobTypeNotTimeCritical,
+			domain.JobTypeTimeCritical,
+			domain.JobTypeNotTimeCritical,
+		}, served)
+	})
+}
+
+func TestSQLQueue_PriorityScheduling_DequeueBatch(t *testing.T) {
+	forEachSQLDialect(t, func(t *testing.T, newQueue func(opts ...Option) *SQLQueue) {
+		ctx := context.Background()
+		sq := newQueue(WithPriorityScheduling(2))
+
+		// set up state
+		types := []string{
+			domain.JobTypeNotTimeCritical,
+			domain.JobTypeTimeCritical,
+			domain.JobTypeTimeCritical,
+			domain.JobTypeTimeCritical,
+		}
+		for _, jobType := range types {
+			_, err := sq.Enqueue(ctx, domain.Job{Type: jobType, Status: domain.JobStatusQueued})
+			require.Nil(t, err)
+		}
+
+		// check that a batch interleaves job types like single dequeues do
+		jobs, err := sq.DequeueBatch(ctx, "consumer-1", 4)
+		require.Nil(t, err)
+
+		ids := make([]int, 0, len(jobs))
+		for _, job := range jobs {
+			ids = append(ids, job.ID)
+		}
+		require.Equal(t, []int{2, 3, 1, 4}, ids)
+	})
+}
+
+func TestSQLQueue_PriorityScheduling_StreakReset(t *testing.T) {
+	forEachSQLDialect(t, func(t *testing.T, newQueue func(opts ...Option) *SQLQueue) {
+		ctx := context.Background()
+		sq := newQueue(WithPriorityScheduling(2))
+
+		// set up state: time critical jobs served while no other job waits
+		for i := 0; i < 3; i++ {
+			_, err := sq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+			require.Nil(t, err)
+		}
+		for i := 0; i < 3; i++ {
+			_, err := sq.Dequeue(ctx, "consumer-1")
+			require.Nil(t, err)
+		}
+
+		types := []string{
+			domain.JobTypeNotTimeCritical,
+			domain.JobTypeTimeCritical,
+			domain.JobTypeTimeCritical,
+			domain.JobTypeTimeCritical,
+		}
+		for _, jobType := range types {
+			_, err := sq.Enqueue(ctx, domain.Job{Type: jobType, Status: domain.JobStatusQueued})
+			require.Nil(t, err)
+		}
+
+		// check that the streak only counts jobs served while both classes
+		// were waiting, like the in-memory queue
+		served := make([]int, 0)
+		for range types {
+			job, err := sq.Dequeue(ctx, "consumer-1")
+			require.Nil(t, err)
+			served = append(served, job.ID)
+		}
+		require.Equal(t, []int{5, 6, 4, 7}, served)
+	})
+}
+
+func TestSQLQueue_BulkChanges(t *testing.T) {
+	forEachSQLDialect(t, func(t *testing.T, newQueue func(opts ...Option) *SQLQueue) {
+		ctx := context.Background()
+		sq := newQueue()
+
+		// set up state
+		for i := 0; i < 4; i++ {
+			_, err := sq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+			require.Nil(t, err)
+		}
+
+		for _, consumerID := range []string{"consumer-1", "consumer-2"} {
+			_, err := sq.Dequeue(ctx, consumerID)
+			require.Nil(t, err)
+		}
+
+		// check that the in progress jobs of a consumer are requeued
+		count, err := sq.RequeueJobs(ctx, domain.JobFilter{Status: domain.JobStatusInProgress, ConsumerID: "consumer-1"})
+		require.Nil(t, err)
+		require.Equal(t, 1, count)
+
+		// check that only active jobs are cancelled
+		count, err = sq.CancelJobs(ctx, domain.JobFilter{Type: domain.JobTypeTimeCritical})
+		require.Nil(t, err)
+		require.Equal(t, 4, count)
+
+		count, err = sq.CancelJobs(ctx, domain.JobFilter{Type: domain.JobTypeTimeCritical})
+		require.Nil(t, err)
+		require.Equal(t, 0, count)
+
+		stats, err := sq.Stats(ctx)
+		require.Nil(t, err)
+		require.Equal(t, map[string]int{domain.JobStatusCancelled: 4}, stats.Statuses)
+	})
+}
+
+func TestSQLQueue_RemoveSettledDependencies(t *testing.T) {
+	forEachSQLDialect(t, func(t *testing.T, newQueue func(opts ...Option) *SQLQueue) {
+		ctx := context.Background()
+		sq := newQueue()
+
+		// set up state
+		parentID, err := sq.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+		require.Nil(t, err)
+
+		for i := 0; i < 2; i++ {
+			_, err = sq.Enqueue(ctx, domain.Job{
+				Type:      domain.JobTypeTimeCritical,
+				Status:    domain.JobStatusQueued,
+				DependsOn: []int{parentID},
+			})
+			require.Nil(t, err)
+		}
+
+		countDependencies := func() int {
+			var count int
+			require.Nil(t, sq.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM job_dependencies WHERE queue_name = $1`, sq.name).Scan(&count))
+			return count
+		}
+
+		// check that the dependencies of blocked jobs are kept
+		require.Nil(t, sq.removeSettledDependencies(ctx))
+		require.Equal(t, 2, countDependencies())
+
+		// check that the dependencies are removed once the jobs are released
+		_, err = sq.Dequeue(ctx, "consumer-1")
+		require.Nil(t, err)
+		require.Nil(t, sq.Conclude(ctx, parentID, "consumer-1", nil))
+
+		require.Nil(t, sq.removeSettledDependencies(ctx))
+		require.Equal(t, 0, countDependencies())
+	})
+}
+
+func TestMigrateSQL(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "jobs.db"))
+	require.Nil(t, err)
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+
+	// check that migrating an up to date schema is a no-op
+	require.Nil(t, MigrateSQL(ctx, db, SQLiteDialect))
+	require.Nil(t, MigrateSQL(ctx, db, SQLiteDialect))
+
+	var version int
+	require.Nil(t, db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version))
+	require.Equal(t, len(sqlMigrations), version)
+
+	// check that queues with jobs are listed
+	_, err = NewSQLQueue(db, SQLiteDialect, "emails").Enqueue(ctx, domain.Job{
+		Type:   domain.JobTypeTimeCritical,
+		Status: domain.JobStatusQueued,
+	})
+	require.Nil(t, err)
+
+	names, err := ListSQLQueues(ctx, db)
+	require.Nil(t, err)
+	require.Equal(t, []string{"emails"}, names)
+}
@@ -0,0 +1,130 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/handler"
+)
+
+// validName matches queue names that are safe to use in URLs and file names.
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Factory creates the job queue for a queue name.
+type Factory func(name string) (handler.JobQueuer, error)
+
+// Registry holds named job queues. Each queue is independent, with its own
+// jobs, ordering, and stats.
+type Registry struct {
+	newQueue   Factory
+	autoCreate bool
+
+	queues map[string]handler.JobQueuer
+
+	lock sync.RWMutex
+}
+
+// New returns a registry that creates queues with the given factory. With
+// autoCreate, a queue is created the first time it is used, otherwise queues
+// must be created through CreateQueue.
+func New(newQueue Factory, autoCreate bool) *Registry {
+	return &Registry{
+		newQueue:   newQueue,
+		autoCreate: autoCreate,
+		queues:     make(map[string]handler.JobQueuer),
+		lock:       sync.RWMutex{},
+	}
+}
+
+// Queue returns the named queue, creating it if the registry creates queues on
+// demand.
+func (r *Registry) Queue(ctx context.Context, name string) (handler.JobQueuer, error) {
+	r.lock.RLock()
+	q, ok := r.queues[name]
+	r.lock.RUnlock()
+
+	if ok {
+		return q, nil
+	}
+
+	if !r.autoCreate {
+		return nil, domain.ErrQueueNotFound{Name: name}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// another request may have created the queue in the meantime
+	if q, ok := r.queues[name]; ok {
+		return q, nil
+	}
+
+	return r.create(name)
+}
+
+// CreateQueue creates a named queue.
+func (r *Registry) CreateQueue(ctx context.Context, name string) (handler.JobQueuer, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.queues[name]; ok {
+		return nil, domain.ErrQueueExists{Name: name}
+	}
+
+	return r.create(name)
+}
+
+// ListQueues returns the names of every queue in alphabetical order.
+func (r *Registry) ListQueues(ctx context.Context) ([]string, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	names := make([]string, 0, len(r.queues))
+	for name := range r.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Close closes every queue that holds resources such as open files, and
+// returns the first error encountered.
+func (r *Registry) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var firstErr error
+	for _, q := range r.queues {
+		closer, ok := q.(io.Closer)
+		if !ok {
+			continue
+		}
+
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// create validates the name and creates the queue. The caller must hold the
+// write lock.
+func (r *Registry) create(name string) (handler.JobQueuer, error) {
+	if !validName.MatchString(name) {
+		return nil, domain.ErrInvalidQueueName{Name: name}
+	}
+
+	q, err := r.newQueue(name)
+	if err != nil {
+		return nil, err
+	}
+	r.queues[name] = q
+
+	return q, nil
+}
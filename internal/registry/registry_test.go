@@ -0,0 +1,81 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+	"github.com/bkrebsbach/simple-job-queue/internal/handler"
+	"github.com/bkrebsbach/simple-job-queue/internal/queue"
+)
+
+func newMemoryQueue(name string) (handler.JobQueuer, error) {
+	return queue.NewInMemoryQueue(), nil
+}
+
+func TestQueue_AutoCreate(t *testing.T) {
+	ctx := context.Background()
+	r := New(newMemoryQueue, true)
+
+	emails, err := r.Queue(ctx, "emails")
+	require.Nil(t, err)
+
+	// check that the same queue is returned on the next lookup
+	again, err := r.Queue(ctx, "emails")
+	require.Nil(t, err)
+	require.True(t, emails == again)
+
+	// check that queues are independent of each other
+	_, err = emails.Enqueue(ctx, domain.Job{Type: domain.JobTypeTimeCritical, Status: domain.JobStatusQueued})
+	require.Nil(t, err)
+
+	reports, err := r.Queue(ctx, "reports")
+	require.Nil(t, err)
+
+	_, err = reports.Dequeue(ctx, "consumer")
+	require.True(t, errors.Is(err, domain.ErrQueueEmpty))
+
+	names, err := r.ListQueues(ctx)
+	require.Nil(t, err)
+	require.Equal(t, []string{"emails", "reports"}, names)
+}
+
+func TestQueue_NoAutoCreate(t *testing.T) {
+	ctx := context.Background()
+	r := New(newMemoryQueue, false)
+
+	// check that unknown queues are not created on demand
+	_, err := r.Queue(ctx, "emails")
+	require.True(t, errors.Is(err, domain.ErrQueueNotFound{}))
+
+	created, err := r.CreateQueue(ctx, "emails")
+	require.Nil(t, err)
+
+	emails, err := r.Queue(ctx, "emails")
+	require.Nil(t, err)
+	require.True(t, created == emails)
+}
+
+func TestCreateQueue(t *testing.T) {
+	ctx := context.Background()
+	r := New(newMemoryQueue, true)
+
+	_, err := r.CreateQueue(ctx, "emails")
+	require.Nil(t, err)
+
+	// check that a queue cannot be created twice
+	_, err = r.CreateQueue(ctx, "emails")
+	require.True(t, errors.Is(err, domain.ErrQueueExists{}))
+
+	// check that invalid names are rejected, including on demand
+	for _, name := range []string{"", "with space", "../etc", string(make([]byte, 65))} {
+		_, err = r.CreateQueue(ctx, name)
+		require.True(t, errors.Is(err, domain.ErrInvalidQueueName{}), name)
+
+		_, err = r.Queue(ctx, name)
+		require.True(t, errors.Is(err, domain.ErrInvalidQueueName{}), name)
+	}
+}
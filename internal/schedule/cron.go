@@ -0,0 +1,220 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// field describes the valid values of a single cron expression field.
+type field struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day of month", min: 1, max: 31}
+	monthField  = field{name: "month", min: 1, max: 12, names: map[string]int{
+		"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6,
+		"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
+	}}
+	// day of week accepts 7 as an alias for Sunday
+	dowField = field{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6,
+	}}
+
+	descriptors = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// maxSearchYears bounds the search for the next run time, so expressions that
+// can never match, e.g. "0 0 30 2 *", do not loop forever.
+const maxSearchYears = 5
+
+// Cron is a parsed standard five field cron expression: minute, hour, day of
+// month, month, and day of week. Each field is a bit set of matching values.
+type Cron struct {
+	minute, hour, dom, month, dow uint64
+
+	// when both day fields are restricted, a day matches if either matches
+	domStar, dowStar bool
+}
+
+// ParseCron parses a five field cron expression, or one of the @yearly,
+// @monthly, @weekly, @daily and @hourly descriptors. Fields support lists,
+// ranges, steps, and month and weekday names.
+func ParseCron(expression string) (Cron, error) {
+	if descriptor, ok := descriptors[strings.ToLower(strings.TrimSpace(expression))]; ok {
+		expression = descriptor
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return Cron{}, fmt.Errorf("cron expression %q must have 5 fields", expression)
+	}
+
+	var (
+		cron Cron
+		err  error
+	)
+	if cron.minute, err = parseField(fields[0], minuteField); err != nil {
+		return Cron{}, err
+	}
+	if cron.hour, err = parseField(fields[1], hourField); err != nil {
+		return Cron{}, err
+	}
+	if cron.dom, err = parseField(fields[2], domField); err != nil {
+		return Cron{}, err
+	}
+	if cron.month, err = parseField(fields[3], monthField); err != nil {
+		return Cron{}, err
+	}
+	if cron.dow, err = parseField(fields[4], dowField); err != nil {
+		return Cron{}, err
+	}
+
+	// fold Sunday as 7 into Sunday as 0
+	if cron.dow&(1<<7) != 0 {
+		cron.dow |= 1
+	}
+
+	cron.domStar = fields[2] == "*" || fields[2] == "?"
+	cron.dowStar = fields[4] == "*" || fields[4] == "?"
+
+	return cron, nil
+}
+
+// parseField parses a comma separated list of values, ranges and steps into a
+// bit set.
+func parseField(value string, f field) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(value, ",") {
+		// split off the step
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q in %s field", part[i+1:], f.name)
+			}
+			part = part[:i]
+		}
+
+		// parse the range
+		var low, high int
+		switch i := strings.Index(part, "-"); {
+		case part == "*" || part == "?":
+			low, high = f.min, f.max
+		case i >= 0:
+			var err error
+			if low, err = parseValue(part[:i], f); err != nil {
+				return 0, err
+			}
+			if high, err = parseValue(part[i+1:], f); err != nil {
+				return 0, err
+			}
+		default:
+			var err error
+			if low, err = parseValue(part, f); err != nil {
+				return 0, err
+			}
+
+			// a single value with a step runs to the end of the range
+			high = low
+			if step > 1 {
+				high = f.max
+			}
+		}
+
+		if low > high {
+			return 0, fmt.Errorf("invalid range %q in %s field", part, f.name)
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// parseValue parses a single number or name within the bounds of the field.
+func parseValue(value string, f field) (int, error) {
+	if v, ok := f.names[strings.ToUpper(value)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(value)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid value %q in %s field", value, f.name)
+	}
+
+	return v, nil
+}
+
+// Next returns the first time after the given time that matches the
+// expression, in the location of the given time. It returns the zero time if
+// the expression does not match within the next few years.
+func (c Cron) Next(after time.Time) time.Time {
+	loc := after.Location()
+
+	// start at the next whole minute
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(maxSearchYears, 0, 0)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			if !next.After(t) {
+				// the wall clock went back for daylight saving time
+				next = t.Truncate(time.Hour).Add(time.Hour)
+			}
+			t = next
+			continue
+		}
+
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+// dayMatches reports whether the day of the given time matches the day of
+// month and day of week fields.
+func (c Cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+
+	return dom || dow
+}
@@ -0,0 +1,75 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCron_Invalid(t *testing.T) {
+	expressions := []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * FOO *",
+	}
+
+	for _, expression := range expressions {
+		_, err := ParseCron(expression)
+		require.Error(t, err, expression)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	start := time.Date(2020, 1, 1, 10, 30, 15, 0, time.UTC) // a Wednesday
+
+	tests := []struct {
+		expression string
+		expected   time.Time
+	}{
+		{"* * * * *", time.Date(2020, 1, 1, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2020, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{"0 9-17 * * *", time.Date(2020, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"30 8 * * *", time.Date(2020, 1, 2, 8, 30, 0, 0, time.UTC)},
+		{"0 0 * * MON", time.Date(2020, 1, 6, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 FEB,MAR *", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2020, 1, 1, 11, 0, 0, 0, time.UTC)},
+		// either day field matches when both are restricted
+		{"0 0 15 * FRI", time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)},
+		// never fires
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, tt := range tests {
+		cron, err := ParseCron(tt.expression)
+		require.Nil(t, err, tt.expression)
+		require.Equal(t, tt.expected, cron.Next(start), tt.expression)
+	}
+}
+
+func TestCronNext_Timezone(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	require.Nil(t, err)
+
+	cron, err := ParseCron("30 2 * * *")
+	require.Nil(t, err)
+
+	// check that the expression is evaluated in the wall clock of the
+	// location
+	next := cron.Next(time.Date(2020, 1, 1, 0, 0, 0, 0, loc))
+	require.Equal(t, time.Date(2020, 1, 1, 7, 30, 0, 0, time.UTC), next.UTC())
+
+	// check that a time skipped by daylight saving time moves to the next day
+	next = cron.Next(time.Date(2020, 3, 8, 0, 0, 0, 0, loc))
+	require.Equal(t, time.Date(2020, 3, 9, 2, 30, 0, 0, loc), next)
+}
@@ -0,0 +1,446 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+// Enqueuer defines the part of a job queue that the scheduler enqueues jobs
+// into.
+type Enqueuer interface {
+	Enqueue(ctx context.Context, job domain.Job) (int, error)
+}
+
+// maxSaveAttempts is the number of times a change to the schedules is made
+// again when other service instances keep saving changes at the same time.
+const maxSaveAttempts = 10
+
+// Scheduler enqueues a fresh job every time one of its recurring schedules
+// fires.
+//
+// Each schedule's next run time is persisted before its job is enqueued, so a
+// restart never fires the same tick twice. Ticks missed while the service was
+// down are not backfilled, an overdue schedule fires once and then resumes
+// from the current time.
+//
+// Several service instances can share the schedules through their store. The
+// schedules are loaded from the store before every change, and a change is only
+// saved if no other instance saved one in the meantime, so every tick is fired
+// by a single instance.
+type Scheduler struct {
+	enqueuer Enqueuer
+	store    Store
+	log      zerolog.Logger
+
+	// isLeader reports whether the instance may fire schedules, every
+	// instance may when it is nil
+	isLeader func() bool
+
+	// schedules, maxID and version are the state last loaded from or saved to
+	// the store
+	schedules map[int]domain.Schedule
+	maxID     int
+	version   int
+
+	now func() time.Time
+
+	lock sync.Mutex
+}
+
+// Option configures a Scheduler.
+type Option func(s *Scheduler)
+
+// WithLeader only fires schedules while isLeader reports that the instance
+// leads its cluster, for a store that only the leader can save to.
+func WithLeader(isLeader func() bool) Option {
+	return func(s *Scheduler) {
+		s.isLeader = isLeader
+	}
+}
+
+// NewScheduler returns a scheduler that enqueues jobs into the given queue, and
+// loads its schedules from the store. A nil store keeps schedules in memory
+// only.
+func NewScheduler(enqueuer Enqueuer, store Store, log zerolog.Logger, opts ...Option) (*Scheduler, error) {
+	if store == nil {
+		store = &memoryStore{}
+	}
+
+	s := &Scheduler{
+		enqueuer: enqueuer,
+		store:    store,
+		log:      log,
+		now:      time.Now,
+		lock:     sync.Mutex{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// CreateSchedule validates and registers a recurring schedule, and returns it
+// with its ID and first run time.
+func (s *Scheduler) CreateSchedule(ctx context.Context, schedule domain.Schedule) (domain.Schedule, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.now()
+
+	next, err := nextRunAt(schedule, now)
+	if err != nil {
+		return domain.Schedule{}, err
+	}
+
+	schedule.Paused = false
+	schedule.NextRunAt = next
+	schedule.LastRunAt = time.Time{}
+	schedule.CreatedAt = now
+
+	err = s.update(func() error {
+		schedule.ID = s.maxID + 1
+		return s.save(schedule.ID, &schedule)
+	})
+	if err != nil {
+		return domain.Schedule{}, err
+	}
+
+	return schedule, nil
+}
+
+// ListSchedules returns every schedule ordered by ID.
+func (s *Scheduler) ListSchedules(ctx context.Context) ([]domain.Schedule, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s.state().Schedules, nil
+}
+
+// FetchSchedule returns the schedule for the given schedule ID.
+func (s *Scheduler) FetchSchedule(ctx context.Context, scheduleID int) (domain.Schedule, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.load(); err != nil {
+		return domain.Schedule{}, err
+	}
+
+	schedule, ok := s.schedules[scheduleID]
+	if !ok {
+		return domain.Schedule{}, domain.ErrScheduleNotFound{ScheduleID: scheduleID}
+	}
+
+	return schedule, nil
+}
+
+// PauseSchedule stops a schedule from firing until it is resumed.
+func (s *Scheduler) PauseSchedule(ctx context.Context, scheduleID int) (domain.Schedule, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var paused domain.Schedule
+	err := s.update(func() error {
+		schedule, ok := s.schedules[scheduleID]
+		if !ok {
+			return domain.ErrScheduleNotFound{ScheduleID: scheduleID}
+		}
+
+		schedule.Paused = true
+		schedule.NextRunAt = time.Time{}
+		paused = schedule
+
+		return s.save(scheduleID, &schedule)
+	})
+	if err != nil {
+		return domain.Schedule{}, err
+	}
+
+	return paused, nil
+}
+
+// ResumeSchedule lets a paused schedule fire again, starting from the next
+// tick after the current time.
+func (s *Scheduler) ResumeSchedule(ctx context.Context, scheduleID int) (domain.Schedule, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var resumed domain.Schedule
+	err := s.update(func() error {
+		schedule, ok := s.schedules[scheduleID]
+		if !ok {
+			return domain.ErrScheduleNotFound{ScheduleID: scheduleID}
+		}
+
+		resumed = schedule
+		if !schedule.Paused {
+			return nil
+		}
+
+		next, err := nextRunAt(schedule, s.now())
+		if err != nil {
+			return err
+		}
+
+		schedule.Paused = false
+		schedule.NextRunAt = next
+		resumed = schedule
+
+		return s.save(scheduleID, &schedule)
+	})
+	if err != nil {
+		return domain.Schedule{}, err
+	}
+
+	return resumed, nil
+}
+
+// DeleteSchedule removes a schedule.
+func (s *Scheduler) DeleteSchedule(ctx context.Context, scheduleID int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.update(func() error {
+		if _, ok := s.schedules[scheduleID]; !ok {
+			return domain.ErrScheduleNotFound{ScheduleID: scheduleID}
+		}
+
+		return s.save(scheduleID, nil)
+	})
+}
+
+// Run fires due schedules every interval. It blocks until the context is
+// cancelled.
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.fireDue(ctx); err != nil {
+				s.log.Error().Err(err).Msg("error firing schedules")
+			}
+		}
+	}
+}
+
+// fireDue advances every due schedule to its next run time, persists the new
+// run times, and then enqueues a job for each schedule that fired.
+func (s *Scheduler) fireDue(ctx context.Context) error {
+	s.lock.Lock()
+
+	if s.isLeader != nil && !s.isLeader() {
+		s.lock.Unlock()
+		return nil
+	}
+
+	if err := s.load(); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+
+	now := s.now()
+
+	schedules := make(map[int]domain.Schedule, len(s.schedules))
+	fired := make([]domain.Schedule, 0)
+	for id, schedule := range s.schedules {
+		schedules[id] = schedule
+
+		if schedule.Paused || schedule.NextRunAt.IsZero() || schedule.NextRunAt.After(now) {
+			continue
+		}
+
+		next, err := nextRunAt(schedule, now)
+		if err != nil {
+			// schedules are validated when they are created, so this only
+			// happens if the timezone database changed
+			s.log.Error().Err(err).Int("schedule_id", schedule.ID).Msg("unable to compute next run")
+			continue
+		}
+
+		schedule.LastRunAt = schedule.NextRunAt
+		schedule.NextRunAt = next
+		schedules[id] = schedule
+		fired = append(fired, schedule)
+	}
+
+	if len(fired) == 0 {
+		s.lock.Unlock()
+		return nil
+	}
+
+	// persist the new run times before enqueuing, so a restart never fires
+	// the same tick twice. If another instance saved the schedules first, it
+	// may have fired them, and they are checked again on the next tick.
+	err := s.commit(schedules)
+	s.lock.Unlock()
+
+	if errors.Is(err, ErrStateChanged) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(fired, func(i, j int) bool {
+		return fired[i].ID < fired[j].ID
+	})
+
+	for _, schedule := range fired {
+		jobID, err := s.enqueuer.Enqueue(ctx, domain.Job{
+			Type:     schedule.Type,
+			Status:   domain.JobStatusQueued,
+			Payload:  schedule.Payload,
+			Priority: schedule.Priority,
+		})
+		if err != nil {
+			s.log.Error().Err(err).Int("schedule_id", schedule.ID).Msg("error enqueuing scheduled job")
+			continue
+		}
+
+		s.log.Info().
+			Int("schedule_id", schedule.ID).
+			Int("job_id", jobID).
+			Msg("enqueued scheduled job")
+	}
+
+	return nil
+}
+
+// load replaces the schedules with the state in the store. The caller must
+// hold the lock.
+func (s *Scheduler) load() error {
+	state, err := s.store.Load()
+	if err != nil {
+		return err
+	}
+
+	s.schedules = make(map[int]domain.Schedule, len(state.Schedules))
+	for _, schedule := range state.Schedules {
+		s.schedules[schedule.ID] = schedule
+	}
+	s.maxID = state.MaxID
+	s.version = state.Version
+
+	return nil
+}
+
+// update loads the schedules and makes a change to them with fn. When another
+// service instance saved the schedules in the meantime, the change is made
+// again on its state. The caller must hold the lock.
+func (s *Scheduler) update(fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		if err := s.load(); err != nil {
+			return err
+		}
+
+		err := fn()
+		if !errors.Is(err, ErrStateChanged) || attempt == maxSaveAttempts {
+			return err
+		}
+	}
+}
+
+// save persists a change to a single schedule. A nil schedule deletes it. The
+// caller must hold the lock.
+func (s *Scheduler) save(scheduleID int, schedule *domain.Schedule) error {
+	schedules := make(map[int]domain.Schedule, len(s.schedules)+1)
+	for id, existing := range s.schedules {
+		schedules[id] = existing
+	}
+
+	if schedule == nil {
+		delete(schedules, scheduleID)
+	} else {
+		schedules[scheduleID] = *schedule
+	}
+
+	return s.commit(schedules)
+}
+
+// commit persists the schedules as the next version of the state, and keeps
+// them once they are persisted. The caller must hold the lock.
+func (s *Scheduler) commit(schedules map[int]domain.Schedule) error {
+	maxID := s.maxID
+	for id := range schedules {
+		if id > maxID {
+			maxID = id
+		}
+	}
+
+	state := newState(schedules, maxID, s.version+1)
+	if err := s.store.Save(state); err != nil {
+		return err
+	}
+
+	s.schedules = schedules
+	s.maxID = maxID
+	s.version = state.Version
+
+	return nil
+}
+
+// state returns the scheduler state with schedules ordered by ID. The caller
+// must hold the lock.
+func (s *Scheduler) state() State {
+	return newState(s.schedules, s.maxID, s.version)
+}
+
+// newState returns a scheduler state with the schedules ordered by ID.
+func newState(schedules map[int]domain.Schedule, maxID int, version int) State {
+	state := State{
+		MaxID:     maxID,
+		Schedules: make([]domain.Schedule, 0, len(schedules)),
+		Version:   version,
+	}
+	for _, schedule := range schedules {
+		state.Schedules = append(state.Schedules, schedule)
+	}
+
+	sort.Slice(state.Schedules, func(i, j int) bool {
+		return state.Schedules[i].ID < state.Schedules[j].ID
+	})
+
+	return state
+}
+
+// nextRunAt returns the first tick of the schedule after the given time.
+func nextRunAt(schedule domain.Schedule, after time.Time) (time.Time, error) {
+	cron, err := ParseCron(schedule.Cron)
+	if err != nil {
+		return time.Time{}, domain.ErrInvalidSchedule{Reason: err.Error()}
+	}
+
+	loc := time.UTC
+	if schedule.Timezone != "" {
+		loc, err = time.LoadLocation(schedule.Timezone)
+		if err != nil {
+			return time.Time{}, domain.ErrInvalidSchedule{Reason: err.Error()}
+		}
+	}
+
+	next := cron.Next(after.In(loc))
+	if next.IsZero() {
+		return time.Time{}, domain.ErrInvalidSchedule{Reason: "cron expression never fires"}
+	}
+
+	return next.UTC(), nil
+}
@@ -0,0 +1,219 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+// recordingEnqueuer records the jobs enqueued by the scheduler.
+type recordingEnqueuer struct {
+	jobs []domain.Job
+	lock sync.Mutex
+}
+
+func (e *recordingEnqueuer) Enqueue(ctx context.Context, job domain.Job) (int, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.jobs = append(e.jobs, job)
+
+	return len(e.jobs), nil
+}
+
+func newTestScheduler(t *testing.T, enqueuer Enqueuer, store Store, now *time.Time) *Scheduler {
+	s, err := NewScheduler(enqueuer, store, zerolog.Nop())
+	require.Nil(t, err)
+	s.now = func() time.Time { return *now }
+
+	return s
+}
+
+func TestScheduler_Fire(t *testing.T) {
+	now := time.Date(2020, 1, 1, 10, 0, 30, 0, time.UTC)
+	enqueuer := &recordingEnqueuer{}
+	s := newTestScheduler(t, enqueuer, nil, &now)
+
+	created, err := s.CreateSchedule(context.Background(), domain.Schedule{
+		Type:    domain.JobTypeNotTimeCritical,
+		Payload: []byte(`{"customer":42}`),
+		Cron:    "*/5 * * * *",
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, created.ID)
+	require.Equal(t, time.Date(2020, 1, 1, 10, 5, 0, 0, time.UTC), created.NextRunAt)
+
+	// check that nothing fires before the schedule is due
+	require.Nil(t, s.fireDue(context.Background()))
+	require.Empty(t, enqueuer.jobs)
+
+	// check that a job is enqueued from the template when the schedule fires
+	now = time.Date(2020, 1, 1, 10, 5, 1, 0, time.UTC)
+	require.Nil(t, s.fireDue(context.Background()))
+	require.Equal(t, []domain.Job{{
+		Type:    domain.JobTypeNotTimeCritical,
+		Status:  domain.JobStatusQueued,
+		Payload: []byte(`{"customer":42}`),
+	}}, enqueuer.jobs)
+
+	fired, err := s.FetchSchedule(context.Background(), created.ID)
+	require.Nil(t, err)
+	require.Equal(t, time.Date(2020, 1, 1, 10, 5, 0, 0, time.UTC), fired.LastRunAt)
+	require.Equal(t, time.Date(2020, 1, 1, 10, 10, 0, 0, time.UTC), fired.NextRunAt)
+
+	// check that the same tick only fires once
+	require.Nil(t, s.fireDue(context.Background()))
+	require.Len(t, enqueuer.jobs, 1)
+}
+
+func TestScheduler_PauseResumeDelete(t *testing.T) {
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	enqueuer := &recordingEnqueuer{}
+	s := newTestScheduler(t, enqueuer, nil, &now)
+
+	created, err := s.CreateSchedule(context.Background(), domain.Schedule{
+		Type: domain.JobTypeNotTimeCritical,
+		Cron: "@hourly",
+	})
+	require.Nil(t, err)
+
+	// check that paused schedules do not fire
+	paused, err := s.PauseSchedule(context.Background(), created.ID)
+	require.Nil(t, err)
+	require.True(t, paused.Paused)
+
+	now = now.Add(3 * time.Hour)
+	require.Nil(t, s.fireDue(context.Background()))
+	require.Empty(t, enqueuer.jobs)
+
+	// check that resumed schedules skip the ticks missed while paused
+	resumed, err := s.ResumeSchedule(context.Background(), created.ID)
+	require.Nil(t, err)
+	require.False(t, resumed.Paused)
+	require.Equal(t, now.Add(time.Hour), resumed.NextRunAt)
+
+	// check that deleted schedules are gone
+	err = s.DeleteSchedule(context.Background(), created.ID)
+	require.Nil(t, err)
+
+	_, err = s.FetchSchedule(context.Background(), created.ID)
+	require.True(t, errors.Is(err, domain.ErrScheduleNotFound{}))
+
+	schedules, err := s.ListSchedules(context.Background())
+	require.Nil(t, err)
+	require.Empty(t, schedules)
+}
+
+func TestScheduler_Invalid(t *testing.T) {
+	now := time.Now()
+	s := newTestScheduler(t, &recordingEnqueuer{}, nil, &now)
+
+	_, err := s.CreateSchedule(context.Background(), domain.Schedule{
+		Type: domain.JobTypeNotTimeCritical,
+		Cron: "not a cron",
+	})
+	require.True(t, errors.Is(err, domain.ErrInvalidSchedule{}))
+
+	_, err = s.CreateSchedule(context.Background(), domain.Schedule{
+		Type:     domain.JobTypeNotTimeCritical,
+		Cron:     "@daily",
+		Timezone: "Mars/Olympus_Mons",
+	})
+	require.True(t, errors.Is(err, domain.ErrInvalidSchedule{}))
+}
+
+func TestScheduler_Restart(t *testing.T) {
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	store := NewFileStore(filepath.Join(t.TempDir(), "schedules.json"))
+	enqueuer := &recordingEnqueuer{}
+
+	s := newTestScheduler(t, enqueuer, store, &now)
+	created, err := s.CreateSchedule(context.Background(), domain.Schedule{
+		Type:     domain.JobTypeTimeCritical,
+		Cron:     "0 * * * *",
+		Timezone: "America/New_York",
+	})
+	require.Nil(t, err)
+
+	now = now.Add(time.Hour)
+	require.Nil(t, s.fireDue(context.Background()))
+	require.Len(t, enqueuer.jobs, 1)
+
+	// check that a restarted scheduler does not fire the same tick again
+	restarted := newTestScheduler(t, enqueuer, store, &now)
+	require.Nil(t, restarted.fireDue(context.Background()))
+	require.Len(t, enqueuer.jobs, 1)
+
+	loaded, err := restarted.FetchSchedule(context.Background(), created.ID)
+	require.Nil(t, err)
+	require.Equal(t, time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC), loaded.NextRunAt)
+
+	// check that IDs keep counting up after a restart
+	second, err := restarted.CreateSchedule(context.Background(), domain.Schedule{
+		Type: domain.JobTypeTimeCritical,
+		Cron: "@daily",
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, second.ID)
+}
+
+func TestScheduler_SharedStore(t *testing.T) {
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	store := &memoryStore{}
+	enqueuer := &recordingEnqueuer{}
+
+	// set up state: two service instances sharing the schedules
+	first := newTestScheduler(t, enqueuer, store, &now)
+	second := newTestScheduler(t, enqueuer, store, &now)
+
+	created, err := first.CreateSchedule(context.Background(), domain.Schedule{
+		Type: domain.JobTypeTimeCritical,
+		Cron: "@hourly",
+	})
+	require.Nil(t, err)
+
+	// check that a schedule created by one instance is seen by the other
+	fetched, err := second.FetchSchedule(context.Background(), created.ID)
+	require.Nil(t, err)
+	require.Equal(t, created, fetched)
+
+	// check that a tick is only fired by one of the instances
+	now = now.Add(time.Hour)
+	require.Nil(t, first.fireDue(context.Background()))
+	require.Nil(t, second.fireDue(context.Background()))
+	require.Len(t, enqueuer.jobs, 1)
+
+	// check that a change based on an outdated state is made again on the
+	// latest state
+	other, err := second.CreateSchedule(context.Background(), domain.Schedule{
+		Type: domain.JobTypeTimeCritical,
+		Cron: "@daily",
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, other.ID)
+
+	paused, err := first.PauseSchedule(context.Background(), created.ID)
+	require.Nil(t, err)
+	require.True(t, paused.Paused)
+
+	schedules, err := second.ListSchedules(context.Background())
+	require.Nil(t, err)
+	require.Len(t, schedules, 2)
+	require.True(t, schedules[0].Paused)
+
+	// check that an instance that is not the leader does not fire schedules
+	follower := newTestScheduler(t, enqueuer, store, &now)
+	WithLeader(func() bool { return false })(follower)
+
+	now = now.Add(24 * time.Hour)
+	require.Nil(t, follower.fireDue(context.Background()))
+	require.Len(t, enqueuer.jobs, 1)
+}
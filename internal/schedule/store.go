@@ -0,0 +1,130 @@
+package schedule
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
+)
+
+// ErrStateChanged is returned when saving a scheduler state that is not based
+// on the latest saved state, because another service instance saved a change
+// in the meantime.
+var ErrStateChanged = errors.New("schedules changed concurrently")
+
+// State is the scheduler state that is persisted between restarts.
+type State struct {
+	MaxID     int
+	Schedules []domain.Schedule
+
+	// Version counts the times the state was saved.
+	Version int
+}
+
+// Store persists the scheduler state. Save only accepts a state whose Version
+// is one higher than the saved state's, and returns ErrStateChanged otherwise,
+// so several service instances can share a store.
+type Store interface {
+	Load() (State, error)
+	Save(state State) error
+}
+
+// memoryStore is a Store that keeps the state in memory, used when schedules
+// do not need to survive a restart.
+type memoryStore struct {
+	state State
+	lock  sync.Mutex
+}
+
+func (s *memoryStore) Load() (State, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.state, nil
+}
+
+func (s *memoryStore) Save(state State) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if state.Version != s.state.Version+1 {
+		return ErrStateChanged
+	}
+	s.state = state
+
+	return nil
+}
+
+// FileStore persists the scheduler state as a JSON file. The file is replaced
+// atomically, so a crash while saving leaves the previous state intact.
+type FileStore struct {
+	path string
+}
+
+// NewFileStore returns a store that persists the scheduler state at path.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Load reads the scheduler state, returning an empty state if nothing has been
+// saved yet.
+func (s *FileStore) Load() (State, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return State{}, nil
+	}
+	if err != nil {
+		return State{}, err
+	}
+
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return State{}, err
+	}
+
+	return state, nil
+}
+
+// Save writes the scheduler state to a temporary file, syncs it to disk, and
+// renames it over the previous state. The file is only used by a single
+// service instance, which saves one state at a time.
+func (s *FileStore) Save(state State) error {
+	saved, err := s.Load()
+	if err != nil {
+		return err
+	}
+	if state.Version != saved.Version+1 {
+		return ErrStateChanged
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
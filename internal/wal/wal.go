@@ -0,0 +1,385 @@
+// Package wal implements an append-only write-ahead log. Each record is framed
+// with its length and a CRC32 checksum, and is synced to disk before Append
+// returns, so a record that was appended survives a crash.
+//
+// The log is split into numbered segment files in a directory, so the part of
+// the log covered by a snapshot can be removed.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// headerSize is the size of the frame in front of every record: the length of
+// the record followed by its checksum, both little endian uint32s.
+const headerSize = 8
+
+// MaxRecordSize is the size of the largest record the log accepts.
+const MaxRecordSize = 64 << 20
+
+// DefaultSegmentSize is the size past which the log moves on to a new segment.
+const DefaultSegmentSize = 64 << 20
+
+// segmentExt is the file extension of segment files.
+const segmentExt = ".wal"
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrRecordTooLarge is returned when appending a record larger than
+// MaxRecordSize.
+var ErrRecordTooLarge = errors.New("wal: record too large")
+
+// Option configures a Log.
+type Option func(*Log)
+
+// WithSegmentSize sets the size past which the log moves on to a new segment.
+func WithSegmentSize(size int64) Option {
+	return func(l *Log) {
+		l.segmentSize = size
+	}
+}
+
+// segmentFile is the segment file open for appending.
+type segmentFile interface {
+	io.WriteSeeker
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+}
+
+// Log is a write-ahead log stored as a sequence of segment files.
+type Log struct {
+	dir         string
+	segmentSize int64
+
+	// segments holds the indexes of the segment files in ascending order, the
+	// last one is open for appending
+	segments []int
+	file     segmentFile
+	size     int64
+
+	// failed is set when a failed append could not be removed from the log,
+	// after which nothing more is appended
+	failed error
+
+	lock sync.Mutex
+}
+
+// Open opens the log in dir, creating it if it does not exist. Records are
+// appended after the existing contents, so Replay should be called before the
+// first Append to recover from a torn write.
+func Open(dir string, opts ...Option) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		dir:         dir,
+		segmentSize: DefaultSegmentSize,
+		lock:        sync.Mutex{},
+	}
+
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	l.segments = segments
+
+	if len(l.segments) == 0 {
+		l.segments = []int{1}
+	}
+
+	if err := l.openSegment(l.segments[len(l.segments)-1]); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Replay calls fn with every record in the segments after the given segment
+// index, in the order they were appended. Pass 0 to replay the whole log. A
+// record at the end of the log that was only partially written, e.g. because
+// the process crashed in the middle of an append, is truncated away.
+func (l *Log) Replay(after int, fn func(record []byte) error) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for i, index := range l.segments {
+		if index <= after {
+			continue
+		}
+
+		last := i == len(l.segments)-1
+		if err := l.replaySegment(index, last, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Append writes a record to the end of the log and syncs it to disk. A record
+// that cannot be written or synced is removed from the log again, so it is not
+// replayed and does not cut off the records appended after it.
+func (l *Log) Append(record []byte) error {
+	if len(record) > MaxRecordSize {
+		return ErrRecordTooLarge
+	}
+
+	frame := make([]byte, headerSize+len(record))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(record)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(record, crcTable))
+	copy(frame[headerSize:], record)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.failed != nil {
+		return l.failed
+	}
+
+	if l.size >= l.segmentSize {
+		if _, err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := l.file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+
+	_, err := l.file.Write(frame)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		// drop what was written of the record
+		if truncateErr := l.file.Truncate(l.size); truncateErr != nil {
+			l.failed = fmt.Errorf("wal: removing a failed append: %w", truncateErr)
+		}
+		return err
+	}
+	l.size += int64(len(frame))
+
+	return nil
+}
+
+// Rotate moves the log on to a new segment, and returns the index of the
+// segment that was closed. Every record appended before Rotate is in that
+// segment or an earlier one.
+func (l *Log) Rotate() (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.rotate()
+}
+
+// RemoveThrough deletes the segments up to and including the given segment
+// index, e.g. because they are covered by a snapshot. The segment open for
+// appending is never removed.
+func (l *Log) RemoveThrough(index int) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	remaining := make([]int, 0, len(l.segments))
+	for i, segment := range l.segments {
+		if segment > index || i == len(l.segments)-1 {
+			remaining = append(remaining, segment)
+			continue
+		}
+
+		if err := os.Remove(l.segmentPath(segment)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	l.segments = remaining
+
+	return nil
+}
+
+// Close closes the segment open for appending.
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.file.Close()
+}
+
+// rotate closes the current segment and opens the next one. The caller must
+// hold the lock.
+func (l *Log) rotate() (int, error) {
+	current := l.segments[len(l.segments)-1]
+
+	if err := l.file.Close(); err != nil {
+		return 0, err
+	}
+
+	next := current + 1
+	if err := l.openSegment(next); err != nil {
+		return 0, err
+	}
+	l.segments = append(l.segments, next)
+
+	// make sure the new segment survives a crash
+	if err := syncDir(l.dir); err != nil {
+		return 0, err
+	}
+
+	return current, nil
+}
+
+// openSegment opens the segment with the given index for appending. The
+// caller must hold the lock.
+func (l *Log) openSegment(index int) error {
+	file, err := os.OpenFile(l.segmentPath(index), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	l.file = file
+	l.size = info.Size()
+
+	return nil
+}
+
+// replaySegment calls fn with every record in a segment. A torn record ends
+// the last segment and is truncated away, anywhere else it means the log is
+// corrupt. The caller must hold the lock.
+func (l *Log) replaySegment(index int, last bool, fn func(record []byte) error) error {
+	file, err := os.Open(l.segmentPath(index))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+
+	for {
+		record, err := readRecord(reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if errors.Is(err, errTornRecord) && last {
+			// drop everything after the last complete record
+			if err := l.file.Truncate(offset); err != nil {
+				return err
+			}
+			l.size = offset
+
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("segment %d at offset %d: %w", index, offset, err)
+		}
+
+		if err := fn(record); err != nil {
+			return err
+		}
+		offset += int64(headerSize + len(record))
+	}
+}
+
+// segmentPath returns the path of the segment with the given index.
+func (l *Log) segmentPath(index int) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", index, segmentExt))
+}
+
+// listSegments returns the indexes of the segment files in dir in ascending
+// order.
+func listSegments(dir string) ([]int, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		index, err := strconv.Atoi(strings.TrimSuffix(name, segmentExt))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, index)
+	}
+	sort.Ints(segments)
+
+	return segments, nil
+}
+
+// syncDir syncs a directory, so files created in or removed from it survive a
+// crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// errTornRecord indicates a record was cut short or does not match its
+// checksum.
+var errTornRecord = errors.New("wal: torn record")
+
+// readRecord reads the next record. It returns io.EOF at the end of the log,
+// and errTornRecord if the record is incomplete or corrupt.
+func readRecord(reader *bufio.Reader) ([]byte, error) {
+	header := make([]byte, headerSize)
+	if n, err := io.ReadFull(reader, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: short header of %d bytes", errTornRecord, n)
+		}
+		return nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(header[0:4])
+	checksum := binary.LittleEndian.Uint32(header[4:8])
+	if size > MaxRecordSize {
+		return nil, fmt.Errorf("%w: record size %d", errTornRecord, size)
+	}
+
+	record := make([]byte, size)
+	if _, err := io.ReadFull(reader, record); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: short record", errTornRecord)
+		}
+		return nil, err
+	}
+
+	if crc32.Checksum(record, crcTable) != checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", errTornRecord)
+	}
+
+	return record, nil
+}
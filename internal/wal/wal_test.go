@@ -0,0 +1,237 @@
+package wal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// replayAll returns every record in the log after the given segment.
+func replayAll(t *testing.T, l *Log, after int) []string {
+	records := make([]string, 0)
+	err := l.Replay(after, func(record []byte) error {
+		records = append(records, string(record))
+		return nil
+	})
+	require.Nil(t, err)
+
+	return records
+}
+
+// failingFile is a segment file that fails writes, syncs or truncates. A
+// failed write writes half of the data first, as a torn write would.
+type failingFile struct {
+	segmentFile
+
+	failWrite, failSync, failTruncate bool
+}
+
+var errInjected = errors.New("injected failure")
+
+func (f *failingFile) Write(data []byte) (int, error) {
+	if f.failWrite {
+		n, _ := f.segmentFile.Write(data[:len(data)/2])
+		return n, errInjected
+	}
+
+	return f.segmentFile.Write(data)
+}
+
+func (f *failingFile) Sync() error {
+	if f.failSync {
+		return errInjected
+	}
+
+	return f.segmentFile.Sync()
+}
+
+func (f *failingFile) Truncate(size int64) error {
+	if f.failTruncate {
+		return errInjected
+	}
+
+	return f.segmentFile.Truncate(size)
+}
+
+func TestAppendReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := Open(dir)
+	require.Nil(t, err)
+	require.Nil(t, l.Append([]byte("first")))
+	require.Nil(t, l.Append([]byte("")))
+	require.Nil(t, l.Append([]byte("third")))
+	require.Nil(t, l.Close())
+
+	// check that records are replayed in order after reopening the log
+	l, err = Open(dir)
+	require.Nil(t, err)
+	require.Equal(t, []string{"first", "", "third"}, replayAll(t, l, 0))
+
+	// check that appends after a replay go to the end of the log
+	require.Nil(t, l.Append([]byte("fourth")))
+	require.Equal(t, []string{"first", "", "third", "fourth"}, replayAll(t, l, 0))
+	require.Nil(t, l.Close())
+}
+
+func TestReplay_TornWrite(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := Open(dir)
+	require.Nil(t, err)
+	require.Nil(t, l.Append([]byte("first")))
+	require.Nil(t, l.Append([]byte("second")))
+	path := l.segmentPath(1)
+	require.Nil(t, l.Close())
+
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	intact := info.Size() - int64(headerSize+len("second"))
+
+	for _, size := range []int64{info.Size() - 1, intact + 3, intact + headerSize} {
+		require.Nil(t, os.Truncate(path, size))
+
+		// check that the partial record is dropped and truncated away
+		l, err = Open(dir)
+		require.Nil(t, err)
+		require.Equal(t, []string{"first"}, replayAll(t, l, 0))
+
+		info, err := os.Stat(path)
+		require.Nil(t, err)
+		require.Equal(t, intact, info.Size())
+
+		// check that the log can be appended to again
+		require.Nil(t, l.Append([]byte("second")))
+		require.Nil(t, l.Close())
+	}
+}
+
+func TestReplay_Corrupt(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := Open(dir)
+	require.Nil(t, err)
+	require.Nil(t, l.Append([]byte("first")))
+	require.Nil(t, l.Append([]byte("second")))
+	path := l.segmentPath(1)
+	require.Nil(t, l.Close())
+
+	// flip a byte in the last record
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	data[len(data)-1] ^= 0xff
+	require.Nil(t, ioutil.WriteFile(path, data, 0644))
+
+	// check that the record failing its checksum marks the end of the log
+	l, err = Open(dir)
+	require.Nil(t, err)
+	require.Equal(t, []string{"first"}, replayAll(t, l, 0))
+	require.Nil(t, l.Close())
+}
+
+func TestReplay_CorruptSegment(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := Open(dir)
+	require.Nil(t, err)
+	require.Nil(t, l.Append([]byte("first")))
+	_, err = l.Rotate()
+	require.Nil(t, err)
+	require.Nil(t, l.Append([]byte("second")))
+	require.Nil(t, l.Close())
+
+	// check that a torn record before the last segment fails the replay
+	// instead of silently dropping the records after it
+	path := l.segmentPath(1)
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Nil(t, os.Truncate(path, info.Size()-1))
+
+	l, err = Open(dir)
+	require.Nil(t, err)
+	err = l.Replay(0, func(record []byte) error { return nil })
+	require.Error(t, err)
+	require.Nil(t, l.Close())
+}
+
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := Open(dir, WithSegmentSize(20))
+	require.Nil(t, err)
+
+	// check that the log moves on to a new segment once the segment is full
+	require.Nil(t, l.Append([]byte("0123456789abcdef")))
+	require.Nil(t, l.Append([]byte("second")))
+	require.Equal(t, []int{1, 2}, l.segments)
+
+	// check that rotating returns the segment covering every appended record
+	index, err := l.Rotate()
+	require.Nil(t, err)
+	require.Equal(t, 2, index)
+	require.Nil(t, l.Append([]byte("third")))
+
+	require.Equal(t, []string{"0123456789abcdef", "second", "third"}, replayAll(t, l, 0))
+	require.Equal(t, []string{"third"}, replayAll(t, l, index))
+
+	// check that removed segments are gone after reopening the log
+	require.Nil(t, l.RemoveThrough(index))
+	require.Nil(t, l.Close())
+
+	l, err = Open(dir, WithSegmentSize(20))
+	require.Nil(t, err)
+	require.Equal(t, []int{3}, l.segments)
+	require.Equal(t, []string{"third"}, replayAll(t, l, 0))
+	require.Nil(t, l.Close())
+}
+
+func TestAppend_Failure(t *testing.T) {
+	for name, failing := range map[string]failingFile{
+		"write": {failWrite: true},
+		"sync":  {failSync: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			l, err := Open(dir)
+			require.Nil(t, err)
+			require.Nil(t, l.Append([]byte("first")))
+
+			// check that a failed append is removed from the log
+			file := failing
+			file.segmentFile = l.file
+			l.file = &file
+			require.True(t, errors.Is(l.Append([]byte("failed")), errInjected))
+
+			// check that the records appended after it are replayed
+			l.file = file.segmentFile
+			require.Nil(t, l.Append([]byte("third")))
+			require.Nil(t, l.Close())
+
+			l, err = Open(dir)
+			require.Nil(t, err)
+			require.Equal(t, []string{"first", "third"}, replayAll(t, l, 0))
+			require.Nil(t, l.Close())
+		})
+	}
+}
+
+func TestAppend_TruncateFailure(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := Open(dir)
+	require.Nil(t, err)
+
+	// check that the log refuses appends once a failed append could not be
+	// removed
+	file := &failingFile{segmentFile: l.file, failWrite: true, failTruncate: true}
+	l.file = file
+	require.True(t, errors.Is(l.Append([]byte("failed")), errInjected))
+
+	l.file = file.segmentFile
+	require.True(t, errors.Is(l.Append([]byte("second")), errInjected))
+	require.Nil(t, l.Close())
+}
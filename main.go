@@ -2,19 +2,33 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
+	"github.com/gomodule/redigo/redis"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	_ "github.com/lib/pq"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
+	_ "modernc.org/sqlite"
 
+	"github.com/bkrebsbach/simple-job-queue/internal/domain"
 	"github.com/bkrebsbach/simple-job-queue/internal/handler"
 	"github.com/bkrebsbach/simple-job-queue/internal/queue"
+	"github.com/bkrebsbach/simple-job-queue/internal/registry"
+	"github.com/bkrebsbach/simple-job-queue/internal/schedule"
 )
 
 func main() {
@@ -48,19 +62,374 @@ func main() {
 	router.Use(hlog.RefererHandler("referer"))
 	router.Use(hlog.RequestIDHandler("req_id", "Request-Id"))
 
-	// setup queue
-	inMemoryQueue := queue.NewInMemoryQueue()
+	visibilityTimeout, err := durationFromEnv("VISIBILITY_TIMEOUT", queue.DefaultVisibilityTimeout)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid VISIBILITY_TIMEOUT")
+	}
+
+	reaperInterval, err := durationFromEnv("REAPER_INTERVAL", 5*time.Second)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid REAPER_INTERVAL")
+	}
+
+	retryPolicy := queue.DefaultRetryPolicy
+	if retryPolicy.MaxAttempts, err = intFromEnv("RETRY_MAX_ATTEMPTS", retryPolicy.MaxAttempts); err != nil {
+		log.Fatal().Err(err).Msg("invalid RETRY_MAX_ATTEMPTS")
+	}
+	if retryPolicy.InitialBackoff, err = durationFromEnv("RETRY_INITIAL_BACKOFF", retryPolicy.InitialBackoff); err != nil {
+		log.Fatal().Err(err).Msg("invalid RETRY_INITIAL_BACKOFF")
+	}
+	if retryPolicy.MaxBackoff, err = durationFromEnv("RETRY_MAX_BACKOFF", retryPolicy.MaxBackoff); err != nil {
+		log.Fatal().Err(err).Msg("invalid RETRY_MAX_BACKOFF")
+	}
+
+	queueOpts := []queue.Option{
+		queue.WithVisibilityTimeout(visibilityTimeout),
+		queue.WithRetryPolicy(retryPolicy),
+	}
+
+	// serve time critical jobs first when a ratio is configured
+	timeCriticalRatio, err := intFromEnv("TIME_CRITICAL_RATIO", 0)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid TIME_CRITICAL_RATIO")
+	}
+	if timeCriticalRatio > 0 {
+		queueOpts = append(queueOpts, queue.WithPriorityScheduling(timeCriticalRatio))
+	}
+
+	// background workers run until the server shuts down
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	// setup named queues, each with its own reaper returning jobs with expired
+	// leases to the queue in the background. Queues are only created on first
+	// use if enabled, so clients cannot create any number of queues.
+	autoCreateQueues, err := boolFromEnv("QUEUE_AUTO_CREATE", false)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid QUEUE_AUTO_CREATE")
+	}
+
+	// the durable backend keeps every queue in its own directory under the
+	// data directory
+	dataDir := os.Getenv("QUEUE_DATA_DIR")
+	if dataDir == "" {
+		dataDir = "data"
+	}
+
+	snapshotInterval, err := durationFromEnv("SNAPSHOT_INTERVAL", time.Minute)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid SNAPSHOT_INTERVAL")
+	}
+
+	// listQueues returns the named queues the backend persisted, which are
+	// recovered on startup
+	var newQueue registry.Factory
+	var listQueues func() ([]string, error)
+
+	// backends shared by several instances also share the recurring job
+	// schedules
+	var scheduleStore schedule.Store
+	var schedulerOpts []schedule.Option
+
+	switch backend := os.Getenv("QUEUE_BACKEND"); backend {
+	case "", "memory":
+		newQueue = func(name string) (handler.JobQueuer, error) {
+			inMemoryQueue := queue.NewInMemoryQueue(queueOpts...)
+			go inMemoryQueue.RunReaper(backgroundCtx, reaperInterval, log)
+
+			return inMemoryQueue, nil
+		}
+	case "durable":
+		newQueue = func(name string) (handler.JobQueuer, error) {
+			durableQueue, err := queue.NewDurableQueue(filepath.Join(dataDir, name), queueOpts...)
+			if err != nil {
+				return nil, err
+			}
+			go durableQueue.RunReaper(backgroundCtx, reaperInterval, log)
+			go durableQueue.RunSnapshotter(backgroundCtx, snapshotInterval, log)
+
+			return durableQueue, nil
+		}
+		listQueues = func() ([]string, error) {
+			entries, err := ioutil.ReadDir(dataDir)
+			if err != nil {
+				return nil, err
+			}
+
+			names := make([]string, 0, len(entries))
+			for _, entry := range entries {
+				if entry.IsDir() {
+					names = append(names, entry.Name())
+				}
+			}
+
+			return names, nil
+		}
+	case "sql":
+		driver := os.Getenv("SQL_DRIVER")
+		if driver == "" {
+			driver = "postgres"
+		}
+
+		var dialect queue.SQLDialect
+		switch driver {
+		case "postgres":
+			dialect = queue.PostgresDialect
+		case "sqlite":
+			dialect = queue.SQLiteDialect
+		default:
+			log.Fatal().Str("driver", driver).Msg("invalid SQL_DRIVER")
+		}
 
-	// setup HTTP job handler
-	jobHandler := &handler.JobHandler{JobQueuer: inMemoryQueue}
+		db, err := sql.Open(driver, os.Getenv("SQL_DSN"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid SQL_DSN")
+		}
+		defer db.Close()
+
+		// SQLite serializes writes, a single connection keeps them from
+		// failing with a locked database
+		if driver == "sqlite" {
+			db.SetMaxOpenConns(1)
+		}
+
+		if err := queue.MigrateSQL(backgroundCtx, db, dialect); err != nil {
+			log.Fatal().Err(err).Msg("unable to migrate database")
+		}
+
+		newQueue = func(name string) (handler.JobQueuer, error) {
+			sqlQueue := queue.NewSQLQueue(db, dialect, name, queueOpts...)
+			go sqlQueue.RunReaper(backgroundCtx, reaperInterval, log)
+
+			return sqlQueue, nil
+		}
+		listQueues = func() ([]string, error) {
+			return queue.ListSQLQueues(backgroundCtx, db)
+		}
+		scheduleStore = queue.NewSQLScheduleStore(db)
+	case "redis":
+		redisURL := os.Getenv("REDIS_URL")
+		if redisURL == "" {
+			redisURL = "redis://localhost:6379"
+		}
+
+		pool := &redis.Pool{
+			MaxIdle:     10,
+			IdleTimeout: 5 * time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.DialURL(redisURL)
+			},
+		}
+		defer pool.Close()
+
+		newQueue = func(name string) (handler.JobQueuer, error) {
+			redisQueue, err := queue.NewRedisQueue(backgroundCtx, pool, name, queueOpts...)
+			if err != nil {
+				return nil, err
+			}
+			go redisQueue.RunReaper(backgroundCtx, reaperInterval, log)
+
+			return redisQueue, nil
+		}
+		listQueues = func() ([]string, error) {
+			return queue.ListRedisQueues(backgroundCtx, pool)
+		}
+		scheduleStore = queue.NewRedisScheduleStore(pool)
+	case "raft":
+		nodeID := os.Getenv("RAFT_NODE_ID")
+		if nodeID == "" {
+			log.Fatal().Msg("RAFT_NODE_ID is required")
+		}
+
+		raftAddr := os.Getenv("RAFT_ADDR")
+		if raftAddr == "" {
+			raftAddr = "127.0.0.1:7000"
+		}
+
+		servers, peerURLs, err := parsePeers(os.Getenv("RAFT_PEERS"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid RAFT_PEERS")
+		}
+
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			log.Fatal().Err(err).Msg("unable to create data directory")
+		}
+
+		raftLog := log.With().Str("component", "raft").Logger()
+
+		conf := raft.DefaultConfig()
+		conf.LocalID = raft.ServerID(nodeID)
+		conf.LogOutput = raftLog
+		conf.LogLevel = "INFO"
+
+		store, err := raftboltdb.NewBoltStore(filepath.Join(dataDir, "raft.db"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to open raft log")
+		}
+		defer store.Close()
+
+		logStore, err := raft.NewLogCache(512, store)
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to open raft log")
+		}
+
+		snapshots, err := raft.NewFileSnapshotStore(dataDir, 2, raftLog)
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to open raft snapshots")
+		}
+
+		transport, err := raft.NewTCPTransport(raftAddr, nil, 3, 10*time.Second, raftLog)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid RAFT_ADDR")
+		}
+
+		cluster, err := queue.NewCluster(queue.ClusterConfig{
+			Raft:        conf,
+			LogStore:    logStore,
+			StableStore: store,
+			Snapshots:   snapshots,
+			Transport:   transport,
+		}, queueOpts...)
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to start raft node")
+		}
+		defer func() {
+			if err := cluster.Close(); err != nil {
+				log.Error().Err(err).Msg("unable to stop raft node")
+			}
+		}()
+
+		// every node bootstraps a new cluster with the same peers, nodes that
+		// already joined a cluster ignore it
+		if err := cluster.Bootstrap(servers); err != nil {
+			log.Fatal().Err(err).Msg("unable to bootstrap cluster")
+		}
+		go cluster.RunReaper(backgroundCtx, reaperInterval, log)
+
+		// schedules are replicated with the jobs, and fired by the leader
+		scheduleStore = cluster.ScheduleStore()
+		schedulerOpts = append(schedulerOpts, schedule.WithLeader(cluster.IsLeader))
+
+		// only the leader serves requests, followers forward them
+		clusterHandler := &handler.ClusterHandler{Node: cluster, NodeID: nodeID, Peers: peerURLs}
+		router.Use(clusterHandler.ForwardToLeader)
+
+		newQueue = func(name string) (handler.JobQueuer, error) {
+			return cluster.Queue(name), nil
+		}
+		listQueues = func() ([]string, error) {
+			return cluster.ListQueues(), nil
+		}
+	default:
+		log.Fatal().Str("backend", backend).Msg("invalid QUEUE_BACKEND")
+	}
+
+	queues := registry.New(newQueue, autoCreateQueues)
+	defer func() {
+		// stop the reapers before closing the queues they work on
+		stopBackground()
+
+		if err := queues.Close(); err != nil {
+			log.Error().Err(err).Msg("unable to close queues")
+		}
+	}()
+
+	// the /jobs routes serve the default queue
+	defaultQueue, err := queues.CreateQueue(backgroundCtx, domain.DefaultQueueName)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to create default queue")
+	}
+
+	// recover the named queues persisted by the backend
+	if listQueues != nil {
+		names, err := listQueues()
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to list queues")
+		}
+
+		for _, name := range names {
+			if name == domain.DefaultQueueName {
+				continue
+			}
+
+			if _, err := queues.CreateQueue(backgroundCtx, name); err != nil {
+				log.Fatal().Err(err).Str("queue", name).Msg("unable to recover queue")
+			}
+		}
+	}
+
+	// setup recurring job schedules, persisted to a file when one is
+	// configured and the backend does not store them
+	schedulerInterval, err := durationFromEnv("SCHEDULER_INTERVAL", time.Second)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid SCHEDULER_INTERVAL")
+	}
+
+	if path := os.Getenv("SCHEDULES_FILE"); path != "" && scheduleStore == nil {
+		scheduleStore = schedule.NewFileStore(path)
+	}
+
+	scheduler, err := schedule.NewScheduler(defaultQueue, scheduleStore, log, schedulerOpts...)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to load schedules")
+	}
+	go scheduler.Run(backgroundCtx, schedulerInterval)
+
+	idempotencyWindow, err := durationFromEnv("IDEMPOTENCY_WINDOW", handler.DefaultIdempotencyWindow)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid IDEMPOTENCY_WINDOW")
+	}
+
+	// setup HTTP handlers
+	jobHandler := &handler.JobHandler{JobQueuer: defaultQueue, IdempotencyWindow: idempotencyWindow}
+	queueHandler := &handler.QueueHandler{Queues: queues}
+	scheduleHandler := &handler.ScheduleHandler{Scheduler: scheduler}
 
 	// define routes
-	router.Route("/jobs", func(router chi.Router) {
+	jobRoutes := func(router chi.Router) {
+		router.Get("/", jobHandler.ListJobs)
 		router.Post("/enqueue", jobHandler.EnqueueJob)
+		router.Post("/enqueue:batch", jobHandler.EnqueueJobs)
 		router.Post("/dequeue", jobHandler.DequeueJob)
+		router.Post("/admin/cancel", jobHandler.CancelJobs)
+		router.Post("/admin/requeue", jobHandler.RequeueJobs)
 		router.Post("/{jobID}/conclude", jobHandler.ConcludeJob)
 		router.Post("/{jobID}/cancel", jobHandler.CancelJob)
+		router.Post("/{jobID}/heartbeat", jobHandler.HeartbeatJob)
+		router.Post("/{jobID}/fail", jobHandler.FailJob)
 		router.Get("/{jobID}", jobHandler.GetJobStatus)
+
+		router.Get("/dead-letters", jobHandler.ListDeadLetters)
+		router.Post("/dead-letters/redrive", jobHandler.RedriveAllDeadLetters)
+		router.Get("/dead-letters/{jobID}", jobHandler.GetDeadLetter)
+		router.Post("/dead-letters/{jobID}/redrive", jobHandler.RedriveDeadLetter)
+
+		router.Post("/workflows", jobHandler.SubmitWorkflow)
+		router.Get("/workflows/{workflowID}", jobHandler.GetWorkflow)
+	}
+	batchRoutes := func(router chi.Router) {
+		router.Post("/", jobHandler.EnqueueBatch)
+		router.Get("/{batchID}", jobHandler.GetBatch)
+	}
+
+	router.Route("/jobs", jobRoutes)
+	router.Route("/batches", batchRoutes)
+
+	router.Route("/queues", func(router chi.Router) {
+		router.Post("/", queueHandler.CreateQueue)
+		router.Get("/", queueHandler.ListQueues)
+		router.Get("/{queue}", queueHandler.GetQueue)
+		router.With(queueHandler.QueueCtx).Route("/{queue}/jobs", jobRoutes)
+		router.With(queueHandler.QueueCtx).Route("/{queue}/batches", batchRoutes)
+	})
+
+	router.Route("/schedules", func(router chi.Router) {
+		router.Post("/", scheduleHandler.CreateSchedule)
+		router.Get("/", scheduleHandler.ListSchedules)
+		router.Get("/{scheduleID}", scheduleHandler.GetSchedule)
+		router.Post("/{scheduleID}/pause", scheduleHandler.PauseSchedule)
+		router.Post("/{scheduleID}/resume", scheduleHandler.ResumeSchedule)
+		router.Delete("/{scheduleID}", scheduleHandler.DeleteSchedule)
 	})
 
 	// handle interrupt signals
@@ -88,3 +457,64 @@ func main() {
 
 	_ = s.Shutdown(ctx)
 }
+
+// durationFromEnv parses a duration such as "30s" from an environment variable,
+// falling back to the given default when the variable is unset.
+func durationFromEnv(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+// intFromEnv parses an integer from an environment variable, falling back to
+// the given default when the variable is unset.
+func intFromEnv(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	return strconv.Atoi(value)
+}
+
+// boolFromEnv parses a boolean such as "true" from an environment variable,
+// falling back to the given default when the variable is unset.
+func boolFromEnv(name string, fallback bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	return strconv.ParseBool(value)
+}
+
+// parsePeers parses the nodes of a cluster from a comma separated list of
+// "id=raft address=HTTP URL" entries, e.g.
+// "node1=10.0.0.1:7000=http://10.0.0.1:8080,node2=10.0.0.2:7000=http://10.0.0.2:8080".
+func parsePeers(value string) ([]raft.Server, map[string]*url.URL, error) {
+	servers := make([]raft.Server, 0)
+	urls := make(map[string]*url.URL)
+
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.SplitN(strings.TrimSpace(entry), "=", 3)
+		if len(fields) != 3 || fields[0] == "" || fields[1] == "" {
+			return nil, nil, fmt.Errorf("invalid peer %q", entry)
+		}
+
+		peerURL, err := url.Parse(fields[2])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid peer %q: %w", entry, err)
+		}
+
+		servers = append(servers, raft.Server{
+			ID:      raft.ServerID(fields[0]),
+			Address: raft.ServerAddress(fields[1]),
+		})
+		urls[fields[0]] = peerURL
+	}
+
+	return servers, urls, nil
+}